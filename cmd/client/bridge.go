@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+)
+
+// sendFrame 发送从 TAP 接口读取的以太网帧：能够代答的 ARP 请求和邻居请求直接写回接口，
+// 目的地址位于已直连的节点时直接发送，否则经服务器转发，由服务器按其 MAC 地址表转发或泛洪
+func sendFrame(conn *serverConn, proto *protocol.Protocol, peers *peerManager, frame []byte) {
+	parsed, err := network.ParseFrame(frame)
+	if err != nil {
+		return
+	}
+	if peers.sendFrame(parsed, frame) {
+		return
+	}
+
+	payload, err := protocol.EncodeFrame(peers.nodeID, frame)
+	if err != nil {
+		log.Printf("编码以太网帧失败: %v", err)
+		return
+	}
+	data, err := proto.Encode(&protocol.Message{
+		Type: protocol.MsgTypeFrame,
+		Data: payload,
+	})
+	if err != nil {
+		log.Printf("编码以太网帧失败: %v", err)
+		return
+	}
+	if _, err := conn.Write(data); err != nil {
+		log.Printf("发送以太网帧失败: %v", err)
+	}
+}
+
+// sendFrame 处理本地局域网发出的以太网帧，返回 false 时应经服务器转发。源地址记为位于本节点；
+// 目标地址已在其他节点学习到的 ARP 请求和邻居请求由本节点代答，不再跨广域网广播；
+// 目的地址位于本节点的帧已由局域网交付，被丢弃
+func (m *peerManager) sendFrame(frame *network.Frame, data []byte) bool {
+	now := time.Now()
+	m.bridge.Learn(frame, m.nodeID, now)
+	if reply := m.bridge.Proxy(frame, m.nodeID, now); reply != nil {
+		if _, err := m.tun.Write(reply); err != nil {
+			log.Printf("写入代答的以太网帧失败: %v", err)
+		}
+		return true
+	}
+
+	owner, ok := m.bridge.Lookup(frame, now)
+	if !ok {
+		return false
+	}
+	if owner == m.nodeID {
+		return true
+	}
+
+	payload, err := protocol.EncodeFrame(m.nodeID, data)
+	if err != nil {
+		return false
+	}
+	m.mutex.Lock()
+	p := m.direct[owner]
+	if p == nil || p.state != stateEstablished {
+		m.mutex.Unlock()
+		return false
+	}
+	link := p.link()
+	m.mutex.Unlock()
+
+	if err := link.send(protocol.MsgTypeFrame, payload); err != nil {
+		log.Printf("直接发送到节点 %s 失败，经服务器中继: %v", p.nodeID, err)
+		return false
+	}
+	return true
+}
+
+// deliverFrame 将服务器转发的以太网帧写入 TAP 接口，并记录帧的源地址位于服务器告知的来源节点，
+// 此后与该节点直连时发往该地址的帧直接发送。服务器代答的帧没有来源，只学习其中声明的地址
+func (m *peerManager) deliverFrame(payload []byte) {
+	if m.bridge == nil {
+		return
+	}
+	source, data, err := protocol.DecodeFrame(payload)
+	if err != nil {
+		log.Printf("丢弃无效的以太网帧: %v", err)
+		return
+	}
+	frame, err := network.ParseFrame(data)
+	if err != nil {
+		log.Printf("丢弃无效的以太网帧: %v", err)
+		return
+	}
+	if source != "" && source != m.nodeID {
+		m.bridge.Learn(frame, source, time.Now())
+	} else {
+		m.bridge.Snoop(frame, "", time.Now())
+	}
+	if _, err := m.tun.Write(data); err != nil {
+		log.Printf("写入以太网帧失败: %v", err)
+	}
+}
@@ -0,0 +1,948 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/internal/stun"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+const (
+	// punchInterval 打洞期间发送探测的间隔，同时是检查直连状态的间隔
+	punchInterval = 100 * time.Millisecond
+	// punchTimeout 打洞超过该时间仍未成功则放弃，继续经服务器中继
+	punchTimeout = 5 * time.Second
+	// directKeepAlive 直连路径上的保活间隔，同时维持双方 NAT 的映射
+	directKeepAlive = 5 * time.Second
+	// directTimeout 超过该时间未收到对端的直连报文则回退到服务器中继
+	directTimeout = 15 * time.Second
+	// relayTimeout 经中继服务建立会话的最长时间，超时后经服务器中继
+	relayTimeout = 10 * time.Second
+)
+
+// directState 与一个节点的直连状态
+type directState int
+
+const (
+	statePunching    directState = iota // 正在打洞，数据经服务器中继
+	stateEstablished                    // 直连已建立，数据直接发送
+	stateFailed                         // 打洞失败或直连超时，数据经服务器中继，等待服务器再次介绍
+	stateRelaying                       // 打洞失败，正在经中继服务建立会话，数据经服务器中继
+)
+
+// directPeer 服务器介绍的节点及与其直连的状态，所有字段由 peerManager.mutex 保护
+type directPeer struct {
+	nodeID     string
+	static     [crypto.KeySize]byte // 对端静态公钥，明文模式为零值
+	candidates []*net.UDPAddr       // 打洞尝试的端点：服务器观察到的公网端点、对端的内网端点和 IPv6 端点以及对端探测的来源
+	addresses  []net.IP             // 对端的虚拟地址
+	routes     []string             // 对端通告的网段
+	version    uint8
+	token      []byte
+	initiator  bool // 节点 ID 较小的一方发起节点之间的 Noise 握手
+
+	// 对称 NAT 的穿透：端口预测时探测对端预测的映射端口，生日攻击时对称一方打开多个套接字、
+	// 另一方探测随机端口
+	method  network.TraversalMethod
+	public  *net.UDPAddr     // 服务器观察到的对端公网端点，预测和探测以其为基准
+	step    int              // 对端对称 NAT 的端口步长
+	sockets []net.PacketConn // 生日攻击额外打开的套接字
+	opened  bool             // 是否已尝试打开额外的套接字
+	pinned  net.PacketConn   // 生日攻击时最先收到对端报文的套接字
+	tried   map[uint16]bool  // 生日攻击已探测的端口
+	probes  int              // 已发送的端口探测数
+
+	// 打洞失败后经中继服务通信：票据由服务器随介绍签发，会话建立后 conn 为中继连接；
+	// 没有票据时经双方在 TURN 服务器上的分配通信，conn 为共用的 TURN 客户端
+	relayTicket []byte
+	relayKey    []byte
+	relay       *network.Connection
+	relayed     *net.UDPAddr // 对端在 TURN 服务器上的中继地址
+
+	state    directState
+	deadline time.Time      // 打洞截止时间
+	addr     *net.UDPAddr   // 已确认可达的对端端点
+	conn     net.PacketConn // 与对端通信使用的套接字，通常是与服务器共用的套接字
+
+	index       uint32 // 本端为直连会话分配的索引
+	remoteIndex uint32
+	keys        *crypto.KeyRing
+	proto       *protocol.Protocol
+
+	// 发起方未完成的握手，超时前只重传同一条消息，避免对端为重传派生出不同的密钥
+	pending    *crypto.Handshake
+	initiation []byte
+	epoch      uint8
+	sentAt     time.Time
+	// 响应方最近一次处理的握手时间戳及其响应，收到重传的握手时重发该响应
+	timestamp int64
+	response  []byte
+
+	lastRecv atomic.Int64 // 最近一次收到对端消息的时间（UnixNano），接收数据包时不持有 m.mutex 的写锁
+	lastSent atomic.Int64 // 最近一次发送的时间（UnixNano），发送数据包时不持有 m.mutex
+}
+
+// owns 判断 ip 是否为对端的虚拟地址或位于对端通告的网段内，返回匹配的前缀长度，不匹配时返回 -1
+func (p *directPeer) owns(ip net.IP) int {
+	for _, address := range p.addresses {
+		if address.Equal(ip) {
+			return 8 * len(address)
+		}
+	}
+	best := -1
+	for _, route := range p.routes {
+		if prefix := network.RoutePrefix(route, ip); prefix > best {
+			best = prefix
+		}
+	}
+	return best
+}
+
+// addCandidate 添加打洞端点，已存在时忽略
+func (p *directPeer) addCandidate(addr *net.UDPAddr) {
+	for _, candidate := range p.candidates {
+		if sameAddr(candidate, addr) {
+			return
+		}
+	}
+	p.candidates = append(p.candidates, addr)
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// validEndpoint 返回可用于打洞的端点，地址或端口缺失时返回 nil
+func validEndpoint(ip net.IP, port uint16) *net.UDPAddr {
+	if ip == nil || ip.IsUnspecified() || port == 0 {
+		return nil
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// introduce 处理服务器的节点介绍，开始向对端打洞。重复的介绍重新开始打洞，
+// 服务器只在双方之间仍有中继流量时才会再次介绍
+func (m *peerManager) introduce(msg *protocol.Message) {
+	var peer protocol.PeerMessage
+	if err := protocol.UnmarshalControl(msg.Version, msg.Data, &peer); err != nil {
+		log.Printf("解析节点介绍失败: %v", err)
+		return
+	}
+	if peer.NodeID == m.nodeID || m.revoked.IsRevoked(peer.NodeID) {
+		return
+	}
+	if !protocol.IsSupportedVersion(peer.Version) || len(peer.Token) == 0 {
+		log.Printf("忽略节点 %s 的介绍: 协议版本 %d 不受支持或缺少令牌", peer.NodeID, peer.Version)
+		return
+	}
+
+	p := &directPeer{
+		nodeID:    peer.NodeID,
+		addresses: peer.Addresses,
+		routes:    peer.Routes,
+		version:   peer.Version,
+		token:     peer.Token,
+		initiator: m.nodeID < peer.NodeID,
+		public:    validEndpoint(peer.PublicIP, peer.PublicPort),
+		step:      int(peer.PortStep),
+		tried:     make(map[uint16]bool),
+		deadline:  time.Now().Add(m.punchTimeout),
+		conn:      m.conn,
+
+		relayTicket: peer.RelayTicket,
+		relayKey:    peer.RelayKey,
+		relayed:     validEndpoint(peer.RelayedIP, peer.RelayedPort),
+	}
+	// 无法穿透的组合直接经中继服务通信，没有中继票据时仍按普通打洞尝试
+	p.method = m.nat.Choose(stun.NATType(peer.NATType), p.step)
+	if p.method == network.TraversalRelay && !m.canRelay(p) {
+		p.method = network.TraversalPunch
+	}
+	// 加密模式下节点之间以 Noise 握手认证对方，公钥必须与节点 ID 相符
+	if m.security.encryption {
+		if len(peer.PublicKey) != crypto.KeySize {
+			log.Printf("忽略节点 %s 的介绍: 缺少公钥", peer.NodeID)
+			return
+		}
+		copy(p.static[:], peer.PublicKey)
+		if crypto.NodeID(p.static) != peer.NodeID {
+			log.Printf("忽略节点 %s 的介绍: 公钥与节点 ID 不符", peer.NodeID)
+			return
+		}
+	}
+	endpoints := []*net.UDPAddr{p.public, validEndpoint(peer.LocalIP, peer.LocalPort)}
+	// 双方都有全局 IPv6 地址时同时向对端的 IPv6 端点打洞，先收到确认的地址族胜出
+	if m.ipv6 {
+		endpoints = append(endpoints, validEndpoint(peer.GlobalIP6, peer.LocalPort))
+	}
+	for _, endpoint := range endpoints {
+		if endpoint != nil {
+			p.addCandidate(endpoint)
+		}
+	}
+	if len(p.candidates) == 0 {
+		log.Printf("忽略节点 %s 的介绍: 没有可用的端点", peer.NodeID)
+		return
+	}
+	index, err := protocol.NewIndex()
+	if err != nil {
+		log.Printf("分配直连会话索引失败: %v", err)
+		return
+	}
+	p.index = index
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// 先安装新通告的路由再撤销旧的，两次介绍都通告的网段不会短暂失去路由
+	m.installRoutes(p.nodeID, p.routes)
+	if previous := m.direct[p.nodeID]; previous != nil {
+		m.closeSockets(previous, nil)
+		m.uninstallRoutes(previous.nodeID, previous.routes)
+		m.dropSession(previous)
+	}
+	m.direct[p.nodeID] = p
+	if p.method == network.TraversalRelay {
+		m.startRelay(p)
+		return
+	}
+	log.Printf("开始与节点 %s 打洞，端点 %v，穿透方式 %s", p.nodeID, p.candidates, p.method)
+	m.punch(p)
+}
+
+// removeDirect 删除与节点的直连，此后发往该节点的数据经服务器中继
+func (m *peerManager) removeDirect(nodeID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if p := m.direct[nodeID]; p != nil {
+		m.closeSockets(p, nil)
+		m.uninstallRoutes(p.nodeID, p.routes)
+		m.dropSession(p)
+	}
+	if m.bridge != nil {
+		m.bridge.Forget(nodeID)
+	}
+	delete(m.direct, nodeID)
+}
+
+// closeSockets 关闭为对端额外打开的套接字和中继连接，keep 除外。与对端通信的套接字被关闭时改回共用的套接字，
+// 共用的 TURN 客户端不关闭
+func (m *peerManager) closeSockets(p *directPeer, keep net.PacketConn) {
+	if turn := m.nat.TURN(); turn != nil && p.conn == net.PacketConn(turn) && p.conn != keep {
+		p.conn = m.conn
+	}
+	if p.relay != nil && net.PacketConn(p.relay) != keep {
+		p.relay.Close()
+		if p.conn == net.PacketConn(p.relay) {
+			p.conn = m.conn
+		}
+		p.relay = nil
+	}
+	var kept []net.PacketConn
+	for _, conn := range p.sockets {
+		if conn == keep {
+			kept = append(kept, conn)
+			continue
+		}
+		conn.Close()
+		if conn == p.conn {
+			p.conn = m.conn
+		}
+	}
+	p.sockets = kept
+}
+
+// finishTraversal 记录一次穿透的结果，成功时只保留直连使用的套接字
+func (m *peerManager) finishTraversal(p *directPeer, success bool) {
+	var keep net.PacketConn
+	if success {
+		keep = p.conn
+	}
+	sockets := len(p.sockets)
+	m.closeSockets(p, keep)
+	stats := m.nat.RecordTraversal(p.method, success, p.probes, sockets)
+	if p.method == network.TraversalPredict || p.method == network.TraversalBirthday {
+		log.Printf("与节点 %s 的 %s 穿透%s，探测 %d 个端口，打开 %d 个套接字；累计 %s",
+			p.nodeID, p.method, map[bool]string{true: "成功", false: "失败"}[success], p.probes, sockets, stats)
+	}
+}
+
+// run 定期发送打洞探测、维护已建立的直连，本节点被吊销时退出
+func (m *peerManager) run() {
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.maintain()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// maintain 检查所有直连：打洞超时或直连超时的节点回退到服务器中继，
+// 已建立的直连按需发送保活和轮换密钥
+func (m *peerManager) maintain() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for _, p := range m.direct {
+		switch p.state {
+		case statePunching:
+			if now.After(p.deadline) {
+				m.finishTraversal(p, false)
+				if m.canRelay(p) {
+					log.Printf("与节点 %s 打洞失败，改经中继服务通信", p.nodeID)
+					p.method = network.TraversalRelay
+					m.startRelay(p)
+					continue
+				}
+				p.state = stateFailed
+				log.Printf("与节点 %s 打洞失败，经服务器中继", p.nodeID)
+				continue
+			}
+			m.punch(p)
+		case stateRelaying:
+			if now.After(p.deadline) {
+				p.state = stateFailed
+				m.finishTraversal(p, false)
+				log.Printf("经中继服务与节点 %s 建立会话超时，经服务器中继", p.nodeID)
+				continue
+			}
+			// 中继会话已绑定，由发起方重传握手
+			if m.security.encryption && p.initiator && p.addr != nil {
+				if err := m.sendHandshake(p, 0); err != nil {
+					log.Printf("发起与节点 %s 的握手失败: %v", p.nodeID, err)
+				}
+			}
+		case stateEstablished:
+			if now.Sub(time.Unix(0, p.lastRecv.Load())) > directTimeout {
+				p.state = stateFailed
+				m.closeSockets(p, nil)
+				m.dropSession(p)
+				log.Printf("与节点 %s 的直连超时，回退到服务器中继", p.nodeID)
+				continue
+			}
+			if p.initiator && p.keys != nil && p.keys.NeedsRekey() {
+				if err := m.sendHandshake(p, p.keys.NextEpoch()); err != nil {
+					log.Printf("发起与节点 %s 的密钥轮换失败: %v", p.nodeID, err)
+				}
+			}
+			if now.Sub(time.Unix(0, p.lastSent.Load())) >= directKeepAlive {
+				if err := m.sendDirect(p, protocol.MsgTypeKeepAlive, nil); err != nil {
+					log.Printf("发送直连保活失败: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// punch 向对端的全部候选端点发送探测，按穿透方式探测更多端口；
+// 加密模式下路径确认后由发起方（重）发握手
+func (m *peerManager) punch(p *directPeer) {
+	probe := m.punchData(p, false)
+	if probe == nil {
+		return
+	}
+	// 打洞期间大部分探测注定被对端 NAT 丢弃，发送失败不影响其他端点
+	for _, addr := range p.candidates {
+		m.conn.WriteTo(probe, addr)
+	}
+	if p.addr == nil {
+		m.traverse(p, probe)
+	}
+	if m.security.encryption && p.initiator && p.addr != nil {
+		if err := m.sendHandshake(p, 0); err != nil {
+			log.Printf("发起与节点 %s 的握手失败: %v", p.nodeID, err)
+		}
+	}
+}
+
+// traverse 穿透对称 NAT：生日攻击时对称一方从额外的套接字向对端打洞，每个套接字各占一个映射；
+// 另一方向对端预测的或随机的映射端口发送探测，为其打开本端 NAT 的过滤
+func (m *peerManager) traverse(p *directPeer, probe []byte) {
+	if p.method == network.TraversalPunch || p.public == nil {
+		return
+	}
+	limits := m.nat.Limits()
+	if local, _ := m.nat.LocalNAT(); local == stun.NATSymmetric {
+		if p.method != network.TraversalBirthday {
+			return
+		}
+		if !p.opened {
+			p.opened = true
+			sockets, err := m.nat.OpenSockets(limits.Sockets)
+			if err != nil {
+				log.Printf("与节点 %s 的生日攻击穿透: %v", p.nodeID, err)
+			}
+			p.sockets = sockets
+			for _, conn := range sockets {
+				go m.readSocket(conn)
+			}
+		}
+		for _, conn := range p.sockets {
+			if p.pinned == nil || p.pinned == conn {
+				conn.WriteTo(probe, p.public)
+			}
+		}
+		return
+	}
+
+	var ports []uint16
+	if p.method == network.TraversalPredict {
+		ports = network.PredictPorts(uint16(p.public.Port), p.step, limits.PredictPorts)
+	} else {
+		ports = limits.RandomPorts(min(limits.ProbesPerRound, limits.MaxProbes-p.probes), p.tried)
+	}
+	for _, port := range ports {
+		m.conn.WriteTo(probe, &net.UDPAddr{IP: p.public.IP, Port: int(port)})
+	}
+	p.probes += len(ports)
+}
+
+// canRelay 判断打洞失败后能否经中继服务或 TURN 服务器与对端通信
+func (m *peerManager) canRelay(p *directPeer) bool {
+	return m.canUseRelayService(p) || (p.relayed != nil && m.nat.TURN() != nil)
+}
+
+// canUseRelayService 判断能否经中继服务与对端通信，中继服务优先于 TURN 服务器
+func (m *peerManager) canUseRelayService(p *directPeer) bool {
+	return len(p.relayTicket) > 0 && m.nat.RelayAddr() != nil
+}
+
+// startRelay 开始经中继服务或 TURN 服务器与对端建立会话，调用方须持有 m.mutex
+func (m *peerManager) startRelay(p *directPeer) {
+	p.state = stateRelaying
+	p.deadline = time.Now().Add(relayTimeout)
+	p.addr, p.probes = nil, 0
+	if m.canUseRelayService(p) {
+		go m.bindRelay(p)
+	} else {
+		go m.bindTURN(p, m.nat.TURN(), p.relayed)
+	}
+}
+
+// updateRelayTicket 处理服务器签发的中继票据：更新与对端通信的票据，
+// 已回退到服务器中继的对端改经中继服务通信
+func (m *peerManager) updateRelayTicket(msg *protocol.Message) {
+	var nat protocol.NATMessage
+	if err := protocol.UnmarshalControl(msg.Version, msg.Data, &nat); err != nil {
+		log.Printf("解析中继票据失败: %v", err)
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p := m.direct[nat.TargetID]
+	if p == nil || len(nat.RelayTicket) == 0 {
+		return
+	}
+	p.relayTicket, p.relayKey = nat.RelayTicket, nat.RelayKey
+	if p.state == stateFailed && m.canRelay(p) {
+		p.method = network.TraversalRelay
+		m.startRelay(p)
+	}
+}
+
+// bindRelay 在中继服务上绑定与对端的会话，双方都绑定后中继路径就绪
+func (m *peerManager) bindRelay(p *directPeer) {
+	conn, err := m.nat.CreateRelayConnection(p.nodeID, p.relayTicket, p.relayKey)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	current := m.direct[p.nodeID] == p && p.state == stateRelaying
+	if err != nil {
+		if current {
+			p.state = stateFailed
+			m.finishTraversal(p, false)
+			log.Printf("经中继服务与节点 %s 建立会话失败，经服务器中继: %v", p.nodeID, err)
+		}
+		return
+	}
+	if !current {
+		conn.Close()
+		return
+	}
+	p.relay = conn
+	p.conn, p.addr = conn, m.nat.RelayAddr()
+	go m.readSocket(conn)
+	m.relayReady(p)
+}
+
+// bindTURN 在 TURN 服务器上为对端的中继地址 peer 创建权限并绑定通道，此后双方的报文
+// 经各自的中继地址转发。TURN 分配由所有对端共用，由 main 中的协程读取
+func (m *peerManager) bindTURN(p *directPeer, turn *network.TURNClient, peer *net.UDPAddr) {
+	err := turn.Permit(peer)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.direct[p.nodeID] != p || p.state != stateRelaying {
+		return
+	}
+	if err != nil {
+		p.state = stateFailed
+		m.finishTraversal(p, false)
+		log.Printf("经 TURN 服务器与节点 %s 建立会话失败，经服务器中继: %v", p.nodeID, err)
+		return
+	}
+	p.conn, p.addr = turn, peer
+	m.relayReady(p)
+}
+
+// relayReady 中继路径就绪后明文模式直接建立连接，加密模式由发起方经中继路径发起 Noise 握手，
+// 中继服务和 TURN 服务器都无法解密双方的消息。调用方须持有 m.mutex
+func (m *peerManager) relayReady(p *directPeer) {
+	if !m.security.encryption {
+		p.proto = protocol.NewProtocol(nil, p.version, 0, 0)
+		m.establish(p, p.conn, p.addr)
+		return
+	}
+	if p.initiator {
+		if err := m.sendHandshake(p, 0); err != nil {
+			log.Printf("发起与节点 %s 的握手失败: %v", p.nodeID, err)
+		}
+	}
+}
+
+// readSocket 读取生日攻击额外打开的套接字、中继连接或 TURN 分配收到的报文，套接字关闭后退出
+func (m *peerManager) readSocket(conn net.PacketConn) {
+	buf := make([]byte, protocol.MaxMessageSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if addr, ok := from.(*net.UDPAddr); ok {
+			m.handleSocketPacket(conn, addr, buf[:n])
+		}
+	}
+}
+
+// punchData 编码打洞探测或确认，失败时返回 nil
+func (m *peerManager) punchData(p *directPeer, ack bool) []byte {
+	payload, err := protocol.MarshalControl(p.version, &protocol.PunchMessage{
+		NodeID: m.nodeID,
+		Token:  p.token,
+		Ack:    ack,
+	})
+	if err != nil {
+		log.Printf("编码打洞探测失败: %v", err)
+		return nil
+	}
+	data, err := (&protocol.Message{Version: p.version, Type: protocol.MsgTypePunch, Data: payload}).Encode()
+	if err != nil {
+		log.Printf("编码打洞探测失败: %v", err)
+		return nil
+	}
+	return data
+}
+
+// sendHandshake 向已确认的对端端点发起 Noise 握手，epoch 为本次握手派生密钥的代数
+func (m *peerManager) sendHandshake(p *directPeer, epoch uint8) error {
+	if p.pending == nil || time.Since(p.sentAt) >= rekeyTimeout {
+		payload, err := protocol.MarshalHandshake(p.version, &protocol.HandshakeMessage{
+			NodeID:       m.nodeID,
+			Timestamp:    time.Now().UnixNano(),
+			Algorithms:   m.security.algorithms,
+			Epoch:        epoch,
+			SenderIndex:  p.index,
+			MinVersion:   p.version,
+			MaxVersion:   p.version,
+			Capabilities: protocol.LocalCapabilities,
+		})
+		if err != nil {
+			return err
+		}
+		hs := crypto.NewInitiatorHandshake(m.security.static, p.static)
+		initiation, err := hs.WriteMessage(payload)
+		if err != nil {
+			return err
+		}
+		data, err := (&protocol.Message{
+			Version: p.version,
+			Type:    protocol.MsgTypeHandshake,
+			Flags:   protocol.FlagEncrypted,
+			Data:    initiation,
+		}).Encode()
+		if err != nil {
+			return err
+		}
+		p.pending, p.initiation, p.epoch, p.sentAt = hs, data, epoch, time.Now()
+	}
+	_, err := p.conn.WriteTo(p.initiation, p.addr)
+	return err
+}
+
+// directLink 直连对端当前的会话和端点，在持有 m.mutex 时取得，此后无需持锁即可发送，
+// 各工作协程据此并行加密和发送。直连随后被替换或关闭不影响已取得的 directLink，发送可能因此失败
+type directLink struct {
+	peer  *directPeer
+	proto *protocol.Protocol
+	conn  net.PacketConn
+	addr  *net.UDPAddr
+}
+
+// link 返回对端当前的直连，调用者须持有 m.mutex
+func (p *directPeer) link() directLink {
+	return directLink{peer: p, proto: p.proto, conn: p.conn, addr: p.addr}
+}
+
+// send 以直连会话编码消息并发送到对端端点
+func (l directLink) send(msgType uint8, payload []byte) error {
+	data, err := l.proto.Encode(&protocol.Message{Type: msgType, Data: payload})
+	if err != nil {
+		return err
+	}
+	if _, err := l.conn.WriteTo(data, l.addr); err != nil {
+		return err
+	}
+	l.peer.lastSent.Store(time.Now().UnixNano())
+	return nil
+}
+
+// sendDirect 以直连会话编码消息并发送到对端端点，调用者须持有 m.mutex
+func (m *peerManager) sendDirect(p *directPeer, msgType uint8, payload []byte) error {
+	return p.link().send(msgType, payload)
+}
+
+// establish 记录已建立的直连，此后经 conn 发往对端的数据不再经过服务器
+func (m *peerManager) establish(p *directPeer, conn net.PacketConn, addr *net.UDPAddr) {
+	p.conn, p.addr = conn, addr
+	if p.state != stateEstablished {
+		if p.method == network.TraversalRelay && p.relay == nil {
+			log.Printf("经 TURN 服务器与节点 %s 建立会话，对端中继地址 %s", p.nodeID, addr)
+		} else if p.method == network.TraversalRelay {
+			log.Printf("经中继服务 %s 与节点 %s 建立会话", addr, p.nodeID)
+		} else {
+			log.Printf("与节点 %s 建立直连 %s", p.nodeID, addr)
+		}
+		m.finishTraversal(p, true)
+	}
+	p.state = stateEstablished
+	p.lastRecv.Store(time.Now().UnixNano())
+	if p.keys != nil {
+		m.sessions[p.index] = p
+	}
+}
+
+// dropSession 删除对端在会话索引表中的记录，调用者须持有 m.mutex
+func (m *peerManager) dropSession(p *directPeer) {
+	if m.sessions[p.index] == p {
+		delete(m.sessions, p.index)
+	}
+}
+
+// send 目的地址属于已直连的节点时直接发送数据包，返回 false 时应经服务器中继。
+// 只在选择对端时持有 m.mutex 的读锁，加密和发送时不持锁，可由多个工作协程并行调用
+func (m *peerManager) send(destination net.IP, packet []byte) bool {
+	m.mutex.RLock()
+	var target *directPeer
+	best := -1
+	for _, p := range m.direct {
+		if p.state != stateEstablished {
+			continue
+		}
+		if prefix := p.owns(destination); prefix > best {
+			target, best = p, prefix
+		}
+	}
+	if target == nil {
+		m.mutex.RUnlock()
+		return false
+	}
+	link := target.link()
+	m.mutex.RUnlock()
+
+	if err := link.send(protocol.MsgTypeData, packet); err != nil {
+		log.Printf("直接发送到节点 %s 失败，经服务器中继: %v", target.nodeID, err)
+		return false
+	}
+	return true
+}
+
+// handlePeerPacket 处理其他节点经与服务器共用的套接字直接发来的报文
+func (m *peerManager) handlePeerPacket(from *net.UDPAddr, data []byte) {
+	m.handleSocketPacket(m.conn, from, data)
+}
+
+// handleSocketPacket 处理其他节点经 conn 直接发来的报文，格式错误或无法认证的报文被丢弃
+func (m *peerManager) handleSocketPacket(conn net.PacketConn, from *net.UDPAddr, data []byte) {
+	msg, err := protocol.DecodeMessage(data)
+	if err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case protocol.MsgTypePunch:
+		m.handlePunch(conn, from, msg)
+	case protocol.MsgTypeHandshake:
+		if m.security.encryption && msg.Flags&protocol.FlagEncrypted != 0 {
+			m.handlePeerHandshake(conn, from, msg)
+		}
+	default:
+		if packet := m.handleDirect(conn, from, data); packet != nil {
+			m.deliver(packet)
+		}
+	}
+}
+
+// handlePunch 处理打洞探测：经收到探测的套接字回复确认，并把探测来源作为候选端点
+// （对称 NAT 为发往本端的报文分配了新的映射）；收到确认说明经该套接字到该端点的路径双向可达
+func (m *peerManager) handlePunch(conn net.PacketConn, from *net.UDPAddr, msg *protocol.Message) {
+	var punch protocol.PunchMessage
+	if err := protocol.UnmarshalControl(msg.Version, msg.Data, &punch); err != nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p := m.direct[punch.NodeID]
+	if p == nil || p.state == stateFailed || !bytes.Equal(p.token, punch.Token) {
+		return
+	}
+	// 生日攻击时对端可能命中多个套接字的映射，只使用最先收到对端报文的一个，
+	// 否则双方可能各自确认不同的路径
+	if p.opened && p.state == statePunching {
+		if p.pinned == nil {
+			p.pinned = conn
+		} else if p.pinned != conn {
+			return
+		}
+	}
+
+	if !punch.Ack {
+		p.addCandidate(from)
+		if ack := m.punchData(p, true); ack != nil {
+			conn.WriteTo(ack, from)
+		}
+		return
+	}
+	if p.state != statePunching || p.addr != nil {
+		return
+	}
+	p.addr, p.conn = from, conn
+	if !m.security.encryption {
+		p.proto = protocol.NewProtocol(nil, p.version, 0, 0)
+		m.establish(p, conn, from)
+		return
+	}
+	if p.initiator {
+		if err := m.sendHandshake(p, 0); err != nil {
+			log.Printf("发起与节点 %s 的握手失败: %v", p.nodeID, err)
+		}
+	}
+}
+
+// handlePeerHandshake 处理节点之间的 Noise 握手：发起方收到的是对其握手的响应，其余为对端发起的握手
+func (m *peerManager) handlePeerHandshake(conn net.PacketConn, from *net.UDPAddr, msg *protocol.Message) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, p := range m.direct {
+		if p.pending != nil && p.conn == conn && sameAddr(p.addr, from) {
+			m.completePeerHandshake(p, from, msg)
+			return
+		}
+	}
+	m.respondPeerHandshake(conn, from, msg)
+}
+
+// completePeerHandshake 发起方处理握手响应，派生直连会话密钥
+func (m *peerManager) completePeerHandshake(p *directPeer, from *net.UDPAddr, msg *protocol.Message) {
+	session, result, err := completeHandshake(p.pending, msg, m.security, p.epoch)
+	if err != nil {
+		log.Printf("与节点 %s 握手失败: %v", p.nodeID, err)
+		return
+	}
+	if result.Version != p.version {
+		log.Printf("与节点 %s 握手失败: 协议版本 %d 与介绍的版本 %d 不符", p.nodeID, result.Version, p.version)
+		return
+	}
+	p.pending, p.initiation = nil, nil
+
+	// 直连已建立且会话索引不变时为密钥轮换，立即切换到新密钥发送
+	if p.state == stateEstablished && result.SenderIndex == p.remoteIndex {
+		p.keys.Install(session)
+		return
+	}
+	p.keys = crypto.NewKeyRing(m.security.policy)
+	p.keys.Install(session)
+	p.remoteIndex = result.SenderIndex
+	p.proto = protocol.NewProtocol(p.keys, p.version, p.index, p.remoteIndex)
+	m.establish(p, p.conn, from)
+}
+
+// respondPeerHandshake 响应方处理对端经 conn 发起的握手，只接受服务器介绍过的节点
+func (m *peerManager) respondPeerHandshake(conn net.PacketConn, from *net.UDPAddr, msg *protocol.Message) {
+	hs := crypto.NewResponderHandshake(m.security.static)
+	payload, err := hs.ReadMessage(msg.Data)
+	if err != nil {
+		return
+	}
+	remote := hs.RemoteStatic()
+	p := m.direct[crypto.NodeID(remote)]
+	if p == nil || p.static != remote || p.initiator || p.state == stateFailed || msg.Version != p.version {
+		log.Printf("拒绝来自 %s 的直连握手 (%s)", from, crypto.NodeID(remote))
+		return
+	}
+
+	var handshake protocol.HandshakeMessage
+	if err := protocol.UnmarshalHandshake(msg.Version, payload, &handshake); err != nil {
+		log.Printf("解析节点 %s 的握手消息失败: %v", p.nodeID, err)
+		return
+	}
+	// 重传的握手只重发此前的响应，不晚于已接受握手的视为重放
+	if handshake.Timestamp == p.timestamp && p.response != nil {
+		conn.WriteTo(p.response, from)
+		return
+	}
+	if handshake.Timestamp <= m.timestamps[remote] {
+		log.Printf("拒绝节点 %s 重放的直连握手", p.nodeID)
+		return
+	}
+
+	// 未协商出算法时不响应，对端打洞超时后继续经服务器中继
+	algorithm, err := crypto.NegotiateAlgorithm(handshake.Algorithms, m.security.algorithms)
+	if err != nil {
+		log.Printf("拒绝节点 %s 的直连握手: %v", p.nodeID, err)
+		return
+	}
+	reply, err := protocol.MarshalHandshake(p.version, &protocol.HandshakeResponse{
+		Status:       protocol.HandshakeStatusOK,
+		Algorithm:    algorithm,
+		SenderIndex:  p.index,
+		Version:      p.version,
+		Capabilities: handshake.Capabilities & protocol.LocalCapabilities,
+	})
+	if err != nil {
+		log.Printf("编码握手响应失败: %v", err)
+		return
+	}
+	response, err := hs.WriteMessage(reply)
+	if err != nil {
+		log.Printf("生成握手响应失败: %v", err)
+		return
+	}
+	session, err := hs.Split(algorithm)
+	if err != nil {
+		log.Printf("派生直连会话密钥失败: %v", err)
+		return
+	}
+	session.Epoch = handshake.Epoch
+	data, err := (&protocol.Message{
+		Version: p.version,
+		Type:    protocol.MsgTypeHandshake,
+		Flags:   protocol.FlagEncrypted,
+		Data:    response,
+	}).Encode()
+	if err != nil {
+		log.Printf("编码握手响应失败: %v", err)
+		return
+	}
+
+	// 同一会话重新握手时暂存新密钥，待发起方切换后再用于发送
+	if p.state == stateEstablished && p.remoteIndex == handshake.SenderIndex {
+		p.keys.Stage(session)
+	} else {
+		p.keys = crypto.NewKeyRing(m.security.policy)
+		p.keys.Install(session)
+		p.remoteIndex = handshake.SenderIndex
+		p.proto = protocol.NewProtocol(p.keys, p.version, p.index, p.remoteIndex)
+		m.establish(p, conn, from)
+	}
+	p.timestamp, p.response = handshake.Timestamp, data
+	m.timestamps[remote] = handshake.Timestamp
+	conn.WriteTo(data, from)
+}
+
+// lookupDirect 查找消息所属的已建立直连：加密消息按会话索引查找，明文消息只接受已确认端点发来的。
+// 调用者须持有 m.mutex 的读锁
+func (m *peerManager) lookupDirect(conn net.PacketConn, from *net.UDPAddr, msg *protocol.Message) *directPeer {
+	if msg.Flags&protocol.FlagEncrypted != 0 {
+		if p := m.sessions[msg.Index]; p != nil && p.state == stateEstablished {
+			return p
+		}
+		return nil
+	}
+	for _, p := range m.direct {
+		if p.state == stateEstablished && p.keys == nil && p.conn == conn && sameAddr(p.addr, from) {
+			return p
+		}
+	}
+	return nil
+}
+
+// handleDirect 以直连会话解码对端发来的消息，返回需要写入 TUN 接口的数据包
+func (m *peerManager) handleDirect(conn net.PacketConn, from *net.UDPAddr, data []byte) []byte {
+	msg, err := protocol.DecodeMessage(data)
+	if err != nil {
+		return nil
+	}
+
+	// 查找对端时只持有读锁，解密时不持锁，各套接字的接收协程可以并行处理
+	m.mutex.RLock()
+	peer := m.lookupDirect(conn, from, msg)
+	var link directLink
+	if peer != nil {
+		link = peer.link()
+	}
+	m.mutex.RUnlock()
+	if peer == nil {
+		return nil
+	}
+
+	msg, err = link.proto.Decode(data)
+	if err != nil {
+		if !errors.Is(err, crypto.ErrReplay) {
+			log.Printf("拒绝节点 %s 的直连消息: %v", peer.nodeID, err)
+		}
+		return nil
+	}
+	// 通过认证后记录对端最新地址，支持对端地址变化
+	now := time.Now()
+	peer.lastRecv.Store(now.UnixNano())
+	if link.conn != conn || !sameAddr(link.addr, from) {
+		m.mutex.Lock()
+		peer.conn, peer.addr = conn, from
+		m.mutex.Unlock()
+	}
+
+	// TAP 模式下记录帧的源地址位于对端，此后发往该地址的帧直接发送
+	if m.bridge != nil {
+		if msg.Type != protocol.MsgTypeFrame {
+			return nil
+		}
+		_, data, err := protocol.DecodeFrame(msg.Data)
+		if err != nil {
+			return nil
+		}
+		frame, err := network.ParseFrame(data)
+		if err != nil {
+			return nil
+		}
+		m.bridge.Learn(frame, peer.nodeID, now)
+		return data
+	}
+	if msg.Type != protocol.MsgTypeData {
+		return nil
+	}
+	// 对端只能以自己的地址或所通告网段内的地址发送
+	packet, err := network.ParsePacket(msg.Data)
+	if err != nil || peer.owns(packet.Source) < 0 {
+		log.Printf("丢弃节点 %s 直接发送的数据包: 源地址不属于该节点", peer.nodeID)
+		return nil
+	}
+	return msg.Data
+}
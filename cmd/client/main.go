@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -11,15 +11,31 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/fenghuilee/sd-wan/internal/auth"
 	"github.com/fenghuilee/sd-wan/internal/config"
 	"github.com/fenghuilee/sd-wan/internal/network"
 	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/internal/stun"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
 )
 
 var (
 	configFile = flag.String("config", "config.yaml", "配置文件路径")
 )
 
+const (
+	// handshakeTimeout 等待握手响应的超时时间
+	handshakeTimeout = 5 * time.Second
+	// handshakeRetryDelay 服务器要求稍后重试时重新握手的间隔，最多重试 handshakeRetries 次
+	handshakeRetryDelay = time.Second
+	handshakeRetries    = 10
+	// routeAnnounceInterval 未被服务器确认的路由通告的重发间隔，最多重发 routeAnnounceRetries 次
+	routeAnnounceInterval = 5 * time.Second
+	routeAnnounceRetries  = 6
+	// stunTimeout 单个 STUN 请求的超时时间，NAT 类型探测最多需要约四倍的时间
+	stunTimeout = time.Second
+)
+
 func main() {
 	flag.Parse()
 
@@ -29,24 +45,68 @@ func main() {
 		log.Fatalf("加载配置失败: %v", err)
 	}
 
-	// 创建 TUN 接口
-	tun, err := network.NewTUN(cfg.Client.DeviceName, cfg.Client.MTU)
+	// 加载安全设置
+	security, err := loadSecurityOptions(cfg)
+	if err != nil {
+		log.Fatalf("加载安全设置失败: %v", err)
+	}
+
+	// 创建 TUN 接口，TAP 模式下创建 TAP 接口，由用户将其与局域网接口桥接。
+	// 每个队列由一个工作协程读取、加密并发送
+	mode, err := cfg.GetMode()
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	workers := cfg.GetQueues()
+	var tun *network.TUN
+	if mode == protocol.ModeTAP {
+		tun, err = network.NewTAP(cfg.Client.DeviceName, cfg.Client.MTU, workers)
+	} else {
+		tun, err = network.NewTUN(cfg.Client.DeviceName, cfg.Client.MTU, workers)
+	}
 	if err != nil {
-		log.Fatalf("创建 TUN 接口失败: %v", err)
+		log.Fatalf("创建 %s 接口失败: %v", protocol.ModeName(mode), err)
 	}
 	defer tun.Close()
 
-	// 设置 IP 地址
-	ip := net.ParseIP(cfg.Network.Subnet[:len(cfg.Network.Subnet)-3])
-	if err := tun.SetIP(ip); err != nil {
-		log.Fatalf("设置 IP 地址失败: %v", err)
+	// 设置地址、MTU 和到虚拟网段的路由
+	subnets, err := cfg.GetSubnets()
+	if err != nil {
+		log.Fatalf("解析虚拟网段失败: %v", err)
+	}
+	addresses, err := clientAddresses(cfg, subnets, security)
+	if err != nil {
+		log.Fatalf("解析本节点地址失败: %v", err)
+	}
+	if len(addresses) == 0 {
+		log.Println("未配置 client.address，使用服务器分配的虚拟地址")
+	}
+	if err := configureTUN(tun, addresses, subnets); errors.Is(err, errors.ErrUnsupported) {
+		log.Printf("警告: %v，须手动配置接口 %s 的地址、MTU 和路由", err, tun.Name())
+	} else if err != nil {
+		log.Fatalf("配置 TUN 接口失败: %v", err)
 	}
 
-	// 创建 NAT 穿透管理器
-	nat := network.NewNATTraversal(
-		net.ParseIP(cfg.NAT.RelayServer),
-		uint16(cfg.NAT.RelayPort),
-	)
+	// 创建 NAT 穿透管理器，中继服务的地址无法解析时打洞失败后只能经服务器中继
+	var relayIP net.IP
+	var relayPort uint16
+	if cfg.NAT.RelayServer != "" {
+		if relayAddr, err := net.ResolveUDPAddr("udp", cfg.GetRelayAddr()); err != nil {
+			log.Printf("警告: 解析中继服务地址失败，不使用中继服务: %v", err)
+		} else {
+			relayIP, relayPort = relayAddr.IP, uint16(relayAddr.Port)
+		}
+	}
+	nat := network.NewNATTraversal(relayIP, relayPort)
+	defer nat.Close()
+	limits := nat.Limits()
+	if cfg.NAT.TraversalSockets > 0 {
+		limits.Sockets = cfg.NAT.TraversalSockets
+	}
+	if cfg.NAT.TraversalProbes > 0 {
+		limits.MaxProbes = cfg.NAT.TraversalProbes
+	}
+	nat.SetLimits(limits)
 
 	// 创建 UDP 连接
 	serverAddr, err := net.ResolveUDPAddr("udp", cfg.Client.ServerAddress)
@@ -54,132 +114,842 @@ func main() {
 		log.Fatalf("解析服务器地址失败: %v", err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, serverAddr)
+	udp, err := listenUDP(workers)
 	if err != nil {
-		log.Fatalf("连接服务器失败: %v", err)
+		log.Fatalf("创建 UDP 套接字失败: %v", err)
 	}
+	conn := newServerConn(udp, serverAddr)
 	defer conn.Close()
 
-	// 发送握手消息
-	if err := sendHandshake(conn, tun); err != nil {
-		log.Fatalf("发送握手消息失败: %v", err)
+	// 经 STUN 探测公网映射和 NAT 类型，随握手上报给服务器
+	stunServer := serverAddr
+	if cfg.NAT.STUNServer != "" {
+		if stunServer, err = net.ResolveUDPAddr("udp", cfg.NAT.STUNServer); err != nil {
+			log.Fatalf("解析 STUN 服务器地址失败: %v", err)
+		}
+	}
+	conn.discover(stunServer)
+	nat.SetLocalNAT(conn.natType, conn.portStep)
+
+	// 配置了 TURN 服务器时分配中继地址，随握手上报给服务器；分配失败时只是不能经 TURN 服务器通信
+	if cfg.NAT.TURNServer != "" {
+		conn.relayed = allocateTURN(nat, cfg)
+	}
+
+	// 与服务器握手，服务器分配了虚拟地址时改用该地址
+	proto, assigned, err := sendHandshake(conn, tun, security)
+	if err != nil {
+		log.Fatalf("握手失败: %v", err)
+	}
+	for _, address := range assigned {
+		if err := applyAddress(tun, address); errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("警告: 须手动为接口 %s 配置服务器分配的地址 %s", tun.Name(), address)
+		} else if err != nil {
+			log.Fatalf("设置服务器分配的地址失败: %v", err)
+		}
+	}
+	if len(assigned) == 0 && len(addresses) == 0 {
+		log.Println("警告: 服务器未分配虚拟地址且未配置 client.address，本节点无法接收其他节点的数据包")
 	}
 
 	// 处理信号
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// 启动消息接收和密钥轮换
+	peers := newPeerManager(security, conn, nat, tun)
+	peers.ipv6 = conn.global6 != nil
+	if mode == protocol.ModeTAP {
+		peers.bridge = network.NewBridge(cfg.GetBridgeConfig())
+		log.Printf("工作在 TAP 模式，可将接口 %s 与局域网接口桥接", tun.Name())
+	}
+	if turn := nat.TURN(); turn != nil {
+		go peers.readSocket(turn)
+	}
+	rekey := newRekeyer(conn, tun, security, proto)
+	go receiveMessages(conn, proto, rekey, peers)
+	// 握手完成后再为工作协程打开共享端口的套接字，报文可能到达其中任一套接字，每个套接字都接收消息
+	conns := workerConns(conn, workers)
+	for _, shared := range conns[1:] {
+		if shared != conn {
+			defer shared.Close()
+			go receiveMessages(shared, proto, rekey, peers)
+		}
+	}
+	if proto.IsEncrypted() {
+		go rekey.run()
+	}
+
+	// 启动打洞和直连维护
+	go peers.run()
+
 	// 启动保活消息发送
-	go sendKeepAlive(conn)
+	go sendKeepAlive(conn, proto, security.nodeID)
+
+	// 通告本节点身后的网段，服务器只接受经过认证的路由通告
+	if len(cfg.Client.Routes) > 0 {
+		if proto.IsEncrypted() {
+			go announceRoutes(conn, proto, peers, cfg.Client.Routes)
+		} else {
+			log.Println("警告: 未启用加密，服务器不接受 client.routes 中的路由通告")
+		}
+	}
 
 	// 启动数据包处理
-	go handlePackets(tun, conn, nat)
+	log.Printf("接口 %s 有 %d 个队列，%d 个工作协程并行加密和发送数据包", tun.Name(), tun.Queues(), workers)
+	go handlePackets(tun, conns, peers, proto)
 
-	// 等待信号
-	<-sigChan
+	// 等待信号，本节点被服务器吊销时同样退出
+	select {
+	case <-sigChan:
+	case <-peers.done:
+	}
+	for _, stats := range nat.Stats() {
+		log.Printf("NAT 穿透统计: %s", stats)
+	}
 	log.Println("正在关闭客户端...")
 }
 
-func sendHandshake(conn *net.UDPConn, tun *network.TUN) error {
-	// 获取本地 IP 地址
-	localIP, err := tun.GetIP()
+// allocateTURN 在配置的 TURN 服务器上分配中继地址，失败时返回 nil
+func allocateTURN(nat *network.NATTraversal, cfg *config.Config) *net.UDPAddr {
+	server, err := net.ResolveUDPAddr("udp", cfg.NAT.TURNServer)
+	if err != nil {
+		log.Printf("警告: 解析 TURN 服务器地址失败，不使用 TURN: %v", err)
+		return nil
+	}
+	turn, err := nat.AllocateTURN(server, cfg.NAT.TURNUsername, cfg.NAT.TURNPassword)
+	if err != nil {
+		log.Printf("警告: %v，不使用 TURN", err)
+		return nil
+	}
+	log.Printf("TURN 服务器 %s 分配的中继地址 %s", server, turn.RelayedAddr())
+	return turn.RelayedAddr()
+}
+
+// securityOptions 客户端安全设置
+type securityOptions struct {
+	encryption   bool
+	static       *crypto.KeyPair
+	nodeID       string // 由身份公钥派生的节点 ID，所有消息中保持一致
+	serverPublic [crypto.KeySize]byte
+	algorithms   []string
+	policy       crypto.RekeyPolicy
+	index        uint32   // 本端会话索引，服务器发来的消息携带该索引
+	preAuthKey   string   // 预授权密钥，仅在加密握手中发送
+	certificate  []byte   // 本节点证书，在加密握手中发送
+	virtualIPs   []net.IP // 本节点证书中声明的虚拟 IP
+	verifier     *auth.Verifier
+	serverName   string // 校验服务器证书时使用的名称
+}
+
+// loadSecurityOptions 根据 security 配置加载身份密钥、握手参数和算法偏好
+func loadSecurityOptions(cfg *config.Config) (*securityOptions, error) {
+	security := &securityOptions{
+		encryption: cfg.Security.Encryption,
+		policy:     cfg.GetRekeyPolicy(),
+	}
+
+	// 明文模式下同样需要身份密钥来确定节点 ID；配置了证书时使用证书中的密钥
+	if cfg.Client.CertFile != "" {
+		cert, err := auth.LoadCertificate(cfg.Client.CertFile, cfg.Client.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载节点证书失败: %v", err)
+		}
+		security.static = cert.KeyPair
+		security.certificate = cert.DER
+		security.virtualIPs = cert.Leaf.IPAddresses
+		log.Printf("节点证书: %s，组 %v，有效期至 %s", cert.Leaf.Subject.CommonName,
+			cert.Leaf.Subject.OrganizationalUnit, cert.Leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		static, created, err := cfg.LoadIdentity()
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端密钥失败: %v", err)
+		}
+		if created {
+			log.Printf("已生成客户端身份密钥: %s", cfg.Security.IdentityFile)
+		}
+		security.static = static
+	}
+	security.nodeID = crypto.NodeID(security.static.Public)
+	log.Printf("节点 ID: %s", security.nodeID)
+
+	if !security.encryption {
+		log.Println("警告: 未启用加密，所有消息以明文传输")
+		return security, nil
+	}
+
+	// 优先使用配置的服务器公钥，否则在握手前获取服务器证书并通过 CA 校验
+	if cfg.Security.ServerPublicKey != "" {
+		serverPublic, err := crypto.ParsePublicKey(cfg.Security.ServerPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("加载服务器公钥失败: %v", err)
+		}
+		security.serverPublic = serverPublic
+	}
+	verifier, err := cfg.LoadVerifier()
 	if err != nil {
+		return nil, fmt.Errorf("加载 CA 证书失败: %v", err)
+	}
+	if verifier == nil && cfg.Security.ServerPublicKey == "" {
+		return nil, errors.New("未配置 security.server_public_key 或 security.ca_file")
+	}
+	security.verifier = verifier
+	security.serverName = cfg.Client.ServerName
+	if security.serverName == "" {
+		host, _, err := net.SplitHostPort(cfg.Client.ServerAddress)
+		if err != nil {
+			return nil, fmt.Errorf("解析服务器地址失败: %v", err)
+		}
+		security.serverName = host
+	}
+
+	index, err := protocol.NewIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	security.index = index
+	security.algorithms = crypto.PreferredAlgorithms(cfg.Security.Algorithm, cfg.Security.HardwareAcceleration)
+	security.preAuthKey = cfg.Security.PreAuthKey
+	return security, nil
+}
+
+// clientAddresses 返回本节点的虚拟地址及其前缀：优先使用 client.address（可带前缀长度），
+// 否则使用节点证书中声明的虚拟 IP，每个协议族取第一个，都没有时返回空。不带前缀长度的地址位于
+// 某个虚拟网段内时取该网段的前缀，否则为单个主机
+func clientAddresses(cfg *config.Config, subnets []*net.IPNet, security *securityOptions) ([]*net.IPNet, error) {
+	var addresses []*net.IPNet
+	if len(cfg.Client.Address) > 0 {
+		for _, address := range cfg.Client.Address {
+			if ip, ipNet, err := net.ParseCIDR(address); err == nil {
+				addresses = append(addresses, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+				continue
+			}
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的地址 %q", address)
+			}
+			addresses = append(addresses, hostAddress(ip, subnets))
+		}
+		return addresses, nil
+	}
+	var v4, v6 bool
+	for _, ip := range security.virtualIPs {
+		if ip.To4() != nil && !v4 {
+			v4 = true
+			addresses = append(addresses, hostAddress(ip, subnets))
+		} else if ip.To4() == nil && !v6 {
+			v6 = true
+			addresses = append(addresses, hostAddress(ip, subnets))
+		}
+	}
+	return addresses, nil
+}
+
+// hostAddress 返回地址及其前缀：位于某个虚拟网段内时取该网段的前缀，否则为单个主机
+func hostAddress(ip net.IP, subnets []*net.IPNet) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return &net.IPNet{IP: ip, Mask: subnet.Mask}
+		}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+}
+
+// configureTUN 为接口添加地址、设置 MTU 并启动接口，没有地址的前缀覆盖整个虚拟网段时
+// 另外安装到该网段的路由
+func configureTUN(tun *network.TUN, addresses []*net.IPNet, subnets []*net.IPNet) error {
+	for _, address := range addresses {
+		if err := tun.AddAddress(address); err != nil {
+			return err
+		}
+	}
+	if err := tun.Up(); err != nil {
 		return err
 	}
+	for _, subnet := range subnets {
+		if !covered(addresses, subnet) {
+			if err := tun.AddRoute(subnet); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// covered 判断某个地址的前缀是否覆盖整个网段 subnet
+func covered(addresses []*net.IPNet, subnet *net.IPNet) bool {
+	prefix, _ := subnet.Mask.Size()
+	for _, address := range addresses {
+		if ones, _ := address.Mask.Size(); ones <= prefix && address.Contains(subnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverConn 客户端的 UDP 套接字。与服务器和其他节点的通信共用同一个套接字，
+// 其他节点向服务器观察到的地址打洞时才能命中同一个 NAT 映射
+type serverConn struct {
+	net.PacketConn
+	server   *net.UDPAddr
+	local    net.IP       // 访问服务器时使用的本机地址，即本节点的局域网地址
+	global6  net.IP       // 本机的全局 IPv6 地址，与本地端口组成 IPv6 端点，没有时为 nil
+	public   *net.UDPAddr // 经 STUN 探测出的公网映射，未探测时为 nil
+	natType  stun.NATType // 经 STUN 探测出的 NAT 类型
+	portStep int          // 对称 NAT 先后分配的映射端口之差
+	relayed  *net.UDPAddr // 在 TURN 服务器上分配的中继地址，未使用 TURN 时为 nil
+}
+
+// newServerConn 创建与服务器通信的套接字
+func newServerConn(conn net.PacketConn, server *net.UDPAddr) *serverConn {
+	return &serverConn{
+		PacketConn: conn,
+		server:     server,
+		local:      localAddress(server),
+		global6:    globalAddress6(server),
+	}
+}
+
+// localAddress 返回访问 server 时使用的本机地址，无法确定时返回 nil
+func localAddress(server *net.UDPAddr) net.IP {
+	probe, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return nil
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr).IP
+}
+
+// ipv6Probe 确定本机全局 IPv6 地址时连接的公网地址，只用于选择源地址，不发送报文
+var ipv6Probe = &net.UDPAddr{IP: net.ParseIP("2001:4860:4860::8888"), Port: 53}
+
+// globalAddress6 返回访问 IPv6 公网时使用的本机全局 IPv6 地址，服务器地址为 IPv6 时以访问服务器的地址为准，
+// 没有全局 IPv6 地址时返回 nil。IPv6 通常不经 NAT，节点之间可经该地址直达
+func globalAddress6(server *net.UDPAddr) net.IP {
+	target := ipv6Probe
+	if server.IP.To4() == nil {
+		target = server
+	}
+	probe, err := net.DialUDP("udp6", nil, target)
+	if err != nil {
+		return nil
+	}
+	defer probe.Close()
+	ip := probe.LocalAddr().(*net.UDPAddr).IP
+	if ip.To4() != nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+	return ip
+}
+
+// discover 经 STUN 探测套接字的公网映射和 NAT 类型，失败时二者保持未知。
+// 探测期间独占套接字，须在开始接收消息之前调用
+func (c *serverConn) discover(server *net.UDPAddr) {
+	result, err := stun.Classify(c.PacketConn, server, stunTimeout)
+	if err != nil {
+		log.Printf("STUN 探测失败: %v", err)
+		return
+	}
+	c.public, c.natType, c.portStep = result.Mapped, result.NAT, result.PortStep
+	if result.NAT == stun.NATSymmetric {
+		log.Printf("公网地址 %s，NAT 类型 %s，端口步长 %d", result.Mapped, result.NAT, result.PortStep)
+		return
+	}
+	log.Printf("公网地址 %s，NAT 类型 %s", result.Mapped, result.NAT)
+}
+
+// Write 向服务器发送报文
+func (c *serverConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.server)
+}
+
+// Read 读取服务器发来的报文，其他来源的报文被丢弃
+func (c *serverConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if c.fromServer(from) {
+			return n, nil
+		}
+	}
+}
+
+// fromServer 判断报文是否来自服务器
+func (c *serverConn) fromServer(addr net.Addr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	return ok && udp.Port == c.server.Port && udp.IP.Equal(c.server.IP)
+}
+
+// newHandshakeMessage 按协议版本 version 构建握手消息，epoch 为本次握手派生密钥的代数
+func newHandshakeMessage(conn *serverConn, tun *network.TUN, security *securityOptions, version, epoch uint8) ([]byte, error) {
+	// 获取本节点的虚拟地址
+	localIP, localIP6 := overlayAddresses(tun.Addresses())
 
 	// 构建握手消息
 	handshake := protocol.HandshakeMessage{
-		NodeID:      generateNodeID(),
-		PublicIP:    getPublicIP(),
-		PublicPort:  uint16(conn.LocalAddr().(*net.UDPAddr).Port),
-		PrivateIP:   localIP,
-		PrivatePort: uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+		NodeID:       security.nodeID,
+		Timestamp:    time.Now().UnixNano(),
+		PublicPort:   uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+		PrivateIP:    localIP,
+		PrivateIP6:   localIP6,
+		PrivatePort:  uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+		Algorithms:   security.algorithms,
+		Epoch:        epoch,
+		SenderIndex:  security.index,
+		MinVersion:   protocol.MinProtocolVersion,
+		MaxVersion:   protocol.MaxProtocolVersion,
+		Capabilities: protocol.LocalCapabilities,
+		PreAuthKey:   security.preAuthKey,
+		Certificate:  security.certificate,
+		LocalIP:      conn.local,
+		NATType:      uint8(conn.natType),
+		PortStep:     int16(conn.portStep),
+		GlobalIP6:    conn.global6,
+		Mode:         protocol.ModeTUN,
+	}
+	if tun.IsTAP() {
+		handshake.Mode = protocol.ModeTAP
+	}
+	if conn.public != nil {
+		handshake.PublicIP = conn.public.IP
+		handshake.PublicPort = uint16(conn.public.Port)
+	}
+	if conn.relayed != nil {
+		handshake.RelayedIP = conn.relayed.IP
+		handshake.RelayedPort = uint16(conn.relayed.Port)
+	}
+
+	return protocol.MarshalHandshake(version, &handshake)
+}
+
+// overlayAddresses 返回握手中上报的虚拟地址：优先取 IPv4 地址，另有 IPv6 地址时作为双栈的第二个地址
+func overlayAddresses(addrs []*net.IPNet) (ip, ip6 net.IP) {
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if ip == nil {
+				ip = addr.IP
+			}
+		} else if ip6 == nil {
+			ip6 = addr.IP
+		}
+	}
+	if ip == nil {
+		return ip6, nil
+	}
+	return ip, ip6
+}
+
+// errLegacyServer 服务器只支持以 JSON 编码握手的协议版本 2
+var errLegacyServer = errors.New("服务器只支持协议版本 2")
+
+// errHandshakeRetry 服务器暂时无法完成握手，例如正在查询客户端证书的 OCSP 状态
+var errHandshakeRetry = errors.New("服务器要求稍后重试握手")
+
+// sendHandshake 与服务器握手，返回会话的协议处理器和服务器分配的虚拟地址，服务器未分配时地址为空
+func sendHandshake(conn *serverConn, tun *network.TUN, security *securityOptions) (*protocol.Protocol, []*net.IPNet, error) {
+	// 握手以与版本无关的 TLV 格式发送，版本 3 及以上的服务器都能解析；
+	// 只有服务器明确表示只支持版本 2 时才以 JSON 重新握手
+	proto, addresses, err := handshakeAt(conn, tun, security, protocol.ProtocolVersion)
+	for retries := 0; errors.Is(err, errHandshakeRetry) && retries < handshakeRetries; retries++ {
+		log.Printf("%v，%v 后重新握手", err, handshakeRetryDelay)
+		time.Sleep(handshakeRetryDelay)
+		proto, addresses, err = handshakeAt(conn, tun, security, protocol.ProtocolVersion)
+	}
+	if errors.Is(err, errLegacyServer) {
+		log.Printf("%v，以版本 %d 重新握手", err, protocol.MinProtocolVersion)
+		proto, addresses, err = handshakeAt(conn, tun, security, protocol.MinProtocolVersion)
+	}
+	return proto, addresses, err
+}
+
+// handshakeAt 以消息头版本 version 编码并发送握手
+func handshakeAt(conn *serverConn, tun *network.TUN, security *securityOptions, version uint8) (*protocol.Protocol, []*net.IPNet, error) {
+	data, err := newHandshakeMessage(conn, tun, security, version, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !security.encryption {
+		return sendPlainHandshake(conn, version, data)
+	}
+
+	if security.serverPublic == ([crypto.KeySize]byte{}) {
+		if err := fetchServerKey(conn, security); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 握手消息在 Noise IK 第一条消息中加密传输
+	hs := crypto.NewInitiatorHandshake(security.static, security.serverPublic)
+	initiation, err := hs.WriteMessage(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := exchange(conn, version, protocol.MsgTypeHandshake, protocol.FlagEncrypted, initiation)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	data, err := json.Marshal(handshake)
+	session, result, err := completeHandshake(hs, response, security, 0)
 	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("与服务器 %s 握手完成，协议版本 %d，能力 %#x，加密算法 %s",
+		crypto.EncodeKey(session.RemoteStatic), result.Version, result.Capabilities, session.Send.Algorithm())
+
+	keys := crypto.NewKeyRing(security.policy)
+	keys.Install(session)
+	return protocol.NewProtocol(keys, result.Version, security.index, result.SenderIndex), assignedAddresses(result), nil
+}
+
+// assignedAddresses 返回握手响应中服务器分配的虚拟地址，双栈时包括 IPv6 前缀中的地址，
+// 未分配或前缀长度无效的地址被忽略
+func assignedAddresses(result *protocol.HandshakeResponse) []*net.IPNet {
+	var addresses []*net.IPNet
+	for _, assigned := range []struct {
+		ip     net.IP
+		prefix uint8
+	}{
+		{result.Address, result.PrefixLength},
+		{result.Address6, result.PrefixLength6},
+	} {
+		ip := assigned.ip
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		if len(ip) == 0 || ip.IsUnspecified() || int(assigned.prefix) > 8*len(ip) {
+			continue
+		}
+		addresses = append(addresses, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(assigned.prefix), 8*len(ip))})
+	}
+	return addresses
+}
+
+// applyAddress 将接口上同一协议族的地址替换为服务器分配的地址，已是该地址时不做修改
+func applyAddress(tun *network.TUN, assigned *net.IPNet) error {
+	for _, address := range tun.Addresses() {
+		if address.String() == assigned.String() {
+			return nil
+		}
+	}
+	log.Printf("使用服务器分配的虚拟地址 %s", assigned)
+	// 平台不支持自动配置时仍记录地址，此后的握手以其作为本节点的地址
+	err := tun.AddAddress(assigned)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
 		return err
 	}
+	for _, address := range tun.Addresses() {
+		if address.String() != assigned.String() && (address.IP.To4() == nil) == (assigned.IP.To4() == nil) {
+			if err := tun.RemoveAddress(address); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+// completeHandshake 处理服务器的 Noise 握手响应并派生会话密钥
+func completeHandshake(hs *crypto.Handshake, response *protocol.Message, security *securityOptions, epoch uint8) (*crypto.Session, *protocol.HandshakeResponse, error) {
+	if response.Flags&protocol.FlagEncrypted == 0 {
+		// 服务器以明文拒绝，通常是双方加密设置或协议版本不兼容
+		if _, err := readPlainResponse(response); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("服务器返回了明文握手响应")
+	}
+
+	payload, err := hs.ReadMessage(response.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("服务器认证失败: %v", err)
+	}
+
+	var result protocol.HandshakeResponse
+	if err := protocol.UnmarshalHandshake(response.Version, payload, &result); err != nil {
+		return nil, nil, fmt.Errorf("解析握手响应失败: %v", err)
+	}
+	if result.Status != protocol.HandshakeStatusOK {
+		return nil, nil, rejection(&result, response.Version)
+	}
+	if result.Version, err = negotiatedVersion(&result, response.Version); err != nil {
+		return nil, nil, err
+	}
+
+	// 服务器只能从客户端提供的算法中选择
+	if _, err := crypto.NegotiateAlgorithm([]string{result.Algorithm}, security.algorithms); err != nil {
+		return nil, nil, fmt.Errorf("服务器选择了未提供的算法: %s", result.Algorithm)
+	}
+
+	session, err := hs.Split(result.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	session.Epoch = epoch
+	return session, &result, nil
+}
+
+// sendPlainHandshake 未启用加密时以消息头版本 version 发送明文握手
+func sendPlainHandshake(conn *serverConn, version uint8, data []byte) (*protocol.Protocol, []*net.IPNet, error) {
+	response, err := exchange(conn, version, protocol.MsgTypeHandshake, 0, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.Flags&protocol.FlagEncrypted != 0 {
+		return nil, nil, errors.New("服务器返回了加密握手响应")
+	}
+	result, err := readPlainResponse(response)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("与服务器握手完成（明文），协议版本 %d，能力 %#x", result.Version, result.Capabilities)
+	return protocol.NewProtocol(nil, result.Version, 0, 0), assignedAddresses(result), nil
+}
+
+// readPlainResponse 解析明文握手响应，服务器拒绝时返回错误
+func readPlainResponse(response *protocol.Message) (*protocol.HandshakeResponse, error) {
+	var result protocol.HandshakeResponse
+	if err := protocol.UnmarshalHandshake(response.Version, response.Data, &result); err != nil {
+		return nil, fmt.Errorf("解析握手响应失败: %v", err)
+	}
+	if result.Status != protocol.HandshakeStatusOK {
+		return nil, rejection(&result, response.Version)
+	}
+
+	version, err := negotiatedVersion(&result, response.Version)
+	if err != nil {
+		return nil, err
+	}
+	result.Version = version
+	return &result, nil
+}
+
+// rejection 返回服务器拒绝握手的错误，服务器要求稍后重试时返回 errHandshakeRetry。服务器以版本 2 应答且声明最高只支持版本 2 时返回 errLegacyServer，
+// 调用方应以 JSON 编码的版本 2 握手重试
+func rejection(result *protocol.HandshakeResponse, header uint8) error {
+	if result.Status == protocol.HandshakeStatusRetry {
+		return fmt.Errorf("%w: %s", errHandshakeRetry, result.Error)
+	}
+	if header < protocol.TLVProtocolVersion && result.MaxVersion != 0 && result.MaxVersion < protocol.TLVProtocolVersion {
+		return fmt.Errorf("%w: %s", errLegacyServer, result.Error)
+	}
+	return fmt.Errorf("服务器拒绝握手: %s", result.Error)
+}
 
+// negotiatedVersion 返回服务器选定的协议版本，旧服务器不携带版本时以响应消息头中的版本计
+func negotiatedVersion(result *protocol.HandshakeResponse, header uint8) (uint8, error) {
+	version := result.Version
+	if version == 0 {
+		version = header
+	}
+	if !protocol.IsSupportedVersion(version) {
+		return 0, fmt.Errorf("服务器选择了不支持的协议版本 %d", version)
+	}
+	return version, nil
+}
+
+// fetchServerKey 获取服务器证书，通过 CA 校验后以证书中的公钥作为服务器静态公钥
+func fetchServerKey(conn *serverConn, security *securityOptions) error {
+	response, err := exchange(conn, protocol.MinProtocolVersion, protocol.MsgTypeCertificate, 0, make([]byte, protocol.CertificateRequestSize))
+	if err != nil {
+		return fmt.Errorf("获取服务器证书失败: %v", err)
+	}
+	public, err := security.verifier.VerifyServer(response.Data, security.serverName)
+	if err != nil {
+		return fmt.Errorf("服务器证书校验失败: %v", err)
+	}
+	security.serverPublic = public
+	log.Printf("服务器 %s 证书校验通过", security.serverName)
+	return nil
+}
+
+// exchange 以消息头版本 version 发送握手或证书请求，并等待服务器同类型的响应
+func exchange(conn *serverConn, version, msgType, flags uint8, payload []byte) (*protocol.Message, error) {
 	msg := &protocol.Message{
-		Version: protocol.ProtocolVersion,
-		Type:    protocol.MsgTypeHandshake,
-		Data:    data,
+		Version: version,
+		Type:    msgType,
+		Flags:   flags,
+		Data:    payload,
 	}
 
 	encoded, err := msg.Encode()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = conn.Write(encoded)
-	return err
-}
+	if _, err = conn.Write(encoded); err != nil {
+		return nil, err
+	}
 
-func sendKeepAlive(conn *net.UDPConn) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+	// 等待服务器响应
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("等待服务器响应失败: %v", err)
+		}
 
-	for range ticker.C {
-		msg := &protocol.Message{
-			Version: protocol.ProtocolVersion,
-			Type:    protocol.MsgTypeKeepAlive,
-			Data:    []byte(generateNodeID()),
+		response, err := protocol.DecodeMessage(buf[:n])
+		if err != nil || response == nil || response.Type != msgType {
+			continue
 		}
+		return response, nil
+	}
+}
 
-		data, err := msg.Encode()
+// receiveMessages 接收服务器和其他节点直接发来的消息
+func receiveMessages(conn *serverConn, proto *protocol.Protocol, rekey *rekeyer, peers *peerManager) {
+	buf := make([]byte, protocol.MaxMessageSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
 		if err != nil {
-			log.Printf("编码保活消息失败: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("读取数据失败: %v", err)
 			continue
 		}
 
-		_, err = conn.Write(data)
-		if err != nil {
-			log.Printf("发送保活消息失败: %v", err)
+		if conn.fromServer(from) {
+			handleServerPacket(buf[:n], proto, rekey, peers)
+		} else if addr, ok := from.(*net.UDPAddr); ok {
+			peers.handlePeerPacket(addr, buf[:n])
 		}
 	}
 }
 
-func handlePackets(tun *network.TUN, conn *net.UDPConn, nat *network.NATTraversal) {
-	buf := make([]byte, 1500)
-	for {
-		// 从 TUN 接口读取数据包
-		n, err := tun.Read(buf)
+// handleServerPacket 处理服务器发来的一个报文，格式错误的报文被丢弃
+func handleServerPacket(data []byte, proto *protocol.Protocol, rekey *rekeyer, peers *peerManager) {
+	msg, err := protocol.DecodeMessage(data)
+	if err != nil {
+		return
+	}
+
+	// 重新握手的响应
+	if msg.Type == protocol.MsgTypeHandshake {
+		rekey.handleResponse(msg)
+		return
+	}
+
+	msg, err = proto.Decode(data)
+	if err != nil {
+		if !errors.Is(err, crypto.ErrReplay) {
+			log.Printf("拒绝服务器消息: %v", err)
+		}
+		return
+	}
+
+	switch msg.Type {
+	case protocol.MsgTypeData:
+		peers.deliver(msg.Data)
+	case protocol.MsgTypeFrame:
+		peers.deliverFrame(msg.Data)
+	case protocol.MsgTypeRevocation:
+		peers.handleRevocation(msg)
+	case protocol.MsgTypePeer:
+		peers.introduce(msg)
+	case protocol.MsgTypeNAT:
+		peers.updateRelayTicket(msg)
+	case protocol.MsgTypeRoute:
+		peers.handleRoute(msg)
+	}
+}
+
+// announceRoutes 向服务器通告本节点身后的网段。服务器接受后将路由推送给所有节点，包括本节点，
+// 尚未收到推送的网段每隔 routeAnnounceInterval 重新通告，最多 routeAnnounceRetries 次
+func announceRoutes(conn *serverConn, proto *protocol.Protocol, peers *peerManager, routes []string) {
+	var pending []string
+	for _, route := range routes {
+		destination, err := network.ParseRoute(route)
 		if err != nil {
-			log.Printf("读取数据包失败: %v", err)
+			log.Printf("忽略 client.routes 中的网段: %v", err)
 			continue
 		}
+		pending = append(pending, destination.String())
+	}
+
+	for attempt := 0; len(pending) > 0 && attempt < routeAnnounceRetries; attempt++ {
+		for _, route := range pending {
+			payload, err := protocol.MarshalControl(proto.Version(), &protocol.RouteMessage{Destination: route})
+			if err != nil {
+				log.Printf("编码路由通告失败: %v", err)
+				return
+			}
+			data, err := proto.Encode(&protocol.Message{Type: protocol.MsgTypeRoute, Data: payload})
+			if err != nil {
+				log.Printf("编码路由通告失败: %v", err)
+				continue
+			}
+			if _, err := conn.Write(data); err != nil {
+				log.Printf("发送路由通告失败: %v", err)
+			}
+		}
+		time.Sleep(routeAnnounceInterval)
+		pending = peers.unacknowledged(pending)
+	}
+	for _, route := range pending {
+		log.Printf("警告: 服务器未接受网段 %s 的路由通告", route)
+	}
+}
+
+func sendKeepAlive(conn *serverConn, proto *protocol.Protocol, nodeID string) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
 
-		// 构建数据消息
+	for range ticker.C {
 		msg := &protocol.Message{
-			Version: protocol.ProtocolVersion,
-			Type:    protocol.MsgTypeData,
-			Length:  uint16(n),
-			Data:    buf[:n],
+			Type: protocol.MsgTypeKeepAlive,
+			Data: []byte(nodeID),
 		}
 
-		// 编码消息
-		data, err := msg.Encode()
+		data, err := proto.Encode(msg)
 		if err != nil {
-			log.Printf("编码数据消息失败: %v", err)
+			log.Printf("编码保活消息失败: %v", err)
 			continue
 		}
 
-		// 发送数据
 		_, err = conn.Write(data)
 		if err != nil {
-			log.Printf("发送数据失败: %v", err)
+			log.Printf("发送保活消息失败: %v", err)
 		}
 	}
 }
 
-func generateNodeID() string {
-	// 生成唯一的节点 ID
-	return fmt.Sprintf("node-%d", time.Now().UnixNano())
-}
+// sendPacket 发送从 TUN 接口读取的数据包：目的节点已直连时直接发送，否则经服务器中继
+func sendPacket(conn *serverConn, proto *protocol.Protocol, peers *peerManager, packet []byte) {
+	// 服务器按内层 IP 包的目的地址转发，其他数据无法转发
+	parsed, err := network.ParsePacket(packet)
+	if err != nil {
+		return
+	}
+	if peers.send(parsed.Destination, packet) {
+		return
+	}
 
-func getPublicIP() net.IP {
-	// 获取公网 IP 地址
-	// TODO: 实现公网 IP 获取
-	return net.ParseIP("0.0.0.0")
+	// 构建数据消息
+	msg := &protocol.Message{
+		Type: protocol.MsgTypeData,
+		Data: packet,
+	}
+
+	// 编码消息
+	data, err := proto.Encode(msg)
+	if err != nil {
+		log.Printf("编码数据消息失败: %v", err)
+		return
+	}
+
+	// 发送数据
+	_, err = conn.Write(data)
+	if err != nil {
+		log.Printf("发送数据失败: %v", err)
+	}
 }
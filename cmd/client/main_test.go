@@ -0,0 +1,1268 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/config"
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/network/nattest"
+	"github.com/fenghuilee/sd-wan/internal/network/turntest"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/internal/relay"
+	"github.com/fenghuilee/sd-wan/internal/stun"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// loadCaptures 读取真实运行时抓取的报文
+func loadCaptures(tb testing.TB) [][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("..", "..", "internal", "protocol", "testdata", "captures", "*.bin"))
+	if err != nil || len(files) == 0 {
+		tb.Fatalf("no captures found: %v", err)
+	}
+	var captures [][]byte
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		captures = append(captures, data)
+	}
+	return captures
+}
+
+// newTestClient 创建已与模拟服务器完成握手、并有一次密钥轮换正在进行的客户端
+func newTestClient(tb testing.TB) (*protocol.Protocol, *rekeyer) {
+	tb.Helper()
+	static, err := crypto.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := crypto.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	security := &securityOptions{
+		encryption:   true,
+		static:       static,
+		serverPublic: server.Public,
+		algorithms:   crypto.SupportedAlgorithms(),
+		policy:       crypto.DefaultRekeyPolicy(),
+		index:        1,
+	}
+
+	initiator := crypto.NewInitiatorHandshake(static, server.Public)
+	responder := crypto.NewResponderHandshake(server)
+	initiation, err := initiator.WriteMessage(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := responder.ReadMessage(initiation); err != nil {
+		tb.Fatal(err)
+	}
+	response, err := responder.WriteMessage(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := initiator.ReadMessage(response); err != nil {
+		tb.Fatal(err)
+	}
+	session, err := initiator.Split(crypto.AlgorithmAES256GCM)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keys := crypto.NewKeyRing(security.policy)
+	keys.Install(session)
+	proto := protocol.NewProtocol(keys, protocol.ProtocolVersion, security.index, 2)
+
+	rekey := newRekeyer(nil, nil, security, proto)
+	rekey.pending = crypto.NewInitiatorHandshake(static, server.Public)
+	if _, err := rekey.pending.WriteMessage(nil); err != nil {
+		tb.Fatal(err)
+	}
+	rekey.epoch = keys.NextEpoch()
+	return proto, rekey
+}
+
+// FuzzHandleServerPacket 客户端处理任意报文都不得 panic，伪造的握手响应不会中断进行中的密钥轮换
+func FuzzHandleServerPacket(f *testing.F) {
+	proto, rekey := newTestClient(f)
+	plain := protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0)
+	peers := newTestPeers(f, "node-0123456789abcdef")
+	for _, data := range loadCaptures(f) {
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{1, protocol.MsgTypeHandshake})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		handleServerPacket(data, proto, rekey, peers)
+		handleServerPacket(data, plain, rekey, peers)
+		if rekey.pending == nil {
+			t.Fatal("forged handshake response completed the pending rekey")
+		}
+	})
+}
+
+// packetRecorder 记录写入 TUN 接口的数据包
+type packetRecorder struct {
+	mutex   sync.Mutex
+	packets [][]byte
+}
+
+func (r *packetRecorder) Write(packet []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.packets = append(r.packets, append([]byte{}, packet...))
+	return len(packet), nil
+}
+
+func (r *packetRecorder) received() [][]byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.packets
+}
+
+func newTestPeers(tb testing.TB, nodeID string) *peerManager {
+	tb.Helper()
+	nat := network.NewNATTraversal(nil, 0)
+	tb.Cleanup(func() { nat.Close() })
+	// 使用已关闭的套接字，模糊测试构造的节点介绍不会向任意地址发送探测
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn.Close()
+	return newPeerManager(&securityOptions{nodeID: nodeID}, conn, nat, &packetRecorder{})
+}
+
+func TestHandleRevocation(t *testing.T) {
+	peers := newTestPeers(t, "node-0123456789abcdef")
+	// 与即将被吊销的节点经中继服务通信
+	relayAddr := startTestRelay(t)
+	peers.nat = network.NewNATTraversal(relayAddr.IP, uint16(relayAddr.Port))
+	other := network.NewNATTraversal(relayAddr.IP, uint16(relayAddr.Port))
+	t.Cleanup(func() {
+		peers.nat.Close()
+		other.Close()
+	})
+	go func() {
+		ticket, key := testRelayTicket("node-1111111111111111", "node-0123456789abcdef")
+		other.CreateRelayConnection("node-0123456789abcdef", ticket, key)
+	}()
+	ticket, key := testRelayTicket("node-0123456789abcdef", "node-1111111111111111")
+	if _, err := peers.nat.CreateRelayConnection("node-1111111111111111", ticket, key); err != nil {
+		t.Fatal(err)
+	}
+	revoke := func(nodeIDs ...string) {
+		payload, err := protocol.MarshalControl(protocol.ProtocolVersion, &protocol.RevocationMessage{NodeIDs: nodeIDs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers.handleRevocation(&protocol.Message{Version: protocol.ProtocolVersion, Type: protocol.MsgTypeRevocation, Data: payload})
+	}
+
+	revoke("node-1111111111111111", "not-a-node-id")
+	if !peers.revoked.IsRevoked("node-1111111111111111") {
+		t.Fatal("revoked node not recorded")
+	}
+	if peers.nat.CloseConnection("node-1111111111111111") == nil {
+		t.Fatal("relay connection to revoked node still open")
+	}
+	select {
+	case <-peers.done:
+		t.Fatal("client stopped by another node's revocation")
+	default:
+	}
+
+	revoke("node-0123456789abcdef")
+	revoke("node-0123456789abcdef")
+	select {
+	case <-peers.done:
+	default:
+		t.Fatal("client not stopped after its own revocation")
+	}
+}
+
+func TestDeliverData(t *testing.T) {
+	peers := newTestPeers(t, "node-0123456789abcdef")
+	plain := protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0)
+	ipv4 := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0, 10, 9, 0, 2, 10, 9, 0, 3}
+
+	for _, payload := range [][]byte{ipv4, {0x45, 0, 0, 40}, []byte("not a packet")} {
+		data, err := plain.Encode(&protocol.Message{Type: protocol.MsgTypeData, Data: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleServerPacket(data, plain, nil, peers)
+	}
+
+	packets := peers.tun.(*packetRecorder).received()
+	if len(packets) != 1 || !bytes.Equal(packets[0], ipv4) {
+		t.Fatalf("packets written to TUN: %x", packets)
+	}
+}
+
+func TestClientAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		address []string
+		subnet6 string
+		cert    []net.IP
+		want    string
+	}{
+		{"cidr", []string{"10.9.0.2/16"}, "", nil, "[10.9.0.2/16]"},
+		{"in subnet", []string{"10.9.0.2"}, "", nil, "[10.9.0.2/24]"},
+		{"outside subnet", []string{"10.8.0.2"}, "", nil, "[10.8.0.2/32]"},
+		{"dual stack", []string{"10.9.0.2", "fd00:9::2"}, "fd00:9::/64", nil, "[10.9.0.2/24 fd00:9::2/64]"},
+		{"certificate", nil, "", []net.IP{net.ParseIP("10.9.0.7")}, "[10.9.0.7/24]"},
+		// 证书中的虚拟 IP 每个协议族取第一个
+		{"certificate dual stack", nil, "fd00:9::/64", []net.IP{net.ParseIP("10.9.0.7"), net.ParseIP("10.9.0.8"), net.ParseIP("fd00:9::7")}, "[10.9.0.7/24 fd00:9::7/64]"},
+		{"none", nil, "", nil, "[]"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Client.Address = tt.address
+			cfg.Network.Subnet, cfg.Network.Subnet6 = "10.9.0.0/24", tt.subnet6
+			subnets, err := cfg.GetSubnets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			addresses, err := clientAddresses(cfg, subnets, &securityOptions{virtualIPs: tt.cert})
+			if err != nil || fmt.Sprint(addresses) != tt.want {
+				t.Fatalf("addresses = %v, %v, want %s", addresses, err, tt.want)
+			}
+		})
+	}
+	if _, err := clientAddresses(&config.Config{Client: config.ClientConfig{Address: []string{"10.9.0"}}}, nil, &securityOptions{}); err == nil {
+		t.Fatal("invalid address accepted")
+	}
+}
+
+func TestAssignedAddresses(t *testing.T) {
+	tests := []struct {
+		address, address6 net.IP
+		prefix, prefix6   uint8
+		want              string
+	}{
+		{net.IPv4(10, 9, 0, 7), nil, 24, 0, "[10.9.0.7/24]"},
+		{net.ParseIP("fd00::7"), nil, 64, 0, "[fd00::7/64]"},
+		{net.IPv4(10, 9, 0, 7), net.ParseIP("fd00::7"), 24, 64, "[10.9.0.7/24 fd00::7/64]"},
+		{net.IPv4(10, 9, 0, 7), net.ParseIP("fd00::7"), 33, 129, "[]"},
+		{net.IPv4zero, nil, 24, 0, "[]"},
+		{nil, nil, 0, 0, "[]"},
+	}
+	for _, tt := range tests {
+		result := &protocol.HandshakeResponse{Address: tt.address, PrefixLength: tt.prefix, Address6: tt.address6, PrefixLength6: tt.prefix6}
+		if got := assignedAddresses(result); fmt.Sprint(got) != tt.want {
+			t.Errorf("assignedAddresses(%v/%d, %v/%d) = %v, want %s", tt.address, tt.prefix, tt.address6, tt.prefix6, got, tt.want)
+		}
+	}
+}
+
+func TestLegacyServerRejection(t *testing.T) {
+	tests := []struct {
+		header uint8
+		max    uint8
+		legacy bool
+	}{
+		{protocol.MinProtocolVersion, protocol.MinProtocolVersion, true},
+		{protocol.MinProtocolVersion, 0, false},
+		{protocol.MinProtocolVersion, protocol.MaxProtocolVersion, false},
+		{protocol.ProtocolVersion, protocol.MaxProtocolVersion, false},
+	}
+	for _, tt := range tests {
+		payload, err := protocol.MarshalHandshake(tt.header, &protocol.HandshakeResponse{
+			Status:     protocol.HandshakeStatusError,
+			MinVersion: protocol.MinProtocolVersion,
+			MaxVersion: tt.max,
+			Error:      "rejected",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readPlainResponse(&protocol.Message{Version: tt.header, Type: protocol.MsgTypeHandshake, Data: payload})
+		if err == nil || errors.Is(err, errLegacyServer) != tt.legacy {
+			t.Errorf("header v%d max v%d: got %v, legacy %v", tt.header, tt.max, err, tt.legacy)
+		}
+	}
+}
+
+func TestRetryRejection(t *testing.T) {
+	for _, status := range []string{protocol.HandshakeStatusRetry, protocol.HandshakeStatusError} {
+		payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeResponse{
+			Status: status,
+			Error:  "certificate status pending",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readPlainResponse(&protocol.Message{Version: protocol.ProtocolVersion, Type: protocol.MsgTypeHandshake, Data: payload})
+		if err == nil || errors.Is(err, errHandshakeRetry) != (status == protocol.HandshakeStatusRetry) {
+			t.Errorf("status %s: got %v", status, err)
+		}
+	}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipNet.IP = ip
+	return ipNet
+}
+
+func TestOverlayAddresses(t *testing.T) {
+	v4, v6 := mustCIDR(t, "10.9.0.2/24"), mustCIDR(t, "fd00:9::2/64")
+	tests := []struct {
+		addrs   []*net.IPNet
+		ip, ip6 string
+	}{
+		// 握手中 IPv4 地址总是作为第一个地址，与接口上地址的顺序无关
+		{[]*net.IPNet{v6, v4}, "10.9.0.2", "fd00:9::2"},
+		{[]*net.IPNet{v6}, "fd00:9::2", "<nil>"},
+		{nil, "<nil>", "<nil>"},
+	}
+	for _, tt := range tests {
+		if ip, ip6 := overlayAddresses(tt.addrs); ip.String() != tt.ip || ip6.String() != tt.ip6 {
+			t.Errorf("overlayAddresses(%v) = %v, %v, want %s, %s", tt.addrs, ip, ip6, tt.ip, tt.ip6)
+		}
+	}
+}
+
+// routeRecorder 记录经 TUN 接口安装的路由
+type routeRecorder struct {
+	packetRecorder
+	routes map[string]bool
+	added  int
+}
+
+func (r *routeRecorder) AddRoute(dst *net.IPNet) error {
+	r.routes[dst.String()] = true
+	r.added++
+	return nil
+}
+
+func (r *routeRecorder) DeleteRoute(dst *net.IPNet) error {
+	if !r.routes[dst.String()] {
+		return fmt.Errorf("no route to %s", dst)
+	}
+	delete(r.routes, dst.String())
+	return nil
+}
+
+func TestPeerRoutes(t *testing.T) {
+	peers := newTestPeers(t, "node-0123456789abcdef")
+	table := &routeRecorder{routes: make(map[string]bool)}
+	peers.tun, peers.routes = table, table
+	introduce := func(nodeID string, routes ...string) {
+		payload, err := protocol.MarshalControl(protocol.ProtocolVersion, &protocol.PeerMessage{
+			NodeID:     nodeID,
+			PublicIP:   net.IPv4(127, 0, 0, 1),
+			PublicPort: 9,
+			Version:    protocol.ProtocolVersion,
+			Token:      testToken,
+			Routes:     routes,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers.introduce(&protocol.Message{Version: protocol.ProtocolVersion, Type: protocol.MsgTypePeer, Data: payload})
+	}
+	check := func(want ...string) {
+		t.Helper()
+		if len(table.routes) != len(want) {
+			t.Fatalf("routes = %v, want %v", table.routes, want)
+		}
+		for _, route := range want {
+			if !table.routes[route] {
+				t.Fatalf("routes = %v, want %v", table.routes, want)
+			}
+		}
+	}
+
+	// 默认路由和无效的网段不安装，网段按网络地址归一
+	introduce("node-1111111111111111", "192.168.1.9/24", "0.0.0.0/0", "bogus", "fd00:1::/64")
+	check("192.168.1.0/24", "fd00:1::/64")
+	// 两个节点通告同一网段时只安装一次，撤销一方后仍保留
+	introduce("node-2222222222222222", "192.168.1.0/24")
+	if table.added != 2 {
+		t.Fatalf("routes added %d times", table.added)
+	}
+	// 再次介绍时按新通告的网段更新
+	introduce("node-1111111111111111", "192.168.1.0/24", "172.16.0.0/16")
+	check("192.168.1.0/24", "172.16.0.0/16")
+	peers.removeDirect("node-2222222222222222")
+	check("192.168.1.0/24", "172.16.0.0/16")
+	peers.removeDirect("node-1111111111111111")
+	check()
+}
+
+func TestPushedRoutes(t *testing.T) {
+	peers := newTestPeers(t, "node-0123456789abcdef")
+	table := &routeRecorder{routes: make(map[string]bool)}
+	peers.tun, peers.routes = table, table
+	push := func(route *protocol.RouteMessage) {
+		payload, err := protocol.MarshalControl(protocol.ProtocolVersion, route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers.handleRoute(&protocol.Message{Version: protocol.ProtocolVersion, Type: protocol.MsgTypeRoute, Data: payload})
+	}
+
+	// 服务器推送的路由不经节点介绍即安装，本节点自己通告的网段只记录为已确认
+	push(&protocol.RouteMessage{Destination: "192.168.5.0/24", NextHop: "node-1111111111111111"})
+	push(&protocol.RouteMessage{Destination: "10.20.0.0/16", NextHop: peers.nodeID})
+	push(&protocol.RouteMessage{Destination: "0.0.0.0/0", NextHop: "node-1111111111111111"})
+	if len(table.routes) != 1 || !table.routes["192.168.5.0/24"] {
+		t.Fatalf("routes = %v", table.routes)
+	}
+	if pending := peers.unacknowledged([]string{"10.20.0.0/16", "10.30.0.0/16"}); len(pending) != 1 || pending[0] != "10.30.0.0/16" {
+		t.Fatalf("unacknowledged routes %v", pending)
+	}
+
+	// 直连的建立和断开不影响服务器推送的路由
+	payload, err := protocol.MarshalControl(protocol.ProtocolVersion, &protocol.PeerMessage{
+		NodeID:     "node-1111111111111111",
+		PublicIP:   net.IPv4(127, 0, 0, 1),
+		PublicPort: 9,
+		Version:    protocol.ProtocolVersion,
+		Token:      testToken,
+		Routes:     []string{"192.168.5.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers.introduce(&protocol.Message{Version: protocol.ProtocolVersion, Type: protocol.MsgTypePeer, Data: payload})
+	peers.removeDirect("node-1111111111111111")
+	if !table.routes["192.168.5.0/24"] {
+		t.Fatal("pushed route removed with the direct path")
+	}
+
+	// 只有通告该网段的节点的撤销生效
+	push(&protocol.RouteMessage{Destination: "192.168.5.0/24", NextHop: "node-2222222222222222", Withdraw: true})
+	if !table.routes["192.168.5.0/24"] {
+		t.Fatal("route withdrawn by another node")
+	}
+	push(&protocol.RouteMessage{Destination: "192.168.5.0/24", NextHop: "node-1111111111111111", Withdraw: true})
+	if len(table.routes) != 0 {
+		t.Fatalf("routes after withdrawal %v", table.routes)
+	}
+}
+
+// testNode 位于模拟 NAT 之后的客户端，public 为服务器观察到的公网端点
+type testNode struct {
+	peers   *peerManager
+	conn    *serverConn
+	public  *net.UDPAddr
+	address net.IP
+}
+
+// newTestNode 在 nat 之后创建客户端，并向模拟服务器发送一个报文以建立 NAT 映射。
+// relayAddr 为 nil 时不使用中继服务
+func newTestNode(tb testing.TB, nat *nattest.NAT, server *net.UDPConn, relayAddr *net.UDPAddr, address net.IP, encryption bool) *testNode {
+	tb.Helper()
+	static, err := crypto.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	security := &securityOptions{
+		encryption: encryption,
+		static:     static,
+		nodeID:     crypto.NodeID(static.Public),
+		algorithms: crypto.SupportedAlgorithms(),
+		policy:     crypto.DefaultRekeyPolicy(),
+	}
+	inside, err := nat.Listen()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn := &serverConn{
+		PacketConn: inside,
+		server:     server.LocalAddr().(*net.UDPAddr),
+		local:      inside.LocalAddr().(*net.UDPAddr).IP,
+	}
+	var traversal *network.NATTraversal
+	if relayAddr != nil {
+		traversal = network.NewNATTraversal(relayAddr.IP, uint16(relayAddr.Port))
+	} else {
+		traversal = network.NewNATTraversal(nil, 0)
+	}
+	traversal.SetListener(func() (net.PacketConn, error) { return inside.ListenSibling() })
+	peers := newPeerManager(security, conn, traversal, &packetRecorder{})
+	peers.punchTimeout = time.Second
+	tb.Cleanup(func() {
+		peers.doneOnce.Do(func() { close(peers.done) })
+		inside.Close()
+		traversal.Close()
+	})
+	go receiveMessages(conn, protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0), nil, peers)
+	go peers.run()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		tb.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, public, err := server.ReadFromUDP(make([]byte, 1500))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &testNode{peers: peers, conn: conn, public: public, address: address}
+}
+
+// testToken 测试中服务器为节点介绍分配的打洞令牌
+var testToken = []byte("punch-token-0123")
+
+// testRelaySecret 测试中服务器与中继服务共享的票据密钥
+var testRelaySecret = []byte("relay-secret-for-tests")
+
+// startTestRelay 在回环地址上运行中继服务
+func startTestRelay(tb testing.TB) *net.UDPAddr {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	go relay.NewServer(conn, testRelaySecret, relay.Limits{}).Serve()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// testRelayTicket 以服务器的身份签发节点 nodeID 与节点 peerID 通信的中继票据
+func testRelayTicket(nodeID, peerID string) (ticket, key []byte) {
+	return relay.IssueTicket(testRelaySecret, relay.Ticket{NodeID: nodeID, PeerID: peerID, Expires: time.Now().Add(time.Minute)})
+}
+
+// testIntroduction 以服务器的身份构造向节点 to 介绍节点 about 的消息
+func testIntroduction(tb testing.TB, to, about *testNode) *protocol.Message {
+	tb.Helper()
+	natType, step := about.peers.nat.LocalNAT()
+	ticket, key := testRelayTicket(to.peers.nodeID, about.peers.nodeID)
+	peer := &protocol.PeerMessage{
+		NodeID:     about.peers.nodeID,
+		PublicKey:  about.peers.security.static.Public[:],
+		PublicIP:   about.public.IP,
+		PublicPort: uint16(about.public.Port),
+		LocalIP:    about.conn.local,
+		LocalPort:  uint16(about.conn.LocalAddr().(*net.UDPAddr).Port),
+		Addresses:  []net.IP{about.address},
+		Version:    protocol.ProtocolVersion,
+		Token:      testToken,
+		NATType:    uint8(natType),
+		PortStep:   int16(step),
+
+		RelayTicket: ticket,
+		RelayKey:    key,
+	}
+	if turn := about.peers.nat.TURN(); turn != nil {
+		peer.RelayedIP, peer.RelayedPort = turn.RelayedAddr().IP, uint16(turn.RelayedAddr().Port)
+	}
+	payload, err := protocol.MarshalControl(protocol.ProtocolVersion, peer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &protocol.Message{Version: protocol.ProtocolVersion, Type: protocol.MsgTypePeer, Data: payload}
+}
+
+// introduceTestNodes 以服务器的身份向两个节点互相介绍对方
+func introduceTestNodes(tb testing.TB, a, b *testNode) {
+	tb.Helper()
+	a.peers.introduce(testIntroduction(tb, a, b))
+	b.peers.introduce(testIntroduction(tb, b, a))
+}
+
+// eventually 在 timeout 内反复检查 condition，直到其成立
+func eventually(timeout time.Duration, condition func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+// ipv4Packet 构造一个只有头部的 IPv4 数据包
+func ipv4Packet(src, dst net.IP) []byte {
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0}
+	packet = append(packet, src.To4()...)
+	return append(packet, dst.To4()...)
+}
+
+func TestHolePunching(t *testing.T) {
+	tests := []struct {
+		a, b    nattest.Behavior
+		sameNAT bool
+		direct  bool
+	}{
+		{nattest.FullCone, nattest.FullCone, false, true},
+		{nattest.PortRestrictedCone, nattest.PortRestrictedCone, false, true},
+		{nattest.Symmetric, nattest.FullCone, false, true},
+		{nattest.Symmetric, nattest.RestrictedCone, false, true},
+		{nattest.Symmetric, nattest.PortRestrictedCone, false, false},
+		{nattest.Symmetric, nattest.Symmetric, false, false},
+		// 同一 NAT 之后的节点经内网端点直连，不依赖发夹转发
+		{nattest.Symmetric, nattest.Symmetric, true, true},
+	}
+	for _, encryption := range []bool{false, true} {
+		for _, tt := range tests {
+			tt, encryption := tt, encryption
+			name := fmt.Sprintf("%v/%v/same=%v/encryption=%v", tt.a, tt.b, tt.sameNAT, encryption)
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { server.Close() })
+				natA, natB := nattest.New(tt.a), nattest.New(tt.b)
+				if tt.sameNAT {
+					natB = natA
+				}
+				a := newTestNode(t, natA, server, nil, net.IPv4(10, 9, 0, 2), encryption)
+				b := newTestNode(t, natB, server, nil, net.IPv4(10, 9, 0, 3), encryption)
+				toB := ipv4Packet(a.address, b.address)
+				toA := ipv4Packet(b.address, a.address)
+
+				introduceTestNodes(t, a, b)
+				if !tt.direct {
+					// 打洞超时后双方都经服务器中继
+					time.Sleep(a.peers.punchTimeout + 3*punchInterval)
+					if a.peers.send(b.address, toB) || b.peers.send(a.address, toA) {
+						t.Fatal("packet sent directly through an impossible path")
+					}
+					sendPacket(a.conn, protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0), a.peers, toB)
+					buf := make([]byte, protocol.MaxMessageSize)
+					server.SetReadDeadline(time.Now().Add(time.Second))
+					n, err := server.Read(buf)
+					if err != nil {
+						t.Fatalf("packet not relayed through the server: %v", err)
+					}
+					if msg, err := protocol.DecodeMessage(buf[:n]); err != nil || msg.Type != protocol.MsgTypeData || !bytes.Equal(msg.Data, toB) {
+						t.Fatalf("server received %x", buf[:n])
+					}
+					return
+				}
+
+				if !eventually(3*time.Second, func() bool { return a.peers.send(b.address, toB) && b.peers.send(a.address, toA) }) {
+					t.Fatal("direct path not established")
+				}
+				for _, node := range []*testNode{a, b} {
+					tun := node.peers.tun.(*packetRecorder)
+					if !eventually(time.Second, func() bool { return len(tun.received()) > 0 }) {
+						t.Fatalf("no packet delivered directly to %s", node.peers.nodeID)
+					}
+				}
+				packet := a.peers.tun.(*packetRecorder).received()[0]
+				if !bytes.Equal(packet, toA) {
+					t.Fatalf("delivered %x, want %x", packet, toA)
+				}
+
+				// 对端长时间无响应后回退到服务器中继
+				a.peers.mutex.Lock()
+				a.peers.direct[b.peers.nodeID].lastRecv.Store(time.Now().Add(-directTimeout - time.Second).UnixNano())
+				a.peers.mutex.Unlock()
+				a.peers.maintain()
+				if a.peers.send(b.address, toB) {
+					t.Fatal("timed out direct path still used")
+				}
+			})
+		}
+	}
+}
+
+func TestSymmetricTraversal(t *testing.T) {
+	tests := []struct {
+		name   string
+		method network.TraversalMethod
+		step   int
+	}{
+		// 随机分配端口的对称 NAT：对称一方打开多个套接字，另一方探测整个端口范围
+		{"birthday", network.TraversalBirthday, 0},
+		// 按固定步长分配端口的对称 NAT：另一方探测预测的端口
+		{"predict", network.TraversalPredict, 3},
+		{"predict-descending", network.TraversalPredict, -2},
+	}
+	for _, encryption := range []bool{false, true} {
+		for _, tt := range tests {
+			tt, encryption := tt, encryption
+			t.Run(fmt.Sprintf("%s/encryption=%v", tt.name, encryption), func(t *testing.T) {
+				t.Parallel()
+				server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { server.Close() })
+
+				// 端口范围避开系统分配的临时端口
+				base := 20000 + rand.Intn(10)*1000
+				limits := network.TraversalLimits{
+					PredictPorts:   8,
+					Sockets:        16,
+					ProbesPerRound: 250,
+					MaxProbes:      1000,
+					MinPort:        uint16(base),
+					MaxPort:        uint16(base + 999),
+				}
+				natA, natB := nattest.New(nattest.Symmetric), nattest.New(nattest.PortRestrictedCone)
+				if tt.step != 0 {
+					natA.AllocatePorts(base+500, tt.step)
+				} else {
+					natA.RandomPorts(base, base+999)
+				}
+				a := newTestNode(t, natA, server, nil, net.IPv4(10, 9, 0, 2), encryption)
+				b := newTestNode(t, natB, server, nil, net.IPv4(10, 9, 0, 3), encryption)
+				a.peers.nat.SetLocalNAT(stun.NATSymmetric, tt.step)
+				b.peers.nat.SetLocalNAT(stun.NATPortRestrictedCone, 0)
+				for _, node := range []*testNode{a, b} {
+					node.peers.nat.SetLimits(limits)
+					node.peers.punchTimeout = 3 * time.Second
+				}
+				toB := ipv4Packet(a.address, b.address)
+				toA := ipv4Packet(b.address, a.address)
+
+				introduceTestNodes(t, a, b)
+				if !eventually(3*time.Second, func() bool { return a.peers.send(b.address, toB) && b.peers.send(a.address, toA) }) {
+					t.Fatal("direct path not established")
+				}
+				for _, node := range []*testNode{a, b} {
+					tun := node.peers.tun.(*packetRecorder)
+					if !eventually(time.Second, func() bool { return len(tun.received()) > 0 }) {
+						t.Fatalf("no packet delivered directly to %s", node.peers.nodeID)
+					}
+					stats := node.peers.nat.Stats()
+					if len(stats) != 1 || stats[0].Method != tt.method || stats[0].Successes != 1 {
+						t.Fatalf("stats = %v", stats)
+					}
+				}
+
+				// 成功后只保留直连使用的套接字，对端也可能命中与服务器共用的套接字的映射
+				a.peers.mutex.Lock()
+				p := a.peers.direct[b.peers.nodeID]
+				sockets, shared := len(p.sockets), p.conn == a.peers.conn
+				a.peers.mutex.Unlock()
+				if sockets > 1 || (sockets == 0) != shared {
+					t.Fatalf("%d sockets kept, shared socket used: %v", sockets, shared)
+				}
+				if tt.method == network.TraversalPredict && b.peers.nat.Stats()[0].Probes == 0 {
+					t.Fatal("no predicted ports probed")
+				}
+			})
+		}
+	}
+}
+
+func TestRelayFallback(t *testing.T) {
+	tests := []struct {
+		name string
+		nat  stun.NATType // 双方自报的 NAT 类型
+		turn bool         // 不使用中继服务，经双方在 TURN 服务器上的分配通信
+	}{
+		// 双方均为对称 NAT，收到介绍后直接经中继服务通信
+		{"symmetric", stun.NATSymmetric, false},
+		// NAT 类型未知时先打洞，失败后改经中继服务通信
+		{"punch-failed", stun.NATUnknown, false},
+		{"symmetric-turn", stun.NATSymmetric, true},
+		{"punch-failed-turn", stun.NATUnknown, true},
+	}
+	for _, encryption := range []bool{false, true} {
+		for _, tt := range tests {
+			tt, encryption := tt, encryption
+			t.Run(fmt.Sprintf("%s/encryption=%v", tt.name, encryption), func(t *testing.T) {
+				t.Parallel()
+				server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { server.Close() })
+				var relayAddr *net.UDPAddr
+				var turnServer *turntest.Server
+				if tt.turn {
+					if turnServer, err = turntest.New("user", "pass"); err != nil {
+						t.Fatal(err)
+					}
+					t.Cleanup(func() { turnServer.Close() })
+				} else {
+					relayAddr = startTestRelay(t)
+				}
+				a := newTestNode(t, nattest.New(nattest.Symmetric), server, relayAddr, net.IPv4(10, 9, 0, 2), encryption)
+				b := newTestNode(t, nattest.New(nattest.Symmetric), server, relayAddr, net.IPv4(10, 9, 0, 3), encryption)
+				for _, node := range []*testNode{a, b} {
+					node.peers.nat.SetLocalNAT(tt.nat, 0)
+					if tt.turn {
+						turn, err := node.peers.nat.AllocateTURN(turnServer.Addr(), "user", "pass")
+						if err != nil {
+							t.Fatal(err)
+						}
+						go node.peers.readSocket(turn)
+					}
+				}
+				toB := ipv4Packet(a.address, b.address)
+				toA := ipv4Packet(b.address, a.address)
+
+				introduceTestNodes(t, a, b)
+				if !eventually(a.peers.punchTimeout+3*time.Second, func() bool {
+					return a.peers.send(b.address, toB) && b.peers.send(a.address, toA)
+				}) {
+					t.Fatal("relay session not established")
+				}
+				for _, node := range []*testNode{a, b} {
+					tun := node.peers.tun.(*packetRecorder)
+					if !eventually(time.Second, func() bool { return len(tun.received()) > 0 }) {
+						t.Fatalf("no packet delivered through the relay to %s", node.peers.nodeID)
+					}
+					stats := node.peers.nat.Stats()
+					if last := stats[len(stats)-1]; last.Method != network.TraversalRelay || last.Successes != 1 {
+						t.Fatalf("stats = %v", stats)
+					}
+				}
+				if packet := a.peers.tun.(*packetRecorder).received()[0]; !bytes.Equal(packet, toA) {
+					t.Fatalf("delivered %x, want %x", packet, toA)
+				}
+
+				// 中继会话超时后关闭中继连接，回退到服务器中继
+				a.peers.mutex.Lock()
+				p := a.peers.direct[b.peers.nodeID]
+				if tt.turn {
+					turn := a.peers.nat.TURN()
+					if p.relay != nil || p.conn != net.PacketConn(turn) || !sameAddr(p.addr, b.peers.nat.TURN().RelayedAddr()) {
+						a.peers.mutex.Unlock()
+						t.Fatal("peer not reached through the TURN server")
+					}
+				} else if p.relay == nil || p.conn != net.PacketConn(p.relay) || !sameAddr(p.addr, relayAddr) {
+					a.peers.mutex.Unlock()
+					t.Fatal("peer not reached through the relay")
+				}
+				p.lastRecv.Store(time.Now().Add(-directTimeout - time.Second).UnixNano())
+				a.peers.mutex.Unlock()
+				a.peers.maintain()
+				if a.peers.send(b.address, toB) {
+					t.Fatal("timed out relay session still used")
+				}
+				if tt.turn {
+					// TURN 分配由所有对端共用，不随对端关闭
+					if turnServer.Allocations() != 2 {
+						t.Fatalf("allocations = %d", turnServer.Allocations())
+					}
+				} else if a.peers.nat.CloseConnection(b.peers.nodeID) == nil {
+					t.Fatal("relay connection still open")
+				}
+			})
+		}
+	}
+}
+
+func TestDirectSessionIndex(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	a := newTestNode(t, nattest.New(nattest.FullCone), server, nil, net.IPv4(10, 9, 0, 2), true)
+	b := newTestNode(t, nattest.New(nattest.FullCone), server, nil, net.IPv4(10, 9, 0, 3), true)
+	introduceTestNodes(t, a, b)
+	if !eventually(3*time.Second, func() bool {
+		return a.peers.send(b.address, ipv4Packet(a.address, b.address)) && b.peers.send(a.address, ipv4Packet(b.address, a.address))
+	}) {
+		t.Fatal("direct path not established")
+	}
+
+	// 已建立的加密直连按本端分配的会话索引登记，接收时据此查找对端
+	a.peers.mutex.RLock()
+	p := a.peers.direct[b.peers.nodeID]
+	indexed := a.peers.sessions[p.index] == p && len(a.peers.sessions) == 1
+	a.peers.mutex.RUnlock()
+	if !indexed {
+		t.Fatal("established session not indexed")
+	}
+	recorder := a.peers.tun.(*packetRecorder)
+	if !eventually(time.Second, func() bool { return len(recorder.received()) > 0 }) {
+		t.Fatal("direct packet not delivered")
+	}
+
+	// 其他会话索引的消息不被接受，删除直连后索引随之删除
+	forged, err := (&protocol.Message{
+		Version: protocol.ProtocolVersion,
+		Type:    protocol.MsgTypeData,
+		Flags:   protocol.FlagEncrypted,
+		Index:   p.index + 1,
+		Data:    make([]byte, 40),
+	}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet := a.peers.handleDirect(a.peers.conn, b.public, forged); packet != nil {
+		t.Fatal("message for an unknown session index accepted")
+	}
+	a.peers.removeDirect(b.peers.nodeID)
+	a.peers.mutex.RLock()
+	defer a.peers.mutex.RUnlock()
+	if len(a.peers.sessions) != 0 {
+		t.Fatalf("sessions after removal: %v", a.peers.sessions)
+	}
+}
+
+func TestDirectHandshakeReplay(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	a := newTestNode(t, nattest.New(nattest.FullCone), server, nil, net.IPv4(10, 9, 0, 2), true)
+	b := newTestNode(t, nattest.New(nattest.FullCone), server, nil, net.IPv4(10, 9, 0, 3), true)
+	introduceTestNodes(t, a, b)
+	if !eventually(3*time.Second, func() bool {
+		return a.peers.send(b.address, ipv4Packet(a.address, b.address)) && b.peers.send(a.address, ipv4Packet(b.address, a.address))
+	}) {
+		t.Fatal("direct path not established")
+	}
+	initiator, responder := a, b
+	if b.peers.nodeID < a.peers.nodeID {
+		initiator, responder = b, a
+	}
+	responder.peers.mutex.Lock()
+	accepted := responder.peers.direct[initiator.peers.nodeID].timestamp
+	responder.peers.mutex.Unlock()
+
+	// 截获的握手与已接受的握手时间戳相同，在节点被重新介绍后重放
+	const replayIndex = 0xdeadbeef
+	payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+		NodeID:      initiator.peers.nodeID,
+		Timestamp:   accepted,
+		Algorithms:  crypto.SupportedAlgorithms(),
+		SenderIndex: replayIndex,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiation, err := crypto.NewInitiatorHandshake(initiator.peers.security.static, responder.peers.security.static.Public).WriteMessage(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.peers.introduce(testIntroduction(t, responder, initiator))
+	responder.peers.handlePeerHandshake(responder.peers.conn, initiator.public, &protocol.Message{
+		Version: protocol.ProtocolVersion,
+		Type:    protocol.MsgTypeHandshake,
+		Flags:   protocol.FlagEncrypted,
+		Data:    initiation,
+	})
+
+	responder.peers.mutex.Lock()
+	defer responder.peers.mutex.Unlock()
+	if p := responder.peers.direct[initiator.peers.nodeID]; p.remoteIndex == replayIndex {
+		t.Fatal("replayed handshake accepted after re-introduction")
+	}
+}
+
+// FuzzHandlePeerPacket 处理其他节点直接发来的任意报文都不得 panic，伪造的报文不能建立直连
+func FuzzHandlePeerPacket(f *testing.F) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { server.Close() })
+	nat := nattest.New(nattest.FullCone)
+	a := newTestNode(f, nat, server, nil, net.IPv4(10, 9, 0, 2), true)
+	// 被介绍的节点已离线，只有伪造的报文能到达
+	b := newTestNode(f, nat, server, nil, net.IPv4(10, 9, 0, 3), true)
+	b.conn.Close()
+	a.peers.introduce(testIntroduction(f, a, b))
+
+	for _, data := range loadCaptures(f) {
+		f.Add(data)
+	}
+	punch, err := protocol.MarshalControl(protocol.ProtocolVersion, &protocol.PunchMessage{NodeID: b.peers.nodeID, Token: testToken})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(encodeFrame(f, protocol.MsgTypePunch, 0, punch))
+	f.Add(encodeFrame(f, protocol.MsgTypeHandshake, protocol.FlagEncrypted, make([]byte, 96)))
+	f.Add(encodeFrame(f, protocol.MsgTypeData, protocol.FlagEncrypted, make([]byte, 40)))
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a.peers.handlePeerPacket(from, data)
+		a.peers.mutex.Lock()
+		established := a.peers.direct[b.peers.nodeID].state == stateEstablished
+		a.peers.mutex.Unlock()
+		if established {
+			t.Fatal("forged packet established a direct session")
+		}
+	})
+}
+
+func encodeFrame(tb testing.TB, msgType, flags uint8, payload []byte) []byte {
+	tb.Helper()
+	data, err := (&protocol.Message{Version: protocol.ProtocolVersion, Type: msgType, Flags: flags, Data: payload}).Encode()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestIPv6Endpoint(t *testing.T) {
+	// 双方的公网 IPv4 端点不可达，只能经 IPv6 端点直连
+	nodes := make([]*testNode, 2)
+	for i := range nodes {
+		udp, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if probe, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+			udp.Close()
+			t.Skipf("IPv6 loopback unavailable: %v", err)
+		} else {
+			probe.Close()
+		}
+		static, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &serverConn{PacketConn: udp, server: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, global6: net.IPv6loopback}
+		traversal := network.NewNATTraversal(nil, 0)
+		peers := newPeerManager(&securityOptions{static: static, nodeID: crypto.NodeID(static.Public)}, conn, traversal, &packetRecorder{})
+		peers.ipv6 = true
+		t.Cleanup(func() {
+			udp.Close()
+			traversal.Close()
+		})
+		go receiveMessages(conn, protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0), nil, peers)
+		nodes[i] = &testNode{peers: peers, conn: conn, address: net.IPv4(10, 9, 0, byte(2+i))}
+	}
+
+	introduce := func(to, about *testNode) {
+		payload, err := protocol.MarshalControl(protocol.ProtocolVersion, &protocol.PeerMessage{
+			NodeID:     about.peers.nodeID,
+			PublicIP:   net.IPv4(192, 0, 2, 1),
+			PublicPort: 9,
+			LocalPort:  uint16(about.conn.LocalAddr().(*net.UDPAddr).Port),
+			Addresses:  []net.IP{about.address},
+			Version:    protocol.ProtocolVersion,
+			Token:      testToken,
+			GlobalIP6:  about.conn.global6,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		to.peers.introduce(&protocol.Message{Version: protocol.ProtocolVersion, Type: protocol.MsgTypePeer, Data: payload})
+	}
+	a, b := nodes[0], nodes[1]
+	introduce(a, b)
+	introduce(b, a)
+	toB := ipv4Packet(a.address, b.address)
+	if !eventually(3*time.Second, func() bool { return a.peers.send(b.address, toB) }) {
+		t.Fatal("direct path not established")
+	}
+	a.peers.mutex.Lock()
+	addr := a.peers.direct[b.peers.nodeID].addr
+	a.peers.mutex.Unlock()
+	if !addr.IP.Equal(net.IPv6loopback) {
+		t.Fatalf("direct path through %v, want the IPv6 endpoint", addr)
+	}
+}
+
+// arpFrame 构造以太网上的 ARP 报文，op 为 1 时为请求
+func arpFrame(op uint16, dst, src net.HardwareAddr, senderIP, targetIP net.IP) []byte {
+	frame := append(append(append([]byte{}, dst...), src...), 0x08, 0x06, 0, 1, 0x08, 0, 6, 4, 0, byte(op))
+	frame = append(append(frame, src...), senderIP.To4()...)
+	return append(append(frame, make([]byte, 6)...), targetIP.To4()...)
+}
+
+// frameMessage 构造服务器转发的来自节点 source 的以太网帧消息
+func frameMessage(tb testing.TB, source string, frame []byte) []byte {
+	tb.Helper()
+	payload, err := protocol.EncodeFrame(source, frame)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	data, err := protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0).Encode(&protocol.Message{Type: protocol.MsgTypeFrame, Data: payload})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestBridgeFrames(t *testing.T) {
+	peers := newTestPeers(t, "node-0123456789abcdef")
+	peers.bridge = network.NewBridge(network.BridgeConfig{Proxy: true})
+	plain := protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0)
+	tun := peers.tun.(*packetRecorder)
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	macA, macB, macL := net.HardwareAddr{2, 0, 0, 0, 0, 0xa}, net.HardwareAddr{2, 0, 0, 0, 0, 0xb}, net.HardwareAddr{2, 0, 0, 0, 0, 0x1}
+	ipA, ipB, ipL := net.IPv4(10, 1, 0, 1), net.IPv4(10, 1, 0, 2), net.IPv4(10, 1, 0, 100)
+
+	// 服务器转发的帧写入 TAP 接口，并学习其源地址所在的节点
+	reply := arpFrame(2, macA, macB, ipB, ipA)
+	handleServerPacket(frameMessage(t, "node-1111111111111111", reply), plain, nil, peers)
+	handleServerPacket(frameMessage(t, "", []byte("not a frame")), plain, nil, peers)
+	if packets := tun.received(); len(packets) != 1 || !bytes.Equal(packets[0], reply) {
+		t.Fatalf("frames written to TAP: %x", packets)
+	}
+	if owner, ok := peers.bridge.Lookup(mustParseFrame(t, ipv4Frame(macB, macA)), time.Now()); !ok || owner != "node-1111111111111111" {
+		t.Fatalf("owner = %q, %v", owner, ok)
+	}
+
+	// 目标地址已在其他节点学习到的 ARP 请求由本节点代答
+	request := arpFrame(1, broadcast, macL, ipL, ipB)
+	if !peers.sendFrame(mustParseFrame(t, request), request) {
+		t.Fatal("ARP request for a remote address not answered locally")
+	}
+	packets := tun.received()
+	if len(packets) != 2 || !bytes.Equal(packets[1][:6], macL) || !bytes.Equal(packets[1][22:28], macB) {
+		t.Fatalf("proxied reply: %x", packets)
+	}
+	// 未直连的节点经服务器转发，发往本节点局域网的帧被丢弃
+	toB := ipv4Frame(macB, macL)
+	if peers.sendFrame(mustParseFrame(t, toB), toB) {
+		t.Fatal("frame for a node without a direct path not relayed")
+	}
+	toLocal := ipv4Frame(macL, macA)
+	if !peers.sendFrame(mustParseFrame(t, toLocal), toLocal) {
+		t.Fatal("frame for the local network forwarded")
+	}
+}
+
+// ipv4Frame 构造以太网上的 IPv4 数据包
+func ipv4Frame(dst, src net.HardwareAddr) []byte {
+	frame := append(append(append([]byte{}, dst...), src...), 0x08, 0x00)
+	return append(frame, ipv4Packet(net.IPv4(10, 1, 0, 1), net.IPv4(10, 1, 0, 2))...)
+}
+
+func mustParseFrame(tb testing.TB, data []byte) *network.Frame {
+	tb.Helper()
+	frame, err := network.ParseFrame(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return frame
+}
+
+func TestDirectFrames(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	nat := nattest.New(nattest.FullCone)
+	a := newTestNode(t, nat, server, nil, net.IPv4(10, 9, 0, 2), true)
+	b := newTestNode(t, nat, server, nil, net.IPv4(10, 9, 0, 3), true)
+	for _, node := range []*testNode{a, b} {
+		node.peers.mutex.Lock()
+		node.peers.bridge = network.NewBridge(network.BridgeConfig{})
+		node.peers.mutex.Unlock()
+	}
+	macA, macB := net.HardwareAddr{2, 0, 0, 0, 0, 0xa}, net.HardwareAddr{2, 0, 0, 0, 0, 0xb}
+
+	// 经服务器收到节点 b 的帧后，发往其源地址的帧在直连建立后直接发送
+	payload, err := protocol.EncodeFrame(b.peers.nodeID, ipv4Frame(macA, macB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.peers.deliverFrame(payload)
+	introduceTestNodes(t, a, b)
+	toB := ipv4Frame(macB, macA)
+	frame := mustParseFrame(t, toB)
+	if !eventually(3*time.Second, func() bool { return a.peers.sendFrame(frame, toB) }) {
+		t.Fatal("frame not sent directly")
+	}
+	tun := b.peers.tun.(*packetRecorder)
+	if !eventually(time.Second, func() bool { return len(tun.received()) > 0 }) {
+		t.Fatal("no frame delivered directly")
+	}
+	if packets := tun.received(); !bytes.Equal(packets[0], toB) {
+		t.Fatalf("delivered %x, want %x", packets[0], toB)
+	}
+	// 直连收到的帧同样学习其源地址所在的节点
+	if owner, ok := b.peers.bridge.Lookup(mustParseFrame(t, ipv4Frame(macA, macB)), time.Now()); !ok || owner != a.peers.nodeID {
+		t.Fatalf("owner = %q, %v", owner, ok)
+	}
+}
+
+// packetQueue 依次返回预先放入的数据包，取完后报告已关闭，模拟 TUN 接口的队列
+type packetQueue struct {
+	packets [][]byte
+}
+
+func (q *packetQueue) Read(buf []byte) (int, error) {
+	if len(q.packets) == 0 {
+		return 0, os.ErrClosed
+	}
+	n := copy(buf, q.packets[0])
+	q.packets = q.packets[1:]
+	return n, nil
+}
+
+func TestDispatchPackets(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	udp, err := listenUDP(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newServerConn(udp, server.LocalAddr().(*net.UDPAddr))
+	conns := workerConns(conn, 4)
+	t.Cleanup(func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	peers := newTestPeers(t, "node-0123456789abcdef")
+	plain := protocol.NewProtocol(nil, protocol.ProtocolVersion, 0, 0)
+
+	// 多个流的数据包交错读出，每个数据包的负载为其在流内的序号
+	const flows, packets = 8, 20
+	queue := &packetQueue{}
+	for seq := 0; seq < packets; seq++ {
+		for flow := 0; flow < flows; flow++ {
+			packet := []byte{0x45, 0, 0, 29, 0, 0, 0, 0, 64, 17, 0, 0, 10, 9, 0, 2, 10, 9, 0, 3}
+			packet = append(packet, 0x10, byte(flow), 0, 53, 0, 9, 0, 0, byte(seq))
+			queue.packets = append(queue.packets, packet)
+		}
+	}
+	dispatchPackets(queue, conns, peers, plain, newPacketBuffers(1500))
+
+	// 共享端口的套接字发出的报文源地址相同，同一流的数据包按读出的顺序到达
+	next := make(map[byte]byte)
+	buf := make([]byte, protocol.MaxMessageSize)
+	for i := 0; i < flows*packets; i++ {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := server.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("received %d of %d packets: %v", i, flows*packets, err)
+		}
+		if from.Port != udp.LocalAddr().(*net.UDPAddr).Port {
+			t.Fatalf("packet sent from %s, not the shared port", from)
+		}
+		msg, err := protocol.DecodeMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		flow, seq := msg.Data[21], msg.Data[28]
+		if seq != next[flow] {
+			t.Fatalf("flow %d: packet %d arrived before %d", flow, seq, next[flow])
+		}
+		next[flow] = seq + 1
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/auth"
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+// peerManager 管理客户端与其他节点之间的连接
+type peerManager struct {
+	nodeID   string
+	security *securityOptions
+	conn     net.PacketConn // 与服务器共用的套接字，除生日攻击外打洞探测和直连消息都经由它收发
+	ipv6     bool           // 本节点有全局 IPv6 地址，可向对端的 IPv6 端点打洞
+	nat      *network.NATTraversal
+	tun      io.Writer            // 其他节点发来的数据包写入 TUN 接口
+	bridge   *network.Bridge      // TAP 模式的二层交换状态，TUN 模式下为 nil
+	revoked  *auth.RevocationList // 服务器通告的已吊销节点
+	// done 本节点被吊销时关闭，客户端随即退出
+	done     chan struct{}
+	doneOnce sync.Once
+
+	mutex  sync.RWMutex
+	direct map[string]*directPeer // 服务器介绍的节点，按节点 ID 索引
+	// 已建立加密直连的节点，按本端分配的会话索引索引，接收直连消息时只需持有读锁查找
+	sessions     map[uint32]*directPeer
+	punchTimeout time.Duration // 打洞超过该时间仍未成功则放弃，继续经服务器中继
+	// 经 TUN 接口到其他节点通告网段的路由，按网段记录引用的节点数，tun 不能安装路由时 routes 为 nil
+	routes    routeTable
+	installed map[string]int
+	// 服务器推送的其他节点通告的网段，按网段记录通告它的节点，与直连时安装的路由分别引用
+	pushed map[string]string
+	// 服务器已确认的本节点通告的网段
+	announced map[string]bool
+	// 各对端静态公钥最近一次被接受的直连握手时间戳，节点被重新介绍或删除后仍保留，拒绝重放更早的握手
+	timestamps map[[crypto.KeySize]byte]int64
+}
+
+// routeTable 安装和删除经 TUN 接口的路由，由 network.TUN 实现
+type routeTable interface {
+	AddRoute(dst *net.IPNet) error
+	DeleteRoute(dst *net.IPNet) error
+}
+
+// newPeerManager 创建节点连接管理器
+func newPeerManager(security *securityOptions, conn net.PacketConn, nat *network.NATTraversal, tun io.Writer) *peerManager {
+	// 内存中的吊销列表不读写文件，不会失败
+	revoked, _ := auth.NewRevocationList("")
+	routes, _ := tun.(routeTable)
+	return &peerManager{
+		nodeID:       security.nodeID,
+		security:     security,
+		conn:         conn,
+		nat:          nat,
+		tun:          tun,
+		revoked:      revoked,
+		done:         make(chan struct{}),
+		direct:       make(map[string]*directPeer),
+		sessions:     make(map[uint32]*directPeer),
+		punchTimeout: punchTimeout,
+		routes:       routes,
+		installed:    make(map[string]int),
+		pushed:       make(map[string]string),
+		announced:    make(map[string]bool),
+		timestamps:   make(map[[crypto.KeySize]byte]int64),
+	}
+}
+
+// installRoutes 安装到节点通告网段的路由，多个节点通告同一网段时只安装一次。
+// 默认路由不安装，以免覆盖到服务器的路由。调用者须持有 m.mutex
+func (m *peerManager) installRoutes(nodeID string, routes []string) {
+	if m.routes == nil {
+		return
+	}
+	for _, route := range peerRoutes(routes) {
+		key := route.String()
+		if m.installed[key] == 0 {
+			if err := m.routes.AddRoute(route); err != nil {
+				log.Printf("安装到节点 %s 的网段 %s 的路由失败: %v", nodeID, key, err)
+				continue
+			}
+		}
+		m.installed[key]++
+	}
+}
+
+// uninstallRoutes 撤销节点对其通告网段的引用，没有节点再通告的网段删除路由。调用者须持有 m.mutex
+func (m *peerManager) uninstallRoutes(nodeID string, routes []string) {
+	if m.routes == nil {
+		return
+	}
+	for _, route := range peerRoutes(routes) {
+		key := route.String()
+		if m.installed[key] == 0 {
+			continue
+		}
+		if m.installed[key]--; m.installed[key] > 0 {
+			continue
+		}
+		delete(m.installed, key)
+		if err := m.routes.DeleteRoute(route); err != nil {
+			log.Printf("删除到节点 %s 的网段 %s 的路由失败: %v", nodeID, key, err)
+		}
+	}
+}
+
+// peerRoutes 解析节点通告的网段，忽略无效的网段、默认路由和重复的网段
+func peerRoutes(routes []string) []*net.IPNet {
+	var parsed []*net.IPNet
+	seen := make(map[string]bool)
+	for _, route := range routes {
+		_, ipNet, err := net.ParseCIDR(route)
+		if err != nil {
+			continue
+		}
+		if ones, _ := ipNet.Mask.Size(); ones == 0 || seen[ipNet.String()] {
+			continue
+		}
+		seen[ipNet.String()] = true
+		parsed = append(parsed, ipNet)
+	}
+	return parsed
+}
+
+// handleRoute 处理服务器推送的路由更新，安装或删除经 TUN 接口到其他节点所通告网段的路由，
+// 发往这些网段的数据包在与通告节点直连前经服务器中继。本节点自己通告的网段只记录为已被服务器确认
+func (m *peerManager) handleRoute(msg *protocol.Message) {
+	var route protocol.RouteMessage
+	if err := protocol.UnmarshalControl(msg.Version, msg.Data, &route); err != nil {
+		log.Printf("解析路由更新失败: %v", err)
+		return
+	}
+	if route.NextHop == "" {
+		return
+	}
+	routes := peerRoutes([]string{route.Destination})
+	if len(routes) == 0 {
+		log.Printf("忽略节点 %s 的无效网段 %q", route.NextHop, route.Destination)
+		return
+	}
+	key := routes[0].String()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if route.NextHop == m.nodeID {
+		m.announced[key] = !route.Withdraw
+		return
+	}
+	owner, ok := m.pushed[key]
+	switch {
+	case route.Withdraw && ok && owner == route.NextHop:
+		delete(m.pushed, key)
+		m.uninstallRoutes(owner, []string{key})
+		log.Printf("撤销节点 %s 通告的网段 %s", owner, key)
+	case !route.Withdraw && !ok:
+		m.pushed[key] = route.NextHop
+		m.installRoutes(route.NextHop, []string{key})
+		log.Printf("节点 %s 通告网段 %s", route.NextHop, key)
+	case !route.Withdraw:
+		m.pushed[key] = route.NextHop
+	}
+}
+
+// unacknowledged 返回 routes 中尚未被服务器确认的网段
+func (m *peerManager) unacknowledged(routes []string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var pending []string
+	for _, route := range routes {
+		if !m.announced[route] {
+			pending = append(pending, route)
+		}
+	}
+	return pending
+}
+
+// handleRevocation 处理服务器的吊销通知，关闭到已吊销节点的连接并拒绝其后续连接
+func (m *peerManager) handleRevocation(msg *protocol.Message) {
+	var revocation protocol.RevocationMessage
+	if err := protocol.UnmarshalControl(msg.Version, msg.Data, &revocation); err != nil {
+		log.Printf("解析吊销通知失败: %v", err)
+		return
+	}
+
+	for _, nodeID := range revocation.NodeIDs {
+		if nodeID == m.nodeID {
+			log.Printf("本节点已被服务器吊销")
+			m.doneOnce.Do(func() { close(m.done) })
+			continue
+		}
+		if _, added, err := m.revoked.Revoke(nodeID, ""); err != nil || !added {
+			continue
+		}
+		m.removeDirect(nodeID)
+		if m.nat.CloseConnection(nodeID) == nil {
+			log.Printf("节点 %s 已被吊销，关闭中继连接", nodeID)
+		} else {
+			log.Printf("节点 %s 已被吊销", nodeID)
+		}
+	}
+}
+
+// deliver 将其他节点发来的数据包写入 TUN 接口，TAP 模式下为以太网帧，无效的数据被丢弃
+func (m *peerManager) deliver(packet []byte) {
+	var err error
+	if m.bridge != nil {
+		_, err = network.ParseFrame(packet)
+	} else {
+		_, err = network.ParsePacket(packet)
+	}
+	if err != nil {
+		log.Printf("丢弃无效的数据包: %v", err)
+		return
+	}
+	if _, err := m.tun.Write(packet); err != nil {
+		log.Printf("写入数据包失败: %v", err)
+	}
+}
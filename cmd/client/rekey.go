@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+const (
+	// rekeyCheckInterval 检查密钥是否需要轮换的间隔
+	rekeyCheckInterval = time.Second
+	// rekeyTimeout 重新握手未收到响应时的重试间隔
+	rekeyTimeout = 5 * time.Second
+)
+
+// rekeyer 客户端会话密钥轮换，由客户端作为发起方定期重新握手
+type rekeyer struct {
+	mutex    sync.Mutex
+	conn     *serverConn
+	tun      *network.TUN
+	security *securityOptions
+	keys     *crypto.KeyRing
+	// remoteIndex 服务器分配的会话索引，version 协商出的协议版本，重新握手时均应保持不变
+	remoteIndex uint32
+	version     uint8
+	pending     *crypto.Handshake
+	epoch       uint8
+	sentAt      time.Time
+}
+
+// newRekeyer 创建密钥轮换器
+func newRekeyer(conn *serverConn, tun *network.TUN, security *securityOptions, proto *protocol.Protocol) *rekeyer {
+	return &rekeyer{
+		conn:        conn,
+		tun:         tun,
+		security:    security,
+		keys:        proto.Keys(),
+		remoteIndex: proto.RemoteIndex(),
+		version:     proto.Version(),
+	}
+}
+
+// run 按时间和消息数检查当前密钥，达到阈值后发起重新握手
+func (r *rekeyer) run() {
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !r.keys.NeedsRekey() {
+			continue
+		}
+		if err := r.initiate(); err != nil {
+			log.Printf("发起密钥轮换失败: %v", err)
+		}
+	}
+}
+
+// initiate 发送重新握手消息，已有未完成的握手且未超时则跳过
+func (r *rekeyer) initiate() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pending != nil && time.Since(r.sentAt) < rekeyTimeout {
+		return nil
+	}
+
+	epoch := r.keys.NextEpoch()
+	data, err := newHandshakeMessage(r.conn, r.tun, r.security, r.version, epoch)
+	if err != nil {
+		return err
+	}
+
+	hs := crypto.NewInitiatorHandshake(r.security.static, r.security.serverPublic)
+	initiation, err := hs.WriteMessage(data)
+	if err != nil {
+		return err
+	}
+
+	msg := &protocol.Message{
+		Version: r.version,
+		Type:    protocol.MsgTypeHandshake,
+		Flags:   protocol.FlagEncrypted,
+		Data:    initiation,
+	}
+	encoded, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	if _, err := r.conn.Write(encoded); err != nil {
+		return err
+	}
+
+	r.pending = hs
+	r.epoch = epoch
+	r.sentAt = time.Now()
+	return nil
+}
+
+// handleResponse 处理重新握手的响应，成功后立即切换到新密钥发送，旧密钥保留用于接收
+func (r *rekeyer) handleResponse(msg *protocol.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pending == nil {
+		return
+	}
+
+	session, result, err := completeHandshake(r.pending, msg, r.security, r.epoch)
+	if err != nil {
+		log.Printf("密钥轮换失败: %v", err)
+		return
+	}
+	if result.SenderIndex != r.remoteIndex {
+		log.Printf("密钥轮换失败: 服务器会话索引变化 %d -> %d", r.remoteIndex, result.SenderIndex)
+		return
+	}
+	if result.Version != r.version {
+		log.Printf("密钥轮换失败: 协议版本变化 %d -> %d", r.version, result.Version)
+		return
+	}
+
+	r.keys.Install(session)
+	r.pending = nil
+	log.Printf("会话密钥已轮换，代数 %d", session.Epoch)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+)
+
+// workerQueueSize 每个工作协程待发送数据包队列的长度，队列满时读取协程等待
+const workerQueueSize = 256
+
+// newPacketBuffers 创建各读取协程和工作协程共用的数据包缓冲池，缓冲区大小为 size，
+// 即接口的 MTU 加帧头，只在有数据包待发送时占用。size 未知（接口的 MTU 不是由本程序设置）时按最大负载分配，
+// 避免读取超过缓冲区的数据包时被截断
+func newPacketBuffers(size int) *sync.Pool {
+	if size <= 0 || size > protocol.MaxPayloadSize {
+		size = protocol.MaxPayloadSize
+	}
+	return &sync.Pool{
+		New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// listenUDP 创建客户端的 UDP 套接字。有多个工作协程时以 SO_REUSEPORT 监听，
+// 握手后各工作协程另外打开共享同一端口的套接字；平台不支持时各工作协程共用该套接字
+func listenUDP(workers int) (*net.UDPConn, error) {
+	if workers > 1 {
+		conn, err := network.ListenUDPReusePort(nil)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return conn, err
+		}
+	}
+	return net.ListenUDP("udp", nil)
+}
+
+// workerConns 为 workers 个工作协程各返回一个与服务器通信的套接字，第一个即 conn，其余为共享 conn 端口的新套接字，
+// 发出的报文源地址与 conn 相同，服务器和对端无法区分。无法共享端口时其余工作协程共用 conn
+func workerConns(conn *serverConn, workers int) []*serverConn {
+	conns := []*serverConn{conn}
+	for len(conns) < workers {
+		udp, err := network.ListenUDPReusePort(conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				log.Printf("警告: 无法打开共享端口的套接字，工作协程共用同一套接字: %v", err)
+			}
+			break
+		}
+		shared := *conn
+		shared.PacketConn = udp
+		conns = append(conns, &shared)
+	}
+	for len(conns) < workers {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// handlePackets 读取 TUN 接口的数据包，由每个套接字一个的工作协程并行加密并发送。
+// 接口有多个队列时每个队列由一个工作协程读取并发送，内核将同一流的数据包分配到同一队列；
+// 只有一个队列时由一个协程读取，按流的哈希值分发给各工作协程。同一流的数据包总是由同一工作协程依次发送，流内的顺序不变
+func handlePackets(tun *network.TUN, conns []*serverConn, peers *peerManager, proto *protocol.Protocol) {
+	buffers := newPacketBuffers(tun.PacketSize())
+	switch {
+	case tun.Queues() > 1:
+		for i := 1; i < tun.Queues(); i++ {
+			go readPackets(tun.Queue(i), conns[i%len(conns)], peers, proto, buffers)
+		}
+		readPackets(tun.Queue(0), conns[0], peers, proto, buffers)
+	case len(conns) > 1:
+		dispatchPackets(tun, conns, peers, proto, buffers)
+	default:
+		readPackets(tun, conns[0], peers, proto, buffers)
+	}
+}
+
+// readPackets 依次读取并发送 queue 中的数据包，直到 queue 被关闭。读取和发送在同一协程中进行，只占用一个缓冲区
+func readPackets(queue io.Reader, conn *serverConn, peers *peerManager, proto *protocol.Protocol, buffers *sync.Pool) {
+	ref := buffers.Get().(*[]byte)
+	defer buffers.Put(ref)
+	buf := *ref
+	for {
+		// 从 TUN 接口读取数据包
+		n, err := queue.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("读取数据包失败: %v", err)
+			continue
+		}
+
+		forwardPacket(conn, proto, peers, buf[:n])
+	}
+}
+
+// dispatchPackets 读取 queue 中的数据包，按流的哈希值分发给每个套接字一个的工作协程，直到 queue 被关闭。
+// 数据包缓冲区取自 buffers，工作协程发送后放回
+func dispatchPackets(queue io.Reader, conns []*serverConn, peers *peerManager, proto *protocol.Protocol, buffers *sync.Pool) {
+	flowHash := network.FlowHash
+	if peers.bridge != nil {
+		flowHash = network.FrameFlowHash
+	}
+
+	workers := make([]chan *[]byte, len(conns))
+	for i, conn := range conns {
+		packets := make(chan *[]byte, workerQueueSize)
+		workers[i] = packets
+		go func(conn *serverConn) {
+			for buf := range packets {
+				forwardPacket(conn, proto, peers, *buf)
+				*buf = (*buf)[:cap(*buf)]
+				buffers.Put(buf)
+			}
+		}(conn)
+	}
+	defer func() {
+		for _, packets := range workers {
+			close(packets)
+		}
+	}()
+
+	for {
+		buf := buffers.Get().(*[]byte)
+		n, err := queue.Read(*buf)
+		if err != nil {
+			buffers.Put(buf)
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			log.Printf("读取数据包失败: %v", err)
+			continue
+		}
+		*buf = (*buf)[:n]
+		workers[flowHash(*buf)%uint32(len(workers))] <- buf
+	}
+}
+
+// forwardPacket 发送从 TUN 接口读取的数据包，TAP 模式下为以太网帧
+func forwardPacket(conn *serverConn, proto *protocol.Protocol, peers *peerManager, packet []byte) {
+	if peers.bridge != nil {
+		sendFrame(conn, proto, peers, packet)
+	} else {
+		sendPacket(conn, proto, peers, packet)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+)
+
+// checkMode 检查节点的虚拟网络模式是否与服务器相同，模式不同的节点无法互通
+func checkMode(security *securityOptions, handshake *protocol.HandshakeMessage) error {
+	if handshake.Mode != security.mode {
+		return fmt.Errorf("节点的虚拟网络模式 %s 与服务器的 %s 不同",
+			protocol.ModeName(handshake.Mode), protocol.ModeName(security.mode))
+	}
+	return nil
+}
+
+// handleFrame 转发 TAP 模式下的以太网帧：学习帧的源地址所在的节点，能够代答的 ARP 请求和邻居请求直接应答，
+// 目的地址已学习的单播帧只发往其所在的节点，广播、组播和未知单播帧在泛洪限额内发往其他所有节点。
+// 转发的帧以发送节点作为来源，sender 为通过认证的发送节点，明文模式下按来源地址查找
+func handleFrame(conn udpWriter, remoteAddr *net.UDPAddr, msg *protocol.Message, sender string, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	bridge := security.bridge
+	if bridge == nil {
+		log.Printf("丢弃 %s 发送的以太网帧: 服务器未工作在 TAP 模式", remoteAddr)
+		return
+	}
+	// 不信任节点自报的来源
+	_, data, err := protocol.DecodeFrame(msg.Data)
+	if err != nil {
+		log.Printf("丢弃无效的以太网帧: %v", err)
+		return
+	}
+	frame, err := network.ParseFrame(data)
+	if err != nil {
+		log.Printf("丢弃无效的以太网帧: %v", err)
+		return
+	}
+
+	var source *network.Node
+	if sender != "" {
+		source = discovery.GetNode(sender)
+	} else {
+		source = endpointOwner(discovery, remoteAddr)
+	}
+	if source == nil {
+		log.Printf("丢弃 %s 发送的以太网帧: 未知节点", remoteAddr)
+		return
+	}
+
+	now := time.Now()
+	if moved := bridge.Learn(frame, source.ID, now); moved != "" {
+		log.Printf("MAC 地址 %s 从节点 %s 迁移到节点 %s", frame.Source, moved, source.ID)
+	}
+	if reply := bridge.Proxy(frame, source.ID, now); reply != nil {
+		sendFrame(conn, source, "", reply, sessions, security)
+		return
+	}
+
+	if owner, ok := bridge.Lookup(frame, now); ok {
+		// 目的主机与源主机位于同一节点的局域网，已由该局域网交付
+		if owner == source.ID {
+			return
+		}
+		if target := discovery.GetNode(owner); target != nil {
+			if sendFrame(conn, target, source.ID, data, sessions, security) {
+				introduceNodes(conn, source, target, discovery, sessions, security)
+			}
+			return
+		}
+	}
+
+	if !bridge.AllowFlood(source.ID, now) {
+		return
+	}
+	for _, node := range discovery.GetNodes() {
+		if node.ID != source.ID {
+			sendFrame(conn, node, source.ID, data, sessions, security)
+		}
+	}
+}
+
+// sendFrame 以节点的会话封装来自节点 source 的以太网帧并发送，返回是否已发送
+func sendFrame(conn udpWriter, node *network.Node, source string, frame []byte, sessions *protocol.SessionTable, security *securityOptions) bool {
+	proto, addr, err := nodeProtocol(sessions, node, security)
+	if err != nil {
+		log.Printf("无法转发到节点 %s: %v", node.ID, err)
+		return false
+	}
+	payload, err := protocol.EncodeFrame(source, frame)
+	if err != nil {
+		log.Printf("编码以太网帧失败: %v", err)
+		return false
+	}
+	data, err := proto.Encode(&protocol.Message{
+		Type: protocol.MsgTypeFrame,
+		Data: payload,
+	})
+	if err != nil {
+		log.Printf("编码以太网帧失败: %v", err)
+		return false
+	}
+	if _, err := conn.WriteToUDP(data, addr); err != nil {
+		log.Printf("发送以太网帧失败: %v", err)
+		return false
+	}
+	return true
+}
+
+// endpointOwner 返回公网端点为 addr 的节点，明文模式下据此确定消息的发送节点
+func endpointOwner(discovery *network.Discovery, addr *net.UDPAddr) *network.Node {
+	for _, node := range discovery.GetNodes() {
+		if int(node.PublicPort) == addr.Port && node.PublicIP.Equal(addr.IP) {
+			return node
+		}
+	}
+	return nil
+}
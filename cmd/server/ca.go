@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/ca"
+)
+
+const caUsage = `用法: server ca <命令> [参数]
+
+命令:
+  init     初始化 CA
+  issue    签发服务器或节点证书
+  list     列出已签发的证书
+  revoke   吊销证书（按序列号或名称）
+  crl      重新签发吊销列表，应在吊销列表过期前定期执行
+
+使用 "server ca <命令> -h" 查看各命令的参数。
+`
+
+// runCA 执行 ca 子命令，返回进程退出码
+func runCA(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+
+	commands := map[string]func([]string) error{
+		"init":   caInit,
+		"issue":  caIssue,
+		"list":   caList,
+		"revoke": caRevoke,
+		"crl":    caCRL,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+	if err := command(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "ca %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// newCAFlagSet 创建带有 -dir 参数的子命令参数集
+func newCAFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("ca "+name, flag.ContinueOnError)
+	dir := fs.String("dir", "ca", "CA 状态目录")
+	return fs, dir
+}
+
+func caInit(args []string) error {
+	fs, dir := newCAFlagSet("init")
+	name := fs.String("name", "SD-WAN CA", "CA 名称")
+	days := fs.Int("days", 3650, "CA 证书有效期（天）")
+	crlDays := fs.Int("crl-days", int(ca.DefaultCRLValidity/(24*time.Hour)), "吊销列表有效期（天）")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	authority, err := ca.Init(*dir, *name, days2duration(*days))
+	if err != nil {
+		return err
+	}
+	if *crlDays != int(ca.DefaultCRLValidity/(24*time.Hour)) {
+		authority.SetCRLValidity(days2duration(*crlDays))
+		if err := authority.WriteCRL(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("已创建 CA %q，证书 %s，吊销列表 %s\n", *name,
+		filepath.Join(*dir, ca.CertFile), filepath.Join(*dir, ca.CRLFile))
+	return nil
+}
+
+func caIssue(args []string) error {
+	fs, dir := newCAFlagSet("issue")
+	kind := fs.String("type", ca.KindNode, "证书类型：node 或 server")
+	name := fs.String("name", "", "节点或服务器名称，写入证书主题 CN")
+	groups := fs.String("groups", "", "节点所属组，逗号分隔，写入证书主题 OU")
+	ips := fs.String("ip", "", "节点证书为虚拟 IP，服务器证书为客户端连接使用的 IP，逗号分隔")
+	dns := fs.String("dns", "", "服务器域名，逗号分隔，仅服务器证书使用")
+	days := fs.Int("days", 365, "证书有效期（天）")
+	out := fs.String("out", ".", "证书和私钥的输出目录")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	req := ca.IssueRequest{
+		Kind:     *kind,
+		Name:     *name,
+		Groups:   splitList(*groups),
+		DNSNames: splitList(*dns),
+		Validity: days2duration(*days),
+	}
+	for _, s := range splitList(*ips) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("无效的 IP 地址 %q", s)
+		}
+		req.IPs = append(req.IPs, ip)
+	}
+
+	authority, err := ca.Open(*dir)
+	if err != nil {
+		return err
+	}
+	issued, err := authority.Issue(req)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*out, 0o700); err != nil {
+		return err
+	}
+	certFile := filepath.Join(*out, *name+".pem")
+	keyFile := filepath.Join(*out, *name+".key")
+	if err := os.WriteFile(keyFile, issued.KeyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, issued.CertPEM, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("已签发%s证书 %s，序列号 %s，节点 ID %s，有效期至 %s\n", kindText(issued.Record.Kind), *name,
+		issued.Record.Serial, issued.Record.NodeID, issued.Record.NotAfter.Format(time.RFC3339))
+	fmt.Printf("证书: %s\n私钥: %s\n", certFile, keyFile)
+	return nil
+}
+
+func caList(args []string) error {
+	fs, dir := newCAFlagSet("list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	authority, err := ca.Open(*dir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "序列号\t类型\t名称\t组\t地址\t节点 ID\t有效期至\t状态")
+	for _, record := range authority.List() {
+		status := "有效"
+		switch {
+		case record.Revoked():
+			status = "已吊销 " + record.RevokedAt.Format(time.RFC3339)
+		case time.Now().After(record.NotAfter):
+			status = "已过期"
+		}
+		var addresses []string
+		for _, ip := range record.IPs {
+			addresses = append(addresses, ip.String())
+		}
+		addresses = append(addresses, record.DNSNames...)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.Serial, record.Kind, record.Name,
+			strings.Join(record.Groups, ","), strings.Join(addresses, ","), record.NodeID,
+			record.NotAfter.Format(time.RFC3339), status)
+	}
+	return w.Flush()
+}
+
+func caRevoke(args []string) error {
+	fs, dir := newCAFlagSet("revoke")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: server ca revoke [-dir 目录] <序列号或名称>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("需要指定一个序列号或名称")
+	}
+
+	authority, err := ca.Open(*dir)
+	if err != nil {
+		return err
+	}
+	revoked, err := authority.Revoke(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, record := range revoked {
+		fmt.Printf("已吊销%s证书 %s，序列号 %s\n", kindText(record.Kind), record.Name, record.Serial)
+	}
+	fmt.Printf("吊销列表已更新: %s\n", filepath.Join(*dir, ca.CRLFile))
+	return nil
+}
+
+func caCRL(args []string) error {
+	fs, dir := newCAFlagSet("crl")
+	days := fs.Int("days", 0, "吊销列表有效期（天），0 表示沿用 CA 的设置")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	authority, err := ca.Open(*dir)
+	if err != nil {
+		return err
+	}
+	if *days > 0 {
+		authority.SetCRLValidity(days2duration(*days))
+	}
+	if err := authority.WriteCRL(); err != nil {
+		return err
+	}
+	fmt.Printf("吊销列表已更新: %s，有效期至 %s\n", filepath.Join(*dir, ca.CRLFile),
+		time.Now().Add(authority.CRLValidity()).Format(time.RFC3339))
+	return nil
+}
+
+func days2duration(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// splitList 拆分逗号分隔的参数，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func kindText(kind string) string {
+	if kind == ca.KindServer {
+		return "服务器"
+	}
+	return "节点"
+}
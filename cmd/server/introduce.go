@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+)
+
+const (
+	// introductionInterval 同一对节点两次介绍的最小间隔，打洞失败的节点在此之后重试
+	introductionInterval = time.Minute
+	// punchTokenSize 打洞令牌的长度
+	punchTokenSize = 16
+)
+
+// introduceNodes 在两个节点之间中转数据后互相介绍对方，双方收到介绍后同时向对方打洞，
+// 成功后直接通信，打洞失败时经中继服务或 TURN 服务器通信。双方都须支持直连能力，
+// 同一对节点在 introductionInterval 内只介绍一次
+func introduceNodes(conn udpWriter, a, b *network.Node, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	if a.ID == b.ID || a.Capabilities&protocol.CapDirect == 0 || b.Capabilities&protocol.CapDirect == 0 {
+		return
+	}
+	// 双方的 NAT 类型注定打洞失败且无法经中继服务或 TURN 服务器通信时不再介绍，继续经服务器中继；
+	// 对称 NAT 与端口受限锥形 NAT 之间须双方都支持端口预测和生日攻击
+	tickets := canRelay(a, b, security)
+	relayed := tickets || canTURN(a, b)
+	switch network.ChooseTraversal(a.NATType, b.NATType, a.PortStep, b.PortStep) {
+	case network.TraversalPunch:
+	case network.TraversalRelay:
+		if !relayed {
+			return
+		}
+	default:
+		if a.Capabilities&b.Capabilities&protocol.CapTraversal == 0 && !relayed {
+			return
+		}
+	}
+	if !discovery.Introduce(a.ID, b.ID, introductionInterval) {
+		return
+	}
+
+	token := make([]byte, punchTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("生成打洞令牌失败: %v", err)
+		return
+	}
+	// 直连会话使用双方都支持的协议版本
+	version := min(a.Version, b.Version)
+
+	// 两条介绍同时发出，双方几乎同时开始打洞
+	if sendIntroduction(conn, a, b, version, token, tickets, discovery, sessions, security) &&
+		sendIntroduction(conn, b, a, version, token, tickets, discovery, sessions, security) {
+		log.Printf("介绍节点 %s 与 %s 打洞直连", a.ID, b.ID)
+	}
+}
+
+// canRelay 判断两个节点能否在打洞失败后经中继服务通信
+func canRelay(a, b *network.Node, security *securityOptions) bool {
+	return security.relaySecret != nil && a.Capabilities&b.Capabilities&protocol.CapRelay != 0
+}
+
+// canTURN 判断两个节点能否在打洞失败后经双方在 TURN 服务器上的中继地址通信
+func canTURN(a, b *network.Node) bool {
+	return a.Relayed != nil && b.Relayed != nil
+}
+
+// sendIntroduction 向节点 to 介绍节点 about 的身份、端点、虚拟地址和所通告的网段，
+// tickets 为 true 时附带经中继服务与其通信的票据，双方都有 TURN 中继地址时附带对端的中继地址
+func sendIntroduction(conn udpWriter, to, about *network.Node, version uint8, token []byte, tickets bool, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) bool {
+	proto, addr, err := nodeProtocol(sessions, to, security)
+	if err != nil {
+		log.Printf("无法向节点 %s 发送介绍: %v", to.ID, err)
+		return false
+	}
+	_, endpoint, err := nodeProtocol(sessions, about, security)
+	if err != nil {
+		log.Printf("无法介绍节点 %s: %v", about.ID, err)
+		return false
+	}
+
+	msg := &protocol.PeerMessage{
+		NodeID:     about.ID,
+		PublicIP:   endpoint.IP,
+		PublicPort: uint16(endpoint.Port),
+		LocalIP:    about.LocalIP,
+		LocalPort:  about.PrivatePort,
+		Addresses:  about.Addresses(),
+		Version:    version,
+		Token:      token,
+		NATType:    uint8(about.NATType),
+		PortStep:   int16(about.PortStep),
+		GlobalIP6:  about.GlobalIP6,
+	}
+	if peer := sessions.ByNode(about.ID); peer != nil {
+		msg.PublicKey = peer.Static[:]
+	}
+	if tickets {
+		msg.RelayTicket, msg.RelayKey = issueRelayTicket(security, to.ID, about.ID)
+	}
+	if canTURN(to, about) {
+		msg.RelayedIP, msg.RelayedPort = about.Relayed.IP, uint16(about.Relayed.Port)
+	}
+	for _, route := range discovery.GetRoutes(about.ID) {
+		msg.Routes = append(msg.Routes, route.Destination)
+	}
+
+	payload, err := protocol.MarshalControl(proto.Version(), msg)
+	if err != nil {
+		log.Printf("编码节点介绍失败: %v", err)
+		return false
+	}
+	sendMessage(conn, addr, proto, protocol.MsgTypePeer, payload)
+	return true
+}
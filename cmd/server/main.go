@@ -1,8 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -10,16 +11,55 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/fenghuilee/sd-wan/internal/auth"
 	"github.com/fenghuilee/sd-wan/internal/config"
+	"github.com/fenghuilee/sd-wan/internal/ipam"
 	"github.com/fenghuilee/sd-wan/internal/network"
 	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/internal/relay"
+	"github.com/fenghuilee/sd-wan/internal/stun"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
 )
 
 var (
 	configFile = flag.String("config", "config.yaml", "配置文件路径")
 )
 
+// securityOptions 服务器安全设置
+type securityOptions struct {
+	encryption bool
+	static     *crypto.KeyPair
+	allowed    []string
+	policy     crypto.RekeyPolicy
+	registry   *auth.Registry // 节点授权表，为 nil 时接受任何节点
+	cert       *auth.Certificate
+	verifier   *auth.Verifier       // 节点证书校验器，为 nil 时不接受证书认证
+	revoked    *auth.RevocationList // 已吊销节点列表，为 nil 时不检查
+
+	relaySecret []byte        // 与中继服务共享的票据密钥，为 nil 时不签发中继票据
+	relayTTL    time.Duration // 中继票据的有效期
+	relayServer net.IP        // 告知节点的中继服务地址，配置为主机名时为 nil
+	relayPort   uint16
+
+	ipam *ipam.Allocator // 虚拟地址分配器，未配置 network.subnet 时为 nil，由节点自报地址
+
+	mode   uint8           // 虚拟网络模式，只接受相同模式的节点
+	bridge *network.Bridge // TAP 模式的二层交换状态，TUN 模式下为 nil
+}
+
 func main() {
+	// ca 子命令管理内置证书颁发机构，revoke 子命令吊销节点，relay 子命令运行中继服务
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ca":
+			os.Exit(runCA(os.Args[2:]))
+		case "revoke":
+			os.Exit(runRevoke(os.Args[2:]))
+		case "relay":
+			os.Exit(runRelay(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	// 加载配置
@@ -28,157 +68,741 @@ func main() {
 		log.Fatalf("加载配置失败: %v", err)
 	}
 
-	// 创建节点发现管理器
-	discovery := network.NewDiscovery(30 * time.Second)
-	discovery.Start()
-
-	// 创建 NAT 穿透管理器
-	nat := network.NewNATTraversal(
-		net.ParseIP(cfg.NAT.RelayServer),
-		uint16(cfg.NAT.RelayPort),
-	)
-
-	// 创建 UDP 服务器
-	addr, err := net.ResolveUDPAddr("udp", cfg.GetServerAddr())
+	// 加载安全设置
+	security, err := loadSecurityOptions(cfg)
 	if err != nil {
-		log.Fatalf("解析地址失败: %v", err)
+		log.Fatalf("加载安全设置失败: %v", err)
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
+	// 创建会话表
+	sessions := protocol.NewSessionTable()
+
+	// 创建节点发现管理器
+	discovery := network.NewDiscovery(nodeExpiryInterval)
+
+	// 创建 UDP 服务器
+	sockets, err := listenUnderlay(cfg)
 	if err != nil {
 		log.Fatalf("创建 UDP 服务器失败: %v", err)
 	}
-	defer conn.Close()
+	defer sockets.Close()
+
+	for i, conn := range sockets.conns() {
+		log.Printf("服务器启动在 %s", conn.LocalAddr())
+
+		// 在同一端口上应答 STUN 请求，配置了备用地址或端口时客户端可据此探测 NAT 类型，备用地址只用于主套接字
+		var responder *stun.Responder
+		if i == 0 {
+			responder, err = stun.NewResponder(conn, net.ParseIP(cfg.Server.STUNAlternateIP), cfg.Server.STUNAlternatePort)
+		} else {
+			responder, err = stun.NewResponder(conn, nil, 0)
+		}
+		if err != nil {
+			log.Fatalf("启动 STUN 响应器失败: %v", err)
+		}
+		defer responder.Close()
+		if other := responder.OtherAddress(); other != nil {
+			log.Printf("STUN 备用地址 %s", other)
+		}
 
-	log.Printf("服务器启动在 %s", addr.String())
+		// 启动消息处理循环，回复经与对端地址协议族相同的套接字发送
+		go handleMessages(conn, sockets, responder, discovery, sessions, security)
+	}
 
 	// 处理信号
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// 启动消息处理循环
-	go handleMessages(conn, discovery, nat)
+	// 移除过期节点，通知其他节点撤销其路由
+	go expireNodes(sockets, discovery, sessions)
+
+	// 监视吊销列表，吊销的节点立即断开
+	if security.revoked != nil {
+		go watchRevocations(sockets, discovery, sessions, security)
+	}
 
 	// 等待信号
 	<-sigChan
 	log.Println("正在关闭服务器...")
 }
 
-func handleMessages(conn *net.UDPConn, discovery *network.Discovery, nat *network.NATTraversal) {
-	buf := make([]byte, 1500)
+// loadSecurityOptions 根据 security 配置加载密钥和允许的算法
+func loadSecurityOptions(cfg *config.Config) (*securityOptions, error) {
+	security := &securityOptions{
+		encryption:  cfg.Security.Encryption,
+		allowed:     cfg.Security.AllowedAlgorithms,
+		policy:      cfg.GetRekeyPolicy(),
+		relayTTL:    time.Duration(cfg.NAT.RelayTicketTTL) * time.Second,
+		relayServer: net.ParseIP(cfg.NAT.RelayServer),
+		relayPort:   uint16(cfg.NAT.RelayPort),
+	}
+	relaySecret, err := cfg.GetRelaySecret()
+	if err != nil {
+		return nil, err
+	}
+	security.relaySecret = relaySecret
+	if security.mode, err = cfg.GetMode(); err != nil {
+		return nil, err
+	}
+	if security.mode == protocol.ModeTAP {
+		security.bridge = network.NewBridge(cfg.GetBridgeConfig())
+		log.Printf("工作在 TAP 模式，节点之间转发以太网帧，每个节点每秒最多泛洪 %d 帧（0 表示不限制）", cfg.Network.FloodRate)
+	}
+	if relaySecret != nil {
+		log.Printf("中继服务已启用，打洞失败的节点经 %s 通信", cfg.GetRelayAddr())
+	}
+	allocator, err := cfg.LoadAllocator()
+	if err != nil {
+		return nil, fmt.Errorf("加载地址分配状态失败: %v", err)
+	}
+	security.ipam = allocator
+	if allocator != nil {
+		log.Printf("从 %v 为节点分配虚拟地址，已分配 %d 个", allocator.Subnets(), len(allocator.Allocations()))
+		for _, subnet := range allocator.Subnets() {
+			if subnet.IP.To4() == nil && !subnet.IP.IsPrivate() {
+				log.Printf("警告: IPv6 虚拟网段 %s 不是 ULA 前缀（fc00::/7），可能与公网地址冲突", subnet)
+			}
+		}
+	}
+	if !security.encryption {
+		log.Println("警告: 未启用加密，所有消息以明文传输")
+		if cfg.Security.RequireAuthorization {
+			log.Println("警告: 明文模式无法认证节点身份，不执行节点授权")
+		}
+		return security, nil
+	}
+
+	if len(security.allowed) == 0 {
+		security.allowed = crypto.SupportedAlgorithms()
+	}
+
+	// 配置了证书时以证书中的密钥作为服务器身份，客户端可通过 CA 校验服务器
+	if cfg.Server.CertFile != "" {
+		cert, err := auth.LoadCertificate(cfg.Server.CertFile, cfg.Server.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载服务器证书失败: %v", err)
+		}
+		security.cert = cert
+		security.static = cert.KeyPair
+		log.Printf("服务器证书: %s，有效期至 %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		static, created, err := cfg.LoadIdentity()
+		if err != nil {
+			return nil, fmt.Errorf("加载服务器密钥失败: %v", err)
+		}
+		if created {
+			log.Printf("已生成服务器身份密钥: %s", cfg.Security.IdentityFile)
+		}
+		security.static = static
+	}
+	log.Printf("服务器公钥: %s", crypto.EncodeKey(security.static.Public))
+
+	verifier, err := cfg.LoadVerifier()
+	if err != nil {
+		return nil, fmt.Errorf("加载 CA 证书失败: %v", err)
+	}
+	security.verifier = verifier
+
+	revoked, err := cfg.LoadRevocations()
+	if err != nil {
+		return nil, fmt.Errorf("加载吊销列表失败: %v", err)
+	}
+	security.revoked = revoked
+	if n := len(revoked.Nodes()); n > 0 {
+		log.Printf("已吊销 %d 个节点", n)
+	}
+
+	if !cfg.Security.RequireAuthorization {
+		log.Println("警告: 未启用节点授权，接受任何节点的握手")
+		return security, nil
+	}
+	registry, err := cfg.LoadRegistry()
+	if err != nil {
+		return nil, fmt.Errorf("加载节点授权表失败: %v", err)
+	}
+	security.registry = registry
+	log.Printf("节点授权已启用，已登记 %d 个节点，%d 个静态授权公钥，%d 个预授权密钥",
+		len(registry.Nodes()), len(cfg.Security.AuthorizedKeys), len(cfg.Security.PreAuthKeys))
+	return security, nil
+}
+
+// handleMessages 读取套接字 conn 上的报文，STUN 请求交给 responder 应答，其余按本协议处理，回复经 out 发送
+func handleMessages(conn *net.UDPConn, out udpWriter, responder *stun.Responder, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	buf := make([]byte, protocol.MaxMessageSize)
 	for {
 		n, remoteAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("读取数据失败: %v", err)
 			continue
 		}
 
-		// 解码消息
-		msg, err := protocol.DecodeMessage(buf[:n])
-		if err != nil {
-			log.Printf("解码消息失败: %v", err)
+		if responder.Handle(buf[:n], remoteAddr) {
 			continue
 		}
+		handlePacket(out, remoteAddr, buf[:n], discovery, sessions, security)
+	}
+}
+
+// handlePacket 处理一个 UDP 报文。报文来自不可信的网络，任何格式错误都只能导致报文被丢弃
+func handlePacket(conn udpWriter, remoteAddr *net.UDPAddr, data []byte, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	// 解码消息
+	msg, err := protocol.DecodeMessage(data)
+	if err != nil {
+		log.Printf("解码消息失败: %v", err)
+		if errors.Is(err, protocol.ErrUnsupportedVersion) && data[1] == protocol.MsgTypeHandshake {
+			rejectVersion(conn, remoteAddr, len(data), data[0], data[0], 0)
+		}
+		return
+	}
+
+	// 握手消息自带加密，其余消息使用会话密钥解密
+	switch msg.Type {
+	case protocol.MsgTypeHandshake:
+		handleHandshake(conn, remoteAddr, msg, discovery, sessions, security)
+		return
+	case protocol.MsgTypeCertificate:
+		handleCertificateRequest(conn, remoteAddr, msg, security)
+		return
+	}
+
+	proto, peer, err := peerProtocol(sessions, msg, security)
+	if err != nil {
+		log.Printf("拒绝来自 %s 的消息: %v", remoteAddr, err)
+		return
+	}
+
+	msg, err = proto.Decode(data)
+	if err != nil {
+		// 重放报文已由会话窗口计数，不逐条记录日志
+		if !errors.Is(err, crypto.ErrReplay) {
+			log.Printf("拒绝来自 %s 的消息: %v", remoteAddr, err)
+		}
+		return
+	}
+
+	// 通过认证后记录对端最新地址，支持客户端地址变化
+	var sender string
+	if peer != nil {
+		peer.SetEndpoint(remoteAddr)
+		sender = peer.NodeID
+	}
+
+	// 处理不同类型的消息
+	switch msg.Type {
+	case protocol.MsgTypeData:
+		handleData(conn, msg, sender, discovery, sessions, security)
+	case protocol.MsgTypeFrame:
+		handleFrame(conn, remoteAddr, msg, sender, discovery, sessions, security)
+	case protocol.MsgTypeKeepAlive:
+		handleKeepAlive(conn, remoteAddr, proto, msg, sender, discovery)
+	case protocol.MsgTypeRoute:
+		handleRoute(conn, remoteAddr, msg, sender, discovery, sessions, security)
+	case protocol.MsgTypeNAT:
+		handleNAT(conn, remoteAddr, proto, msg, sender, discovery, sessions, security)
+	default:
+		log.Printf("未知消息类型: %d", msg.Type)
+	}
+}
 
-		// 处理不同类型的消息
-		switch msg.Type {
-		case protocol.MsgTypeHandshake:
-			handleHandshake(conn, remoteAddr, msg, discovery)
-		case protocol.MsgTypeData:
-			handleData(conn, remoteAddr, msg, discovery, nat)
-		case protocol.MsgTypeKeepAlive:
-			handleKeepAlive(conn, remoteAddr, msg, discovery)
-		case protocol.MsgTypeRoute:
-			handleRoute(conn, remoteAddr, msg, discovery)
-		case protocol.MsgTypeNAT:
-			handleNAT(conn, remoteAddr, msg, nat)
-		default:
-			log.Printf("未知消息类型: %d", msg.Type)
+// peerProtocol 根据消息头中的会话索引返回对端及其协议处理器
+func peerProtocol(sessions *protocol.SessionTable, msg *protocol.Message, security *securityOptions) (*protocol.Protocol, *protocol.Peer, error) {
+	if !security.encryption {
+		// 明文模式不保存会话，逐条检查消息版本
+		if !protocol.IsSupportedVersion(msg.Version) {
+			return nil, nil, fmt.Errorf("%w: %d", protocol.ErrUnsupportedVersion, msg.Version)
 		}
+		return protocol.NewProtocol(nil, msg.Version, 0, 0), nil, nil
+	}
+	if msg.Flags&protocol.FlagEncrypted == 0 {
+		return nil, nil, protocol.ErrUnencryptedMessage
+	}
+
+	peer := sessions.ByIndex(msg.Index)
+	if peer == nil {
+		return nil, nil, fmt.Errorf("未知的会话索引 %d", msg.Index)
 	}
+	return peer.Protocol(), peer, nil
 }
 
-func handleHandshake(conn *net.UDPConn, remoteAddr *net.UDPAddr, msg *protocol.Message, discovery *network.Discovery) {
+// nodeProtocol 返回向节点发送消息使用的协议处理器和地址
+func nodeProtocol(sessions *protocol.SessionTable, node *network.Node, security *securityOptions) (*protocol.Protocol, *net.UDPAddr, error) {
+	if !security.encryption {
+		return protocol.NewProtocol(nil, node.Version, 0, 0), &net.UDPAddr{
+			IP:   node.PublicIP,
+			Port: int(node.PublicPort),
+		}, nil
+	}
+
+	peer := sessions.ByNode(node.ID)
+	if peer == nil || peer.Endpoint() == nil {
+		return nil, nil, errors.New("节点没有可用的会话")
+	}
+	return peer.Protocol(), peer.Endpoint(), nil
+}
+
+func handleHandshake(conn udpWriter, remoteAddr *net.UDPAddr, msg *protocol.Message, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	noise := msg.Flags&protocol.FlagEncrypted != 0
+
+	// 双方加密设置不一致时以明文返回错误，便于对端定位问题；请求短于响应时不回复
+	if noise != security.encryption {
+		reason := protocol.ErrUnexpectedEncryption
+		if security.encryption {
+			reason = protocol.ErrUnencryptedMessage
+		}
+		log.Printf("拒绝握手 %s: %v", remoteAddr, reason)
+		replyVersion := protocol.HandshakeReplyVersion(msg.Version)
+		if reply, err := protocol.MarshalHandshake(replyVersion, &protocol.HandshakeResponse{
+			Status: protocol.HandshakeStatusError,
+			Error:  reason.Error(),
+		}); err == nil {
+			sendRejection(conn, remoteAddr, protocol.HeaderSize+len(msg.Data), replyVersion, reply)
+		}
+		return
+	}
+
+	if !security.encryption {
+		handlePlainHandshake(conn, remoteAddr, msg, discovery, security)
+		return
+	}
+
+	hs := crypto.NewResponderHandshake(security.static)
+	payload, err := hs.ReadMessage(msg.Data)
+	if err != nil {
+		log.Printf("握手认证失败 %s: %v", remoteAddr, err)
+		return
+	}
+
+	// 版本协商之前的拒绝响应按对端消息头选择编码，版本 3 及以上的对端总能解析 TLV
+	replyVersion := protocol.HandshakeReplyVersion(msg.Version)
 	var handshake protocol.HandshakeMessage
-	if err := json.Unmarshal(msg.Data, &handshake); err != nil {
+	if err := protocol.UnmarshalHandshake(msg.Version, payload, &handshake); err != nil {
 		log.Printf("解析握手消息失败: %v", err)
+		if errors.Is(err, protocol.ErrUnsupportedVersion) {
+			reason := protocol.VersionErrorText(msg.Version, msg.Version)
+			if reply, err := writeHandshakeResponse(hs, replyVersion, versionErrorResponse(reason)); err == nil {
+				sendHandshakeMessage(conn, remoteAddr, replyVersion, protocol.FlagEncrypted, reply)
+			}
+		}
+		return
+	}
+
+	// 只接受持有有效证书或已授权的节点，证书状态尚在查询时让节点稍后重试
+	identity, err := authorizeNode(security, hs.RemoteStatic(), &handshake)
+	if err != nil {
+		log.Printf("拒绝握手 %s (%s): %v", remoteAddr, crypto.NodeID(hs.RemoteStatic()), err)
+		status := protocol.HandshakeStatusError
+		if errors.Is(err, auth.ErrOCSPPending) {
+			status = protocol.HandshakeStatusRetry
+		}
+		if reply, err := writeHandshakeResponse(hs, replyVersion, &protocol.HandshakeResponse{
+			Status: status,
+			Error:  err.Error(),
+		}); err == nil {
+			sendHandshakeMessage(conn, remoteAddr, replyVersion, protocol.FlagEncrypted, reply)
+		}
+		return
+	}
+
+	// 拒绝重放的握手消息，时间戳在握手被接受后才记录
+	if err := sessions.CheckTimestamp(hs.RemoteStatic(), handshake.Timestamp); err != nil {
+		log.Printf("拒绝握手 %s: %v", remoteAddr, err)
 		return
 	}
 
-	// 创建新节点
-	node := &network.Node{
-		ID:          handshake.NodeID,
-		PublicIP:    handshake.PublicIP,
-		PublicPort:  handshake.PublicPort,
-		PrivateIP:   handshake.PrivateIP,
-		PrivatePort: handshake.PrivatePort,
-		LastSeen:    time.Now(),
+	// 节点 ID 由已认证的静态公钥派生，不信任对端自报的 ID
+	if nodeID := crypto.NodeID(hs.RemoteStatic()); handshake.NodeID != nodeID {
+		log.Printf("节点 %s 自报 ID %q 与公钥不符，使用 %s", remoteAddr, handshake.NodeID, nodeID)
+		handshake.NodeID = nodeID
+	}
+
+	// 选择双方都支持的最高协议版本
+	version, err := protocol.NegotiateVersion(handshake.MinVersion, handshake.MaxVersion, msg.Version)
+	if err != nil {
+		reason := protocol.VersionErrorText(handshake.MinVersion, handshake.MaxVersion)
+		log.Printf("拒绝握手 %s: %s", remoteAddr, reason)
+		if reply, err := writeHandshakeResponse(hs, replyVersion, versionErrorResponse(reason)); err == nil {
+			sendHandshakeMessage(conn, remoteAddr, replyVersion, protocol.FlagEncrypted, reply)
+		}
+		return
 	}
 
-	// 添加或更新节点
+	// 按客户端优先级协商双方都允许的加密算法
+	algorithm, err := crypto.NegotiateAlgorithm(handshake.Algorithms, security.allowed)
+	if err != nil {
+		log.Printf("拒绝握手 %s: %v (客户端提供 %v)", remoteAddr, err, handshake.Algorithms)
+		if reply, err := writeHandshakeResponse(hs, version, &protocol.HandshakeResponse{
+			Status: protocol.HandshakeStatusError,
+			Error:  err.Error(),
+		}); err == nil {
+			sendHandshakeMessage(conn, remoteAddr, version, protocol.FlagEncrypted, reply)
+		}
+		return
+	}
+
+	if err := checkMode(security, &handshake); err != nil {
+		log.Printf("拒绝握手 %s (%s): %v", remoteAddr, handshake.NodeID, err)
+		if reply, err := writeHandshakeResponse(hs, version, &protocol.HandshakeResponse{
+			Status: protocol.HandshakeStatusError,
+			Error:  err.Error(),
+		}); err == nil {
+			sendHandshakeMessage(conn, remoteAddr, version, protocol.FlagEncrypted, reply)
+		}
+		return
+	}
+
+	// 分配虚拟地址，节点的虚拟地址不能与其他节点冲突
+	node := newNode(&handshake, version, remoteAddr)
+	if identity != nil {
+		node.Name = identity.Name
+		node.Groups = identity.Groups
+		node.VirtualIPs = identity.IPs
+	}
+	addresses, err := assignAddresses(security.ipam, node)
+	if err == nil {
+		err = checkAddresses(discovery, node)
+	}
+	if err != nil {
+		log.Printf("拒绝握手 %s (%s): %v", remoteAddr, handshake.NodeID, err)
+		if reply, err := writeHandshakeResponse(hs, version, &protocol.HandshakeResponse{
+			Status: protocol.HandshakeStatusError,
+			Error:  err.Error(),
+		}); err == nil {
+			sendHandshakeMessage(conn, remoteAddr, version, protocol.FlagEncrypted, reply)
+		}
+		return
+	}
+
+	// 同一节点使用相同会话索引和协议版本重新握手时轮换密钥，否则建立新会话
+	peer := sessions.ByStatic(hs.RemoteStatic())
+	rekey := peer != nil && peer.RemoteIndex == handshake.SenderIndex && peer.Version == version
+	if !rekey {
+		peer = &protocol.Peer{
+			RemoteIndex:  handshake.SenderIndex,
+			NodeID:       handshake.NodeID,
+			Static:       hs.RemoteStatic(),
+			Keys:         crypto.NewKeyRing(security.policy),
+			Version:      version,
+			Capabilities: handshake.Capabilities & protocol.LocalCapabilities,
+		}
+		if err := sessions.Add(peer); err != nil {
+			log.Printf("分配会话索引失败: %v", err)
+			return
+		}
+	}
+
+	// 生成握手响应并派生会话密钥
+	response := &protocol.HandshakeResponse{
+		Status:       protocol.HandshakeStatusOK,
+		Algorithm:    algorithm,
+		SenderIndex:  peer.Index,
+		Version:      peer.Version,
+		Capabilities: peer.Capabilities,
+	}
+	setAssignedAddresses(response, security.ipam, addresses)
+	reply, err := writeHandshakeResponse(hs, peer.Version, response)
+	if err != nil {
+		log.Printf("生成握手响应失败: %v", err)
+		if !rekey {
+			sessions.Remove(peer)
+		}
+		return
+	}
+
+	session, err := hs.Split(algorithm)
+	if err != nil {
+		log.Printf("派生会话密钥失败: %v", err)
+		if !rekey {
+			sessions.Remove(peer)
+		}
+		return
+	}
+	session.Epoch = handshake.Epoch
+
+	// 重新握手时暂存新密钥，待客户端切换后再用于发送
+	if rekey {
+		peer.Keys.Stage(session)
+		log.Printf("节点 %s 密钥轮换，代数 %d", handshake.NodeID, session.Epoch)
+	} else {
+		peer.Keys.Install(session)
+		log.Printf("节点 %s 握手完成，协议版本 %d，能力 %#x，加密算法 %s，会话索引 %d，NAT 类型 %s",
+			handshake.NodeID, peer.Version, peer.Capabilities, algorithm, peer.Index, stun.NATType(handshake.NATType))
+	}
+	sessions.RecordTimestamp(peer.Static, handshake.Timestamp)
+	peer.SetEndpoint(remoteAddr)
+
+	// 添加或更新节点。轮换密钥时保留节点通告的路由；新会话的节点须重新通告，原有路由通知其他节点撤销
+	previousRoutes := discovery.GetRoutes(node.ID)
+	if rekey {
+		node.Routes = previousRoutes
+	}
 	discovery.AddNode(node)
 
 	// 发送响应
-	response := &protocol.Message{
-		Version: protocol.ProtocolVersion,
-		Type:    protocol.MsgTypeHandshake,
-		Data:    []byte("OK"),
+	sendHandshakeMessage(conn, remoteAddr, peer.Version, protocol.FlagEncrypted, reply)
+
+	// 新会话建立后推送其他节点通告的路由
+	if !rekey {
+		if len(previousRoutes) > 0 {
+			pushRoutes(conn, sessions, previousRoutes, true)
+		}
+		sendNodeRoutes(conn, remoteAddr, peer.Protocol(), discovery, node.ID)
 	}
 
-	data, err := response.Encode()
+	// 新会话建立后告知节点已吊销的节点，离线期间发生的吊销也能生效
+	if !rekey && security.revoked != nil {
+		var nodeIDs []string
+		for _, revoked := range security.revoked.Nodes() {
+			nodeIDs = append(nodeIDs, revoked.NodeID)
+		}
+		sendRevocations(conn, remoteAddr, peer.Protocol(), nodeIDs)
+	}
+}
+
+// authorizeNode 检查握手发起方的身份。已吊销的节点一律拒绝；携带证书的节点必须通过 CA 校验，证书主题映射为节点名称和组；
+// 未携带证书的节点由授权表检查，未授权节点可出示预授权密钥完成登记
+func authorizeNode(security *securityOptions, public [crypto.KeySize]byte, handshake *protocol.HandshakeMessage) (*auth.Identity, error) {
+	if security.revoked != nil && security.revoked.IsRevoked(crypto.NodeID(public)) {
+		return nil, auth.ErrNodeRevoked
+	}
+	if len(handshake.Certificate) > 0 {
+		if security.verifier == nil {
+			return nil, errors.New("服务器未配置 CA，无法校验证书")
+		}
+		identity, err := security.verifier.VerifyNode(handshake.Certificate, public)
+		if err != nil {
+			return nil, fmt.Errorf("证书校验失败: %w", err)
+		}
+		log.Printf("节点 %s 证书校验通过，名称 %s，组 %v，虚拟 IP %v", crypto.NodeID(public), identity.Name, identity.Groups, identity.IPs)
+		return identity, nil
+	}
+
+	if security.registry == nil {
+		return nil, nil
+	}
+	enrolled, err := security.registry.Authorize(public, handshake.PreAuthKey)
 	if err != nil {
-		log.Printf("编码响应失败: %v", err)
+		return nil, err
+	}
+	if enrolled {
+		log.Printf("节点 %s 使用预授权密钥完成登记", crypto.NodeID(public))
+	}
+	return nil, nil
+}
+
+// handleCertificateRequest 以明文返回服务器证书，供只配置了 CA 的客户端获取并校验服务器公钥
+func handleCertificateRequest(conn udpWriter, remoteAddr *net.UDPAddr, msg *protocol.Message, security *securityOptions) {
+	if security.cert == nil {
+		return
+	}
+	// 请求不短于响应时才回复，避免被用于反射放大攻击
+	if len(msg.Data) < len(security.cert.DER) {
+		log.Printf("忽略来自 %s 的证书请求: 请求过短", remoteAddr)
 		return
 	}
 
-	_, err = conn.WriteToUDP(data, remoteAddr)
+	data, err := (&protocol.Message{
+		Version: protocol.MinProtocolVersion,
+		Type:    protocol.MsgTypeCertificate,
+		Data:    security.cert.DER,
+	}).Encode()
 	if err != nil {
-		log.Printf("发送响应失败: %v", err)
+		log.Printf("编码证书失败: %v", err)
+		return
+	}
+	if _, err := conn.WriteToUDP(data, remoteAddr); err != nil {
+		log.Printf("发送证书失败: %v", err)
 	}
 }
 
-func handleData(conn *net.UDPConn, remoteAddr *net.UDPAddr, msg *protocol.Message, discovery *network.Discovery, nat *network.NATTraversal) {
-	// 查找目标节点
-	route := discovery.FindRoute(string(msg.Data[:4]))
-	if route == nil {
-		log.Printf("未找到路由: %s", string(msg.Data[:4]))
+// handlePlainHandshake 处理未启用加密时的明文握手
+func handlePlainHandshake(conn udpWriter, remoteAddr *net.UDPAddr, msg *protocol.Message, discovery *network.Discovery, security *securityOptions) {
+	var handshake protocol.HandshakeMessage
+	if err := protocol.UnmarshalHandshake(msg.Version, msg.Data, &handshake); err != nil {
+		log.Printf("解析握手消息失败: %v", err)
+		if errors.Is(err, protocol.ErrUnsupportedVersion) {
+			rejectVersion(conn, remoteAddr, protocol.HeaderSize+len(msg.Data), 0, 0, msg.Version)
+		}
 		return
 	}
 
-	// 获取目标节点信息
-	targetNode := discovery.GetNode(route.NextHop)
-	if targetNode == nil {
-		log.Printf("未找到目标节点: %s", route.NextHop)
+	version, err := protocol.NegotiateVersion(handshake.MinVersion, handshake.MaxVersion, msg.Version)
+	if err != nil {
+		rejectVersion(conn, remoteAddr, protocol.HeaderSize+len(msg.Data), handshake.MinVersion, handshake.MaxVersion, msg.Version)
 		return
 	}
 
-	// 尝试直接发送
-	_, err := conn.WriteToUDP(msg.Data, &net.UDPAddr{
-		IP:   targetNode.PublicIP,
-		Port: int(targetNode.PublicPort),
-	})
+	node := newNode(&handshake, version, remoteAddr)
+	var addresses []net.IP
+	if err = checkMode(security, &handshake); err == nil {
+		addresses, err = assignAddresses(security.ipam, node)
+	}
+	if err != nil {
+		log.Printf("拒绝握手 %s (%s): %v", remoteAddr, handshake.NodeID, err)
+		if reply, err := protocol.MarshalHandshake(version, &protocol.HandshakeResponse{
+			Status: protocol.HandshakeStatusError,
+			Error:  err.Error(),
+		}); err == nil {
+			sendHandshakeMessage(conn, remoteAddr, version, 0, reply)
+		}
+		return
+	}
+	discovery.AddNode(node)
+	log.Printf("节点 %s 握手完成（明文），协议版本 %d，NAT 类型 %s", handshake.NodeID, version, stun.NATType(handshake.NATType))
 
-	// 如果直接发送失败，使用 NAT 穿透
+	response := &protocol.HandshakeResponse{
+		Status:       protocol.HandshakeStatusOK,
+		Version:      version,
+		Capabilities: handshake.Capabilities & protocol.LocalCapabilities,
+	}
+	setAssignedAddresses(response, security.ipam, addresses)
+	reply, err := protocol.MarshalHandshake(version, response)
 	if err != nil {
-		err = nat.SendData(targetNode.ID, msg.Data)
-		if err != nil {
-			log.Printf("发送数据失败: %v", err)
+		log.Printf("编码响应失败: %v", err)
+		return
+	}
+	sendHandshakeMessage(conn, remoteAddr, version, 0, reply)
+}
+
+// rejectVersion 以明文拒绝协议版本不兼容的握手，并告知服务器支持的版本范围。
+// 未声明版本范围的旧节点以其消息头中的版本 header 计，requestSize 为请求报文的长度。
+// 以版本 2 发起握手的旧节点收到 JSON 编码的拒绝响应，其余对端收到与版本无关的 TLV 编码。
+func rejectVersion(conn udpWriter, remoteAddr *net.UDPAddr, requestSize int, min, max, header uint8) {
+	if min == 0 && max == 0 {
+		min, max = header, header
+	}
+	reason := protocol.VersionErrorText(min, max)
+	log.Printf("拒绝握手 %s: %s", remoteAddr, reason)
+
+	version := protocol.HandshakeReplyVersion(header)
+	reply, err := protocol.MarshalHandshake(version, versionErrorResponse(reason))
+	if err != nil {
+		log.Printf("编码响应失败: %v", err)
+		return
+	}
+	sendRejection(conn, remoteAddr, requestSize, version, reply)
+}
+
+// sendRejection 以明文发送未经认证的握手拒绝响应。响应报文比长度为 requestSize 的请求长时不回复，
+// 避免伪造源地址的短报文被用于反射放大攻击
+func sendRejection(conn udpWriter, remoteAddr *net.UDPAddr, requestSize int, version uint8, reply []byte) {
+	if protocol.HeaderSize+len(reply) > requestSize {
+		log.Printf("不回复 %s 的握手: 请求短于拒绝响应", remoteAddr)
+		return
+	}
+	sendHandshakeMessage(conn, remoteAddr, version, 0, reply)
+}
+
+// versionErrorResponse 构建版本不兼容的握手响应
+func versionErrorResponse(reason string) *protocol.HandshakeResponse {
+	return &protocol.HandshakeResponse{
+		Status:     protocol.HandshakeStatusError,
+		MinVersion: protocol.MinProtocolVersion,
+		MaxVersion: protocol.MaxProtocolVersion,
+		Error:      reason,
+	}
+}
+
+// newNode 根据握手消息和协商出的协议版本创建节点。节点的公网地址取服务器观察到的握手来源地址，
+// 节点自报的地址在 NAT 之后通常不可达
+func newNode(handshake *protocol.HandshakeMessage, version uint8, remoteAddr *net.UDPAddr) *network.Node {
+	return &network.Node{
+		ID:           handshake.NodeID,
+		PublicIP:     remoteAddr.IP,
+		PublicPort:   uint16(remoteAddr.Port),
+		PrivateIP:    handshake.PrivateIP,
+		PrivateIP6:   handshake.PrivateIP6,
+		PrivatePort:  handshake.PrivatePort,
+		LocalIP:      handshake.LocalIP,
+		GlobalIP6:    globalIP6(handshake.GlobalIP6),
+		Version:      version,
+		Capabilities: handshake.Capabilities & protocol.LocalCapabilities,
+		NATType:      stun.NATType(handshake.NATType),
+		PortStep:     int(handshake.PortStep),
+		Relayed:      relayedAddr(handshake),
+		LastSeen:     time.Now(),
+	}
+}
+
+// relayedAddr 返回节点自报的 TURN 中继地址，未携带或不完整时返回 nil
+func relayedAddr(handshake *protocol.HandshakeMessage) *net.UDPAddr {
+	if handshake.RelayedIP == nil || handshake.RelayedIP.IsUnspecified() || handshake.RelayedPort == 0 {
+		return nil
+	}
+	return &net.UDPAddr{IP: handshake.RelayedIP, Port: int(handshake.RelayedPort)}
+}
+
+// globalIP6 返回节点自报的全局 IPv6 地址，不是全局单播地址时返回 nil
+func globalIP6(ip net.IP) net.IP {
+	if ip.To4() != nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+	return ip
+}
+
+// assignAddresses 从虚拟网段为节点各分配一个地址并作为节点的自身地址，同一节点总是得到相同的地址，
+// 节点自报的地址可用时优先分配。返回的地址与网段顺序相同，双栈时第二个地址作为节点的 IPv6 地址。
+// 证书中声明了虚拟 IP 的节点使用证书中的地址，此时及未配置地址分配时返回 nil
+func assignAddresses(allocator *ipam.Allocator, node *network.Node) ([]net.IP, error) {
+	if allocator == nil || len(node.VirtualIPs) > 0 {
+		return nil, nil
+	}
+	ips, err := allocator.Allocate(node.ID, []net.IP{node.PrivateIP, node.PrivateIP6})
+	if err != nil {
+		return nil, fmt.Errorf("分配虚拟地址失败: %w", err)
+	}
+	if !ips[0].Equal(node.PrivateIP) || (len(ips) > 1 && !ips[1].Equal(node.PrivateIP6)) {
+		log.Printf("为节点 %s 分配虚拟地址 %v", node.ID, ips)
+	}
+	node.PrivateIP, node.PrivateIP6 = ips[0], nil
+	if len(ips) > 1 {
+		node.PrivateIP6 = ips[1]
+	}
+	return ips, nil
+}
+
+// setAssignedAddresses 在握手响应中写入分配的地址及其网段的前缀长度
+func setAssignedAddresses(response *protocol.HandshakeResponse, allocator *ipam.Allocator, ips []net.IP) {
+	if len(ips) == 0 {
+		return
+	}
+	subnets := allocator.Subnets()
+	ones, _ := subnets[0].Mask.Size()
+	response.Address, response.PrefixLength = ips[0], uint8(ones)
+	if len(ips) > 1 {
+		ones, _ = subnets[1].Mask.Size()
+		response.Address6, response.PrefixLength6 = ips[1], uint8(ones)
+	}
+}
+
+// checkAddresses 检查节点的虚拟地址是否已被其他节点使用
+func checkAddresses(discovery *network.Discovery, node *network.Node) error {
+	for _, address := range node.Addresses() {
+		if owner := discovery.AddressOwner(address); owner != nil && owner.ID != node.ID {
+			return fmt.Errorf("地址 %s 已被节点 %s 使用", address, owner.ID)
 		}
 	}
+	return nil
 }
 
-func handleKeepAlive(conn *net.UDPConn, remoteAddr *net.UDPAddr, msg *protocol.Message, discovery *network.Discovery) {
-	// 更新节点最后可见时间
-	node := discovery.GetNode(string(msg.Data))
-	if node != nil {
-		node.LastSeen = time.Now()
+// writeHandshakeResponse 按协议版本编码握手响应并写入 Noise 握手第二条消息
+func writeHandshakeResponse(hs *crypto.Handshake, version uint8, resp *protocol.HandshakeResponse) ([]byte, error) {
+	payload, err := protocol.MarshalHandshake(version, resp)
+	if err != nil {
+		return nil, err
 	}
+	return hs.WriteMessage(payload)
+}
 
-	// 发送响应
+// sendHandshakeMessage 发送握手响应，握手消息本身已由 Noise 保护，不再经过会话加密
+func sendHandshakeMessage(conn udpWriter, remoteAddr *net.UDPAddr, version, flags uint8, payload []byte) {
 	response := &protocol.Message{
-		Version: protocol.ProtocolVersion,
-		Type:    protocol.MsgTypeKeepAlive,
-		Data:    []byte("OK"),
+		Version: version,
+		Type:    protocol.MsgTypeHandshake,
+		Flags:   flags,
+		Data:    payload,
 	}
 
 	data, err := response.Encode()
@@ -193,28 +817,14 @@ func handleKeepAlive(conn *net.UDPConn, remoteAddr *net.UDPAddr, msg *protocol.M
 	}
 }
 
-func handleRoute(conn *net.UDPConn, remoteAddr *net.UDPAddr, msg *protocol.Message, discovery *network.Discovery) {
-	var route protocol.RouteMessage
-	if err := json.Unmarshal(msg.Data, &route); err != nil {
-		log.Printf("解析路由消息失败: %v", err)
-		return
-	}
-
-	// 添加路由
-	discovery.AddRoute(string(msg.Data[:4]), network.Route{
-		Destination: route.Destination,
-		NextHop:     route.NextHop,
-		Metric:      route.Metric,
-	})
-
-	// 发送响应
+// sendMessage 使用对端会话编码并发送一条消息
+func sendMessage(conn udpWriter, remoteAddr *net.UDPAddr, proto *protocol.Protocol, msgType uint8, payload []byte) {
 	response := &protocol.Message{
-		Version: protocol.ProtocolVersion,
-		Type:    protocol.MsgTypeRoute,
-		Data:    []byte("OK"),
+		Type: msgType,
+		Data: payload,
 	}
 
-	data, err := response.Encode()
+	data, err := proto.Encode(response)
 	if err != nil {
 		log.Printf("编码响应失败: %v", err)
 		return
@@ -226,35 +836,186 @@ func handleRoute(conn *net.UDPConn, remoteAddr *net.UDPAddr, msg *protocol.Messa
 	}
 }
 
-func handleNAT(conn *net.UDPConn, remoteAddr *net.UDPAddr, msg *protocol.Message, nat *network.NATTraversal) {
-	var natMsg protocol.NATMessage
-	if err := json.Unmarshal(msg.Data, &natMsg); err != nil {
-		log.Printf("解析 NAT 消息失败: %v", err)
+// handleData 转发数据消息：解析内层 IP 包的目的地址，找到拥有该地址的节点，
+// 以目标节点的会话重新封装后发送。sender 为通过认证的发送节点，明文模式下为空
+func handleData(conn udpWriter, msg *protocol.Message, sender string, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	packet, err := network.ParsePacket(msg.Data)
+	if err != nil {
+		log.Printf("丢弃无效的数据包: %v", err)
 		return
 	}
 
-	// 创建中继连接
-	err := nat.CreateRelayConnection(natMsg.TargetID, natMsg.TargetIP, natMsg.TargetPort)
+	// 节点只能以自己的地址或所通告网段内的地址发送，防止伪造源地址
+	source := discovery.FindNode(packet.Source)
+	if sender != "" && (source == nil || source.ID != sender) {
+		log.Printf("丢弃节点 %s 发送的数据包: 源地址 %s 不属于该节点", sender, packet.Source)
+		return
+	}
+
+	// 查找目标节点
+	targetNode := discovery.FindNode(packet.Destination)
+	if targetNode == nil {
+		log.Printf("未找到路由: %s", packet.Destination)
+		return
+	}
+	if targetNode.ID == sender {
+		return
+	}
+
+	// 使用目标节点的会话重新加密
+	targetProto, targetAddr, err := nodeProtocol(sessions, targetNode, security)
 	if err != nil {
-		log.Printf("创建中继连接失败: %v", err)
+		log.Printf("无法转发到节点 %s: %v", targetNode.ID, err)
 		return
 	}
 
+	data, err := targetProto.Encode(&protocol.Message{
+		Type: protocol.MsgTypeData,
+		Data: msg.Data,
+	})
+	if err != nil {
+		log.Printf("编码数据消息失败: %v", err)
+		return
+	}
+
+	if _, err := conn.WriteToUDP(data, targetAddr); err != nil {
+		log.Printf("发送数据失败: %v", err)
+		return
+	}
+
+	// 经服务器中转的双方互相介绍，此后尝试打洞直连
+	if source != nil {
+		introduceNodes(conn, source, targetNode, discovery, sessions, security)
+	}
+}
+
+// handleKeepAlive 处理保活消息，sender 为通过认证的发送节点，明文模式下以消息中的节点 ID 计
+func handleKeepAlive(conn udpWriter, remoteAddr *net.UDPAddr, proto *protocol.Protocol, msg *protocol.Message, sender string, discovery *network.Discovery) {
+	if sender == "" {
+		sender = string(msg.Data)
+	}
+
+	// 更新节点最后可见时间
+	if !discovery.Touch(sender) {
+		log.Printf("收到未知节点 %q 的保活消息", sender)
+	}
+
 	// 发送响应
-	response := &protocol.Message{
-		Version: protocol.ProtocolVersion,
-		Type:    protocol.MsgTypeNAT,
-		Data:    []byte("OK"),
+	sendMessage(conn, remoteAddr, proto, protocol.MsgTypeKeepAlive, []byte("OK"))
+}
+
+// handleRoute 处理节点通告的路由，sender 为通过认证的发送节点。
+// 明文模式下无法认证发送方，不接受路由通告
+func handleRoute(conn udpWriter, remoteAddr *net.UDPAddr, msg *protocol.Message, sender string, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	if sender == "" {
+		log.Printf("忽略来自 %s 的路由通告: 无法认证发送方", remoteAddr)
+		return
 	}
 
-	data, err := response.Encode()
+	var route protocol.RouteMessage
+	if err := protocol.UnmarshalControl(msg.Version, msg.Data, &route); err != nil {
+		log.Printf("解析路由消息失败: %v", err)
+		return
+	}
+
+	destination, err := checkRoute(&route, sender, discovery, security.ipam)
 	if err != nil {
-		log.Printf("编码响应失败: %v", err)
+		log.Printf("拒绝节点 %s 的路由 %q: %v", sender, route.Destination, err)
 		return
 	}
 
-	_, err = conn.WriteToUDP(data, remoteAddr)
+	// 路由归属于通告它的节点，下一跳即该节点，重复通告同一目的地址时替换原路由
+	accepted := network.Route{
+		Destination: destination.String(),
+		NextHop:     sender,
+		Metric:      route.Metric,
+	}
+	discovery.AddRoute(sender, accepted)
+
+	// 推送给所有节点，通告路由的节点收到推送即确认路由已被接受
+	pushRoutes(conn, sessions, []network.Route{accepted}, false)
+}
+
+// checkRoute 校验节点 sender 通告的路由并返回目的网段：下一跳只能是节点自身，
+// 目的网段不得与虚拟地址网段或其他节点的虚拟地址重叠，避免劫持发往其他节点的流量
+func checkRoute(route *protocol.RouteMessage, sender string, discovery *network.Discovery, allocator *ipam.Allocator) (*net.IPNet, error) {
+	if route.NextHop != "" && route.NextHop != sender {
+		return nil, fmt.Errorf("下一跳 %q 不是通告路由的节点", route.NextHop)
+	}
+	destination, err := network.ParseRoute(route.Destination)
 	if err != nil {
-		log.Printf("发送响应失败: %v", err)
+		return nil, err
+	}
+	if allocator != nil {
+		for _, subnet := range allocator.Subnets() {
+			if subnet.Contains(destination.IP) || destination.Contains(subnet.IP) {
+				return nil, fmt.Errorf("与虚拟地址网段 %s 重叠", subnet)
+			}
+		}
+	}
+	for _, node := range discovery.GetNodes() {
+		if node.ID == sender {
+			continue
+		}
+		for _, address := range node.Addresses() {
+			if destination.Contains(address) {
+				return nil, fmt.Errorf("包含节点 %s 的虚拟地址 %s", node.ID, address)
+			}
+		}
+	}
+	return destination, nil
+}
+
+// handleNAT 处理节点经中继服务与目标节点通信的请求，为双方各签发一张票据。
+// sender 为通过认证的发送节点，明文模式无法认证发送方，不签发票据
+func handleNAT(conn udpWriter, remoteAddr *net.UDPAddr, proto *protocol.Protocol, msg *protocol.Message, sender string, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	var natMsg protocol.NATMessage
+	if err := protocol.UnmarshalControl(msg.Version, msg.Data, &natMsg); err != nil {
+		log.Printf("解析 NAT 消息失败: %v", err)
+		return
+	}
+	if security.relaySecret == nil || sender == "" {
+		log.Printf("拒绝中继请求: 未启用中继服务或无法认证节点")
+		return
+	}
+	node, target := discovery.GetNode(sender), discovery.GetNode(natMsg.TargetID)
+	if node == nil || target == nil || target.ID == sender || target.Capabilities&protocol.CapRelay == 0 {
+		log.Printf("拒绝节点 %s 的中继请求: 节点 %q 不存在或不支持中继", sender, natMsg.TargetID)
+		return
+	}
+
+	sendRelayTicket(conn, remoteAddr, proto, node, target, security)
+	if targetProto, targetAddr, err := nodeProtocol(sessions, target, security); err == nil {
+		sendRelayTicket(conn, targetAddr, targetProto, target, node, security)
+	} else {
+		log.Printf("无法向节点 %s 发送中继票据: %v", target.ID, err)
+	}
+}
+
+// sendRelayTicket 向节点 to 发送经中继服务与节点 peer 通信的票据
+func sendRelayTicket(conn udpWriter, remoteAddr *net.UDPAddr, proto *protocol.Protocol, to, peer *network.Node, security *securityOptions) {
+	ticket, key := issueRelayTicket(security, to.ID, peer.ID)
+	payload, err := protocol.MarshalControl(proto.Version(), &protocol.NATMessage{
+		TargetID:    peer.ID,
+		TargetIP:    peer.PublicIP,
+		TargetPort:  peer.PublicPort,
+		RelayServer: security.relayServer,
+		RelayPort:   security.relayPort,
+		RelayTicket: ticket,
+		RelayKey:    key,
+	})
+	if err != nil {
+		log.Printf("编码 NAT 消息失败: %v", err)
+		return
 	}
+	sendMessage(conn, remoteAddr, proto, protocol.MsgTypeNAT, payload)
+}
+
+// issueRelayTicket 签发节点 nodeID 经中继服务与节点 peerID 通信的票据
+func issueRelayTicket(security *securityOptions, nodeID, peerID string) (ticket, key []byte) {
+	return relay.IssueTicket(security.relaySecret, relay.Ticket{
+		NodeID:  nodeID,
+		PeerID:  peerID,
+		Expires: time.Now().Add(security.relayTTL),
+	})
 }
@@ -0,0 +1,1325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/auth"
+	"github.com/fenghuilee/sd-wan/internal/config"
+	"github.com/fenghuilee/sd-wan/internal/ipam"
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/internal/relay"
+	"github.com/fenghuilee/sd-wan/internal/stun"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testServer 在回环地址上运行的服务器，client 是模拟客户端使用的套接字
+type testServer struct {
+	conn      *net.UDPConn
+	client    *net.UDPConn
+	discovery *network.Discovery
+	sessions  *protocol.SessionTable
+	security  *securityOptions
+}
+
+func listenLoopback(tb testing.TB) *net.UDPConn {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestServer(tb testing.TB, encryption bool) *testServer {
+	tb.Helper()
+	s := &testServer{
+		conn:      listenLoopback(tb),
+		client:    listenLoopback(tb),
+		discovery: network.NewDiscovery(time.Minute),
+		sessions:  protocol.NewSessionTable(),
+		security: &securityOptions{
+			encryption: encryption,
+			allowed:    crypto.SupportedAlgorithms(),
+			policy:     crypto.DefaultRekeyPolicy(),
+		},
+	}
+	if encryption {
+		static, err := crypto.GenerateKeyPair()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		s.security.static = static
+	}
+	return s
+}
+
+// handle 以模拟客户端的地址向服务器投递一个报文
+func (s *testServer) handle(data []byte) {
+	handlePacket(s.conn, s.client.LocalAddr().(*net.UDPAddr), data, s.discovery, s.sessions, s.security)
+}
+
+// receive 读取服务器发给模拟客户端的下一个报文
+func (s *testServer) receive(tb testing.TB) *protocol.Message {
+	tb.Helper()
+	buf := make([]byte, 1500)
+	s.client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := s.client.Read(buf)
+	if err != nil {
+		tb.Fatalf("no response from server: %v", err)
+	}
+	msg, err := protocol.DecodeMessage(buf[:n])
+	if err != nil {
+		tb.Fatalf("decode response: %v", err)
+	}
+	return msg
+}
+
+// expectNoReply 确认服务器没有向模拟客户端回复
+func (s *testServer) expectNoReply(tb testing.TB) {
+	tb.Helper()
+	s.client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := s.client.Read(make([]byte, 1500)); err == nil {
+		tb.Fatalf("unexpected %d-byte reply", n)
+	}
+}
+
+// connect 以客户端身份完成握手，返回与服务器通信使用的协议处理器和服务器记录的节点 ID
+func (s *testServer) connect(tb testing.TB) (*protocol.Protocol, string) {
+	tb.Helper()
+	return s.connectAt(tb, nil)
+}
+
+// connectAt 与 connect 相同，但在握手中上报节点的虚拟地址
+func (s *testServer) connectAt(tb testing.TB, privateIP net.IP) (*protocol.Protocol, string) {
+	tb.Helper()
+	static, err := crypto.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	handshake := &protocol.HandshakeMessage{
+		NodeID:       crypto.NodeID(static.Public),
+		Timestamp:    time.Now().UnixNano(),
+		PublicIP:     net.IPv4(127, 0, 0, 1),
+		PublicPort:   uint16(s.client.LocalAddr().(*net.UDPAddr).Port),
+		PrivateIP:    privateIP,
+		Algorithms:   crypto.SupportedAlgorithms(),
+		SenderIndex:  7,
+		MinVersion:   protocol.MinProtocolVersion,
+		MaxVersion:   protocol.MaxProtocolVersion,
+		Capabilities: protocol.LocalCapabilities,
+		Mode:         s.security.mode,
+	}
+	payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, handshake)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if !s.security.encryption {
+		s.handle(encodeFrame(tb, protocol.ProtocolVersion, protocol.MsgTypeHandshake, 0, payload))
+		response := s.receive(tb)
+		var result protocol.HandshakeResponse
+		if err := protocol.UnmarshalHandshake(response.Version, response.Data, &result); err != nil {
+			tb.Fatal(err)
+		}
+		return protocol.NewProtocol(nil, result.Version, 0, 0), handshake.NodeID
+	}
+
+	hs, result := s.noiseHandshake(tb, static, payload)
+	if result.Status != protocol.HandshakeStatusOK {
+		tb.Fatalf("handshake rejected: %s", result.Error)
+	}
+	session, err := hs.Split(result.Algorithm)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keys := crypto.NewKeyRing(s.security.policy)
+	keys.Install(session)
+	return protocol.NewProtocol(keys, result.Version, handshake.SenderIndex, result.SenderIndex), handshake.NodeID
+}
+
+// noiseHandshake 发送 Noise 握手并返回服务器的握手响应
+func (s *testServer) noiseHandshake(tb testing.TB, static *crypto.KeyPair, payload []byte) (*crypto.Handshake, *protocol.HandshakeResponse) {
+	tb.Helper()
+	hs := crypto.NewInitiatorHandshake(static, s.security.static.Public)
+	initiation, err := hs.WriteMessage(payload)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.handle(encodeFrame(tb, protocol.ProtocolVersion, protocol.MsgTypeHandshake, protocol.FlagEncrypted, initiation))
+
+	response := s.receive(tb)
+	reply, err := hs.ReadMessage(response.Data)
+	if err != nil {
+		tb.Fatalf("read handshake response: %v", err)
+	}
+	var result protocol.HandshakeResponse
+	if err := protocol.UnmarshalHandshake(response.Version, reply, &result); err != nil {
+		tb.Fatal(err)
+	}
+	return hs, &result
+}
+
+func encodeFrame(tb testing.TB, version, msgType, flags uint8, payload []byte) []byte {
+	tb.Helper()
+	data, err := (&protocol.Message{Version: version, Type: msgType, Flags: flags, Data: payload}).Encode()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// loadCaptures 读取真实运行时抓取的报文
+func loadCaptures(tb testing.TB) [][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("..", "..", "internal", "protocol", "testdata", "captures", "*.bin"))
+	if err != nil || len(files) == 0 {
+		tb.Fatalf("no captures found: %v", err)
+	}
+	var captures [][]byte
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		captures = append(captures, data)
+	}
+	return captures
+}
+
+// controlPayloads 各类会话消息的典型负载，包括曾导致越界的短负载
+func controlPayloads(tb testing.TB) map[uint8][][]byte {
+	tb.Helper()
+	route, err := (&protocol.RouteMessage{Destination: "10.1.0.0/24", NextHop: "node-test", Metric: 1}).MarshalBinary()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	nat, err := (&protocol.NATMessage{TargetID: "node-peer", TargetIP: net.IPv4(127, 0, 0, 1), TargetPort: 9}).MarshalBinary()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ipv4 := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0, 10, 9, 0, 2, 10, 9, 0, 7}
+	return map[uint8][][]byte{
+		protocol.MsgTypeData:      {nil, {1}, {1, 2, 3}, ipv4},
+		protocol.MsgTypeKeepAlive: {nil, []byte("node-test")},
+		protocol.MsgTypeRoute:     {nil, {1}, route},
+		protocol.MsgTypeNAT:       {nil, {2, 0}, nat},
+		0xff:                      {nil},
+	}
+}
+
+func TestShortPayloadsDoNotPanic(t *testing.T) {
+	for _, encryption := range []bool{false, true} {
+		s := newTestServer(t, encryption)
+		proto, _ := s.connect(t)
+		for msgType, payloads := range controlPayloads(t) {
+			for _, payload := range payloads {
+				data, err := proto.Encode(&protocol.Message{Type: msgType, Data: payload})
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.handle(data)
+			}
+		}
+	}
+}
+
+func TestRouteOwnedBySender(t *testing.T) {
+	s := newTestServer(t, true)
+	s.connectAt(t, net.IPv4(10, 7, 0, 2))
+	proto, nodeID := s.connect(t)
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/24")
+	allocator, err := ipam.New(filepath.Join(t.TempDir(), "ipam.json"), []*net.IPNet{subnet}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.security.ipam = allocator
+
+	announce := func(route *protocol.RouteMessage) {
+		t.Helper()
+		payload, err := protocol.MarshalControl(proto.Version(), route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Encode(&protocol.Message{Type: protocol.MsgTypeRoute, Data: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handle(data)
+	}
+
+	// 下一跳不是发送节点、目的地址无效、与虚拟地址网段或其他节点的虚拟地址重叠的路由被拒绝
+	announce(&protocol.RouteMessage{Destination: "10.1.0.0/24", NextHop: "node-other"})
+	announce(&protocol.RouteMessage{Destination: "not-a-prefix"})
+	announce(&protocol.RouteMessage{Destination: "10.9.0.128/25"})
+	announce(&protocol.RouteMessage{Destination: "10.0.0.0/8"})
+	announce(&protocol.RouteMessage{Destination: "10.7.0.2"})
+	if routes := s.discovery.GetRoutes(nodeID); len(routes) != 0 {
+		t.Fatalf("invalid routes accepted: %+v", routes)
+	}
+
+	// 重复通告同一目的地址时替换原路由
+	announce(&protocol.RouteMessage{Destination: "10.1.0.1/24", Metric: 5})
+	announce(&protocol.RouteMessage{Destination: "10.1.0.0/24", NextHop: nodeID, Metric: 2})
+	routes := s.discovery.GetRoutes(nodeID)
+	if len(routes) != 1 || routes[0] != (network.Route{Destination: "10.1.0.0/24", NextHop: nodeID, Metric: 2}) {
+		t.Fatalf("routes of sender: %+v", routes)
+	}
+}
+
+func TestPlainRouteIgnored(t *testing.T) {
+	s := newTestServer(t, false)
+	proto, nodeID := s.connect(t)
+	payload, err := protocol.MarshalControl(proto.Version(), &protocol.RouteMessage{Destination: "10.1.0.0/24", NextHop: nodeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := proto.Encode(&protocol.Message{Type: protocol.MsgTypeRoute, Data: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handle(data)
+	if routes := s.discovery.GetRoutes(nodeID); len(routes) != 0 {
+		t.Fatalf("plaintext route accepted: %+v", routes)
+	}
+}
+
+func TestRoutesPushedToAllNodes(t *testing.T) {
+	s := newTestServer(t, true)
+	alice, aliceID := s.connectAt(t, net.IPv4(10, 9, 0, 2))
+	bob, bobID := s.connectAt(t, net.IPv4(10, 9, 0, 3))
+	payload, err := protocol.MarshalControl(bob.Version(), &protocol.RouteMessage{Destination: "192.168.5.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := bob.Encode(&protocol.Message{Type: protocol.MsgTypeRoute, Data: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handle(data)
+
+	// 接受的路由推送给所有节点，不依赖节点之间的中继流量和介绍；通告路由的节点据此确认
+	added, withdrawn := []string{"192.168.5.0/24 via " + bobID}, []string{"withdraw 192.168.5.0/24 via " + bobID}
+	routes := s.collectRoutes(t, map[string]*protocol.Protocol{"alice": alice, "bob": bob})
+	if fmt.Sprint(routes["alice"]) != fmt.Sprint(added) || fmt.Sprint(routes["bob"]) != fmt.Sprint(added) {
+		t.Fatalf("pushed routes %v, want %v for both nodes", routes, added)
+	}
+
+	// 新上线的节点在握手后收到已有的路由
+	carol, _ := s.connectAt(t, net.IPv4(10, 9, 0, 4))
+	if routes := s.collectRoutes(t, map[string]*protocol.Protocol{"carol": carol}); fmt.Sprint(routes["carol"]) != fmt.Sprint(added) {
+		t.Fatalf("routes sent to a new node: %v", routes)
+	}
+
+	// 节点过期后其他节点收到撤销
+	s.discovery.GetNode(bobID).LastSeen = time.Now().Add(-time.Hour)
+	removeExpired(s.conn, s.discovery, s.sessions, time.Minute)
+	routes = s.collectRoutes(t, map[string]*protocol.Protocol{"alice": alice, "carol": carol})
+	if fmt.Sprint(routes["alice"]) != fmt.Sprint(withdrawn) || fmt.Sprint(routes["carol"]) != fmt.Sprint(withdrawn) {
+		t.Fatalf("withdrawn routes %v, want %v", routes, withdrawn)
+	}
+	if s.discovery.GetNode(aliceID) == nil || s.discovery.GetNode(bobID) != nil {
+		t.Fatal("wrong node expired")
+	}
+}
+
+func TestKeepAliveMatchesHandshakeNode(t *testing.T) {
+	for _, encryption := range []bool{false, true} {
+		s := newTestServer(t, encryption)
+		proto, nodeID := s.connect(t)
+		node := s.discovery.GetNode(nodeID)
+		if node == nil {
+			t.Fatalf("node %s not registered by handshake", nodeID)
+		}
+		node.LastSeen = time.Time{}
+
+		data, err := proto.Encode(&protocol.Message{Type: protocol.MsgTypeKeepAlive, Data: []byte(nodeID)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handle(data)
+		if s.discovery.GetNode(nodeID).LastSeen.IsZero() {
+			t.Errorf("encryption=%v: keepalive did not refresh node %s", encryption, nodeID)
+		}
+	}
+}
+
+func TestHandshakeNodeIDDerivedFromKey(t *testing.T) {
+	s := newTestServer(t, true)
+	_, nodeID := s.connect(t)
+	peer := s.sessions.ByNode(nodeID)
+	if peer == nil || crypto.NodeID(peer.Static) != nodeID {
+		t.Fatalf("session for %s not keyed by derived node ID", nodeID)
+	}
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	s := newTestServer(t, false)
+	tests := []struct {
+		name            string
+		header          uint8
+		min, max        uint8
+		status          string
+		responseVersion uint8
+	}{
+		{"current", protocol.ProtocolVersion, protocol.MinProtocolVersion, protocol.MaxProtocolVersion, protocol.HandshakeStatusOK, protocol.ProtocolVersion},
+		{"newer peer", protocol.MaxProtocolVersion + 1, protocol.MinProtocolVersion, protocol.MaxProtocolVersion + 1, protocol.HandshakeStatusOK, protocol.ProtocolVersion},
+		{"legacy peer", protocol.MinProtocolVersion, protocol.MinProtocolVersion, protocol.MinProtocolVersion, protocol.HandshakeStatusOK, protocol.MinProtocolVersion},
+		// 拒绝响应以 TLV 编码，版本范围位于固定标签，更新版本的对端也能读出
+		{"no common version", protocol.MaxProtocolVersion + 1, protocol.MaxProtocolVersion + 1, protocol.MaxProtocolVersion + 2, protocol.HandshakeStatusError, protocol.ProtocolVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 请求不短于拒绝响应时服务器才以明文回复
+			payload, err := protocol.MarshalHandshake(tt.header, &protocol.HandshakeMessage{
+				NodeID:     "node-" + tt.name,
+				PreAuthKey: strings.Repeat("p", 128),
+				MinVersion: tt.min,
+				MaxVersion: tt.max,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.handle(encodeFrame(t, tt.header, protocol.MsgTypeHandshake, 0, payload))
+			response := s.receive(t)
+			if response.Version != tt.responseVersion {
+				t.Fatalf("response version %d, want %d", response.Version, tt.responseVersion)
+			}
+			var result protocol.HandshakeResponse
+			if err := protocol.UnmarshalHandshake(response.Version, response.Data, &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != tt.status {
+				t.Fatalf("status %q (%s), want %q", result.Status, result.Error, tt.status)
+			}
+			if result.Status == protocol.HandshakeStatusError && result.MaxVersion != protocol.MaxProtocolVersion {
+				t.Fatalf("rejection advertises max version %d", result.MaxVersion)
+			}
+		})
+	}
+}
+
+func TestShortRejectionNotReflected(t *testing.T) {
+	plain, encrypted := newTestServer(t, false), newTestServer(t, true)
+
+	// 伪造源地址的短握手不能换来更长的明文拒绝响应
+	plain.handle([]byte{1, protocol.MsgTypeHandshake})
+	plain.expectNoReply(t)
+	encrypted.handle(encodeFrame(t, protocol.ProtocolVersion, protocol.MsgTypeHandshake, 0, nil))
+	encrypted.expectNoReply(t)
+	payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+		MinVersion: protocol.MaxProtocolVersion + 1,
+		MaxVersion: protocol.MaxProtocolVersion + 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.handle(encodeFrame(t, protocol.ProtocolVersion, protocol.MsgTypeHandshake, 0, payload))
+	plain.expectNoReply(t)
+
+	// 不短于响应的旧版本握手仍收到拒绝响应
+	legacy := append([]byte{1, protocol.MsgTypeHandshake}, make([]byte, 512)...)
+	plain.handle(legacy)
+	response := plain.receive(t)
+	var result protocol.HandshakeResponse
+	if err := protocol.UnmarshalHandshake(response.Version, response.Data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != protocol.HandshakeStatusError || len(legacy) < protocol.HeaderSize+len(response.Data) {
+		t.Fatalf("rejection %+v for a %d-byte request", result, len(legacy))
+	}
+}
+
+func TestHandshakeRequiresAuthorization(t *testing.T) {
+	s := newTestServer(t, true)
+	registry, err := auth.NewRegistry(filepath.Join(t.TempDir(), "nodes.json"),
+		[]auth.PreAuthKey{{Key: "preauth-0123456789abcdef"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.security.registry = registry
+
+	static, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempt := func(preAuthKey string) *protocol.HandshakeResponse {
+		payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+			Timestamp:  time.Now().UnixNano(),
+			Algorithms: crypto.SupportedAlgorithms(),
+			MinVersion: protocol.MinProtocolVersion,
+			MaxVersion: protocol.MaxProtocolVersion,
+			PreAuthKey: preAuthKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, result := s.noiseHandshake(t, static, payload)
+		return result
+	}
+
+	for _, key := range []string{"", "preauth-wrong-key-000000"} {
+		if result := attempt(key); result.Status != protocol.HandshakeStatusError {
+			t.Fatalf("handshake with key %q accepted", key)
+		}
+	}
+	if s.sessions.ByStatic(static.Public) != nil || s.discovery.GetNode(crypto.NodeID(static.Public)) != nil {
+		t.Fatal("unauthorized node registered")
+	}
+
+	if result := attempt("preauth-0123456789abcdef"); result.Status != protocol.HandshakeStatusOK {
+		t.Fatalf("enrollment rejected: %s", result.Error)
+	}
+	// 登记后无需再提供预授权密钥
+	if result := attempt(""); result.Status != protocol.HandshakeStatusOK {
+		t.Fatalf("enrolled node rejected: %s", result.Error)
+	}
+}
+
+// issueTestCertificates 创建测试 CA，写入 CA 证书并为 nodeKey 签发节点证书，返回 CA 文件路径和节点证书
+func issueTestCertificates(tb testing.TB, nodeKey [crypto.KeySize]byte, subject pkix.Name) (string, []byte) {
+	tb.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	caFile := filepath.Join(tb.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+
+	nodeDER, err := auth.CreateCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}, caCert, nodeKey, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return caFile, nodeDER
+}
+
+func TestHandshakeWithCertificate(t *testing.T) {
+	s := newTestServer(t, true)
+	registry, err := auth.NewRegistry(filepath.Join(t.TempDir(), "nodes.json"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.security.registry = registry
+
+	static, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, der := issueTestCertificates(t, static.Public, pkix.Name{CommonName: "branch-1", OrganizationalUnit: []string{"office"}})
+	if s.security.verifier, err = auth.NewVerifier(caFile, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	attempt := func(static *crypto.KeyPair) *protocol.HandshakeResponse {
+		payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+			Timestamp:   time.Now().UnixNano(),
+			Algorithms:  crypto.SupportedAlgorithms(),
+			MinVersion:  protocol.MinProtocolVersion,
+			MaxVersion:  protocol.MaxProtocolVersion,
+			Certificate: der,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, result := s.noiseHandshake(t, static, payload)
+		return result
+	}
+
+	// 证书公钥与握手静态公钥不符时拒绝
+	other, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := attempt(other); result.Status != protocol.HandshakeStatusError {
+		t.Fatal("certificate of another key accepted")
+	}
+
+	if result := attempt(static); result.Status != protocol.HandshakeStatusOK {
+		t.Fatalf("handshake rejected: %s", result.Error)
+	}
+	node := s.discovery.GetNode(crypto.NodeID(static.Public))
+	if node == nil || node.Name != "branch-1" || len(node.Groups) != 1 || node.Groups[0] != "office" {
+		t.Fatalf("node identity not taken from certificate: %+v", node)
+	}
+}
+
+func TestCertificateRequest(t *testing.T) {
+	s := newTestServer(t, true)
+	_, der := issueTestCertificates(t, s.security.static.Public, pkix.Name{CommonName: "server"})
+	s.security.cert = &auth.Certificate{DER: der, KeyPair: s.security.static}
+
+	// 短于证书的请求不回复，避免反射放大
+	s.handle(encodeFrame(t, protocol.MinProtocolVersion, protocol.MsgTypeCertificate, 0, make([]byte, len(der)-1)))
+	s.client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := s.client.Read(make([]byte, 1500)); err == nil {
+		t.Fatal("server answered a certificate request shorter than the certificate")
+	}
+
+	s.handle(encodeFrame(t, protocol.MinProtocolVersion, protocol.MsgTypeCertificate, 0, make([]byte, protocol.CertificateRequestSize)))
+	response := s.receive(t)
+	if response.Type != protocol.MsgTypeCertificate || !bytes.Equal(response.Data, der) {
+		t.Fatalf("unexpected response %+v", response)
+	}
+}
+
+// FuzzHandlePacket 服务器处理任意报文都不得 panic
+func FuzzHandlePacket(f *testing.F) {
+	servers := []*testServer{newTestServer(f, false), newTestServer(f, true)}
+	for _, data := range loadCaptures(f) {
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{1, protocol.MsgTypeHandshake})
+	f.Add(encodeFrame(f, protocol.ProtocolVersion, protocol.MsgTypeData, 0, []byte{1}))
+	f.Add(encodeFrame(f, protocol.ProtocolVersion, protocol.MsgTypeHandshake, protocol.FlagEncrypted, make([]byte, 96)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, s := range servers {
+			s.handle(data)
+		}
+	})
+}
+
+// FuzzHandleSessionMessage 通过认证的会话消息携带任意负载时，各消息处理函数都不得 panic
+func FuzzHandleSessionMessage(f *testing.F) {
+	plain := newTestServer(f, false)
+	encrypted := newTestServer(f, true)
+	type client struct {
+		server *testServer
+		proto  *protocol.Protocol
+	}
+	plainProto, _ := plain.connect(f)
+	encryptedProto, _ := encrypted.connect(f)
+	clients := []client{{plain, plainProto}, {encrypted, encryptedProto}}
+
+	for msgType, payloads := range controlPayloads(f) {
+		for _, payload := range payloads {
+			f.Add(msgType, payload)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, msgType uint8, payload []byte) {
+		for _, c := range clients {
+			data, err := c.proto.Encode(&protocol.Message{Type: msgType, Data: payload})
+			if err != nil {
+				return
+			}
+			c.server.handle(data)
+		}
+	})
+}
+
+// readMessages 读取服务器发给模拟客户端的 count 个报文，返回能以 proto 解密且类型为 msgType 的消息
+func (s *testServer) readMessages(tb testing.TB, proto *protocol.Protocol, msgType uint8, count int) []*protocol.Message {
+	tb.Helper()
+	var messages []*protocol.Message
+	for i := 0; i < count; i++ {
+		buf := make([]byte, protocol.MaxMessageSize)
+		s.client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := s.client.Read(buf)
+		if err != nil {
+			tb.Fatalf("no message from server: %v", err)
+		}
+		msg, err := proto.Decode(buf[:n])
+		if err != nil || msg.Type != msgType {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// readRevocation 读取服务器发给模拟客户端的报文，返回能以 proto 解密的吊销通知中的节点
+func (s *testServer) readRevocation(tb testing.TB, proto *protocol.Protocol, count int) []string {
+	tb.Helper()
+	var nodeIDs []string
+	for _, msg := range s.readMessages(tb, proto, protocol.MsgTypeRevocation, count) {
+		var revocation protocol.RevocationMessage
+		if err := protocol.UnmarshalControl(msg.Version, msg.Data, &revocation); err != nil {
+			tb.Fatal(err)
+		}
+		nodeIDs = append(nodeIDs, revocation.NodeIDs...)
+	}
+	return nodeIDs
+}
+
+func TestRevokeNode(t *testing.T) {
+	s := newTestServer(t, true)
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	revoked, err := auth.NewRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.security.revoked = revoked
+
+	victim, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	victimID := crypto.NodeID(victim.Public)
+	attempt := func() *protocol.HandshakeResponse {
+		payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+			Timestamp:  time.Now().UnixNano(),
+			Algorithms: crypto.SupportedAlgorithms(),
+			MinVersion: protocol.MinProtocolVersion,
+			MaxVersion: protocol.MaxProtocolVersion,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, result := s.noiseHandshake(t, victim, payload)
+		return result
+	}
+	if result := attempt(); result.Status != protocol.HandshakeStatusOK {
+		t.Fatalf("handshake rejected: %s", result.Error)
+	}
+
+	// 其他节点持有经由被吊销节点的路由
+	proto, nodeID := s.connect(t)
+	s.discovery.AddRoute(nodeID, network.Route{Destination: "10.2.0.0/24", NextHop: victimID})
+	s.discovery.AddRoute(victimID, network.Route{Destination: "10.3.0.0/24", NextHop: victimID})
+
+	// 由其他进程（revoke 子命令）修改吊销列表，服务器重新加载后断开节点
+	cli, err := auth.NewRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cli.Revoke(crypto.EncodeKey(victim.Public), "test"); err != nil {
+		t.Fatal(err)
+	}
+	added, err := revoked.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].NodeID != victimID {
+		t.Fatalf("reload added %+v", added)
+	}
+	revokeNodes(s.conn, added, s.discovery, s.sessions)
+
+	// 两个节点共用模拟客户端的地址，各收到一条吊销通知
+	if nodeIDs := s.readRevocation(t, proto, 2); len(nodeIDs) != 1 || nodeIDs[0] != victimID {
+		t.Fatalf("peer notified of %v", nodeIDs)
+	}
+	if s.sessions.ByNode(victimID) != nil || s.discovery.GetNode(victimID) != nil {
+		t.Fatal("revoked node still connected")
+	}
+	if routes := s.discovery.GetRoutes(nodeID); len(routes) != 0 {
+		t.Fatalf("routes via revoked node not withdrawn: %+v", routes)
+	}
+	// 在线节点随后收到被吊销节点所通告路由的撤销
+	if routes := s.collectRoutes(t, map[string]*protocol.Protocol{"peer": proto}); fmt.Sprint(routes["peer"]) != "[withdraw 10.3.0.0/24 via "+victimID+"]" {
+		t.Fatalf("peer received route updates %v", routes)
+	}
+
+	if result := attempt(); result.Status != protocol.HandshakeStatusError {
+		t.Fatal("revoked node allowed to handshake again")
+	}
+
+	// 新连接的节点在握手后收到完整的吊销列表
+	proto, _ = s.connect(t)
+	if nodeIDs := s.readRevocation(t, proto, 1); len(nodeIDs) != 1 || nodeIDs[0] != victimID {
+		t.Fatalf("new node notified of %v", nodeIDs)
+	}
+}
+
+// ipv4Packet 构造一个只有头部的 IPv4 数据包
+func ipv4Packet(src, dst net.IP) []byte {
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0}
+	packet = append(packet, src.To4()...)
+	return append(packet, dst.To4()...)
+}
+
+func TestForwardData(t *testing.T) {
+	s := newTestServer(t, true)
+	alice, _ := s.connectAt(t, net.IPv4(10, 9, 0, 2))
+	bob, bobID := s.connectAt(t, net.IPv4(10, 9, 0, 3))
+	s.discovery.AddRoute(bobID, network.Route{Destination: "192.168.5.0/24", NextHop: bobID})
+
+	send := func(packet []byte) {
+		data, err := alice.Encode(&protocol.Message{Type: protocol.MsgTypeData, Data: packet})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handle(data)
+	}
+
+	// 按节点地址和所通告的网段转发，伪造源地址的数据包被丢弃
+	spoofed := ipv4Packet(net.IPv4(10, 9, 0, 3), net.IPv4(10, 9, 0, 3))
+	direct := ipv4Packet(net.IPv4(10, 9, 0, 2), net.IPv4(10, 9, 0, 3))
+	routed := ipv4Packet(net.IPv4(10, 9, 0, 2), net.IPv4(192, 168, 5, 7))
+	for _, packet := range [][]byte{spoofed, direct, routed} {
+		send(packet)
+	}
+	// 首次转发后服务器向双方各发送一条节点介绍
+	messages := s.readMessages(t, bob, protocol.MsgTypeData, 4)
+	if len(messages) != 2 {
+		t.Fatalf("forwarded %d packets, want 2", len(messages))
+	}
+	for i, want := range [][]byte{direct, routed} {
+		if !bytes.Equal(messages[i].Data, want) {
+			t.Fatalf("forwarded %x, want %x", messages[i].Data, want)
+		}
+	}
+}
+
+func TestIntroduceNodes(t *testing.T) {
+	s := newTestServer(t, true)
+	s.security.relaySecret, s.security.relayTTL = testRelaySecret, time.Minute
+	alice, aliceID := s.connectAt(t, net.IPv4(10, 9, 0, 2))
+	bob, bobID := s.connectAt(t, net.IPv4(10, 9, 0, 3))
+	s.discovery.AddRoute(bobID, network.Route{Destination: "192.168.5.0/24", NextHop: bobID})
+	aliceRelayed := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 20), Port: 49160}
+	bobRelayed := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 20), Port: 49161}
+	s.discovery.GetNode(aliceID).Relayed = aliceRelayed
+	s.discovery.GetNode(bobID).Relayed = bobRelayed
+
+	data, err := alice.Encode(&protocol.Message{Type: protocol.MsgTypeData, Data: ipv4Packet(net.IPv4(10, 9, 0, 2), net.IPv4(10, 9, 0, 3))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handle(data)
+
+	// 数据包和两条介绍共用模拟客户端的地址，按各自的会话解密
+	var packets [][]byte
+	for i := 0; i < 3; i++ {
+		buf := make([]byte, protocol.MaxMessageSize)
+		s.client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := s.client.Read(buf)
+		if err != nil {
+			t.Fatalf("no message from server: %v", err)
+		}
+		packets = append(packets, buf[:n])
+	}
+	introduction := func(proto *protocol.Protocol) *protocol.PeerMessage {
+		for _, packet := range packets {
+			msg, err := proto.Decode(packet)
+			if err != nil || msg.Type != protocol.MsgTypePeer {
+				continue
+			}
+			var peer protocol.PeerMessage
+			if err := protocol.UnmarshalControl(msg.Version, msg.Data, &peer); err != nil {
+				t.Fatal(err)
+			}
+			return &peer
+		}
+		t.Fatal("no introduction received")
+		return nil
+	}
+	toAlice, toBob := introduction(alice), introduction(bob)
+
+	bobStatic := s.sessions.ByNode(bobID).Static
+	client := s.client.LocalAddr().(*net.UDPAddr)
+	if toAlice.NodeID != bobID || !bytes.Equal(toAlice.PublicKey, bobStatic[:]) ||
+		!toAlice.PublicIP.Equal(client.IP) || int(toAlice.PublicPort) != client.Port {
+		t.Fatalf("introduction of bob: %+v", toAlice)
+	}
+	if len(toAlice.Addresses) != 1 || !toAlice.Addresses[0].Equal(net.IPv4(10, 9, 0, 3)) ||
+		len(toAlice.Routes) != 1 || toAlice.Routes[0] != "192.168.5.0/24" {
+		t.Fatalf("addresses of bob: %v, routes %v", toAlice.Addresses, toAlice.Routes)
+	}
+	if toBob.NodeID != aliceID || len(toBob.Token) == 0 || !bytes.Equal(toBob.Token, toAlice.Token) {
+		t.Fatalf("introduction of alice: %+v", toBob)
+	}
+	// 双方各持有一张绑定自己和对端的中继票据
+	checkRelayTicket(t, toAlice.RelayTicket, toAlice.RelayKey, aliceID, bobID)
+	checkRelayTicket(t, toBob.RelayTicket, toBob.RelayKey, bobID, aliceID)
+	// 双方都有 TURN 中继地址时介绍中附带对端的中继地址
+	if !toAlice.RelayedIP.Equal(bobRelayed.IP) || int(toAlice.RelayedPort) != bobRelayed.Port ||
+		!toBob.RelayedIP.Equal(aliceRelayed.IP) || int(toBob.RelayedPort) != aliceRelayed.Port {
+		t.Fatalf("relayed addresses: %v:%d, %v:%d", toAlice.RelayedIP, toAlice.RelayedPort, toBob.RelayedIP, toBob.RelayedPort)
+	}
+
+	// 同一对节点不会被反复介绍
+	if s.discovery.Introduce(aliceID, bobID, introductionInterval) {
+		t.Fatal("pair introduced again within the interval")
+	}
+}
+
+var testRelaySecret = []byte("relay-secret-for-tests")
+
+// checkRelayTicket 校验中继票据授权节点 nodeID 与节点 peerID 通信，且票据密钥正确
+func checkRelayTicket(t *testing.T, data, key []byte, nodeID, peerID string) {
+	t.Helper()
+	ticket, verified, err := relay.VerifyTicket(testRelaySecret, data, time.Now())
+	if err != nil {
+		t.Fatalf("relay ticket for %s: %v", nodeID, err)
+	}
+	if ticket.NodeID != nodeID || ticket.PeerID != peerID || !bytes.Equal(verified, key) {
+		t.Fatalf("relay ticket %+v for %s to %s", ticket, nodeID, peerID)
+	}
+}
+
+func TestRelayTicketRequest(t *testing.T) {
+	s := newTestServer(t, true)
+	alice, aliceID := s.connectAt(t, net.IPv4(10, 9, 0, 2))
+	bob, bobID := s.connectAt(t, net.IPv4(10, 9, 0, 3))
+	request := func(targetID string) {
+		payload, err := protocol.MarshalControl(alice.Version(), &protocol.NATMessage{TargetID: targetID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := alice.Encode(&protocol.Message{Type: protocol.MsgTypeNAT, Data: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handle(data)
+	}
+	// 两张票据共用模拟客户端的地址，按各自的会话解密
+	var packets [][]byte
+	ticket := func(proto *protocol.Protocol) *protocol.NATMessage {
+		for _, packet := range packets {
+			msg, err := proto.Decode(packet)
+			if err != nil || msg.Type != protocol.MsgTypeNAT {
+				continue
+			}
+			var nat protocol.NATMessage
+			if err := protocol.UnmarshalControl(msg.Version, msg.Data, &nat); err != nil {
+				t.Fatal(err)
+			}
+			return &nat
+		}
+		t.Fatal("no relay ticket received")
+		return nil
+	}
+
+	// 未启用中继服务时不签发票据
+	request(bobID)
+	s.client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := s.client.Read(make([]byte, protocol.MaxMessageSize)); err == nil {
+		t.Fatal("relay ticket issued without a relay secret")
+	}
+
+	// 请求方和目标节点各收到一张票据
+	s.security.relaySecret, s.security.relayTTL = testRelaySecret, time.Minute
+	request(bobID)
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, protocol.MaxMessageSize)
+		s.client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := s.client.Read(buf)
+		if err != nil {
+			t.Fatalf("no message from server: %v", err)
+		}
+		packets = append(packets, buf[:n])
+	}
+	toAlice, toBob := ticket(alice), ticket(bob)
+	if toAlice.TargetID != bobID || toBob.TargetID != aliceID {
+		t.Fatalf("tickets for %s and %s", toAlice.TargetID, toBob.TargetID)
+	}
+	checkRelayTicket(t, toAlice.RelayTicket, toAlice.RelayKey, aliceID, bobID)
+	checkRelayTicket(t, toBob.RelayTicket, toBob.RelayKey, bobID, aliceID)
+}
+
+func TestHandshakeAddressConflict(t *testing.T) {
+	s := newTestServer(t, true)
+	s.connectAt(t, net.IPv4(10, 9, 0, 2))
+
+	static, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+		Timestamp:  time.Now().UnixNano(),
+		PrivateIP:  net.IPv4(10, 9, 0, 2),
+		Algorithms: crypto.SupportedAlgorithms(),
+		MinVersion: protocol.MinProtocolVersion,
+		MaxVersion: protocol.MaxProtocolVersion,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, result := s.noiseHandshake(t, static, payload); result.Status != protocol.HandshakeStatusError {
+		t.Fatal("handshake with a conflicting address accepted")
+	}
+	if s.discovery.GetNode(crypto.NodeID(static.Public)) != nil {
+		t.Fatal("conflicting node registered")
+	}
+}
+
+func TestHandshakeAssignsAddress(t *testing.T) {
+	newKey := func() *crypto.KeyPair {
+		kp, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kp
+	}
+	a, b, reserved := newKey(), newKey(), newKey()
+
+	path := filepath.Join(t.TempDir(), "addresses.json")
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00:9::/64")
+	reservations := map[string][]net.IP{crypto.NodeID(reserved.Public): {net.IPv4(10, 9, 0, 200)}}
+	excluded, err := ipam.ParseRange("10.9.0.1-10.9.0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAllocator := func() *ipam.Allocator {
+		allocator, err := ipam.New(path, []*net.IPNet{subnet, subnet6}, reservations, []ipam.Range{excluded})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allocator
+	}
+	s := newTestServer(t, true)
+	s.security.ipam = newAllocator()
+
+	attempt := func(static *crypto.KeyPair, requested, requested6 net.IP) *protocol.HandshakeResponse {
+		t.Helper()
+		payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+			Timestamp:   time.Now().UnixNano(),
+			PrivateIP:   requested,
+			PrivateIP6:  requested6,
+			Algorithms:  crypto.SupportedAlgorithms(),
+			SenderIndex: 7,
+			MinVersion:  protocol.MinProtocolVersion,
+			MaxVersion:  protocol.MaxProtocolVersion,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, result := s.noiseHandshake(t, static, payload)
+		if result.Status != protocol.HandshakeStatusOK {
+			t.Fatalf("handshake rejected: %s", result.Error)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name                  string
+		static                *crypto.KeyPair
+		requested, requested6 string
+		want, want6           string
+	}{
+		{"requested", a, "10.9.0.50", "fd00:9::50", "10.9.0.50", "fd00:9::50"},
+		// 请求的地址已被占用或在排除的地址段内时分配第一个空闲地址
+		{"first free", b, "10.9.0.3", "", "10.9.0.10", "fd00:9::1"},
+		{"sticky", b, "10.9.0.77", "fd00:9::77", "10.9.0.10", "fd00:9::1"},
+		{"reserved", reserved, "", "", "10.9.0.200", "fd00:9::2"},
+	}
+	for _, tt := range tests {
+		result := attempt(tt.static, net.ParseIP(tt.requested), net.ParseIP(tt.requested6))
+		if result.Address.String() != tt.want || result.PrefixLength != 24 ||
+			result.Address6.String() != tt.want6 || result.PrefixLength6 != 64 {
+			t.Fatalf("%s: assigned %v/%d and %v/%d, want %s/24 and %s/64", tt.name,
+				result.Address, result.PrefixLength, result.Address6, result.PrefixLength6, tt.want, tt.want6)
+		}
+		// 服务器按分配的地址转发发往该节点的数据
+		for _, want := range []string{tt.want, tt.want6} {
+			if owner := s.discovery.AddressOwner(net.ParseIP(want)); owner == nil || owner.ID != crypto.NodeID(tt.static.Public) {
+				t.Fatalf("%s: owner of %v = %+v", tt.name, want, owner)
+			}
+		}
+	}
+
+	// 服务器重启后分配不变
+	s.security.ipam = newAllocator()
+	s.discovery = network.NewDiscovery(time.Minute)
+	if result := attempt(a, nil, nil); !result.Address.Equal(net.IPv4(10, 9, 0, 50)) || !result.Address6.Equal(net.ParseIP("fd00:9::50")) {
+		t.Fatalf("assigned %v and %v after restart", result.Address, result.Address6)
+	}
+
+	// 明文模式同样分配地址
+	plain := newTestServer(t, false)
+	plain.security.ipam = s.security.ipam
+	payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+		NodeID:     "node-plain",
+		MinVersion: protocol.MinProtocolVersion,
+		MaxVersion: protocol.MaxProtocolVersion,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.handle(encodeFrame(t, protocol.ProtocolVersion, protocol.MsgTypeHandshake, 0, payload))
+	response := plain.receive(t)
+	var result protocol.HandshakeResponse
+	if err := protocol.UnmarshalHandshake(response.Version, response.Data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Address.Equal(net.IPv4(10, 9, 0, 11)) || plain.discovery.AddressOwner(result.Address6) == nil {
+		t.Fatalf("plain handshake assigned %v and %v", result.Address, result.Address6)
+	}
+}
+
+func TestIntroduceIncompatibleNATs(t *testing.T) {
+	tests := []struct {
+		a, b      stun.NATType
+		traversal bool // 双方是否支持端口预测和生日攻击
+		relay     bool // 是否启用中继服务
+		turn      int  // 在 TURN 服务器上分配了中继地址的节点数
+		want      bool
+	}{
+		{stun.NATSymmetric, stun.NATSymmetric, true, false, 0, false},
+		{stun.NATSymmetric, stun.NATPortRestrictedCone, false, false, 0, false},
+		{stun.NATSymmetric, stun.NATPortRestrictedCone, true, false, 0, true},
+		{stun.NATSymmetric, stun.NATRestrictedCone, false, false, 0, true},
+		{stun.NATSymmetric, stun.NATSymmetric, true, true, 0, true},
+		{stun.NATSymmetric, stun.NATPortRestrictedCone, false, true, 0, true},
+		{stun.NATSymmetric, stun.NATSymmetric, true, false, 1, false},
+		{stun.NATSymmetric, stun.NATSymmetric, true, false, 2, true},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, true)
+		if tt.relay {
+			s.security.relaySecret = testRelaySecret
+		}
+		_, aliceID := s.connectAt(t, net.IPv4(10, 9, 0, 2))
+		_, bobID := s.connectAt(t, net.IPv4(10, 9, 0, 3))
+		alice, bob := s.discovery.GetNode(aliceID), s.discovery.GetNode(bobID)
+		alice.NATType, bob.NATType = tt.a, tt.b
+		for i, node := range []*network.Node{alice, bob}[:tt.turn] {
+			node.Relayed = &net.UDPAddr{IP: net.IPv4(198, 51, 100, 20), Port: 49160 + i}
+		}
+		if !tt.traversal {
+			alice.Capabilities &^= protocol.CapTraversal
+		}
+
+		introduceNodes(s.conn, alice, bob, s.discovery, s.sessions, s.security)
+		if introduced := !s.discovery.Introduce(aliceID, bobID, introductionInterval); introduced != tt.want {
+			t.Errorf("%v/%v traversal=%v relay=%v turn=%d: introduced = %v, want %v", tt.a, tt.b, tt.traversal, tt.relay, tt.turn, introduced, tt.want)
+		}
+	}
+}
+
+func TestSTUNBinding(t *testing.T) {
+	s := newTestServer(t, false)
+	responder, err := stun.NewResponder(s.conn, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	go handleMessages(s.conn, s.conn, responder, s.discovery, s.sessions, s.security)
+
+	binding, err := stun.Bind(s.client, s.conn.LocalAddr().(*net.UDPAddr), 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.Mapped.String() != s.client.LocalAddr().String() {
+		t.Fatalf("mapped = %v, want %v", binding.Mapped, s.client.LocalAddr())
+	}
+}
+
+func TestUnderlayDispatch(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{Host: "127.0.0.1", Host6: "::1"}}
+	sockets, err := listenUnderlay(cfg)
+	if err != nil {
+		t.Skipf("cannot listen on IPv6 loopback: %v", err)
+	}
+	defer sockets.Close()
+	if len(sockets.conns()) != 2 {
+		t.Fatalf("conns = %v", sockets.conns())
+	}
+
+	// 回复经与对端地址协议族相同的套接字发出
+	for i, host := range []string{"127.0.0.1", "::1"} {
+		peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		if _, err := sockets.WriteToUDP([]byte("ping"), peer.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 16)
+		_, from, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := sockets.conns()[i].LocalAddr().String(); from.String() != want {
+			t.Fatalf("reply to %s from %v, want %s", host, from, want)
+		}
+	}
+}
+
+// collectFrames 读取服务器发给模拟客户端的报文直到一段时间内没有新报文，按能解密的节点返回其中的以太网帧
+func (s *testServer) collectFrames(tb testing.TB, protos map[string]*protocol.Protocol) map[string][][]byte {
+	tb.Helper()
+	frames := make(map[string][][]byte)
+	buf := make([]byte, protocol.MaxMessageSize)
+	for {
+		s.client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := s.client.Read(buf)
+		if err != nil {
+			return frames
+		}
+		for name, proto := range protos {
+			msg, err := proto.Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			if msg.Type == protocol.MsgTypeFrame {
+				source, frame, err := protocol.DecodeFrame(msg.Data)
+				if err != nil {
+					tb.Fatal(err)
+				}
+				frames[name] = append(frames[name], append([]byte(source+"|"), frame...))
+			}
+			break
+		}
+	}
+}
+
+// collectRoutes 读取服务器发给模拟客户端的报文直到一段时间内没有新报文，按能解密的节点返回其中的路由更新
+func (s *testServer) collectRoutes(tb testing.TB, protos map[string]*protocol.Protocol) map[string][]string {
+	tb.Helper()
+	routes := make(map[string][]string)
+	buf := make([]byte, protocol.MaxMessageSize)
+	for {
+		s.client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := s.client.Read(buf)
+		if err != nil {
+			return routes
+		}
+		for name, proto := range protos {
+			msg, err := proto.Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			if msg.Type == protocol.MsgTypeRoute {
+				var route protocol.RouteMessage
+				if err := protocol.UnmarshalControl(msg.Version, msg.Data, &route); err != nil {
+					tb.Fatal(err)
+				}
+				update := route.Destination + " via " + route.NextHop
+				if route.Withdraw {
+					update = "withdraw " + update
+				}
+				routes[name] = append(routes[name], update)
+			}
+			break
+		}
+	}
+}
+
+// arpFrame 构造以太网上的 ARP 报文，op 为 1 时为请求
+func arpFrame(op uint16, dst, src net.HardwareAddr, senderIP, targetIP net.IP) []byte {
+	frame := append(append(append([]byte{}, dst...), src...), 0x08, 0x06, 0, 1, 0x08, 0, 6, 4, 0, byte(op))
+	frame = append(append(frame, src...), senderIP.To4()...)
+	return append(append(frame, make([]byte, 6)...), targetIP.To4()...)
+}
+
+func TestForwardFrames(t *testing.T) {
+	s := newTestServer(t, true)
+	s.security.mode = protocol.ModeTAP
+	s.security.bridge = network.NewBridge(network.BridgeConfig{FloodRate: 1, FloodBurst: 2, Proxy: true})
+	protos := make(map[string]*protocol.Protocol)
+	ids := make(map[string]string)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		protos[name], ids[name] = s.connect(t)
+	}
+	send := func(name string, frame []byte) {
+		payload, err := protocol.EncodeFrame("forged-source", frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := protos[name].Encode(&protocol.Message{Type: protocol.MsgTypeFrame, Data: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handle(data)
+	}
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	macA, macB, macC := net.HardwareAddr{2, 0, 0, 0, 0, 0xa}, net.HardwareAddr{2, 0, 0, 0, 0, 0xb}, net.HardwareAddr{2, 0, 0, 0, 0, 0xc}
+	ipA, ipB, ipC := net.IPv4(10, 1, 0, 1), net.IPv4(10, 1, 0, 2), net.IPv4(10, 1, 0, 3)
+
+	// 广播帧泛洪到其他节点，来源为通过认证的发送节点
+	request := arpFrame(1, broadcast, macA, ipA, ipB)
+	send("alice", request)
+	frames := s.collectFrames(t, protos)
+	want := append([]byte(ids["alice"]+"|"), request...)
+	if len(frames["alice"]) != 0 || len(frames["bob"]) != 1 || len(frames["carol"]) != 1 || !bytes.Equal(frames["bob"][0], want) {
+		t.Fatalf("flooded frames: %q", frames)
+	}
+
+	// 已学习目的地址的单播帧只发往其所在的节点
+	reply := arpFrame(2, macA, macB, ipB, ipA)
+	send("bob", reply)
+	frames = s.collectFrames(t, protos)
+	if len(frames) != 1 || len(frames["alice"]) != 1 || !bytes.Equal(frames["alice"][0], append([]byte(ids["bob"]+"|"), reply...)) {
+		t.Fatalf("unicast frames: %q", frames)
+	}
+
+	// 目标地址已学习的 ARP 请求由服务器代答，不再泛洪
+	send("carol", arpFrame(1, broadcast, macC, ipC, ipB))
+	frames = s.collectFrames(t, protos)
+	if len(frames) != 1 || len(frames["carol"]) != 1 || !bytes.HasPrefix(frames["carol"][0], append([]byte("|"), macC...)) {
+		t.Fatalf("proxied frames: %q", frames)
+	}
+
+	// 超出泛洪限额的帧被丢弃
+	for i := 0; i < 3; i++ {
+		send("carol", append(append(append([]byte{}, broadcast...), macC...), 0x88, 0xb5, byte(i)))
+	}
+	if frames = s.collectFrames(t, protos); len(frames["alice"]) != 2 || len(frames["bob"]) != 2 {
+		t.Fatalf("rate limited floods: %q", frames)
+	}
+
+	// 虚拟网络模式不同的节点被拒绝
+	s.security.mode = protocol.ModeTUN
+	static, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := protocol.MarshalHandshake(protocol.ProtocolVersion, &protocol.HandshakeMessage{
+		NodeID:     crypto.NodeID(static.Public),
+		Timestamp:  time.Now().UnixNano(),
+		Algorithms: crypto.SupportedAlgorithms(),
+		MinVersion: protocol.MinProtocolVersion,
+		MaxVersion: protocol.MaxProtocolVersion,
+		Mode:       protocol.ModeTAP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, result := s.noiseHandshake(t, static, payload); result.Status != protocol.HandshakeStatusError {
+		t.Fatalf("handshake with a different mode accepted: %+v", result)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/config"
+	"github.com/fenghuilee/sd-wan/internal/relay"
+)
+
+// runRelay 执行 relay 子命令，在 nat.relay_port 上运行中继服务，返回进程退出码。
+// 中继服务与协调服务器使用同一配置文件中的 relay_secret 和吊销列表，可部署在另一台主机上
+func runRelay(args []string) int {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "配置文件路径")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: server relay [-config 配置文件]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := serveRelay(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "relay: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func serveRelay(configPath string) error {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("加载配置失败: %v", err)
+	}
+	secret, err := cfg.GetRelaySecret()
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.New("未配置 nat.relay_secret")
+	}
+	revoked, err := cfg.LoadRevocations()
+	if err != nil {
+		return fmt.Errorf("加载吊销列表失败: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: cfg.NAT.RelayPort})
+	if err != nil {
+		return fmt.Errorf("创建 UDP 服务器失败: %v", err)
+	}
+	defer conn.Close()
+
+	limits := cfg.GetRelayLimits()
+	server := relay.NewServer(conn, secret, limits)
+	server.SetRevoked(revoked.IsRevoked)
+	log.Printf("中继服务启动在 %s，每个会话限速 %d 字节/秒", conn.LocalAddr(), limits.Rate)
+
+	// 吊销列表由 revoke 子命令更新，定期重新加载
+	go func() {
+		ticker := time.NewTicker(revocationPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := revoked.Reload(); err != nil {
+				log.Printf("重新加载吊销列表失败: %v", err)
+			}
+		}
+	}()
+	go server.Serve()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	stats := server.Stats()
+	log.Printf("正在关闭中继服务... 会话 %d 个，已转发 %d 字节，超出配额丢弃 %d 字节",
+		stats.Sessions, stats.Forwarded, stats.Dropped)
+	return nil
+}
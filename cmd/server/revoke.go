@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/auth"
+	"github.com/fenghuilee/sd-wan/internal/config"
+	"github.com/fenghuilee/sd-wan/internal/ipam"
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+)
+
+const (
+	// revocationPollInterval 检查吊销列表文件是否更新的间隔
+	revocationPollInterval = 5 * time.Second
+	// revocationBatchSize 每条吊销通知携带的最多节点数，使消息不超过常见的路径 MTU
+	revocationBatchSize = 32
+)
+
+// watchRevocations 定期重新加载吊销列表，断开新吊销的节点
+func watchRevocations(conn udpWriter, discovery *network.Discovery, sessions *protocol.SessionTable, security *securityOptions) {
+	ticker := time.NewTicker(revocationPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		added, err := security.revoked.Reload()
+		if err != nil {
+			log.Printf("重新加载吊销列表失败: %v", err)
+			continue
+		}
+		if len(added) > 0 {
+			revokeNodes(conn, added, discovery, sessions)
+			releaseAddresses(security.ipam, added)
+			if security.bridge != nil {
+				for _, node := range added {
+					security.bridge.Forget(node.NodeID)
+				}
+			}
+		}
+	}
+}
+
+// revokeNodes 断开已吊销的节点：先通知所有在线节点（包括被吊销的节点本身），
+// 再删除其会话、节点信息和路由。中继服务读取同一吊销列表，不再为其转发
+func revokeNodes(conn udpWriter, nodes []auth.RevokedNode, discovery *network.Discovery, sessions *protocol.SessionTable) {
+	nodeIDs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		nodeIDs = append(nodeIDs, node.NodeID)
+	}
+	for _, peer := range sessions.Peers() {
+		if endpoint := peer.Endpoint(); endpoint != nil {
+			sendRevocations(conn, endpoint, peer.Protocol(), nodeIDs)
+		}
+	}
+
+	for _, node := range nodes {
+		if peer := sessions.ByNode(node.NodeID); peer != nil {
+			sessions.Remove(peer)
+		}
+		routes := discovery.GetRoutes(node.NodeID)
+		discovery.RemoveNode(node.NodeID)
+		withdrawn := len(routes) + discovery.WithdrawRoutes(node.NodeID)
+		pushRoutes(conn, sessions, routes, true)
+		log.Printf("节点 %s 已吊销，断开会话并撤销 %d 条路由", node.NodeID, withdrawn)
+	}
+}
+
+// releaseAddresses 释放已吊销节点分配到的虚拟地址，使其可以分配给其他节点
+func releaseAddresses(allocator *ipam.Allocator, nodes []auth.RevokedNode) {
+	if allocator == nil {
+		return
+	}
+	for _, node := range nodes {
+		if released, err := allocator.Release(node.NodeID); err != nil {
+			log.Printf("释放节点 %s 的虚拟地址失败: %v", node.NodeID, err)
+		} else if released {
+			log.Printf("已释放节点 %s 的虚拟地址", node.NodeID)
+		}
+	}
+}
+
+// sendRevocations 向一个对端发送吊销通知，节点较多时分批发送
+func sendRevocations(conn udpWriter, remoteAddr *net.UDPAddr, proto *protocol.Protocol, nodeIDs []string) {
+	for len(nodeIDs) > 0 {
+		batch := nodeIDs
+		if len(batch) > revocationBatchSize {
+			batch = batch[:revocationBatchSize]
+		}
+		nodeIDs = nodeIDs[len(batch):]
+
+		payload, err := protocol.MarshalControl(proto.Version(), &protocol.RevocationMessage{NodeIDs: batch})
+		if err != nil {
+			log.Printf("编码吊销通知失败: %v", err)
+			return
+		}
+		sendMessage(conn, remoteAddr, proto, protocol.MsgTypeRevocation, payload)
+	}
+}
+
+// runRevoke 执行 revoke 子命令，将节点加入服务器的吊销列表，返回进程退出码。
+// 运行中的服务器在 revocationPollInterval 内感知变化并断开该节点。
+func runRevoke(args []string) int {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "配置文件路径")
+	reason := fs.String("reason", "", "吊销原因")
+	list := fs.Bool("list", false, "列出已吊销的节点")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: server revoke [-config 配置文件] [-reason 原因] <节点 ID 或公钥>")
+		fmt.Fprintln(fs.Output(), "      server revoke [-config 配置文件] -list")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if !*list && fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := revoke(*configPath, fs.Arg(0), *reason, *list); err != nil {
+		fmt.Fprintf(os.Stderr, "revoke: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func revoke(configPath, target, reason string, list bool) error {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("加载配置失败: %v", err)
+	}
+	if cfg.Security.RevokedNodesFile == "" {
+		return errors.New("未配置 security.revoked_nodes_file")
+	}
+	revoked, err := cfg.LoadRevocations()
+	if err != nil {
+		return err
+	}
+
+	if list {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "节点 ID\t吊销时间\t原因")
+		for _, node := range revoked.Nodes() {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", node.NodeID, node.RevokedAt.Format(time.RFC3339), node.Reason)
+		}
+		return w.Flush()
+	}
+
+	node, added, err := revoked.Revoke(target, reason)
+	if err != nil {
+		return err
+	}
+	if !added {
+		fmt.Printf("节点 %s 已于 %s 吊销\n", node.NodeID, node.RevokedAt.Format(time.RFC3339))
+		return nil
+	}
+	fmt.Printf("已吊销节点 %s，写入 %s\n", node.NodeID, cfg.Security.RevokedNodesFile)
+	return nil
+}
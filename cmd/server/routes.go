@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+)
+
+// nodeExpiryInterval 检查过期节点的间隔，超过三个间隔未见的节点被移除
+const nodeExpiryInterval = 30 * time.Second
+
+// expireNodes 定期移除长时间未见的节点，通知其他节点撤销其通告的路由
+func expireNodes(conn udpWriter, discovery *network.Discovery, sessions *protocol.SessionTable) {
+	ticker := time.NewTicker(nodeExpiryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removeExpired(conn, discovery, sessions, 3*nodeExpiryInterval)
+	}
+}
+
+// removeExpired 移除超过 timeout 未见的节点并推送其路由的撤销
+func removeExpired(conn udpWriter, discovery *network.Discovery, sessions *protocol.SessionTable, timeout time.Duration) {
+	for _, node := range discovery.Cleanup(timeout) {
+		if len(node.Routes) > 0 {
+			log.Printf("节点 %s 已过期，撤销 %d 条路由", node.ID, len(node.Routes))
+			pushRoutes(conn, sessions, node.Routes, true)
+		}
+	}
+}
+
+// pushRoutes 向所有已认证的节点推送路由更新，withdraw 为 true 时通知撤销。
+// 节点据此安装或删除经 TUN 接口到这些网段的路由，与是否已和通告路由的节点直连无关
+func pushRoutes(conn udpWriter, sessions *protocol.SessionTable, routes []network.Route, withdraw bool) {
+	for _, peer := range sessions.Peers() {
+		if endpoint := peer.Endpoint(); endpoint != nil {
+			sendRoutes(conn, endpoint, peer.Protocol(), routes, withdraw)
+		}
+	}
+}
+
+// sendNodeRoutes 向新加入的节点发送其他节点已通告的路由
+func sendNodeRoutes(conn udpWriter, remoteAddr *net.UDPAddr, proto *protocol.Protocol, discovery *network.Discovery, nodeID string) {
+	for _, node := range discovery.GetNodes() {
+		if node.ID != nodeID {
+			sendRoutes(conn, remoteAddr, proto, discovery.GetRoutes(node.ID), false)
+		}
+	}
+}
+
+// sendRoutes 向一个节点发送路由更新，每条路由一条消息，下一跳为通告路由的节点
+func sendRoutes(conn udpWriter, remoteAddr *net.UDPAddr, proto *protocol.Protocol, routes []network.Route, withdraw bool) {
+	for _, route := range routes {
+		payload, err := protocol.MarshalControl(proto.Version(), &protocol.RouteMessage{
+			Destination: route.Destination,
+			NextHop:     route.NextHop,
+			Metric:      route.Metric,
+			Withdraw:    withdraw,
+		})
+		if err != nil {
+			log.Printf("编码路由更新失败: %v", err)
+			return
+		}
+		sendMessage(conn, remoteAddr, proto, protocol.MsgTypeRoute, payload)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/fenghuilee/sd-wan/internal/config"
+)
+
+// udpWriter 向节点发送报文的套接字
+type udpWriter interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+// underlay 服务器的底层套接字。server.host 为通配地址时一个套接字同时收发 IPv4 和 IPv6 报文；
+// host 为具体的 IPv4 地址且配置了 server.host6 时，IPv6 报文经单独的套接字收发
+type underlay struct {
+	primary *net.UDPConn
+	v6      *net.UDPConn // 未配置 server.host6 时为 nil
+}
+
+// listenUnderlay 按 server 配置监听服务器的底层套接字
+func listenUnderlay(cfg *config.Config) (*underlay, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.GetServerAddr())
+	if err != nil {
+		return nil, fmt.Errorf("解析地址失败: %v", err)
+	}
+	u := &underlay{}
+	if u.primary, err = net.ListenUDP("udp", addr); err != nil {
+		return nil, err
+	}
+	if cfg.Server.Host6 == "" {
+		return u, nil
+	}
+
+	// udp6 套接字只接收 IPv6 报文，与 IPv4 套接字使用同一端口不冲突
+	addr6, err := net.ResolveUDPAddr("udp6", cfg.GetServerAddr6())
+	if err != nil {
+		u.Close()
+		return nil, fmt.Errorf("解析 IPv6 地址失败: %v", err)
+	}
+	if u.v6, err = net.ListenUDP("udp6", addr6); err != nil {
+		u.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// conns 返回需要读取的套接字
+func (u *underlay) conns() []*net.UDPConn {
+	if u.v6 == nil {
+		return []*net.UDPConn{u.primary}
+	}
+	return []*net.UDPConn{u.primary, u.v6}
+}
+
+// WriteToUDP 经与目的地址协议族相同的套接字发送报文
+func (u *underlay) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if u.v6 != nil && addr.IP.To4() == nil {
+		return u.v6.WriteToUDP(b, addr)
+	}
+	return u.primary.WriteToUDP(b, addr)
+}
+
+// Close 关闭所有套接字
+func (u *underlay) Close() error {
+	var err error
+	for _, conn := range u.conns() {
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
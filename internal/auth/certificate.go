@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+	"golang.org/x/crypto/ocsp"
+)
+
+// 节点证书的公钥即节点的 Curve25519 静态公钥，由内部 CA 签发。
+// Noise 握手证明对端持有该公钥对应的私钥，证书则证明该公钥属于 CA 认可的节点，
+// 因此握手中只需传输叶子证书，根证书由双方在 ca_file 中配置。
+
+// ocspTimeout 查询 OCSP 响应器的超时时间
+const ocspTimeout = 3 * time.Second
+
+// ocspCacheTime OCSP 响应未给出下次更新时间时的缓存时间
+const ocspCacheTime = time.Hour
+
+// ocspRefreshTime 缓存的 OCSP 响应在下次更新时间前多久开始后台刷新
+const ocspRefreshTime = 5 * time.Minute
+
+// ocspFailureTime 查询 OCSP 失败后的重试间隔，期间的校验直接返回缓存的失败结果
+const ocspFailureTime = 30 * time.Second
+
+var (
+	// ErrCertificateRevoked 证书已被吊销
+	ErrCertificateRevoked = errors.New("certificate revoked")
+	// ErrCertificateKeyMismatch 证书公钥与握手认证的静态公钥不一致
+	ErrCertificateKeyMismatch = errors.New("certificate key does not match handshake key")
+	// ErrCRLExpired 吊销列表已过期，需要 CA 重新签发
+	ErrCRLExpired = errors.New("certificate revocation list expired")
+	// ErrOCSPPending 正在后台查询证书的 OCSP 状态，查询完成前证书不被接受，对端应稍后重试
+	ErrOCSPPending = errors.New("certificate status pending")
+)
+
+// Certificate 本节点证书及对应的 Curve25519 静态密钥对
+type Certificate struct {
+	DER     []byte
+	Leaf    *x509.Certificate
+	KeyPair *crypto.KeyPair
+}
+
+// Identity 证书中的节点身份
+type Identity struct {
+	Name   string   // 节点名称，取自证书主题 CN
+	Groups []string // 节点所属组，取自证书主题 OU
+	IPs    []net.IP // 节点的虚拟 IP，取自证书的 IP 地址扩展
+	Serial *big.Int
+}
+
+// LoadCertificate 加载 PEM 格式的证书和 PKCS#8 编码的 X25519 私钥，并检查两者是否匹配
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s 不是 PEM 格式的证书", certFile)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析证书 %s 失败: %v", certFile, err)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s 不是 PEM 格式的 PKCS#8 私钥", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析私钥 %s 失败: %v", keyFile, err)
+	}
+	private, ok := key.(*ecdh.PrivateKey)
+	if !ok || private.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s 不是 X25519 私钥", keyFile)
+	}
+	kp, err := crypto.NewKeyPair(private.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := certificateKey(leaf)
+	if err != nil {
+		return nil, err
+	}
+	if public != kp.Public {
+		return nil, fmt.Errorf("证书 %s 与私钥 %s 不匹配", certFile, keyFile)
+	}
+	return &Certificate{DER: leaf.Raw, Leaf: leaf, KeyPair: kp}, nil
+}
+
+// certificateKey 返回证书中的 X25519 公钥。ParseCertificate 不解析 X25519 公钥，
+// 需要从原始 SubjectPublicKeyInfo 中解析
+func certificateKey(cert *x509.Certificate) ([crypto.KeySize]byte, error) {
+	var public [crypto.KeySize]byte
+	parsed, err := x509.ParsePKIXPublicKey(cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return public, fmt.Errorf("解析证书公钥失败: %v", err)
+	}
+	key, ok := parsed.(*ecdh.PublicKey)
+	if !ok || key.Curve() != ecdh.X25519() {
+		return public, errors.New("证书公钥不是 X25519 公钥")
+	}
+	copy(public[:], key.Bytes())
+	return public, nil
+}
+
+// ocspEntry 缓存的 OCSP 查询结果，expires 之前有效，refresh 之后在后台重新查询
+type ocspEntry struct {
+	err     error
+	expires time.Time
+	refresh time.Time
+}
+
+// Verifier 使用内部 CA 校验对端证书，并通过吊销列表和 OCSP 检查证书是否已吊销
+type Verifier struct {
+	roots   *x509.CertPool
+	issuers []*x509.Certificate
+
+	crlFile  string
+	crlMtime time.Time
+	crl      *x509.RevocationList
+	revoked  map[string]bool
+
+	ocsp        bool
+	ocspCache   map[string]ocspEntry
+	ocspPending map[string]chan struct{} // 正在查询的证书序列号，查询完成时关闭对应的通道
+	client      *http.Client
+
+	mutex sync.Mutex
+}
+
+// NewVerifier 从 caFile 加载受信任的 CA 证书。crlFile 非空时检查 CA 签发的吊销列表，
+// 文件变化后自动重新加载；checkOCSP 为 true 时向证书中声明的 OCSP 响应器查询证书状态。
+func NewVerifier(caFile, crlFile string, checkOCSP bool) (*Verifier, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	v := &Verifier{
+		roots:       x509.NewCertPool(),
+		crlFile:     crlFile,
+		ocsp:        checkOCSP,
+		ocspCache:   make(map[string]ocspEntry),
+		ocspPending: make(map[string]chan struct{}),
+		client:      &http.Client{Timeout: ocspTimeout},
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("解析 CA 证书失败: %v", err)
+		}
+		v.roots.AddCert(ca)
+		v.issuers = append(v.issuers, ca)
+	}
+	if len(v.issuers) == 0 {
+		return nil, fmt.Errorf("%s 中没有 CA 证书", caFile)
+	}
+
+	if crlFile != "" {
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		if err := v.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// VerifyNode 校验节点证书，证书公钥必须与握手中认证的静态公钥一致。
+// VerifyNode 在处理握手时调用，不等待 OCSP 查询：证书状态未知时在后台查询并返回 ErrOCSPPending
+func (v *Verifier) VerifyNode(der []byte, public [crypto.KeySize]byte) (*Identity, error) {
+	cert, err := v.verify(der, x509.ExtKeyUsageClientAuth, "", false)
+	if err != nil {
+		return nil, err
+	}
+	key, err := certificateKey(cert)
+	if err != nil {
+		return nil, err
+	}
+	if key != public {
+		return nil, ErrCertificateKeyMismatch
+	}
+	return &Identity{
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.OrganizationalUnit,
+		IPs:    cert.IPAddresses,
+		Serial: cert.SerialNumber,
+	}, nil
+}
+
+// VerifyServer 校验服务器证书，证书必须对 serverName（域名或 IP 地址）有效，返回服务器静态公钥。
+// 证书状态未知时等待 OCSP 查询完成
+func (v *Verifier) VerifyServer(der []byte, serverName string) ([crypto.KeySize]byte, error) {
+	cert, err := v.verify(der, x509.ExtKeyUsageServerAuth, serverName, true)
+	if err != nil {
+		return [crypto.KeySize]byte{}, err
+	}
+	return certificateKey(cert)
+}
+
+// verify 校验证书链、用途和吊销状态，返回叶子证书。wait 为 true 时等待 OCSP 查询完成
+func (v *Verifier) verify(der []byte, usage x509.ExtKeyUsage, name string, wait bool) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("解析证书失败: %v", err)
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:     v.roots,
+		DNSName:   name,
+		KeyUsages: []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 叶子证书本身被配置为 CA 时链中只有一个证书
+	chain := chains[0]
+	issuer := chain[len(chain)-1]
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+
+	v.mutex.Lock()
+	err = v.checkCRL(cert)
+	v.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkOCSP(cert, issuer, wait); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// checkCRL 检查证书是否在吊销列表中，吊销列表文件变化时重新加载
+func (v *Verifier) checkCRL(cert *x509.Certificate) error {
+	if v.crlFile == "" {
+		return nil
+	}
+	info, err := os.Stat(v.crlFile)
+	if err != nil {
+		return fmt.Errorf("读取吊销列表失败: %v", err)
+	}
+	if !info.ModTime().Equal(v.crlMtime) {
+		if err := v.loadCRL(); err != nil {
+			return err
+		}
+	}
+
+	if !v.crl.NextUpdate.IsZero() && time.Now().After(v.crl.NextUpdate) {
+		return ErrCRLExpired
+	}
+	if v.revoked[cert.SerialNumber.String()] {
+		return ErrCertificateRevoked
+	}
+	return nil
+}
+
+// loadCRL 加载并校验吊销列表，吊销列表必须由受信任的 CA 签名
+func (v *Verifier) loadCRL() error {
+	info, err := os.Stat(v.crlFile)
+	if err != nil {
+		return fmt.Errorf("读取吊销列表失败: %v", err)
+	}
+	data, err := os.ReadFile(v.crlFile)
+	if err != nil {
+		return fmt.Errorf("读取吊销列表失败: %v", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("解析吊销列表失败: %v", err)
+	}
+
+	signed := false
+	for _, issuer := range v.issuers {
+		if bytes.Equal(crl.RawIssuer, issuer.RawSubject) && crl.CheckSignatureFrom(issuer) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("吊销列表不是由受信任的 CA 签发")
+	}
+
+	v.crl = crl
+	v.crlMtime = info.ModTime()
+	v.revoked = make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		v.revoked[entry.SerialNumber.String()] = true
+	}
+	return nil
+}
+
+// checkOCSP 返回缓存的 OCSP 查询结果，缓存的响应接近下次更新时间时在后台刷新。
+// 没有有效结果时在后台向证书声明的 OCSP 响应器查询，wait 为 false 时不等待查询完成而返回 ErrOCSPPending，
+// 网络请求不会阻塞握手处理，也不持有锁。未声明响应器的证书只依赖吊销列表；响应器不可用时拒绝证书。
+func (v *Verifier) checkOCSP(cert, issuer *x509.Certificate, wait bool) error {
+	if !v.ocsp || len(cert.OCSPServer) == 0 {
+		return nil
+	}
+	serial := cert.SerialNumber.String()
+	now := time.Now()
+
+	v.mutex.Lock()
+	if entry, ok := v.ocspCache[serial]; ok && now.Before(entry.expires) {
+		if !now.Before(entry.refresh) {
+			v.fetchOCSP(serial, cert, issuer)
+		}
+		v.mutex.Unlock()
+		return entry.err
+	}
+	done := v.fetchOCSP(serial, cert, issuer)
+	v.mutex.Unlock()
+	if !wait {
+		return ErrOCSPPending
+	}
+
+	<-done
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.ocspCache[serial].err
+}
+
+// fetchOCSP 在后台查询证书状态并缓存结果，返回查询完成时关闭的通道。同一证书同时只有一个查询。
+// 调用方须持有锁
+func (v *Verifier) fetchOCSP(serial string, cert, issuer *x509.Certificate) chan struct{} {
+	if done, ok := v.ocspPending[serial]; ok {
+		return done
+	}
+	done := make(chan struct{})
+	v.ocspPending[serial] = done
+	go func() {
+		resp, err := v.queryOCSP(cert, issuer)
+		v.mutex.Lock()
+		v.storeOCSP(serial, resp, err)
+		delete(v.ocspPending, serial)
+		v.mutex.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// storeOCSP 缓存 OCSP 查询结果并清理过期的缓存。响应缓存到其下次更新时间；
+// 查询失败时仍有效的响应保留到下次更新时间，否则缓存失败结果 ocspFailureTime，避免每次握手都查询。
+// 调用方须持有锁
+func (v *Verifier) storeOCSP(serial string, resp *ocsp.Response, err error) {
+	now := time.Now()
+	for cached, entry := range v.ocspCache {
+		if !now.Before(entry.expires) {
+			delete(v.ocspCache, cached)
+		}
+	}
+
+	if err == nil && !resp.NextUpdate.IsZero() && !now.Before(resp.NextUpdate) {
+		err = errors.New("OCSP 响应已过期")
+	}
+	if err != nil {
+		if entry, ok := v.ocspCache[serial]; ok {
+			entry.refresh = now.Add(ocspFailureTime)
+			v.ocspCache[serial] = entry
+			return
+		}
+		v.ocspCache[serial] = ocspEntry{
+			err:     fmt.Errorf("查询 OCSP 失败: %v", err),
+			expires: now.Add(ocspFailureTime),
+			refresh: now.Add(ocspFailureTime),
+		}
+		return
+	}
+
+	entry := ocspEntry{expires: resp.NextUpdate}
+	if entry.expires.IsZero() {
+		entry.expires = now.Add(ocspCacheTime)
+	}
+	entry.refresh = entry.expires.Add(-ocspRefreshTime)
+	if lifetime := entry.expires.Sub(now); lifetime < 2*ocspRefreshTime {
+		entry.refresh = now.Add(lifetime / 2)
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		entry.err = ErrCertificateRevoked
+	default:
+		entry.err = errors.New("OCSP 响应器不认识该证书")
+	}
+	v.ocspCache[serial] = entry
+}
+
+func (v *Verifier) queryOCSP(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := v.client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP 响应器返回 %s", httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
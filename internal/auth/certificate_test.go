@@ -0,0 +1,380 @@
+package auth
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA 测试用 CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue 为 X25519 公钥签发证书
+func (ca *testCA) issue(t *testing.T, serial int64, public [crypto.KeySize]byte, usage x509.ExtKeyUsage, template x509.Certificate) []byte {
+	t.Helper()
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageKeyAgreement
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := CreateCertificate(&template, ca.cert, public, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// writeCRL 写入吊销 serials 的吊销列表
+func (ca *testCA) writeCRL(t *testing.T, nextUpdate time.Time, serials ...int64) string {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.write(t, "crl.pem", "X509 CRL", der)
+}
+
+func TestVerifyNode(t *testing.T) {
+	ca := newTestCA(t)
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := ca.issue(t, 2, kp.Public, x509.ExtKeyUsageClientAuth, x509.Certificate{
+		Subject: pkix.Name{CommonName: "branch-1", OrganizationalUnit: []string{"office", "printers"}},
+	})
+
+	crl := ca.writeCRL(t, time.Now().Add(time.Hour))
+	v, err := NewVerifier(filepath.Join(ca.dir, "ca.pem"), crl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := v.VerifyNode(der, kp.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Name != "branch-1" || len(identity.Groups) != 2 || identity.Groups[1] != "printers" {
+		t.Fatalf("identity %+v", identity)
+	}
+
+	other, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.VerifyNode(der, other.Public); !errors.Is(err, ErrCertificateKeyMismatch) {
+		t.Fatalf("other key: got %v, want ErrCertificateKeyMismatch", err)
+	}
+
+	server := ca.issue(t, 3, kp.Public, x509.ExtKeyUsageServerAuth, x509.Certificate{})
+	if _, err := v.VerifyNode(server, kp.Public); err == nil {
+		t.Fatal("server certificate accepted as node certificate")
+	}
+
+	// 吊销列表更新后立即生效
+	later := time.Now().Add(time.Second)
+	ca.writeCRL(t, time.Now().Add(time.Hour), 2)
+	os.Chtimes(crl, later, later)
+	if _, err := v.VerifyNode(der, kp.Public); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("revoked: got %v, want ErrCertificateRevoked", err)
+	}
+
+	later = later.Add(time.Second)
+	ca.writeCRL(t, time.Now().Add(-time.Minute))
+	os.Chtimes(crl, later, later)
+	if _, err := v.VerifyNode(der, kp.Public); !errors.Is(err, ErrCRLExpired) {
+		t.Fatalf("stale CRL: got %v, want ErrCRLExpired", err)
+	}
+}
+
+func TestVerifyServer(t *testing.T) {
+	ca := newTestCA(t)
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := ca.issue(t, 2, kp.Public, x509.ExtKeyUsageServerAuth, x509.Certificate{
+		DNSNames: []string{"vpn.example.com"},
+	})
+	v, err := NewVerifier(filepath.Join(ca.dir, "ca.pem"), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := v.VerifyServer(der, "vpn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public != kp.Public {
+		t.Fatal("server key mismatch")
+	}
+	if _, err := v.VerifyServer(der, "other.example.com"); err == nil {
+		t.Fatal("certificate accepted for the wrong name")
+	}
+
+	// 其他 CA 签发的证书不受信任
+	if _, err := v.VerifyServer(newTestCA(t).issue(t, 2, kp.Public, x509.ExtKeyUsageServerAuth, x509.Certificate{
+		DNSNames: []string{"vpn.example.com"},
+	}), "vpn.example.com"); err == nil {
+		t.Fatal("certificate from unknown CA accepted")
+	}
+}
+
+// testResponder 测试用 OCSP 响应器，按序列号返回预设状态，未预设的序列号返回 HTTP 错误
+type testResponder struct {
+	ca      *testCA
+	release chan struct{} // 关闭前响应器阻塞所有请求
+
+	mutex    sync.Mutex
+	status   map[int64]int
+	requests map[int64]int
+}
+
+func newTestResponder(t *testing.T, ca *testCA) (*testResponder, *httptest.Server) {
+	r := &testResponder{
+		ca:       ca,
+		release:  make(chan struct{}),
+		status:   make(map[int64]int),
+		requests: make(map[int64]int),
+	}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *testResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	<-r.release
+	body, _ := io.ReadAll(req.Body)
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serial := request.SerialNumber.Int64()
+	r.mutex.Lock()
+	r.requests[serial]++
+	status, ok := r.status[serial]
+	r.mutex.Unlock()
+	if !ok {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	resp, err := ocsp.CreateResponse(r.ca.cert, r.ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, r.ca.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+func (r *testResponder) count(serial int64) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.requests[serial]
+}
+
+// waitNode 等待后台 OCSP 查询完成，返回查询完成后的校验结果
+func waitNode(t *testing.T, v *Verifier, der []byte, public [crypto.KeySize]byte) error {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := v.VerifyNode(der, public)
+		if !errors.Is(err, ErrOCSPPending) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("OCSP query did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVerifyOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	responder, server := newTestResponder(t, ca)
+	responder.status[2] = ocsp.Good
+	responder.status[3] = ocsp.Revoked
+	responder.status[5] = ocsp.Good
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(serial int64, usage x509.ExtKeyUsage) []byte {
+		return ca.issue(t, serial, kp.Public, usage, x509.Certificate{
+			DNSNames:   []string{"vpn.example.com"},
+			OCSPServer: []string{server.URL},
+		})
+	}
+	good, revoked, unavailable := issue(2, x509.ExtKeyUsageClientAuth), issue(3, x509.ExtKeyUsageClientAuth), issue(4, x509.ExtKeyUsageClientAuth)
+	v, err := NewVerifier(filepath.Join(ca.dir, "ca.pem"), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 响应器阻塞时校验节点证书不等待查询，同一证书只有一个查询
+	for i := 0; i < 3; i++ {
+		if _, err := v.VerifyNode(good, kp.Public); !errors.Is(err, ErrOCSPPending) {
+			t.Fatalf("blocked responder: got %v, want ErrOCSPPending", err)
+		}
+	}
+	close(responder.release)
+	if err := waitNode(t, v, good, kp.Public); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitNode(t, v, revoked, kp.Public); !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("revoked: got %v, want ErrCertificateRevoked", err)
+	}
+	if err := waitNode(t, v, unavailable, kp.Public); err == nil {
+		t.Fatal("certificate accepted while the responder is unavailable")
+	}
+
+	// 响应缓存到下次更新时间，失败结果也被短暂缓存
+	for i := 0; i < 3; i++ {
+		v.VerifyNode(good, kp.Public)
+		v.VerifyNode(revoked, kp.Public)
+		if _, err := v.VerifyNode(unavailable, kp.Public); err == nil || errors.Is(err, ErrOCSPPending) {
+			t.Fatalf("cached failure: got %v", err)
+		}
+	}
+	for serial := int64(2); serial <= 4; serial++ {
+		if n := responder.count(serial); n != 1 {
+			t.Fatalf("serial %d queried %d times, want 1", serial, n)
+		}
+	}
+
+	// 接近下次更新时间时在后台刷新，刷新失败时仍使用有效的缓存响应
+	responder.mutex.Lock()
+	delete(responder.status, 2)
+	responder.mutex.Unlock()
+	v.mutex.Lock()
+	entry := v.ocspCache["2"]
+	entry.refresh = time.Now()
+	v.ocspCache["2"] = entry
+	v.mutex.Unlock()
+	if _, err := v.VerifyNode(good, kp.Public); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); responder.count(2) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("cached response not refreshed")
+		}
+	}
+	if err := waitNode(t, v, good, kp.Public); err != nil {
+		t.Fatalf("failed refresh: got %v, want the cached response", err)
+	}
+
+	// 校验服务器证书时等待查询完成
+	if _, err := v.VerifyServer(issue(5, x509.ExtKeyUsageServerAuth), "vpn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var public [crypto.KeySize]byte
+	copy(public[:], private.PublicKey().Bytes())
+	certFile := ca.write(t, "node.pem", "CERTIFICATE", ca.issue(t, 2, public, x509.ExtKeyUsageClientAuth, x509.Certificate{}))
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := ca.write(t, "node.key", "PRIVATE KEY", pkcs8)
+
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.KeyPair.Public != public {
+		t.Fatal("loaded key does not match certificate")
+	}
+
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err = x509.MarshalPKCS8PrivateKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCertificate(certFile, ca.write(t, "other.key", "PRIVATE KEY", pkcs8)); err == nil {
+		t.Fatal("mismatched key accepted")
+	}
+}
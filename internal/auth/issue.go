@@ -0,0 +1,117 @@
+package auth
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+// tbsPublicKeyField 证书 TBSCertificate 中 SubjectPublicKeyInfo 的位置（含显式版本号）
+const tbsPublicKeyField = 6
+
+// CreateCertificate 由 CA 为 X25519 公钥签发证书，返回 DER 编码的证书。
+//
+// 标准库只能解析而不能签发 X25519 公钥的证书，因此先以临时 ECDSA 公钥生成证书，
+// 再将其中的公钥替换为 X25519 公钥并用 CA 私钥重新签名，其余字段与模板一致。
+func CreateCertificate(template, parent *x509.Certificate, public [crypto.KeySize]byte, signer gocrypto.Signer) ([]byte, error) {
+	placeholder, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &placeholder.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := signatureHash(cert.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(public[:])
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 替换 TBSCertificate 中的公钥
+	var fields []asn1.RawValue
+	if rest, err := asn1.Unmarshal(cert.RawTBSCertificate, &fields); err != nil || len(rest) != 0 {
+		return nil, errors.New("无法解析证书内容")
+	}
+	if len(fields) <= tbsPublicKeyField {
+		return nil, errors.New("证书内容字段不完整")
+	}
+	fields[tbsPublicKeyField] = asn1.RawValue{FullBytes: spki}
+	tbs, err := asn1.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// 重新签名
+	digest := tbs
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbs)
+		digest = h.Sum(nil)
+	}
+	signature, err := signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var outer []asn1.RawValue
+	if rest, err := asn1.Unmarshal(der, &outer); err != nil || len(rest) != 0 || len(outer) != 3 {
+		return nil, errors.New("无法解析证书")
+	}
+	bits, err := asn1.Marshal(asn1.BitString{Bytes: signature, BitLength: len(signature) * 8})
+	if err != nil {
+		return nil, err
+	}
+	outer[0] = asn1.RawValue{FullBytes: tbs}
+	outer[2] = asn1.RawValue{FullBytes: bits}
+	der, err = asn1.Marshal(outer)
+	if err != nil {
+		return nil, err
+	}
+
+	// 确认结果可被解析且签名有效
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.CheckSignatureFrom(parent); err != nil {
+		return nil, fmt.Errorf("重新签名的证书无效: %v", err)
+	}
+	return der, nil
+}
+
+// signatureHash 返回签名算法使用的摘要算法，Ed25519 直接对原文签名
+func signatureHash(algorithm x509.SignatureAlgorithm) (gocrypto.Hash, error) {
+	switch algorithm {
+	case x509.ECDSAWithSHA256, x509.SHA256WithRSA:
+		return gocrypto.SHA256, nil
+	case x509.ECDSAWithSHA384, x509.SHA384WithRSA:
+		return gocrypto.SHA384, nil
+	case x509.ECDSAWithSHA512, x509.SHA512WithRSA:
+		return gocrypto.SHA512, nil
+	case x509.PureEd25519:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("不支持的 CA 签名算法 %v", algorithm)
+	}
+}
@@ -0,0 +1,216 @@
+// Package auth 管理节点入网授权。
+//
+// 服务器只接受已授权静态公钥发起的握手。已授权公钥来自配置文件中的静态列表，
+// 或由节点在握手中出示有效的预授权密钥后登记，登记结果持久化保存在状态文件中，
+// 之后该节点无需再提供预授权密钥。预授权密钥分为一次性和可重复使用两种，均可设置过期时间。
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+// MinPreAuthKeyLength 预授权密钥的最短长度，过短的密钥容易被猜中
+const MinPreAuthKeyLength = 16
+
+var (
+	// ErrUnauthorized 节点未授权且未提供预授权密钥
+	ErrUnauthorized = errors.New("node not authorized")
+	// ErrInvalidPreAuthKey 预授权密钥不存在
+	ErrInvalidPreAuthKey = errors.New("invalid pre-auth key")
+	// ErrPreAuthKeyExpired 预授权密钥已过期
+	ErrPreAuthKeyExpired = errors.New("pre-auth key expired")
+	// ErrPreAuthKeyUsed 一次性预授权密钥已被使用
+	ErrPreAuthKeyUsed = errors.New("pre-auth key already used")
+)
+
+// PreAuthKey 预授权密钥
+type PreAuthKey struct {
+	Key      string
+	Reusable bool      // 是否可供多个节点重复使用，否则只能登记一个节点
+	Expires  time.Time // 过期时间，零值表示永不过期
+}
+
+// Node 已登记的节点
+type Node struct {
+	NodeID     string    `json:"node_id"`
+	PublicKey  string    `json:"public_key"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+}
+
+// state 持久化保存的登记状态
+type state struct {
+	Nodes    []Node   `json:"nodes"`
+	UsedKeys []string `json:"used_keys"` // 已使用的一次性预授权密钥的 SHA-256 摘要
+}
+
+// Registry 节点授权表
+type Registry struct {
+	path     string
+	keys     []PreAuthKey
+	static   map[[crypto.KeySize]byte]bool
+	nodes    map[[crypto.KeySize]byte]Node
+	usedKeys map[string]bool
+	mutex    sync.Mutex
+}
+
+// NewRegistry 创建节点授权表并从状态文件 path 加载已登记的节点，文件不存在时视为空表。
+// authorized 为配置中静态授权的公钥，keys 为可用的预授权密钥。
+func NewRegistry(path string, keys []PreAuthKey, authorized [][crypto.KeySize]byte) (*Registry, error) {
+	for _, key := range keys {
+		if len(key.Key) < MinPreAuthKeyLength {
+			return nil, fmt.Errorf("预授权密钥长度不能少于 %d 个字符", MinPreAuthKeyLength)
+		}
+	}
+
+	r := &Registry{
+		path:     path,
+		keys:     keys,
+		static:   make(map[[crypto.KeySize]byte]bool),
+		nodes:    make(map[[crypto.KeySize]byte]Node),
+		usedKeys: make(map[string]bool),
+	}
+	for _, public := range authorized {
+		r.static[public] = true
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("解析授权状态文件 %s 失败: %v", path, err)
+	}
+	for _, node := range st.Nodes {
+		public, err := crypto.ParsePublicKey(node.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("授权状态文件 %s 中的节点 %s: %v", path, node.NodeID, err)
+		}
+		r.nodes[public] = node
+	}
+	for _, digest := range st.UsedKeys {
+		r.usedKeys[digest] = true
+	}
+	return r, nil
+}
+
+// IsAuthorized 判断静态公钥是否已授权
+func (r *Registry) IsAuthorized(public [crypto.KeySize]byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.isAuthorized(public)
+}
+
+func (r *Registry) isAuthorized(public [crypto.KeySize]byte) bool {
+	if r.static[public] {
+		return true
+	}
+	_, ok := r.nodes[public]
+	return ok
+}
+
+// Authorize 检查握手发起方是否已授权。未授权的节点提供有效的预授权密钥时完成登记，
+// enrolled 表示本次调用登记了新节点。
+func (r *Registry) Authorize(public [crypto.KeySize]byte, preAuthKey string) (enrolled bool, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.isAuthorized(public) {
+		return false, nil
+	}
+	if preAuthKey == "" {
+		return false, ErrUnauthorized
+	}
+
+	key := r.lookup(preAuthKey)
+	if key == nil {
+		return false, ErrInvalidPreAuthKey
+	}
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		return false, ErrPreAuthKeyExpired
+	}
+	digest := keyDigest(preAuthKey)
+	if !key.Reusable && r.usedKeys[digest] {
+		return false, ErrPreAuthKeyUsed
+	}
+
+	// 先持久化再生效，保存失败时不登记节点，一次性密钥也不会被消耗
+	node := Node{
+		NodeID:     crypto.NodeID(public),
+		PublicKey:  crypto.EncodeKey(public),
+		EnrolledAt: time.Now().UTC(),
+	}
+	r.nodes[public] = node
+	if !key.Reusable {
+		r.usedKeys[digest] = true
+	}
+	if err := r.save(); err != nil {
+		delete(r.nodes, public)
+		if !key.Reusable {
+			delete(r.usedKeys, digest)
+		}
+		return false, fmt.Errorf("保存授权状态失败: %v", err)
+	}
+	return true, nil
+}
+
+// Nodes 返回所有已登记的节点，不包括配置中静态授权的公钥
+func (r *Registry) Nodes() []Node {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	nodes := make([]Node, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// lookup 以常量时间比较查找预授权密钥
+func (r *Registry) lookup(preAuthKey string) *PreAuthKey {
+	var found *PreAuthKey
+	for i := range r.keys {
+		if subtle.ConstantTimeCompare([]byte(r.keys[i].Key), []byte(preAuthKey)) == 1 {
+			found = &r.keys[i]
+		}
+	}
+	return found
+}
+
+// save 保存登记状态
+func (r *Registry) save() error {
+	st := state{
+		Nodes:    make([]Node, 0, len(r.nodes)),
+		UsedKeys: make([]string, 0, len(r.usedKeys)),
+	}
+	for _, node := range r.nodes {
+		st.Nodes = append(st.Nodes, node)
+	}
+	for digest := range r.usedKeys {
+		st.UsedKeys = append(st.UsedKeys, digest)
+	}
+	data, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, data)
+}
+
+// keyDigest 计算预授权密钥的摘要，状态文件中不保存密钥明文
+func keyDigest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+func newPublicKey(t *testing.T) [crypto.KeySize]byte {
+	t.Helper()
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp.Public
+}
+
+func TestAuthorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	keys := []PreAuthKey{
+		{Key: "single-use-0123456789"},
+		{Key: "reusable-0123456789", Reusable: true},
+		{Key: "expired-0123456789", Reusable: true, Expires: time.Now().Add(-time.Minute)},
+	}
+	static := newPublicKey(t)
+	r, err := NewRegistry(path, keys, [][crypto.KeySize]byte{static})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b, c, d := newPublicKey(t), newPublicKey(t), newPublicKey(t), newPublicKey(t)
+	tests := []struct {
+		name     string
+		public   [crypto.KeySize]byte
+		key      string
+		enrolled bool
+		err      error
+	}{
+		{"static key", static, "", false, nil},
+		{"unknown node", a, "", false, ErrUnauthorized},
+		{"wrong key", a, "wrong-0123456789abcd", false, ErrInvalidPreAuthKey},
+		{"expired key", a, "expired-0123456789", false, ErrPreAuthKeyExpired},
+		{"single use", a, "single-use-0123456789", true, nil},
+		{"already enrolled", a, "", false, nil},
+		{"single use reused", b, "single-use-0123456789", false, ErrPreAuthKeyUsed},
+		{"reusable", b, "reusable-0123456789", true, nil},
+		{"reusable again", c, "reusable-0123456789", true, nil},
+	}
+	for _, tt := range tests {
+		enrolled, err := r.Authorize(tt.public, tt.key)
+		if enrolled != tt.enrolled || !errors.Is(err, tt.err) {
+			t.Errorf("%s: got (%v, %v), want (%v, %v)", tt.name, enrolled, err, tt.enrolled, tt.err)
+		}
+	}
+
+	// 重新加载后保留登记的节点和已使用的一次性密钥
+	reloaded, err := NewRegistry(path, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, public := range [][crypto.KeySize]byte{a, b, c} {
+		if !reloaded.IsAuthorized(public) {
+			t.Errorf("node %s lost after reload", crypto.NodeID(public))
+		}
+	}
+	if reloaded.IsAuthorized(static) {
+		t.Error("static key persisted to the state file")
+	}
+	if _, err := reloaded.Authorize(d, "single-use-0123456789"); !errors.Is(err, ErrPreAuthKeyUsed) {
+		t.Errorf("single-use key after reload: got %v, want ErrPreAuthKeyUsed", err)
+	}
+}
+
+func TestNewRegistryRejectsShortKey(t *testing.T) {
+	if _, err := NewRegistry(filepath.Join(t.TempDir(), "nodes.json"), []PreAuthKey{{Key: "short"}}, nil); err == nil {
+		t.Fatal("short pre-auth key accepted")
+	}
+}
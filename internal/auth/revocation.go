@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+// ErrNodeRevoked 节点已被吊销
+var ErrNodeRevoked = errors.New("node revoked")
+
+// RevokedNode 已吊销的节点
+type RevokedNode struct {
+	NodeID    string    `json:"node_id"`
+	PublicKey string    `json:"public_key,omitempty"` // 以公钥吊销时记录，便于核对
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// RevocationList 已吊销节点列表，以节点 ID 标识节点。节点 ID 由身份公钥派生，
+// 吊销后该身份的握手均被拒绝，节点只能以新的身份重新申请授权。
+//
+// 列表保存在状态文件中，可由其他进程（如 revoke 子命令）修改，服务器通过 Reload 感知变化。
+type RevocationList struct {
+	path    string
+	modTime time.Time
+	nodes   map[string]RevokedNode
+	mutex   sync.Mutex
+}
+
+// NewRevocationList 创建吊销列表并从状态文件 path 加载，文件不存在时视为空表；
+// path 为空时只保存在内存中
+func NewRevocationList(path string) (*RevocationList, error) {
+	l := &RevocationList{
+		path:  path,
+		nodes: make(map[string]RevokedNode),
+	}
+	if _, err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ParseNodeTarget 将节点 ID 或 Base64 编码的身份公钥解析为节点 ID，公钥无法解析时返回错误
+func ParseNodeTarget(target string) (nodeID, publicKey string, err error) {
+	if IsNodeID(target) {
+		return target, "", nil
+	}
+	public, err := crypto.ParsePublicKey(target)
+	if err != nil {
+		return "", "", fmt.Errorf("%q 既不是节点 ID 也不是公钥: %v", target, err)
+	}
+	return crypto.NodeID(public), target, nil
+}
+
+// IsNodeID 判断 s 是否为由公钥派生的节点 ID
+func IsNodeID(s string) bool {
+	id, ok := strings.CutPrefix(s, "node-")
+	if !ok || len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// IsRevoked 判断节点是否已被吊销
+func (l *RevocationList) IsRevoked(nodeID string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, ok := l.nodes[nodeID]
+	return ok
+}
+
+// Revoke 吊销节点 ID 或公钥 target 对应的节点并保存，节点已被吊销时 added 为 false
+func (l *RevocationList) Revoke(target, reason string) (node RevokedNode, added bool, err error) {
+	nodeID, publicKey, err := ParseNodeTarget(target)
+	if err != nil {
+		return RevokedNode{}, false, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if existing, ok := l.nodes[nodeID]; ok {
+		return existing, false, nil
+	}
+
+	// 先持久化再生效，保存失败时不修改列表
+	node = RevokedNode{
+		NodeID:    nodeID,
+		PublicKey: publicKey,
+		Reason:    reason,
+		RevokedAt: time.Now().UTC(),
+	}
+	l.nodes[nodeID] = node
+	if err := l.save(); err != nil {
+		delete(l.nodes, nodeID)
+		return RevokedNode{}, false, fmt.Errorf("保存吊销列表失败: %v", err)
+	}
+	return node, true, nil
+}
+
+// Nodes 返回所有已吊销的节点，按吊销时间排序
+func (l *RevocationList) Nodes() []RevokedNode {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.sorted(l.nodes)
+}
+
+// Reload 状态文件被修改后重新加载，返回新增的吊销节点。从文件中删除的节点随之恢复。
+func (l *RevocationList) Reload() ([]RevokedNode, error) {
+	if l.path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if info.ModTime().Equal(l.modTime) {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+	var st struct {
+		Nodes []RevokedNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("解析吊销列表 %s 失败: %v", l.path, err)
+	}
+
+	nodes := make(map[string]RevokedNode, len(st.Nodes))
+	added := make(map[string]RevokedNode)
+	for _, node := range st.Nodes {
+		if !IsNodeID(node.NodeID) {
+			return nil, fmt.Errorf("吊销列表 %s 中的节点 ID %q 无效", l.path, node.NodeID)
+		}
+		nodes[node.NodeID] = node
+		if _, ok := l.nodes[node.NodeID]; !ok {
+			added[node.NodeID] = node
+		}
+	}
+	l.nodes = nodes
+	l.modTime = info.ModTime()
+	return l.sorted(added), nil
+}
+
+// sorted 返回按吊销时间排序的节点
+func (l *RevocationList) sorted(nodes map[string]RevokedNode) []RevokedNode {
+	list := make([]RevokedNode, 0, len(nodes))
+	for _, node := range nodes {
+		list = append(list, node)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].RevokedAt.Equal(list[j].RevokedAt) {
+			return list[i].RevokedAt.Before(list[j].RevokedAt)
+		}
+		return list[i].NodeID < list[j].NodeID
+	})
+	return list
+}
+
+// save 将吊销列表写入临时文件后重命名，并记录新的修改时间，避免 Reload 重复加载自己的修改
+func (l *RevocationList) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(struct {
+		Nodes []RevokedNode `json:"nodes"`
+	}{l.sorted(l.nodes)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.path, data); err != nil {
+		return err
+	}
+	if info, err := os.Stat(l.path); err == nil {
+		l.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// writeFileAtomic 写入临时文件后重命名，避免中断时留下不完整的文件
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+func TestRevocationList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	l, err := NewRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeID := crypto.NodeID(kp.Public)
+
+	for _, target := range []string{"", "node-xyz", "node-0123", "bm90IGEga2V5"} {
+		if _, _, err := l.Revoke(target, ""); err == nil {
+			t.Fatalf("invalid target %q accepted", target)
+		}
+	}
+
+	node, added, err := l.Revoke(crypto.EncodeKey(kp.Public), "lost laptop")
+	if err != nil || !added || node.NodeID != nodeID {
+		t.Fatalf("revoke by key: %+v %v %v", node, added, err)
+	}
+	if _, added, err := l.Revoke(nodeID, ""); err != nil || added {
+		t.Fatalf("revoke twice: added %v, err %v", added, err)
+	}
+	if !l.IsRevoked(nodeID) {
+		t.Fatal("node not revoked")
+	}
+	// 本进程的修改不会被当作新增重复加载
+	if added, err := l.Reload(); err != nil || len(added) != 0 {
+		t.Fatalf("reload own change: %+v %v", added, err)
+	}
+
+	// 其他进程加载到相同的列表，并可吊销更多节点
+	other, err := NewRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := other.Nodes(); len(nodes) != 1 || nodes[0].Reason != "lost laptop" {
+		t.Fatalf("persisted nodes %+v", nodes)
+	}
+	if _, _, err := other.Revoke("node-0123456789abcdef", ""); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	reloaded, err := l.Reload()
+	if err != nil || len(reloaded) != 1 || reloaded[0].NodeID != "node-0123456789abcdef" {
+		t.Fatalf("reload: %+v %v", reloaded, err)
+	}
+
+	// 从文件中删除的节点恢复
+	if err := os.WriteFile(path, []byte(`{"nodes": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Second)
+	os.Chtimes(path, later, later)
+	if _, err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if l.IsRevoked(nodeID) {
+		t.Fatal("node still revoked after removal from file")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"nodes": [{"node_id": "bogus"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Second)
+	os.Chtimes(path, later, later)
+	if _, err := l.Reload(); err == nil {
+		t.Fatal("invalid node ID accepted")
+	}
+	if _, err := NewRevocationList(path); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("invalid file: %v", err)
+	}
+}
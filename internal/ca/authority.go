@@ -0,0 +1,425 @@
+// Package ca 实现内置的证书颁发机构，为服务器和节点签发证书。
+//
+// CA 的全部状态保存在一个本地目录中：
+//
+//	ca.pem    CA 证书，分发给所有节点作为 security.ca_file
+//	ca.key    CA 私钥（ECDSA P-256，PKCS#8），只应保存在签发证书的机器上
+//	ca.json   已签发证书的记录，包括吊销状态
+//	crl.pem   吊销列表，分发给服务器作为 security.crl_file
+//	certs/    已签发的证书副本，按序列号命名
+//
+// 签发的证书公钥为节点的 X25519 身份密钥，主题 CN 为节点名称，OU 为节点所属组，
+// 节点证书的 IP 地址扩展为节点的虚拟 IP，服务器证书的域名和 IP 地址扩展为客户端连接时使用的地址。
+package ca
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/auth"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+// CA 目录中的文件名
+const (
+	CertFile  = "ca.pem"
+	KeyFile   = "ca.key"
+	StateFile = "ca.json"
+	CRLFile   = "crl.pem"
+	CertsDir  = "certs"
+)
+
+// 证书类型
+const (
+	KindServer = "server"
+	KindNode   = "node"
+)
+
+// DefaultCRLValidity 吊销列表的默认有效期，过期前需要重新签发
+const DefaultCRLValidity = 30 * 24 * time.Hour
+
+var (
+	// ErrExists 目录中已存在 CA
+	ErrExists = errors.New("CA already exists")
+	// ErrNotFound 没有匹配的证书
+	ErrNotFound = errors.New("certificate not found")
+)
+
+// Record 已签发证书的记录
+type Record struct {
+	Serial    string    `json:"serial"` // 十六进制序列号
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Groups    []string  `json:"groups,omitempty"`
+	IPs       []net.IP  `json:"ips,omitempty"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	PublicKey string    `json:"public_key"`
+	NodeID    string    `json:"node_id"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// Revoked 判断证书是否已吊销
+func (r *Record) Revoked() bool {
+	return !r.RevokedAt.IsZero()
+}
+
+// state 持久化保存在 ca.json 中的状态
+type state struct {
+	CRLNumber    int64    `json:"crl_number"`
+	CRLValidity  string   `json:"crl_validity"`
+	Certificates []Record `json:"certificates"`
+}
+
+// Authority 本地目录中的证书颁发机构
+type Authority struct {
+	dir   string
+	cert  *x509.Certificate
+	key   *ecdsa.PrivateKey
+	state state
+}
+
+// IssueRequest 签发证书的参数
+type IssueRequest struct {
+	Kind     string
+	Name     string
+	Groups   []string
+	IPs      []net.IP // 节点证书为虚拟 IP，服务器证书为客户端连接时使用的 IP
+	DNSNames []string // 仅服务器证书使用
+	Validity time.Duration
+}
+
+// Issued 签发结果，私钥只在签发时返回，CA 不保存
+type Issued struct {
+	Record  Record
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// Init 在 dir 中创建新的 CA，validity 为 CA 证书有效期
+func Init(dir, name string, validity time.Duration) (*Authority, error) {
+	if _, err := os.Stat(filepath.Join(dir, KeyFile)); err == nil {
+		return nil, ErrExists
+	}
+	if err := os.MkdirAll(filepath.Join(dir, CertsDir), 0o700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(dir, KeyFile), pemBlock("PRIVATE KEY", pkcs8), 0o600); err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(dir, CertFile), pemBlock("CERTIFICATE", der), 0o644); err != nil {
+		return nil, err
+	}
+
+	a := &Authority{
+		dir:   dir,
+		cert:  cert,
+		key:   key,
+		state: state{CRLValidity: DefaultCRLValidity.String()},
+	}
+	if err := a.WriteCRL(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Open 打开 dir 中已有的 CA
+func Open(dir string) (*Authority, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, CertFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s 不是 PEM 格式的证书", CertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(filepath.Join(dir, KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s 不是 PEM 格式的私钥", KeyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CA 私钥不是 ECDSA 私钥")
+	}
+
+	a := &Authority{dir: dir, cert: cert, key: key}
+	data, err := os.ReadFile(filepath.Join(dir, StateFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.state); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", StateFile, err)
+	}
+	return a, nil
+}
+
+// Certificate 返回 CA 证书
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// CRLValidity 返回吊销列表的有效期
+func (a *Authority) CRLValidity() time.Duration {
+	validity, err := time.ParseDuration(a.state.CRLValidity)
+	if err != nil || validity <= 0 {
+		return DefaultCRLValidity
+	}
+	return validity
+}
+
+// SetCRLValidity 设置吊销列表的有效期，下次签发吊销列表时生效
+func (a *Authority) SetCRLValidity(validity time.Duration) {
+	a.state.CRLValidity = validity.String()
+}
+
+// Issue 生成新的 X25519 密钥并签发证书
+func (a *Authority) Issue(req IssueRequest) (*Issued, error) {
+	var usage x509.ExtKeyUsage
+	switch req.Kind {
+	case KindServer:
+		usage = x509.ExtKeyUsageServerAuth
+		if len(req.IPs) == 0 && len(req.DNSNames) == 0 {
+			return nil, errors.New("服务器证书至少需要一个域名或 IP 地址")
+		}
+	case KindNode:
+		usage = x509.ExtKeyUsageClientAuth
+		if len(req.DNSNames) > 0 {
+			return nil, errors.New("节点证书不能包含域名")
+		}
+	default:
+		return nil, fmt.Errorf("未知的证书类型 %q", req.Kind)
+	}
+	if req.Name == "" {
+		return nil, errors.New("证书名称不能为空")
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var public [crypto.KeySize]byte
+	copy(public[:], private.PublicKey().Bytes())
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(req.Validity)
+	if notAfter.After(a.cert.NotAfter) {
+		notAfter = a.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.Name, OrganizationalUnit: req.Groups},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  req.IPs,
+		DNSNames:     req.DNSNames,
+	}
+	der, err := auth.CreateCertificate(template, a.cert, public, a.key)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	record := Record{
+		Serial:    serial.Text(16),
+		Kind:      req.Kind,
+		Name:      req.Name,
+		Groups:    req.Groups,
+		IPs:       req.IPs,
+		DNSNames:  req.DNSNames,
+		PublicKey: crypto.EncodeKey(public),
+		NodeID:    crypto.NodeID(public),
+		NotBefore: template.NotBefore.UTC(),
+		NotAfter:  notAfter.UTC(),
+	}
+	certPEM := pemBlock("CERTIFICATE", der)
+	if err := writeFile(filepath.Join(a.dir, CertsDir, record.Serial+".pem"), certPEM, 0o644); err != nil {
+		return nil, err
+	}
+	a.state.Certificates = append(a.state.Certificates, record)
+	if err := a.save(); err != nil {
+		return nil, err
+	}
+	return &Issued{Record: record, CertPEM: certPEM, KeyPEM: pemBlock("PRIVATE KEY", pkcs8)}, nil
+}
+
+// List 返回所有已签发证书的记录，按签发时间排序
+func (a *Authority) List() []Record {
+	records := append([]Record{}, a.state.Certificates...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].NotBefore.Before(records[j].NotBefore)
+	})
+	return records
+}
+
+// Revoke 吊销序列号或名称与 match 相符的所有未吊销证书，并重新签发吊销列表
+func (a *Authority) Revoke(match string) ([]Record, error) {
+	var revoked []Record
+	now := time.Now().UTC()
+	for i := range a.state.Certificates {
+		record := &a.state.Certificates[i]
+		if record.Revoked() || (!strings.EqualFold(record.Serial, match) && record.Name != match) {
+			continue
+		}
+		record.RevokedAt = now
+		revoked = append(revoked, *record)
+	}
+	if len(revoked) == 0 {
+		return nil, ErrNotFound
+	}
+	if err := a.WriteCRL(); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// WriteCRL 签发包含所有已吊销证书的吊销列表并保存状态，吊销列表有效期见 CRLValidity
+func (a *Authority) WriteCRL() error {
+	a.state.CRLNumber++
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(a.state.CRLNumber),
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(a.CRLValidity()),
+	}
+	for _, record := range a.state.Certificates {
+		if !record.Revoked() {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(record.Serial, 16)
+		if !ok {
+			return fmt.Errorf("证书记录中的序列号 %q 无效", record.Serial)
+		}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: record.RevokedAt,
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, a.cert, a.key)
+	if err != nil {
+		return err
+	}
+	// 先保存递增后的编号，避免签发两份编号相同的吊销列表
+	if err := a.save(); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(a.dir, CRLFile), pemBlock("X509 CRL", der), 0o644)
+}
+
+// save 保存 CA 状态
+func (a *Authority) save() error {
+	data, err := json.MarshalIndent(&a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(a.dir, StateFile), data, 0o600)
+}
+
+// newSerial 生成 128 位随机序列号，序列号必须为正数
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+func pemBlock(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+// writeFile 先写入临时文件再重命名，避免中断时留下不完整的文件
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
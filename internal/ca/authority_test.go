@@ -0,0 +1,120 @@
+package ca
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/auth"
+)
+
+// writeIssued 将签发结果写入 dir，返回证书和私钥路径
+func writeIssued(t *testing.T, dir string, issued *Issued) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, issued.Record.Name+".pem")
+	keyFile := filepath.Join(dir, issued.Record.Name+".key")
+	if err := os.WriteFile(certFile, issued.CertPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, issued.KeyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestIssueAndRevoke(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Init(dir, "test ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Init(dir, "test ca", 24*time.Hour); !errors.Is(err, ErrExists) {
+		t.Fatalf("second init: got %v, want ErrExists", err)
+	}
+
+	node, err := a.Issue(IssueRequest{
+		Kind:     KindNode,
+		Name:     "branch-1",
+		Groups:   []string{"office"},
+		IPs:      []net.IP{net.ParseIP("10.0.0.2")},
+		Validity: 365 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.Record.NotAfter.Equal(a.Certificate().NotAfter.UTC()) {
+		t.Fatalf("certificate outlives the CA: %v", node.Record.NotAfter)
+	}
+	server, err := a.Issue(IssueRequest{Kind: KindServer, Name: "server", DNSNames: []string{"vpn.example.com"}, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Issue(IssueRequest{Kind: KindServer, Name: "nameless"}); err == nil {
+		t.Fatal("server certificate without addresses accepted")
+	}
+	if _, err := a.Issue(IssueRequest{Kind: KindNode, Name: "branch-2", DNSNames: []string{"x"}}); err == nil {
+		t.Fatal("node certificate with DNS names accepted")
+	}
+
+	// 签发的证书可被加载并通过校验
+	certFile, keyFile := writeIssued(t, dir, node)
+	cert, err := auth.LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := auth.NewVerifier(filepath.Join(dir, CertFile), filepath.Join(dir, CRLFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := v.VerifyNode(cert.DER, cert.KeyPair.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Name != "branch-1" || len(identity.Groups) != 1 || len(identity.IPs) != 1 || !identity.IPs[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("identity %+v", identity)
+	}
+	serverFile, serverKey := writeIssued(t, dir, server)
+	serverCert, err := auth.LoadCertificate(serverFile, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.VerifyServer(serverCert.DER, "vpn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后状态一致
+	a, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := a.List(); len(records) != 2 || records[0].Name != "branch-1" || records[0].NodeID != node.Record.NodeID {
+		t.Fatalf("records %+v", records)
+	}
+
+	if _, err := a.Revoke("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("revoke unknown: got %v, want ErrNotFound", err)
+	}
+	revoked, err := a.Revoke("branch-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].Serial != node.Record.Serial {
+		t.Fatalf("revoked %+v", revoked)
+	}
+	if _, err := a.Revoke(node.Record.Serial); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("revoke twice: got %v, want ErrNotFound", err)
+	}
+
+	// 吊销列表更新后校验失败
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filepath.Join(dir, CRLFile), later, later)
+	if _, err := v.VerifyNode(cert.DER, cert.KeyPair.Public); !errors.Is(err, auth.ErrCertificateRevoked) {
+		t.Fatalf("revoked: got %v, want ErrCertificateRevoked", err)
+	}
+	if _, err := v.VerifyServer(serverCert.DER, "vpn.example.com"); err != nil {
+		t.Fatalf("server certificate affected by revocation: %v", err)
+	}
+}
@@ -1,46 +1,116 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
 
+	"github.com/fenghuilee/sd-wan/internal/auth"
+	"github.com/fenghuilee/sd-wan/internal/ipam"
+	"github.com/fenghuilee/sd-wan/internal/network"
+	"github.com/fenghuilee/sd-wan/internal/protocol"
+	"github.com/fenghuilee/sd-wan/internal/relay"
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
 	"github.com/spf13/viper"
 )
 
 // ServerConfig 服务器配置
 type ServerConfig struct {
-	Host     string `mapstructure:"host"`
+	Host     string `mapstructure:"host"`  // 监听地址，通配地址（0.0.0.0 或 ::）同时接收 IPv4 和 IPv6 报文
+	Host6    string `mapstructure:"host6"` // host 为具体的 IPv4 地址时另外监听的 IPv6 地址，端口与 port 相同
 	Port     int    `mapstructure:"port"`
-	CertFile string `mapstructure:"cert_file"`
-	KeyFile  string `mapstructure:"key_file"`
+	CertFile string `mapstructure:"cert_file"` // 服务器证书（PEM），设置后服务器以证书中的密钥作为身份
+	KeyFile  string `mapstructure:"key_file"`  // 服务器证书对应的 X25519 私钥（PKCS#8 PEM）
+
+	STUNAlternateIP   string `mapstructure:"stun_alternate_ip"`   // STUN 响应器的备用地址，须为本机的另一个地址
+	STUNAlternatePort int    `mapstructure:"stun_alternate_port"` // STUN 响应器的备用端口
 }
 
 // ClientConfig 客户端配置
 type ClientConfig struct {
-	ServerAddress string `mapstructure:"server_address"`
-	DeviceName    string `mapstructure:"device_name"`
-	MTU           int    `mapstructure:"mtu"`
+	ServerAddress string   `mapstructure:"server_address"`
+	DeviceName    string   `mapstructure:"device_name"`
+	MTU           int      `mapstructure:"mtu"`
+	CertFile      string   `mapstructure:"cert_file"`   // 节点证书（PEM），设置后客户端以证书中的密钥作为身份
+	KeyFile       string   `mapstructure:"key_file"`    // 节点证书对应的 X25519 私钥（PKCS#8 PEM）
+	ServerName    string   `mapstructure:"server_name"` // 校验服务器证书时使用的名称，默认取 server_address 中的主机
+	Address       []string `mapstructure:"address"`     // 本节点的虚拟地址，双栈时可同时配置 IPv4 和 IPv6 地址，留空时使用节点证书中声明的虚拟 IP
+	Queues        int      `mapstructure:"queues"`      // TUN 接口的队列数，即并行加密和发送数据包的工作协程数，0 表示 CPU 核数
+	Routes        []string `mapstructure:"routes"`      // 本节点向其他节点通告的网段（如身后的局域网），服务器校验后推送给所有节点
 }
 
 // NetworkConfig 网络配置
 type NetworkConfig struct {
 	Subnet    string `mapstructure:"subnet"`
+	Subnet6   string `mapstructure:"subnet6"` // 与 subnet 并存的 IPv6 ULA 前缀（如 fd00:10::/64），组成双栈虚拟网络
 	DNS       string `mapstructure:"dns"`
 	KeepAlive int    `mapstructure:"keep_alive"`
 	Reconnect int    `mapstructure:"reconnect"`
+	// 服务器从 subnet 和 subnet6 为节点各分配一个虚拟地址
+	Reservations map[string][]string `mapstructure:"reservations"` // 按节点 ID 静态保留的地址，每个网段至多一个
+	Exclude      []string            `mapstructure:"exclude"`      // 不参与动态分配的地址、地址段（a-b）或网段
+	AddressFile  string              `mapstructure:"address_file"` // 已分配地址的状态文件，相对路径基于配置文件所在目录
+	// 虚拟网络模式，服务器与客户端须相同：tun 转发 IP 包，tap 转发以太网帧，可将各节点的局域网桥接为同一个二层网段
+	Mode       string `mapstructure:"mode"`
+	MACAgeing  int    `mapstructure:"mac_ageing"`  // TAP 模式下 MAC 地址表项的老化时间（秒）
+	FloodRate  int    `mapstructure:"flood_rate"`  // TAP 模式下每个节点每秒最多泛洪的广播、组播和未知单播帧数，0 表示不限制
+	FloodBurst int    `mapstructure:"flood_burst"` // TAP 模式下每个节点可突发泛洪的帧数
+	ARPProxy   bool   `mapstructure:"arp_proxy"`   // TAP 模式下以学习到的地址代答 ARP 请求和 IPv6 邻居请求，减少跨广域网的广播
 }
 
 // NATConfig NAT穿透配置
 type NATConfig struct {
 	RelayServer string `mapstructure:"relay_server"`
 	RelayPort   int    `mapstructure:"relay_port"`
+	STUNServer  string `mapstructure:"stun_server"` // 客户端探测公网地址和 NAT 类型使用的 STUN 服务器，留空时使用 client.server_address
+	// 对称 NAT 生日攻击穿透的上限，为 0 时使用默认值
+	TraversalSockets int `mapstructure:"traversal_sockets"` // 对称 NAT 一侧额外打开的套接字数
+	TraversalProbes  int `mapstructure:"traversal_probes"`  // 另一侧最多探测的端口数
+	// 中继服务，服务器与中继服务配置相同的 relay_secret，留空时不使用中继
+	RelaySecret    string `mapstructure:"relay_secret"`     // 服务器签发中继票据、中继服务校验票据的共享密钥
+	RelayTicketTTL int    `mapstructure:"relay_ticket_ttl"` // 中继票据的有效期（秒）
+	RelayRateLimit int    `mapstructure:"relay_rate_limit"` // 中继服务每个会话每秒最多转发的字节数，0 表示不限制
+	RelayBurst     int    `mapstructure:"relay_burst"`      // 中继服务每个会话可突发转发的字节数
+	// 标准 TURN 服务器（如 coturn），客户端在其上分配中继地址作为打洞失败后的回退，留空时不使用
+	TURNServer   string `mapstructure:"turn_server"`   // TURN 服务器的地址（host:port）
+	TURNUsername string `mapstructure:"turn_username"` // 长期凭据的用户名
+	TURNPassword string `mapstructure:"turn_password"` // 长期凭据的密码
 }
 
 // SecurityConfig 加密配置
 type SecurityConfig struct {
-	Encryption           bool   `yaml:"encryption"`
-	Algorithm            string `yaml:"algorithm"`
-	HardwareAcceleration bool   `yaml:"hardware_acceleration"`
-	KeySize              int    `yaml:"key_size"`
+	Encryption           bool     `mapstructure:"encryption"`
+	Algorithm            string   `mapstructure:"algorithm"`
+	HardwareAcceleration bool     `mapstructure:"hardware_acceleration"`
+	KeySize              int      `mapstructure:"key_size"`
+	AllowedAlgorithms    []string `mapstructure:"allowed_algorithms"`   // 服务器允许协商的算法，留空表示全部支持的算法
+	PrivateKey           string   `mapstructure:"private_key"`          // 本节点 Curve25519 静态私钥（Base64），优先于 identity_file
+	IdentityFile         string   `mapstructure:"identity_file"`        // 本节点身份密钥文件，不存在时自动生成，相对路径基于配置文件所在目录
+	ServerPublicKey      string   `mapstructure:"server_public_key"`    // 服务器静态公钥（Base64），客户端握手时使用
+	RekeyAfterTime       int      `mapstructure:"rekey_after_time"`     // 会话密钥轮换周期（秒）
+	RekeyAfterMessages   uint64   `mapstructure:"rekey_after_messages"` // 单个会话密钥最多发送的消息数
+
+	RequireAuthorization bool               `mapstructure:"require_authorization"` // 服务器只接受已授权节点的握手，仅在加密模式下生效
+	AuthorizedKeys       []string           `mapstructure:"authorized_keys"`       // 静态授权的节点公钥（Base64）
+	AuthorizedNodesFile  string             `mapstructure:"authorized_nodes_file"` // 通过预授权密钥登记的节点，相对路径基于配置文件所在目录
+	PreAuthKeys          []PreAuthKeyConfig `mapstructure:"preauth_keys"`          // 服务器接受的预授权密钥
+	PreAuthKey           string             `mapstructure:"preauth_key"`           // 客户端首次入网时使用的预授权密钥
+	RevokedNodesFile     string             `mapstructure:"revoked_nodes_file"`    // 服务器的已吊销节点列表，文件更新后自动生效，相对路径基于配置文件所在目录
+
+	CAFile  string `mapstructure:"ca_file"`  // 内部 CA 证书（PEM），用于校验对端证书
+	CRLFile string `mapstructure:"crl_file"` // CA 签发的吊销列表，文件更新后自动重新加载
+	OCSP    bool   `mapstructure:"ocsp"`     // 是否向证书中声明的 OCSP 响应器查询证书状态
+}
+
+// PreAuthKeyConfig 预授权密钥配置
+type PreAuthKeyConfig struct {
+	Key      string `mapstructure:"key"`
+	Reusable bool   `mapstructure:"reusable"` // 是否可供多个节点使用
+	Expires  string `mapstructure:"expires"`  // 过期时间（RFC 3339），留空表示永不过期
 }
 
 // Config 总配置结构
@@ -49,13 +119,27 @@ type Config struct {
 	Client   ClientConfig   `mapstructure:"client"`
 	Network  NetworkConfig  `mapstructure:"network"`
 	NAT      NATConfig      `mapstructure:"nat"`
-	Security SecurityConfig `yaml:"security"`
+	Security SecurityConfig `mapstructure:"security"`
 }
 
 // LoadConfig 加载配置
 func LoadConfig(path string) (*Config, error) {
 	viper.SetConfigFile(path)
 	viper.AutomaticEnv()
+	viper.SetDefault("security.algorithm", "aes-256-gcm")
+	viper.SetDefault("security.rekey_after_time", 120)
+	viper.SetDefault("security.rekey_after_messages", uint64(1)<<60)
+	viper.SetDefault("security.identity_file", "identity.key")
+	viper.SetDefault("security.require_authorization", true)
+	viper.SetDefault("security.authorized_nodes_file", "authorized_nodes.json")
+	viper.SetDefault("security.revoked_nodes_file", "revoked_nodes.json")
+	viper.SetDefault("network.address_file", "addresses.json")
+	viper.SetDefault("network.mode", "tun")
+	viper.SetDefault("network.mac_ageing", 300)
+	viper.SetDefault("network.flood_rate", 200)
+	viper.SetDefault("network.arp_proxy", true)
+	viper.SetDefault("nat.relay_ticket_ttl", 600)
+	viper.SetDefault("nat.relay_rate_limit", 1<<20)
 
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, err
@@ -66,15 +150,198 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	for _, file := range []*string{
+		&config.Server.CertFile, &config.Server.KeyFile,
+		&config.Client.CertFile, &config.Client.KeyFile,
+		&config.Security.IdentityFile, &config.Security.AuthorizedNodesFile, &config.Security.RevokedNodesFile,
+		&config.Security.CAFile, &config.Security.CRLFile,
+		&config.Network.AddressFile,
+	} {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(filepath.Dir(path), *file)
+		}
+	}
+
 	return &config, nil
 }
 
 // GetServerAddr 获取服务器地址
 func (c *Config) GetServerAddr() string {
-	return fmt.Sprintf("%s:%d", c.Server.Host, c.Server.Port)
+	return net.JoinHostPort(c.Server.Host, strconv.Itoa(c.Server.Port))
+}
+
+// GetServerAddr6 获取服务器另外监听的 IPv6 地址，未配置 host6 时返回空
+func (c *Config) GetServerAddr6() string {
+	if c.Server.Host6 == "" {
+		return ""
+	}
+	return net.JoinHostPort(c.Server.Host6, strconv.Itoa(c.Server.Port))
 }
 
 // GetRelayAddr 获取中继服务器地址
 func (c *Config) GetRelayAddr() string {
-	return fmt.Sprintf("%s:%d", c.NAT.RelayServer, c.NAT.RelayPort)
+	return net.JoinHostPort(c.NAT.RelayServer, strconv.Itoa(c.NAT.RelayPort))
+}
+
+// GetSubnets 获取虚拟网段：subnet 及与之并存的 IPv6 前缀 subnet6，未配置的网段不包含在内
+func (c *Config) GetSubnets() ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	if c.Network.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(c.Network.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("解析 network.subnet 失败: %v", err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	if c.Network.Subnet6 != "" {
+		_, subnet, err := net.ParseCIDR(c.Network.Subnet6)
+		if err != nil {
+			return nil, fmt.Errorf("解析 network.subnet6 失败: %v", err)
+		}
+		if subnet.IP.To4() != nil {
+			return nil, fmt.Errorf("network.subnet6 %s 不是 IPv6 前缀", subnet)
+		}
+		if len(subnets) > 0 && subnets[0].IP.To4() == nil {
+			return nil, errors.New("network.subnet 与 network.subnet6 都是 IPv6 网段")
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// GetRelaySecret 获取服务器与中继服务共享的票据密钥，未配置时返回 nil
+func (c *Config) GetRelaySecret() ([]byte, error) {
+	if c.NAT.RelaySecret == "" {
+		return nil, nil
+	}
+	if len(c.NAT.RelaySecret) < relay.MinSecretLength {
+		return nil, fmt.Errorf("nat.relay_secret 至少需要 %d 个字符", relay.MinSecretLength)
+	}
+	return []byte(c.NAT.RelaySecret), nil
+}
+
+// GetRelayLimits 获取中继服务对每个会话的限制
+func (c *Config) GetRelayLimits() relay.Limits {
+	return relay.Limits{Rate: c.NAT.RelayRateLimit, Burst: c.NAT.RelayBurst}
+}
+
+// GetQueues 获取 TUN 接口的队列数，未配置时取 CPU 核数
+func (c *Config) GetQueues() int {
+	if c.Client.Queues > 0 {
+		return c.Client.Queues
+	}
+	return runtime.NumCPU()
+}
+
+// GetMode 获取虚拟网络模式，见 protocol.Mode* 常量
+func (c *Config) GetMode() (uint8, error) {
+	switch c.Network.Mode {
+	case "", "tun":
+		return protocol.ModeTUN, nil
+	case "tap":
+		return protocol.ModeTAP, nil
+	}
+	return 0, fmt.Errorf("未知的 network.mode %q，可选 tun 或 tap", c.Network.Mode)
+}
+
+// GetBridgeConfig 获取 TAP 模式的二层转发设置
+func (c *Config) GetBridgeConfig() network.BridgeConfig {
+	return network.BridgeConfig{
+		Ageing:     time.Duration(c.Network.MACAgeing) * time.Second,
+		FloodRate:  c.Network.FloodRate,
+		FloodBurst: c.Network.FloodBurst,
+		Proxy:      c.Network.ARPProxy,
+	}
+}
+
+// GetRekeyPolicy 获取会话密钥轮换策略
+func (c *Config) GetRekeyPolicy() crypto.RekeyPolicy {
+	policy := crypto.DefaultRekeyPolicy()
+	if c.Security.RekeyAfterTime > 0 {
+		policy.RekeyAfterTime = time.Duration(c.Security.RekeyAfterTime) * time.Second
+	}
+	if c.Security.RekeyAfterMessages > 0 && c.Security.RekeyAfterMessages < crypto.RejectAfterMessages {
+		policy.RekeyAfterMessages = c.Security.RekeyAfterMessages
+	}
+	return policy
+}
+
+// LoadIdentity 加载本节点身份密钥：优先使用 private_key，否则从 identity_file 加载，
+// 文件不存在时生成并保存新密钥。created 表示本次生成了新密钥。
+func (c *Config) LoadIdentity() (identity *crypto.KeyPair, created bool, err error) {
+	if c.Security.PrivateKey != "" {
+		identity, err = crypto.ParseKeyPair(c.Security.PrivateKey)
+		return identity, false, err
+	}
+	if c.Security.IdentityFile == "" {
+		return nil, false, fmt.Errorf("未配置 security.private_key 或 security.identity_file")
+	}
+	return crypto.LoadOrCreateKeyPair(c.Security.IdentityFile)
+}
+
+// LoadRegistry 根据 security 配置创建节点授权表
+func (c *Config) LoadRegistry() (*auth.Registry, error) {
+	keys := make([]auth.PreAuthKey, 0, len(c.Security.PreAuthKeys))
+	for _, key := range c.Security.PreAuthKeys {
+		preAuthKey := auth.PreAuthKey{Key: key.Key, Reusable: key.Reusable}
+		if key.Expires != "" {
+			expires, err := time.Parse(time.RFC3339, key.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("解析预授权密钥过期时间失败: %v", err)
+			}
+			preAuthKey.Expires = expires
+		}
+		keys = append(keys, preAuthKey)
+	}
+
+	authorized := make([][crypto.KeySize]byte, 0, len(c.Security.AuthorizedKeys))
+	for _, encoded := range c.Security.AuthorizedKeys {
+		public, err := crypto.ParsePublicKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		authorized = append(authorized, public)
+	}
+
+	return auth.NewRegistry(c.Security.AuthorizedNodesFile, keys, authorized)
+}
+
+// LoadRevocations 加载服务器的已吊销节点列表，未配置 revoked_nodes_file 时只保存在内存中
+func (c *Config) LoadRevocations() (*auth.RevocationList, error) {
+	return auth.NewRevocationList(c.Security.RevokedNodesFile)
+}
+
+// LoadAllocator 根据 network 配置创建服务器的虚拟地址分配器，未配置 subnet 和 subnet6 时返回 nil
+func (c *Config) LoadAllocator() (*ipam.Allocator, error) {
+	subnets, err := c.GetSubnets()
+	if err != nil || len(subnets) == 0 {
+		return nil, err
+	}
+	reservations := make(map[string][]net.IP, len(c.Network.Reservations))
+	for nodeID, addresses := range c.Network.Reservations {
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("节点 %s 的保留地址 %q 无效", nodeID, address)
+			}
+			reservations[nodeID] = append(reservations[nodeID], ip)
+		}
+	}
+	excluded := make([]ipam.Range, 0, len(c.Network.Exclude))
+	for _, s := range c.Network.Exclude {
+		r, err := ipam.ParseRange(s)
+		if err != nil {
+			return nil, err
+		}
+		excluded = append(excluded, r)
+	}
+	return ipam.New(c.Network.AddressFile, subnets, reservations, excluded)
+}
+
+// LoadVerifier 根据 security 配置创建证书校验器，未配置 ca_file 时返回 nil
+func (c *Config) LoadVerifier() (*auth.Verifier, error) {
+	if c.Security.CAFile == "" {
+		return nil, nil
+	}
+	return auth.NewVerifier(c.Security.CAFile, c.Security.CRLFile, c.Security.OCSP)
 }
@@ -0,0 +1,440 @@
+// Package ipam 为节点分配虚拟网段内的地址。
+//
+// 服务器在节点握手时按节点 ID 分配地址，同时配置 IPv4 网段和 IPv6 前缀时每个节点各得到一个地址，分配结果持久化保存在状态文件中，
+// 同一节点重新连接或服务器重启后仍得到相同的地址。配置中的静态保留地址只分配给指定节点，
+// 排除的地址段不参与动态分配。
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrExhausted 网段内已没有可分配的地址
+	ErrExhausted = errors.New("address pool exhausted")
+)
+
+// Range 一段连续的地址，包含首尾
+type Range struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+// ParseRange 解析单个地址（10.0.0.1）、地址段（10.0.0.100-10.0.0.199）或网段（10.0.0.64/26）
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		prefix = prefix.Masked()
+		return Range{Start: prefix.Addr(), End: lastAddr(prefix)}, nil
+	}
+	first, last, found := strings.Cut(s, "-")
+	start, err := netip.ParseAddr(strings.TrimSpace(first))
+	if err != nil {
+		return Range{}, fmt.Errorf("无效的地址段 %q", s)
+	}
+	end := start
+	if found {
+		if end, err = netip.ParseAddr(strings.TrimSpace(last)); err != nil {
+			return Range{}, fmt.Errorf("无效的地址段 %q", s)
+		}
+	}
+	start, end = start.Unmap(), end.Unmap()
+	if start.BitLen() != end.BitLen() || end.Less(start) {
+		return Range{}, fmt.Errorf("无效的地址段 %q", s)
+	}
+	return Range{Start: start, End: end}, nil
+}
+
+// Contains 判断地址是否在地址段内
+func (r Range) Contains(addr netip.Addr) bool {
+	return r.Start.Compare(addr) <= 0 && addr.Compare(r.End) <= 0
+}
+
+func (r Range) String() string {
+	if r.Start == r.End {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+// Allocation 一个节点分配到的地址
+type Allocation struct {
+	NodeID      string    `json:"node_id"`
+	Address     string    `json:"address"`
+	AllocatedAt time.Time `json:"allocated_at"`
+}
+
+// state 持久化保存的分配状态
+type state struct {
+	Allocations []Allocation `json:"allocations"`
+}
+
+// Allocator 虚拟地址分配器，可同时管理多个网段（如 IPv4 网段和 IPv6 ULA 前缀），
+// 每个节点在每个网段内各分配一个地址
+type Allocator struct {
+	path     string
+	pools    []*pool
+	excluded []Range
+
+	mutex  sync.Mutex
+	owners map[netip.Addr]string // 已分配或保留的地址及其节点 ID
+}
+
+// pool 一个网段的保留地址和已分配地址
+type pool struct {
+	prefix      netip.Prefix
+	reserved    map[string]netip.Addr // 静态保留的地址，按节点 ID 索引
+	allocations map[string]Allocation // 按节点 ID 索引
+}
+
+// New 创建网段 subnets 的地址分配器，并从状态文件 path 加载已有的分配，文件不存在时视为没有分配。
+// 各网段不能重叠。reservations 为按节点 ID 静态保留的地址，每个网段至多一个；excluded 为不参与动态分配的地址段。
+// 网段或保留地址变化后，状态文件中不再有效的分配被丢弃，对应节点下次握手时重新分配。
+func New(path string, subnets []*net.IPNet, reservations map[string][]net.IP, excluded []Range) (*Allocator, error) {
+	if len(subnets) == 0 {
+		return nil, errors.New("未指定分配地址的网段")
+	}
+	a := &Allocator{
+		path:     path,
+		excluded: excluded,
+		owners:   make(map[netip.Addr]string),
+	}
+	for _, subnet := range subnets {
+		ones, bits := subnet.Mask.Size()
+		addr, ok := netip.AddrFromSlice(subnet.IP)
+		if !ok || bits == 0 {
+			return nil, fmt.Errorf("无效的网段 %s", subnet)
+		}
+		addr = addr.Unmap()
+		if addr.BitLen() != bits {
+			return nil, fmt.Errorf("无效的网段 %s", subnet)
+		}
+		prefix := netip.PrefixFrom(addr, ones).Masked()
+		for _, p := range a.pools {
+			if p.prefix.Overlaps(prefix) {
+				return nil, fmt.Errorf("网段 %s 与 %s 重叠", prefix, p.prefix)
+			}
+		}
+		a.pools = append(a.pools, &pool{
+			prefix:      prefix,
+			reserved:    make(map[string]netip.Addr),
+			allocations: make(map[string]Allocation),
+		})
+	}
+	for nodeID, ips := range reservations {
+		for _, ip := range ips {
+			reserved, ok := netip.AddrFromSlice(ip)
+			reserved = reserved.Unmap()
+			p := a.pool(reserved)
+			if !ok || p == nil || !p.usable(reserved) {
+				return nil, fmt.Errorf("节点 %s 的保留地址 %s 不是网段 %s 内可用的地址", nodeID, ip, a.prefixes())
+			}
+			if existing, ok := p.reserved[nodeID]; ok {
+				return nil, fmt.Errorf("节点 %s 在网段 %s 内保留了多个地址 %s 和 %s", nodeID, p.prefix, existing, reserved)
+			}
+			if owner, ok := a.owners[reserved]; ok {
+				return nil, fmt.Errorf("地址 %s 同时保留给节点 %s 和 %s", reserved, owner, nodeID)
+			}
+			p.reserved[nodeID] = reserved
+			a.owners[reserved] = nodeID
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("解析地址分配状态文件 %s 失败: %v", path, err)
+	}
+	for _, allocation := range st.Allocations {
+		addr, err := netip.ParseAddr(allocation.Address)
+		if err != nil {
+			continue
+		}
+		p := a.pool(addr)
+		if p == nil || !a.dynamic(p, addr) {
+			continue
+		}
+		if _, ok := p.reserved[allocation.NodeID]; ok {
+			continue
+		}
+		if _, ok := p.allocations[allocation.NodeID]; ok {
+			continue
+		}
+		if _, ok := a.owners[addr]; ok {
+			continue
+		}
+		p.allocations[allocation.NodeID] = allocation
+		a.owners[addr] = allocation.NodeID
+	}
+	return a, nil
+}
+
+// Subnets 返回分配地址的网段
+func (a *Allocator) Subnets() []*net.IPNet {
+	subnets := make([]*net.IPNet, 0, len(a.pools))
+	for _, p := range a.pools {
+		subnets = append(subnets, &net.IPNet{
+			IP:   p.prefix.Addr().AsSlice(),
+			Mask: net.CIDRMask(p.prefix.Bits(), p.prefix.Addr().BitLen()),
+		})
+	}
+	return subnets
+}
+
+// Lookup 返回节点在各网段内的保留地址或已分配的地址，没有时返回空
+func (a *Allocator) Lookup(nodeID string) []net.IP {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var ips []net.IP
+	for _, p := range a.pools {
+		if addr, ok := p.lookup(nodeID); ok {
+			ips = append(ips, addr.AsSlice())
+		}
+	}
+	return ips
+}
+
+// Allocate 返回节点在每个网段内的地址，顺序与网段相同：保留地址优先，其次是此前分配的地址，否则分配一个新地址。
+// requested 为节点希望使用的地址，落在某个网段内且可用时优先分配，否则分配该网段内第一个空闲地址。
+// 任一网段的地址耗尽时返回 ErrExhausted，其他网段也不分配
+func (a *Allocator) Allocate(nodeID string, requested []net.IP) ([]net.IP, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ips := make([]net.IP, 0, len(a.pools))
+	added := make(map[*pool]netip.Addr)
+	rollback := func() {
+		for p, addr := range added {
+			delete(p.allocations, nodeID)
+			delete(a.owners, addr)
+		}
+	}
+	for _, p := range a.pools {
+		if addr, ok := p.lookup(nodeID); ok {
+			ips = append(ips, addr.AsSlice())
+			continue
+		}
+		addr, ok := a.requested(p, requested)
+		if !ok {
+			if addr, ok = a.free(p); !ok {
+				rollback()
+				return nil, fmt.Errorf("%w: %s", ErrExhausted, p.prefix)
+			}
+		}
+		p.allocations[nodeID] = Allocation{NodeID: nodeID, Address: addr.String(), AllocatedAt: time.Now().UTC()}
+		a.owners[addr] = nodeID
+		added[p] = addr
+		ips = append(ips, addr.AsSlice())
+	}
+	if len(added) == 0 {
+		return ips, nil
+	}
+
+	// 先持久化再生效，保存失败时不分配
+	if err := a.save(); err != nil {
+		rollback()
+		return nil, fmt.Errorf("保存地址分配状态失败: %v", err)
+	}
+	return ips, nil
+}
+
+// Release 释放节点在各网段内动态分配的地址，保留地址不受影响。released 表示本次调用释放了地址
+func (a *Allocator) Release(nodeID string) (released bool, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	removed := make(map[*pool]Allocation)
+	for _, p := range a.pools {
+		if allocation, ok := p.allocations[nodeID]; ok {
+			addr, _ := netip.ParseAddr(allocation.Address)
+			delete(p.allocations, nodeID)
+			delete(a.owners, addr)
+			removed[p] = allocation
+		}
+	}
+	if len(removed) == 0 {
+		return false, nil
+	}
+	if err := a.save(); err != nil {
+		for p, allocation := range removed {
+			addr, _ := netip.ParseAddr(allocation.Address)
+			p.allocations[nodeID] = allocation
+			a.owners[addr] = nodeID
+		}
+		return false, fmt.Errorf("保存地址分配状态失败: %v", err)
+	}
+	return true, nil
+}
+
+// Allocations 返回所有动态分配的地址，不包括保留地址
+func (a *Allocator) Allocations() []Allocation {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.allocations()
+}
+
+func (a *Allocator) allocations() []Allocation {
+	var allocations []Allocation
+	for _, p := range a.pools {
+		for _, allocation := range p.allocations {
+			allocations = append(allocations, allocation)
+		}
+	}
+	return allocations
+}
+
+// pool 返回包含地址的网段
+func (a *Allocator) pool(addr netip.Addr) *pool {
+	for _, p := range a.pools {
+		if p.prefix.Contains(addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// prefixes 返回所有网段，用于错误信息
+func (a *Allocator) prefixes() string {
+	prefixes := make([]string, 0, len(a.pools))
+	for _, p := range a.pools {
+		prefixes = append(prefixes, p.prefix.String())
+	}
+	return strings.Join(prefixes, ", ")
+}
+
+// requested 返回节点请求的地址中落在网段 p 内、可以动态分配且未被占用的地址
+func (a *Allocator) requested(p *pool, requested []net.IP) (netip.Addr, bool) {
+	for _, ip := range requested {
+		addr, ok := netip.AddrFromSlice(ip)
+		addr = addr.Unmap()
+		if !ok || !p.prefix.Contains(addr) {
+			continue
+		}
+		if _, used := a.owners[addr]; !used && a.dynamic(p, addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// lookup 返回节点在网段内的保留地址或已分配的地址
+func (p *pool) lookup(nodeID string) (netip.Addr, bool) {
+	if addr, ok := p.reserved[nodeID]; ok {
+		return addr, true
+	}
+	if allocation, ok := p.allocations[nodeID]; ok {
+		addr, err := netip.ParseAddr(allocation.Address)
+		return addr, err == nil
+	}
+	return netip.Addr{}, false
+}
+
+// usable 判断地址是否为网段内可分配给节点的地址。IPv4 的网络地址和广播地址、
+// IPv6 的子网路由器任播地址除外
+func (p *pool) usable(addr netip.Addr) bool {
+	if !p.prefix.Contains(addr) {
+		return false
+	}
+	if addr.Is4() && p.prefix.Bits() < 31 {
+		return addr != p.prefix.Addr() && addr != lastAddr(p.prefix)
+	}
+	if addr.Is6() && p.prefix.Bits() < 127 {
+		return addr != p.prefix.Addr()
+	}
+	return true
+}
+
+// dynamic 判断地址是否可以在网段 p 内动态分配，即可用且不在排除的地址段内
+func (a *Allocator) dynamic(p *pool, addr netip.Addr) bool {
+	_, excluded := a.excludedRange(addr)
+	return p.usable(addr) && !excluded
+}
+
+// free 返回网段 p 内第一个可以动态分配且未被占用的地址
+func (a *Allocator) free(p *pool) (netip.Addr, bool) {
+	last := lastAddr(p.prefix)
+	for addr := p.prefix.Addr(); addr.IsValid() && addr.Compare(last) <= 0; addr = addr.Next() {
+		// 跳过整个排除的地址段，避免逐个检查大段的排除地址
+		if r, ok := a.excludedRange(addr); ok {
+			addr = r.End
+			continue
+		}
+		if _, used := a.owners[addr]; !used && p.usable(addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// excludedRange 返回包含地址的排除地址段
+func (a *Allocator) excludedRange(addr netip.Addr) (Range, bool) {
+	for _, r := range a.excluded {
+		if r.Contains(addr) {
+			return r, true
+		}
+	}
+	return Range{}, false
+}
+
+// save 保存分配状态
+func (a *Allocator) save() error {
+	st := state{Allocations: a.allocations()}
+	if st.Allocations == nil {
+		st.Allocations = []Allocation{}
+	}
+	data, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path, data)
+}
+
+// lastAddr 返回网段内的最后一个地址
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// writeFileAtomic 写入临时文件后重命名，避免中断时留下不完整的文件
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,216 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustSubnets(t *testing.T, subnets ...string) []*net.IPNet {
+	t.Helper()
+	var parsed []*net.IPNet
+	for _, s := range subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, subnet)
+	}
+	return parsed
+}
+
+func ips(addrs ...string) []net.IP {
+	var parsed []net.IP
+	for _, addr := range addrs {
+		parsed = append(parsed, net.ParseIP(addr))
+	}
+	return parsed
+}
+
+func mustRanges(t *testing.T, ranges ...string) []Range {
+	t.Helper()
+	var parsed []Range
+	for _, s := range ranges {
+		r, err := ParseRange(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.100 - 10.0.0.199", "10.0.0.100-10.0.0.199", true},
+		{"10.0.0.70/26", "10.0.0.64-10.0.0.127", true},
+		{"fd00::10-fd00::1f", "fd00::10-fd00::1f", true},
+		{"10.0.0.9-10.0.0.1", "", false},
+		{"10.0.0.1-fd00::1", "", false},
+		{"10.0.0", "", false},
+	}
+	for _, tt := range tests {
+		r, err := ParseRange(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && r.String() != tt.want) {
+			t.Errorf("ParseRange(%q) = %v, %v", tt.in, r, err)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	reservations := map[string][]net.IP{"node-r": ips("10.0.0.5")}
+	a, err := New(path, mustSubnets(t, "10.0.0.0/29"), reservations, mustRanges(t, "10.0.0.1-10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		nodeID    string
+		requested string
+		want      string
+		err       error
+	}{
+		// 网络地址和排除的地址段跳过
+		{"first free", "node-a", "", "10.0.0.3", nil},
+		{"sticky", "node-a", "10.0.0.6", "10.0.0.3", nil},
+		{"reserved", "node-r", "10.0.0.4", "10.0.0.5", nil},
+		{"requested", "node-b", "10.0.0.6", "10.0.0.6", nil},
+		// 请求的地址已保留、被排除或是广播地址时分配空闲地址
+		{"requested reserved", "node-c", "10.0.0.5", "10.0.0.4", nil},
+		{"exhausted", "node-d", "10.0.0.7", "", ErrExhausted},
+	}
+	for _, tt := range tests {
+		got, err := a.Allocate(tt.nodeID, ips(tt.requested))
+		if !errors.Is(err, tt.err) || (err == nil && (len(got) != 1 || got[0].String() != tt.want)) {
+			t.Fatalf("%s: Allocate(%s) = %v, %v", tt.name, tt.nodeID, got, err)
+		}
+	}
+
+	// 重启后分配保持不变
+	a, err = New(path, mustSubnets(t, "10.0.0.0/29"), reservations, mustRanges(t, "10.0.0.1-10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Allocations()) != 3 {
+		t.Fatalf("allocations = %v", a.Allocations())
+	}
+	if got := a.Lookup("node-b"); len(got) != 1 || got[0].String() != "10.0.0.6" {
+		t.Fatalf("node-b = %v", got)
+	}
+
+	// 释放后地址可再分配，保留地址不能释放
+	if released, err := a.Release("node-b"); err != nil || !released {
+		t.Fatalf("release = %v, %v", released, err)
+	}
+	if released, _ := a.Release("node-r"); released {
+		t.Fatal("released a reserved address")
+	}
+	if got, err := a.Allocate("node-d", nil); err != nil || got[0].String() != "10.0.0.6" {
+		t.Fatalf("node-d = %v, %v", got, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	a, err := New(path, mustSubnets(t, "fd00::/64"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IPv6 跳过子网路由器任播地址
+	for _, nodeID := range []string{"node-a", "node-b", "node-c"} {
+		if _, err := a.Allocate(nodeID, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := a.Lookup("node-a"); len(got) != 1 || got[0].String() != "fd00::1" {
+		t.Fatalf("node-a = %v", got)
+	}
+
+	// 新的保留地址和排除的地址段使冲突的分配失效
+	reservations := map[string][]net.IP{"node-c": ips("fd00::100"), "node-r": ips("fd00::1")}
+	a, err = New(path, mustSubnets(t, "fd00::/64"), reservations, mustRanges(t, "fd00::2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for nodeID, want := range map[string]string{"node-a": "[]", "node-b": "[]", "node-c": "[fd00::100]"} {
+		if got := a.Lookup(nodeID); fmt.Sprint(got) != want {
+			t.Fatalf("%s = %v, want %s", nodeID, got, want)
+		}
+	}
+	if got, err := a.Allocate("node-a", ips("fd00::2")); err != nil || got[0].String() != "fd00::3" {
+		t.Fatalf("node-a = %v, %v", got, err)
+	}
+
+	// 网段变化后旧的分配全部失效
+	if a, err = New(path, mustSubnets(t, "fd01::/64"), nil, nil); err != nil || len(a.Allocations()) != 0 {
+		t.Fatalf("allocations = %v, %v", a.Allocations(), err)
+	}
+
+	if _, err := New(path, mustSubnets(t, "10.0.0.0/24"), map[string][]net.IP{"node-a": ips("10.0.1.1")}, nil); err == nil {
+		t.Fatal("accepted a reservation outside the subnet")
+	}
+	duplicate := map[string][]net.IP{"node-a": ips("10.0.0.9"), "node-b": ips("10.0.0.9")}
+	if _, err := New(path, mustSubnets(t, "10.0.0.0/24"), duplicate, nil); err == nil {
+		t.Fatal("accepted a duplicate reservation")
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(path, mustSubnets(t, "10.0.0.0/24"), nil, nil); err == nil {
+		t.Fatal("accepted a corrupt state file")
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	subnets := mustSubnets(t, "10.0.0.0/30", "fd00:1::/64")
+	reservations := map[string][]net.IP{"node-r": ips("fd00:1::100")}
+	a, err := New(path, subnets, reservations, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个网段各分配一个地址，请求的地址按所在网段使用
+	got, err := a.Allocate("node-a", ips("fd00:1::9"))
+	if err != nil || fmt.Sprint(got) != "[10.0.0.1 fd00:1::9]" {
+		t.Fatalf("node-a = %v, %v", got, err)
+	}
+	// 保留地址只覆盖其所在的网段
+	if got, err = a.Allocate("node-r", nil); err != nil || fmt.Sprint(got) != "[10.0.0.2 fd00:1::100]" {
+		t.Fatalf("node-r = %v, %v", got, err)
+	}
+	// 任一网段耗尽时不分配任何地址
+	if got, err = a.Allocate("node-b", nil); !errors.Is(err, ErrExhausted) || len(a.Allocations()) != 3 {
+		t.Fatalf("node-b = %v, %v, allocations %v", got, err, a.Allocations())
+	}
+
+	// 去掉 IPv6 前缀后只保留 IPv4 的分配
+	a, err = New(path, subnets[:1], nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Lookup("node-a"); fmt.Sprint(got) != "[10.0.0.1]" {
+		t.Fatalf("node-a = %v", got)
+	}
+	if released, err := a.Release("node-a"); err != nil || !released || len(a.Allocations()) != 1 {
+		t.Fatalf("release = %v, %v, allocations %v", released, err, a.Allocations())
+	}
+
+	if _, err := New(path, mustSubnets(t, "10.0.0.0/24", "10.0.0.128/25"), nil, nil); err == nil {
+		t.Fatal("accepted overlapping subnets")
+	}
+	twice := map[string][]net.IP{"node-a": ips("fd00:1::1", "fd00:1::2")}
+	if _, err := New(path, subnets, twice, nil); err == nil {
+		t.Fatal("accepted two reservations in one subnet")
+	}
+}
@@ -0,0 +1,241 @@
+package network
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMACAgeing MAC 地址表和邻居表表项的默认老化时间
+	DefaultMACAgeing = 5 * time.Minute
+	// maxBridgeEntries MAC 地址表和邻居表各自的容量上限，表满后不再学习新的表项，
+	// 发往未学习地址的帧按泛洪处理，避免伪造大量源地址耗尽内存
+	maxBridgeEntries = 16384
+)
+
+// BridgeConfig 二层转发设置
+type BridgeConfig struct {
+	Ageing     time.Duration // 表项的老化时间，为 0 时使用 DefaultMACAgeing
+	FloodRate  int           // 每个节点每秒最多泛洪的帧数，0 表示不限制
+	FloodBurst int           // 每个节点可突发泛洪的帧数，不足 FloodRate 时按 FloodRate 计
+	Proxy      bool          // 是否以学习到的地址代答 ARP 请求和邻居请求
+}
+
+// macKey MAC 地址表的键，不同 VLAN 中的同一地址分别学习
+type macKey struct {
+	vlan uint16
+	mac  [6]byte
+}
+
+// macEntry MAC 地址表项：地址所在的节点及最近一次见到的时间
+type macEntry struct {
+	owner string
+	seen  time.Time
+}
+
+// neighborKey 邻居表的键
+type neighborKey struct {
+	vlan uint16
+	ip   netip.Addr
+}
+
+// neighborEntry 邻居表项：地址的链路层地址及其所在的节点
+type neighborEntry struct {
+	mac   [6]byte
+	owner string
+	seen  time.Time
+}
+
+// floodBucket 节点泛洪帧数的令牌桶
+type floodBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Bridge 在节点之间转发以太网帧的二层交换状态：按帧的源地址学习 MAC 地址所在的节点，
+// 从 ARP 和邻居发现报文中学习地址与 MAC 地址的对应关系并据此代答，限制每个节点泛洪的帧数。
+// 节点以 ID 标识，空字符串表示所在节点未知
+type Bridge struct {
+	config BridgeConfig
+
+	mutex     sync.Mutex
+	macs      map[macKey]macEntry
+	neighbors map[neighborKey]neighborEntry
+	floods    map[string]*floodBucket
+	swept     time.Time // 上次清理过期表项的时间
+}
+
+// NewBridge 创建二层交换状态
+func NewBridge(config BridgeConfig) *Bridge {
+	if config.Ageing <= 0 {
+		config.Ageing = DefaultMACAgeing
+	}
+	config.FloodBurst = max(config.FloodBurst, config.FloodRate)
+	return &Bridge{
+		config:    config,
+		macs:      make(map[macKey]macEntry),
+		neighbors: make(map[neighborKey]neighborEntry),
+		floods:    make(map[string]*floodBucket),
+	}
+}
+
+// Learn 记录帧的源地址位于节点 owner，并学习帧中 ARP 或邻居发现报文声明的地址。
+// 返回该地址此前所在的其他节点，地址未迁移时返回空
+func (b *Bridge) Learn(frame *Frame, owner string, now time.Time) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sweep(now)
+
+	var moved string
+	key := macKey{vlan: frame.VLAN, mac: [6]byte(frame.Source)}
+	if entry, ok := b.macs[key]; ok || len(b.macs) < maxBridgeEntries {
+		if ok && entry.owner != owner && now.Sub(entry.seen) < b.config.Ageing {
+			moved = entry.owner
+		}
+		b.macs[key] = macEntry{owner: owner, seen: now}
+	}
+	b.snoop(frame, owner, now)
+	return moved
+}
+
+// Snoop 只学习帧中 ARP 或邻居发现报文声明的地址，用于所在节点未知的帧
+func (b *Bridge) Snoop(frame *Frame, owner string, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sweep(now)
+	b.snoop(frame, owner, now)
+}
+
+// snoop 学习帧中声明的地址与 MAC 地址的对应关系，调用者须持有 b.mutex
+func (b *Bridge) snoop(frame *Frame, owner string, now time.Time) {
+	binding, _, ok := neighborMessage(frame)
+	if !ok || !binding.ip.IsValid() || binding.ip.IsUnspecified() || len(binding.mac) != 6 || binding.mac[0]&1 != 0 {
+		return
+	}
+	key := neighborKey{vlan: frame.VLAN, ip: binding.ip}
+	if _, ok := b.neighbors[key]; ok || len(b.neighbors) < maxBridgeEntries {
+		b.neighbors[key] = neighborEntry{mac: [6]byte(binding.mac), owner: owner, seen: now}
+	}
+}
+
+// Lookup 返回帧的目的地址所在的节点，目的地址为广播、组播或尚未学习时返回 false
+func (b *Bridge) Lookup(frame *Frame, now time.Time) (string, bool) {
+	if frame.Multicast() {
+		return "", false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entry, ok := b.macs[macKey{vlan: frame.VLAN, mac: [6]byte(frame.Destination)}]
+	if !ok || now.Sub(entry.seen) >= b.config.Ageing {
+		return "", false
+	}
+	return entry.owner, true
+}
+
+// Proxy 帧为 ARP 请求或邻居请求且目标地址已在其他节点学习到时返回代答的帧，否则返回 nil。
+// 目标地址位于请求方所在节点 owner 时由该节点上的主机自己应答
+func (b *Bridge) Proxy(frame *Frame, owner string, now time.Time) []byte {
+	if !b.config.Proxy {
+		return nil
+	}
+	_, query, ok := neighborMessage(frame)
+	if !ok || query == nil || len(query.sender.mac) != 6 || query.sender.mac[0]&1 != 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	entry, found := b.neighbors[neighborKey{vlan: frame.VLAN, ip: query.target}]
+	b.mutex.Unlock()
+	if !found || entry.owner == owner || now.Sub(entry.seen) >= b.config.Ageing {
+		return nil
+	}
+	if entry.mac == [6]byte(query.sender.mac) {
+		return nil
+	}
+	answer := net.HardwareAddr(entry.mac[:])
+	if query.target.Is4() {
+		return arpReplyFrame(query, answer, frame.VLAN)
+	}
+	return ndpAdvertFrame(query, answer, frame.VLAN)
+}
+
+// AllowFlood 判断节点 owner 此时能否再泛洪一个帧，能则扣除一个令牌
+func (b *Bridge) AllowFlood(owner string, now time.Time) bool {
+	if b.config.FloodRate == 0 {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	bucket := b.floods[owner]
+	if bucket == nil {
+		bucket = &floodBucket{tokens: float64(b.config.FloodBurst), last: now}
+		b.floods[owner] = bucket
+	}
+	bucket.tokens = min(float64(b.config.FloodBurst), bucket.tokens+now.Sub(bucket.last).Seconds()*float64(b.config.FloodRate))
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Forget 删除位于节点 owner 的全部表项，节点离线或被吊销时调用
+func (b *Bridge) Forget(owner string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, entry := range b.macs {
+		if entry.owner == owner {
+			delete(b.macs, key)
+		}
+	}
+	for key, entry := range b.neighbors {
+		if entry.owner == owner {
+			delete(b.neighbors, key)
+		}
+	}
+	delete(b.floods, owner)
+}
+
+// Len 返回 MAC 地址表和邻居表的表项数
+func (b *Bridge) Len() (macs, neighbors int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.macs), len(b.neighbors)
+}
+
+// sweep 每隔老化时间清理一次过期的表项，调用者须持有 b.mutex
+func (b *Bridge) sweep(now time.Time) {
+	if now.Sub(b.swept) < b.config.Ageing {
+		return
+	}
+	b.swept = now
+	for key, entry := range b.macs {
+		if now.Sub(entry.seen) >= b.config.Ageing {
+			delete(b.macs, key)
+		}
+	}
+	for key, entry := range b.neighbors {
+		if now.Sub(entry.seen) >= b.config.Ageing {
+			delete(b.neighbors, key)
+		}
+	}
+	for owner, bucket := range b.floods {
+		if now.Sub(bucket.last) >= b.config.Ageing {
+			delete(b.floods, owner)
+		}
+	}
+}
+
+// neighborMessage 解析帧中的 ARP 或邻居发现报文
+func neighborMessage(frame *Frame) (neighborBinding, *neighborQuery, bool) {
+	switch frame.EtherType {
+	case EtherTypeARP:
+		return parseARP(frame.Payload)
+	case EtherTypeIPv6:
+		return parseNDP(frame.Payload, frame.Source)
+	}
+	return neighborBinding{}, nil, false
+}
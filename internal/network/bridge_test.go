@@ -0,0 +1,192 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func mustMAC(t *testing.T, s string) net.HardwareAddr {
+	t.Helper()
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mac
+}
+
+// arpFrame 构造以太网上的 ARP 报文，op 为 1 时为请求
+func arpFrame(op uint16, dst, src net.HardwareAddr, senderIP, targetIP net.IP) []byte {
+	frame := frameHeader(dst, src, 0, EtherTypeARP)
+	frame = append(frame, 0, 1, 0x08, 0, 6, 4)
+	frame = binary.BigEndian.AppendUint16(frame, op)
+	frame = append(frame, src...)
+	frame = append(frame, senderIP.To4()...)
+	frame = append(frame, make([]byte, 6)...)
+	return append(frame, targetIP.To4()...)
+}
+
+// ndpFrame 构造以太网上的邻居请求或邻居通告，option 为携带的链路层地址选项类型
+func ndpFrame(icmpType byte, dst, src net.HardwareAddr, srcIP, dstIP, target netip.Addr, option byte) []byte {
+	icmp := []byte{icmpType, 0, 0, 0, 0, 0, 0, 0}
+	icmp = append(icmp, target.AsSlice()...)
+	icmp = append(icmp, option, 1)
+	icmp = append(icmp, src...)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(srcIP, dstIP, icmp))
+	frame := frameHeader(dst, src, 0, EtherTypeIPv6)
+	frame = append(frame, 0x60, 0, 0, 0, 0, byte(len(icmp)), protocolICMPv6, 255)
+	frame = append(frame, srcIP.AsSlice()...)
+	frame = append(frame, dstIP.AsSlice()...)
+	return append(frame, icmp...)
+}
+
+func mustParseFrame(t *testing.T, data []byte) *Frame {
+	t.Helper()
+	frame, err := ParseFrame(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestParseFrame(t *testing.T) {
+	a, b := mustMAC(t, "02:00:00:00:00:0a"), mustMAC(t, "02:00:00:00:00:0b")
+	tagged := frameHeader(b, a, 42, EtherTypeIPv4)
+	frame := mustParseFrame(t, append(tagged, 0x45))
+	if frame.VLAN != 42 || frame.EtherType != EtherTypeIPv4 || len(frame.Payload) != 1 || frame.Multicast() {
+		t.Fatalf("frame = %+v", frame)
+	}
+	broadcast := mustParseFrame(t, frameHeader(net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, a, 0, EtherTypeARP))
+	if !broadcast.Multicast() {
+		t.Fatal("broadcast frame not flooded")
+	}
+
+	if _, err := ParseFrame(tagged[:12]); !errors.Is(err, ErrFrameTooShort) {
+		t.Fatalf("short frame: %v", err)
+	}
+	if _, err := ParseFrame(tagged[:16]); !errors.Is(err, ErrFrameTooShort) {
+		t.Fatalf("short VLAN tag: %v", err)
+	}
+	if _, err := ParseFrame(frameHeader(a, net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 1}, 0, EtherTypeIPv4)); !errors.Is(err, ErrInvalidSource) {
+		t.Fatalf("multicast source: %v", err)
+	}
+}
+
+func TestBridgeLearning(t *testing.T) {
+	b := NewBridge(BridgeConfig{Ageing: time.Minute})
+	now := time.Now()
+	a, c := mustMAC(t, "02:00:00:00:00:0a"), mustMAC(t, "02:00:00:00:00:0c")
+	fromA := mustParseFrame(t, frameHeader(c, a, 0, EtherTypeIPv4))
+	toA := mustParseFrame(t, frameHeader(a, c, 0, EtherTypeIPv4))
+	toATagged := mustParseFrame(t, frameHeader(a, c, 7, EtherTypeIPv4))
+
+	if _, ok := b.Lookup(toA, now); ok {
+		t.Fatal("unknown address found")
+	}
+	if moved := b.Learn(fromA, "node-a", now); moved != "" {
+		t.Fatalf("moved from %q", moved)
+	}
+	if owner, ok := b.Lookup(toA, now); !ok || owner != "node-a" {
+		t.Fatalf("owner = %q, %v", owner, ok)
+	}
+	// 不同 VLAN 中的地址分别学习
+	if _, ok := b.Lookup(toATagged, now); ok {
+		t.Fatal("address learned across VLANs")
+	}
+
+	// 地址迁移到其他节点
+	if moved := b.Learn(fromA, "node-b", now.Add(time.Second)); moved != "node-a" {
+		t.Fatalf("moved from %q", moved)
+	}
+	if owner, _ := b.Lookup(toA, now); owner != "node-b" {
+		t.Fatalf("owner = %q", owner)
+	}
+	// 表项老化后不再使用
+	if _, ok := b.Lookup(toA, now.Add(2*time.Minute)); ok {
+		t.Fatal("expired address found")
+	}
+
+	b.Forget("node-b")
+	if macs, _ := b.Len(); macs != 0 {
+		t.Fatalf("%d addresses left", macs)
+	}
+}
+
+func TestBridgeProxy(t *testing.T) {
+	b := NewBridge(BridgeConfig{Proxy: true})
+	now := time.Now()
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	a, c := mustMAC(t, "02:00:00:00:00:0a"), mustMAC(t, "02:00:00:00:00:0c")
+	ipA, ipC := net.IPv4(10, 1, 0, 1), net.IPv4(10, 1, 0, 3)
+
+	// 学习 node-c 应答中声明的地址后代答其他节点的请求
+	request := mustParseFrame(t, arpFrame(1, broadcast, a, ipA, ipC))
+	if reply := b.Proxy(request, "node-a", now); reply != nil {
+		t.Fatal("answered an unknown address")
+	}
+	b.Learn(mustParseFrame(t, arpFrame(2, a, c, ipC, ipA)), "node-c", now)
+	reply := b.Proxy(request, "node-a", now)
+	parsed, err := ParseFrame(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding, query, ok := neighborMessage(parsed)
+	if !ok || query != nil || binding.ip != netip.AddrFrom4([4]byte(ipC.To4())) || !bytes.Equal(binding.mac, c) ||
+		!bytes.Equal(parsed.Destination, a) || !bytes.Equal(parsed.Payload[18:28], append(a, ipA.To4()...)) {
+		t.Fatalf("reply = %x", reply)
+	}
+	// 目标地址位于请求方所在的节点时由其局域网应答
+	if reply := b.Proxy(request, "node-c", now); reply != nil {
+		t.Fatal("answered a request for a local address")
+	}
+	if NewBridge(BridgeConfig{}).Proxy(request, "node-a", now) != nil {
+		t.Fatal("answered with proxying disabled")
+	}
+
+	// IPv6 邻居请求以邻居通告代答
+	llA, llC := netip.MustParseAddr("fe80::a"), netip.MustParseAddr("fe80::c")
+	solicitedNode := netip.MustParseAddr("ff02::1:ff00:c")
+	b.Learn(mustParseFrame(t, ndpFrame(ndpAdvertisement, a, c, llC, llA, llC, ndpOptionTarget)), "node-c", now)
+	solicit := mustParseFrame(t, ndpFrame(ndpSolicitation, net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 0x0c}, a, llA, solicitedNode, llC, ndpOptionSource))
+	reply = b.Proxy(solicit, "node-a", now)
+	advert, err := ParseFrame(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding, query, ok = neighborMessage(advert)
+	if !ok || query != nil || binding.ip != llC || !bytes.Equal(binding.mac, c) || !bytes.Equal(advert.Destination, a) {
+		t.Fatalf("advertisement = %x", reply)
+	}
+	icmp := advert.Payload[ipv6HeaderSize:]
+	if icmpv6Checksum(llC, llA, icmp) != 0 {
+		t.Fatalf("checksum %x invalid", icmp[2:4])
+	}
+}
+
+func TestFloodLimit(t *testing.T) {
+	b := NewBridge(BridgeConfig{FloodRate: 10, FloodBurst: 20})
+	now := time.Now()
+	allowed := 0
+	for i := 0; i < 30; i++ {
+		if b.AllowFlood("node-a", now) {
+			allowed++
+		}
+	}
+	if allowed != 20 {
+		t.Fatalf("allowed %d floods, want the burst of 20", allowed)
+	}
+	// 其他节点的限额不受影响，令牌按速率补充
+	if !b.AllowFlood("node-b", now) {
+		t.Fatal("another node rate limited")
+	}
+	if !b.AllowFlood("node-a", now.Add(100*time.Millisecond)) || b.AllowFlood("node-a", now.Add(100*time.Millisecond)) {
+		t.Fatal("tokens not refilled at the configured rate")
+	}
+	if unlimited := NewBridge(BridgeConfig{}); !unlimited.AllowFlood("node-a", now) {
+		t.Fatal("flooding limited without a rate")
+	}
+}
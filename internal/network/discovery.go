@@ -1,20 +1,34 @@
 package network
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/stun"
 )
 
 // Node 表示网络中的一个节点
 type Node struct {
-	ID          string
-	PublicIP    net.IP
-	PublicPort  uint16
-	PrivateIP   net.IP
-	PrivatePort uint16
-	LastSeen    time.Time
-	Routes      []Route
+	ID           string
+	PublicIP     net.IP
+	PublicPort   uint16
+	PrivateIP    net.IP
+	PrivateIP6   net.IP // 双栈虚拟网络中节点的 IPv6 虚拟地址
+	PrivatePort  uint16
+	LocalIP      net.IP       // 节点自报的局域网地址，与 PrivatePort 组成内网端点
+	GlobalIP6    net.IP       // 节点自报的全局 IPv6 地址，与 PrivatePort 组成 IPv6 端点
+	Version      uint8        // 与该节点协商出的协议版本
+	Capabilities uint32       // 与该节点协商出的能力位
+	NATType      stun.NATType // 节点自报的 NAT 类型
+	PortStep     int          // 节点自报的对称 NAT 端口步长
+	Relayed      *net.UDPAddr // 节点在 TURN 服务器上分配的中继地址，未使用 TURN 时为 nil
+	Name         string       // 节点证书中的名称，未使用证书认证时为空
+	Groups       []string     // 节点证书中的组
+	VirtualIPs   []net.IP     // 节点证书中声明的虚拟 IP
+	LastSeen     time.Time
+	Routes       []Route
 }
 
 // Route 表示一条路由
@@ -29,13 +43,16 @@ type Discovery struct {
 	nodes    map[string]*Node
 	mutex    sync.RWMutex
 	interval time.Duration
+	// introduced 记录每对节点最近一次被互相介绍的时间
+	introduced map[[2]string]time.Time
 }
 
 // NewDiscovery 创建新的节点发现管理器
 func NewDiscovery(interval time.Duration) *Discovery {
 	return &Discovery{
-		nodes:    make(map[string]*Node),
-		interval: interval,
+		nodes:      make(map[string]*Node),
+		interval:   interval,
+		introduced: make(map[[2]string]time.Time),
 	}
 }
 
@@ -50,7 +67,34 @@ func (d *Discovery) AddNode(node *Node) {
 func (d *Discovery) RemoveNode(nodeID string) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
+	d.removeNode(nodeID)
+}
+
+// removeNode 在持有锁的情况下移除节点及其介绍记录
+func (d *Discovery) removeNode(nodeID string) {
 	delete(d.nodes, nodeID)
+	for pair := range d.introduced {
+		if pair[0] == nodeID || pair[1] == nodeID {
+			delete(d.introduced, pair)
+		}
+	}
+}
+
+// Introduce 判断是否应将两个节点互相介绍：同一对节点在 interval 内只介绍一次，
+// 返回 true 时记录本次介绍的时间
+func (d *Discovery) Introduce(a, b string, interval time.Duration) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	pair := [2]string{a, b}
+	if b < a {
+		pair = [2]string{b, a}
+	}
+	now := time.Now()
+	if last, ok := d.introduced[pair]; ok && now.Sub(last) < interval {
+		return false
+	}
+	d.introduced[pair] = now
+	return true
 }
 
 // GetNode 获取节点信息
@@ -68,12 +112,29 @@ func (d *Discovery) UpdateNode(node *Node) {
 		existing.PublicIP = node.PublicIP
 		existing.PublicPort = node.PublicPort
 		existing.PrivateIP = node.PrivateIP
+		existing.PrivateIP6 = node.PrivateIP6
 		existing.PrivatePort = node.PrivatePort
+		existing.LocalIP = node.LocalIP
+		existing.GlobalIP6 = node.GlobalIP6
+		existing.NATType = node.NATType
+		existing.PortStep = node.PortStep
+		existing.Relayed = node.Relayed
 		existing.LastSeen = time.Now()
 		existing.Routes = node.Routes
 	}
 }
 
+// Touch 更新节点最后可见时间，节点不存在时返回 false
+func (d *Discovery) Touch(nodeID string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	node, ok := d.nodes[nodeID]
+	if ok {
+		node.LastSeen = time.Now()
+	}
+	return ok
+}
+
 // GetNodes 获取所有节点
 func (d *Discovery) GetNodes() []*Node {
 	d.mutex.RLock()
@@ -85,25 +146,55 @@ func (d *Discovery) GetNodes() []*Node {
 	return nodes
 }
 
-// Cleanup 清理过期节点
-func (d *Discovery) Cleanup(timeout time.Duration) {
+// Cleanup 清理过期节点，返回被移除的节点
+func (d *Discovery) Cleanup(timeout time.Duration) []*Node {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	now := time.Now()
+	var removed []*Node
 	for id, node := range d.nodes {
 		if now.Sub(node.LastSeen) > timeout {
-			delete(d.nodes, id)
+			d.removeNode(id)
+			removed = append(removed, node)
 		}
 	}
+	return removed
 }
 
-// AddRoute 添加路由
+// AddRoute 添加路由，节点已通告过相同目的地址的路由时替换原路由
 func (d *Discovery) AddRoute(nodeID string, route Route) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	if node, ok := d.nodes[nodeID]; ok {
-		node.Routes = append(node.Routes, route)
+	node, ok := d.nodes[nodeID]
+	if !ok {
+		return
 	}
+	for i := range node.Routes {
+		if node.Routes[i].Destination == route.Destination {
+			node.Routes[i] = route
+			return
+		}
+	}
+	node.Routes = append(node.Routes, route)
+}
+
+// WithdrawRoutes 撤销其他节点通告的、以 nextHop 为下一跳的路由，返回撤销的路由数
+func (d *Discovery) WithdrawRoutes(nextHop string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	withdrawn := 0
+	for _, node := range d.nodes {
+		var routes []Route
+		for _, route := range node.Routes {
+			if route.NextHop == nextHop {
+				withdrawn++
+				continue
+			}
+			routes = append(routes, route)
+		}
+		node.Routes = routes
+	}
+	return withdrawn
 }
 
 // GetRoutes 获取节点的路由
@@ -127,7 +218,8 @@ func (d *Discovery) FindRoute(destination string) *Route {
 	for _, node := range d.nodes {
 		for _, route := range node.Routes {
 			if route.Destination == destination && route.Metric < bestMetric {
-				bestRoute = &route
+				found := route
+				bestRoute = &found
 				bestMetric = route.Metric
 			}
 		}
@@ -136,6 +228,99 @@ func (d *Discovery) FindRoute(destination string) *Route {
 	return bestRoute
 }
 
+// Addresses 返回节点自身的虚拟地址。节点证书声明了虚拟 IP 时以证书为准，否则为握手中上报或服务器分配的地址
+func (n *Node) Addresses() []net.IP {
+	if len(n.VirtualIPs) > 0 {
+		return n.VirtualIPs
+	}
+	var addresses []net.IP
+	for _, ip := range []net.IP{n.PrivateIP, n.PrivateIP6} {
+		if ip != nil && !ip.IsUnspecified() {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// AddressOwner 查找以 ip 为自身虚拟地址的节点
+func (d *Discovery) AddressOwner(ip net.IP) *Node {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.addressOwner(ip)
+}
+
+func (d *Discovery) addressOwner(ip net.IP) *Node {
+	for _, node := range d.nodes {
+		for _, address := range node.Addresses() {
+			if address.Equal(ip) {
+				return node
+			}
+		}
+	}
+	return nil
+}
+
+// FindNode 查找数据包应转发到的节点：先匹配节点自身的虚拟地址，
+// 再按最长前缀匹配节点通告的路由，前缀相同时选择度量值较小的路由。
+// 路由指定了在线的下一跳节点时返回下一跳，否则返回通告路由的节点。
+func (d *Discovery) FindNode(ip net.IP) *Node {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if node := d.addressOwner(ip); node != nil {
+		return node
+	}
+
+	var best *Node
+	bestPrefix, bestMetric := -1, uint8(0)
+	for _, node := range d.nodes {
+		for _, route := range node.Routes {
+			prefix := RoutePrefix(route.Destination, ip)
+			if prefix < 0 || prefix < bestPrefix || (prefix == bestPrefix && route.Metric >= bestMetric) {
+				continue
+			}
+			best, bestPrefix, bestMetric = node, prefix, route.Metric
+			if next, ok := d.nodes[route.NextHop]; ok {
+				best = next
+			}
+		}
+	}
+	return best
+}
+
+// ParseRoute 解析路由目的地址（CIDR 或单个地址），返回其网段
+func ParseRoute(destination string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(destination); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(destination)
+	if ip == nil {
+		return nil, fmt.Errorf("无效的路由目的地址 %q", destination)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}, nil
+}
+
+// RoutePrefix 返回路由目的地址 destination（CIDR 或单个地址）的前缀长度，不包含 ip 时返回 -1
+func RoutePrefix(destination string, ip net.IP) int {
+	if _, network, err := net.ParseCIDR(destination); err == nil {
+		if !network.Contains(ip) {
+			return -1
+		}
+		ones, _ := network.Mask.Size()
+		return ones
+	}
+	if address := net.ParseIP(destination); address != nil && address.Equal(ip) {
+		if ip.To4() != nil {
+			return 8 * net.IPv4len
+		}
+		return 8 * net.IPv6len
+	}
+	return -1
+}
+
 // Start 启动节点发现服务
 func (d *Discovery) Start() {
 	go func() {
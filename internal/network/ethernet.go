@@ -0,0 +1,257 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// 以太网类型
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeARP  = 0x0806
+	EtherTypeVLAN = 0x8100 // 802.1Q 标签
+	EtherTypeIPv6 = 0x86DD
+)
+
+const (
+	ethernetHeaderSize = 14
+	vlanTagSize        = 4
+
+	arpSize          = 28
+	arpRequest       = 1
+	arpReply         = 2
+	icmpv6Header     = 8
+	ndpMessageSize   = icmpv6Header + 16 // 邻居请求和邻居通告的固定部分，含目标地址
+	ndpSolicitation  = 135
+	ndpAdvertisement = 136
+	ndpOptionSource  = 1 // 源链路层地址选项
+	ndpOptionTarget  = 2 // 目标链路层地址选项
+	protocolICMPv6   = 58
+)
+
+var (
+	// ErrFrameTooShort 帧短于以太网头部
+	ErrFrameTooShort = errors.New("frame too short")
+	// ErrInvalidSource 帧的源地址为组播地址
+	ErrInvalidSource = errors.New("multicast source address")
+)
+
+// Frame 从 TAP 接口读取或写入的以太网帧的头部信息
+type Frame struct {
+	Destination net.HardwareAddr
+	Source      net.HardwareAddr
+	VLAN        uint16 // 802.1Q VLAN ID，未打标签时为 0
+	EtherType   uint16 // 去掉 VLAN 标签后的以太网类型
+	Payload     []byte
+}
+
+// ParseFrame 解析以太网帧头部，带一层 802.1Q 标签时取标签内的类型。
+// 返回的地址和负载引用 data 的内容，data 被复用前需要复制。
+func ParseFrame(data []byte) (*Frame, error) {
+	if len(data) < ethernetHeaderSize {
+		return nil, ErrFrameTooShort
+	}
+	frame := &Frame{
+		Destination: net.HardwareAddr(data[0:6]),
+		Source:      net.HardwareAddr(data[6:12]),
+		EtherType:   binary.BigEndian.Uint16(data[12:14]),
+		Payload:     data[ethernetHeaderSize:],
+	}
+	if frame.Source[0]&1 != 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSource, frame.Source)
+	}
+	if frame.EtherType == EtherTypeVLAN {
+		if len(frame.Payload) < vlanTagSize {
+			return nil, ErrFrameTooShort
+		}
+		frame.VLAN = binary.BigEndian.Uint16(frame.Payload[0:2]) & 0x0fff
+		frame.EtherType = binary.BigEndian.Uint16(frame.Payload[2:4])
+		frame.Payload = frame.Payload[vlanTagSize:]
+	}
+	return frame, nil
+}
+
+// Multicast 判断帧的目的地址是否为广播或组播地址，这类帧需要泛洪到所有节点
+func (f *Frame) Multicast() bool {
+	return f.Destination[0]&1 != 0
+}
+
+// neighborBinding ARP 或邻居发现报文中声明的地址与链路层地址的对应关系
+type neighborBinding struct {
+	ip  netip.Addr
+	mac net.HardwareAddr
+}
+
+// neighborQuery 请求解析的目标地址及请求方的地址
+type neighborQuery struct {
+	target netip.Addr
+	sender neighborBinding // 请求方的地址，重复地址检测的邻居请求中为未指定地址
+}
+
+// parseARP 解析以太网上的 IPv4 ARP 报文，返回发送方的地址绑定，为请求时另外返回请求的目标地址
+func parseARP(payload []byte) (neighborBinding, *neighborQuery, bool) {
+	if len(payload) < arpSize || binary.BigEndian.Uint16(payload[0:2]) != 1 ||
+		binary.BigEndian.Uint16(payload[2:4]) != EtherTypeIPv4 || payload[4] != 6 || payload[5] != 4 {
+		return neighborBinding{}, nil, false
+	}
+	sender := neighborBinding{
+		ip:  netip.AddrFrom4([4]byte(payload[14:18])),
+		mac: net.HardwareAddr(payload[8:14]),
+	}
+	switch binary.BigEndian.Uint16(payload[6:8]) {
+	case arpRequest:
+		return sender, &neighborQuery{target: netip.AddrFrom4([4]byte(payload[24:28])), sender: sender}, true
+	case arpReply:
+		return sender, nil, true
+	}
+	return neighborBinding{}, nil, false
+}
+
+// parseNDP 解析 IPv6 邻居请求和邻居通告：邻居通告声明目标地址的链路层地址，
+// 邻居请求声明请求方的链路层地址并查询目标地址。跳数限制不为 255 的报文可能来自其他链路，被忽略
+func parseNDP(payload []byte, source net.HardwareAddr) (neighborBinding, *neighborQuery, bool) {
+	if len(payload) < ipv6HeaderSize+ndpMessageSize || payload[0]>>4 != 6 ||
+		payload[6] != protocolICMPv6 || payload[7] != 255 {
+		return neighborBinding{}, nil, false
+	}
+	end := ipv6HeaderSize + int(binary.BigEndian.Uint16(payload[4:6]))
+	if end > len(payload) || end < ipv6HeaderSize+ndpMessageSize {
+		return neighborBinding{}, nil, false
+	}
+	icmp := payload[ipv6HeaderSize:end]
+	if icmp[1] != 0 {
+		return neighborBinding{}, nil, false
+	}
+	target := netip.AddrFrom16([16]byte(icmp[8:24]))
+	src := netip.AddrFrom16([16]byte(payload[8:24]))
+
+	switch icmp[0] {
+	case ndpSolicitation:
+		query := &neighborQuery{target: target}
+		if mac := ndpOption(icmp[ndpMessageSize:], ndpOptionSource); mac != nil && !src.IsUnspecified() {
+			query.sender = neighborBinding{ip: src, mac: mac}
+			return query.sender, query, true
+		}
+		// 未携带源链路层地址选项（如重复地址检测的请求）时只学习请求方，应答发往以太网源地址
+		query.sender = neighborBinding{ip: src, mac: source}
+		return neighborBinding{}, query, true
+	case ndpAdvertisement:
+		mac := ndpOption(icmp[ndpMessageSize:], ndpOptionTarget)
+		if mac == nil {
+			mac = source
+		}
+		return neighborBinding{ip: target, mac: mac}, nil, true
+	}
+	return neighborBinding{}, nil, false
+}
+
+// ndpOption 返回邻居发现选项中指定类型的以太网链路层地址，不存在或格式错误时返回 nil
+func ndpOption(options []byte, optionType byte) net.HardwareAddr {
+	for len(options) >= 8 {
+		size := int(options[1]) * 8
+		if size == 0 || size > len(options) {
+			return nil
+		}
+		if options[0] == optionType && size == 8 {
+			return net.HardwareAddr(options[2:8])
+		}
+		options = options[size:]
+	}
+	return nil
+}
+
+// frameHeader 构建以太网头部，vlan 不为 0 时带 802.1Q 标签
+func frameHeader(dst, src net.HardwareAddr, vlan, etherType uint16) []byte {
+	header := make([]byte, 0, ethernetHeaderSize+vlanTagSize)
+	header = append(header, dst...)
+	header = append(header, src...)
+	if vlan != 0 {
+		header = binary.BigEndian.AppendUint16(header, EtherTypeVLAN)
+		header = binary.BigEndian.AppendUint16(header, vlan)
+	}
+	return binary.BigEndian.AppendUint16(header, etherType)
+}
+
+// arpReplyFrame 构建以 answer 应答 query 的 ARP 响应帧
+func arpReplyFrame(query *neighborQuery, answer net.HardwareAddr, vlan uint16) []byte {
+	frame := frameHeader(query.sender.mac, answer, vlan, EtherTypeARP)
+	frame = binary.BigEndian.AppendUint16(frame, 1)
+	frame = binary.BigEndian.AppendUint16(frame, EtherTypeIPv4)
+	frame = append(frame, 6, 4)
+	frame = binary.BigEndian.AppendUint16(frame, arpReply)
+	frame = append(frame, answer...)
+	frame = append(frame, query.target.AsSlice()...)
+	frame = append(frame, query.sender.mac...)
+	return append(frame, query.sender.ip.AsSlice()...)
+}
+
+// ndpAdvertFrame 构建以 answer 应答邻居请求 query 的邻居通告帧。
+// 重复地址检测的请求来自未指定地址，通告发往所有节点组播地址
+func ndpAdvertFrame(query *neighborQuery, answer net.HardwareAddr, vlan uint16) []byte {
+	dst, dstMAC := query.sender.ip, query.sender.mac
+	flags := uint32(0x60000000) // Solicited | Override
+	if dst.IsUnspecified() {
+		dst = netip.IPv6LinkLocalAllNodes()
+		dstMAC = net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}
+		flags = 0x20000000
+	}
+
+	icmp := make([]byte, 0, ndpMessageSize+8)
+	icmp = append(icmp, ndpAdvertisement, 0, 0, 0)
+	icmp = binary.BigEndian.AppendUint32(icmp, flags)
+	icmp = append(icmp, query.target.AsSlice()...)
+	icmp = append(icmp, ndpOptionTarget, 1)
+	icmp = append(icmp, answer...)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(query.target, dst, icmp))
+
+	frame := frameHeader(dstMAC, answer, vlan, EtherTypeIPv6)
+	frame = append(frame, 0x60, 0, 0, 0)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(icmp)))
+	frame = append(frame, protocolICMPv6, 255)
+	frame = append(frame, query.target.AsSlice()...)
+	frame = append(frame, dst.AsSlice()...)
+	return append(frame, icmp...)
+}
+
+// icmpv6Checksum 计算包含 IPv6 伪头部的 ICMPv6 校验和，data 中的校验和字段须为 0
+func icmpv6Checksum(src, dst netip.Addr, data []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for len(b) >= 2 {
+			sum += uint32(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		}
+		if len(b) == 1 {
+			sum += uint32(b[0]) << 8
+		}
+	}
+	add(src.AsSlice())
+	add(dst.AsSlice())
+	sum += uint32(len(data)) + protocolICMPv6
+	add(data)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// FrameFlowHash 返回以太网帧所属流的哈希值：承载 IP 包的帧按 FlowHash 计算，其他帧按两端的 MAC 地址计算，
+// 同一流两个方向的帧哈希值相同。无法解析时返回 0
+func FrameFlowHash(data []byte) uint32 {
+	frame, err := ParseFrame(data)
+	if err != nil {
+		return 0
+	}
+	if frame.EtherType == EtherTypeIPv4 || frame.EtherType == EtherTypeIPv6 {
+		return FlowHash(frame.Payload)
+	}
+	src, dst := frame.Source, frame.Destination
+	if bytes.Compare(src, dst) > 0 {
+		src, dst = dst, src
+	}
+	return fnv32a(fnv32a(fnvOffset, src), dst)
+}
@@ -1,33 +1,63 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/relay"
+	"github.com/fenghuilee/sd-wan/internal/stun"
 )
 
-// NATTraversal NAT穿透管理器
+// NATTraversal NAT穿透管理器，管理中继连接、TURN 分配以及对称 NAT 的端口预测和生日攻击穿透
 type NATTraversal struct {
 	relayServer net.IP
 	relayPort   uint16
 	connections sync.Map
+
+	mutex     sync.Mutex
+	localNAT  stun.NATType // 本端的 NAT 类型
+	localStep int          // 本端对称 NAT 的端口步长，随机分配时为 0
+	limits    TraversalLimits
+	listen    func() (net.PacketConn, error)
+	stats     [traversalMethods]TraversalStats
+	turn      *TURNClient
 }
 
-// Connection NAT连接
+// relayBindTimeout 绑定中继会话并等待对端绑定的最长时间
+const relayBindTimeout = 5 * time.Second
+
+// relayBindInterval 绑定请求的重传间隔
+const relayBindInterval = 250 * time.Millisecond
+
+// ErrNoRelay 没有配置中继服务
+var ErrNoRelay = errors.New("未配置中继服务")
+
+// Connection 经中继服务到一个节点的连接，实现 net.PacketConn：写入的报文封装为数据帧发往中继服务，
+// 读取时返回对端经中继服务发来的报文，两个方向的地址均为中继服务的地址
 type Connection struct {
-	targetID   string
-	targetIP   net.IP
-	targetPort uint16
-	conn       *net.UDPConn
-	lastSeen   time.Time
+	nat      *NATTraversal
+	targetID string
+	relay    *net.UDPAddr
+	conn     net.PacketConn
+	ticket   []byte
+	key      []byte
+	lastSeen atomic.Int64 // 最近一次收发的时间（Unix 纳秒）
 }
 
-// NewNATTraversal 创建新的NAT穿透管理器
+// NewNATTraversal 创建新的NAT穿透管理器，relayServer 为空时不使用中继服务
 func NewNATTraversal(relayServer net.IP, relayPort uint16) *NATTraversal {
 	nat := &NATTraversal{
 		relayServer: relayServer,
 		relayPort:   relayPort,
+		limits:      DefaultTraversalLimits(),
+		listen: func() (net.PacketConn, error) {
+			return net.ListenUDP("udp", nil)
+		},
 	}
 
 	// 启动连接清理
@@ -36,70 +66,211 @@ func NewNATTraversal(relayServer net.IP, relayPort uint16) *NATTraversal {
 	return nat
 }
 
-// CreateRelayConnection 创建中继连接
-func (n *NATTraversal) CreateRelayConnection(targetID string, targetIP net.IP, targetPort uint16) error {
-	// 创建 UDP 连接
-	addr := &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: 0,
+// RelayAddr 返回中继服务的地址，未配置时返回 nil
+func (n *NATTraversal) RelayAddr() *net.UDPAddr {
+	if n.relayServer == nil || n.relayPort == 0 {
+		return nil
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	return &net.UDPAddr{IP: n.relayServer, Port: int(n.relayPort)}
+}
+
+// CreateRelayConnection 以协调服务器签发的票据 ticket 和票据密钥 key 在中继服务上绑定到节点 targetID 的会话，
+// 等待对端也完成绑定后返回连接。每个连接使用单独的套接字，中继服务以来源地址区分会话
+func (n *NATTraversal) CreateRelayConnection(targetID string, ticket, key []byte) (*Connection, error) {
+	addr := n.RelayAddr()
+	if addr == nil {
+		return nil, ErrNoRelay
+	}
+	n.mutex.Lock()
+	listen := n.listen
+	n.mutex.Unlock()
+	conn, err := listen()
 	if err != nil {
-		return fmt.Errorf("创建 UDP 连接失败: %v", err)
+		return nil, fmt.Errorf("创建 UDP 连接失败: %v", err)
 	}
 
 	connection := &Connection{
-		targetID:   targetID,
-		targetIP:   targetIP,
-		targetPort: targetPort,
-		conn:       conn,
-		lastSeen:   time.Now(),
+		nat:      n,
+		targetID: targetID,
+		relay:    addr,
+		conn:     conn,
+		ticket:   ticket,
+		key:      key,
 	}
+	if err := connection.bind(relayBindTimeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	connection.touch()
 
-	n.connections.Store(targetID, connection)
-	return nil
+	// 替换同一目标的旧连接时关闭旧连接，避免泄漏套接字
+	if previous, loaded := n.connections.Swap(targetID, connection); loaded {
+		previous.(*Connection).conn.Close()
+	}
+	return connection, nil
 }
 
-// SendData 发送数据
-func (n *NATTraversal) SendData(targetID string, data []byte) error {
-	value, ok := n.connections.Load(targetID)
-	if !ok {
-		return fmt.Errorf("连接不存在: %s", targetID)
+// AllocateTURN 以长期凭据在 TURN 服务器 server 上分配中继地址，替换此前的分配。
+// 分配由穿透管理器持有，Close 时释放
+func (n *NATTraversal) AllocateTURN(server *net.UDPAddr, username, password string) (*TURNClient, error) {
+	n.mutex.Lock()
+	listen := n.listen
+	n.mutex.Unlock()
+	conn, err := listen()
+	if err != nil {
+		return nil, fmt.Errorf("创建 UDP 连接失败: %v", err)
+	}
+	client, err := NewTURNClient(conn, server, username, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	conn := value.(*Connection)
-	conn.lastSeen = time.Now()
+	n.mutex.Lock()
+	previous := n.turn
+	n.turn = client
+	n.mutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return client, nil
+}
 
-	// 发送到中继服务器
-	relayAddr := &net.UDPAddr{
-		IP:   n.relayServer,
-		Port: int(n.relayPort),
+// TURN 返回 TURN 服务器上的分配，未分配时返回 nil
+func (n *NATTraversal) TURN() *TURNClient {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.turn
+}
+
+// bind 重传绑定请求，直到中继服务确认双方都已绑定或超时
+func (c *Connection) bind(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	defer c.conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, relay.MaxFrameSize)
+	for time.Now().Before(deadline) {
+		if err := c.sendBind(); err != nil {
+			return err
+		}
+		c.conn.SetReadDeadline(time.Now().Add(relayBindInterval))
+		for {
+			n, from, err := c.conn.ReadFrom(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !c.fromRelay(from) {
+				continue
+			}
+			frame, err := relay.ParseFrame(buf[:n])
+			if err != nil {
+				continue
+			}
+			if code, reason := frame.Error(); code == relay.ErrorUnauthorized {
+				return fmt.Errorf("中继服务拒绝绑定: %s", reason)
+			}
+			if frame.Paired() {
+				return nil
+			}
+		}
 	}
+	return fmt.Errorf("等待节点 %s 绑定中继会话超时", c.targetID)
+}
 
-	_, err := conn.conn.WriteToUDP(data, relayAddr)
+// sendBind 发送一次绑定请求，时间戳取当前时间，每次绑定都比此前的大
+func (c *Connection) sendBind() error {
+	frame := relay.NewBindFrame(c.ticket, c.key, uint64(time.Now().UnixNano()))
+	_, err := c.conn.WriteTo(frame.Encode(), c.relay)
 	return err
 }
 
-// ReceiveData 接收数据
+// fromRelay 判断报文是否来自中继服务，忽略其他来源的报文
+func (c *Connection) fromRelay(from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	return ok && addr.IP.Equal(c.relay.IP) && addr.Port == c.relay.Port
+}
+
+func (c *Connection) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// ReadFrom 读取对端经中继服务发来的下一个报文。中继服务丢失会话（如重启）时自动重新绑定
+func (c *Connection) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.conn.ReadFrom(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !c.fromRelay(from) {
+			continue
+		}
+		frame, err := relay.ParseFrame(b[:n])
+		if err != nil {
+			continue
+		}
+		switch frame.Type {
+		case relay.FrameData:
+			c.touch()
+			return copy(b, frame.Payload), c.relay, nil
+		case relay.FrameError:
+			if code, _ := frame.Error(); code == relay.ErrorNotBound {
+				c.sendBind()
+			}
+		}
+	}
+}
+
+// WriteTo 经中继服务向对端发送报文，addr 被忽略
+func (c *Connection) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.touch()
+	if _, err := c.conn.WriteTo((&relay.Frame{Type: relay.FrameData, Payload: b}).Encode(), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close 关闭连接并将其从穿透管理器中移除
+func (c *Connection) Close() error {
+	c.nat.connections.CompareAndDelete(c.targetID, c)
+	return c.conn.Close()
+}
+
+// LocalAddr 返回连接的本地地址
+func (c *Connection) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// SetDeadline 设置读写截止时间
+func (c *Connection) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline 设置读截止时间
+func (c *Connection) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline 设置写截止时间
+func (c *Connection) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// SendData 经中继服务向节点发送数据
+func (n *NATTraversal) SendData(targetID string, data []byte) error {
+	value, ok := n.connections.Load(targetID)
+	if !ok {
+		return fmt.Errorf("连接不存在: %s", targetID)
+	}
+	_, err := value.(*Connection).WriteTo(data, nil)
+	return err
+}
+
+// ReceiveData 接收节点经中继服务发来的数据
 func (n *NATTraversal) ReceiveData(targetID string) ([]byte, error) {
 	value, ok := n.connections.Load(targetID)
 	if !ok {
 		return nil, fmt.Errorf("连接不存在: %s", targetID)
 	}
 
-	conn := value.(*Connection)
-	conn.lastSeen = time.Now()
-
-	buf := make([]byte, 1500)
-	readLen, _, err := conn.conn.ReadFromUDP(buf)
+	buf := make([]byte, relay.MaxFrameSize)
+	readLen, _, err := value.(*Connection).ReadFrom(buf)
 	if err != nil {
 		return nil, err
 	}
-
-	if readLen <= 0 {
-		return nil, fmt.Errorf("读取数据长度为 0")
-	}
-
 	return buf[:readLen], nil
 }
 
@@ -110,15 +281,15 @@ func (n *NATTraversal) CloseConnection(targetID string) error {
 		return fmt.Errorf("连接不存在: %s", targetID)
 	}
 
-	conn := value.(*Connection)
-	err := conn.conn.Close()
-	n.connections.Delete(targetID)
-	return err
+	return value.(*Connection).Close()
 }
 
-// Close 关闭所有连接
+// Close 关闭所有连接并释放 TURN 分配
 func (n *NATTraversal) Close() error {
 	var lastErr error
+	if turn := n.TURN(); turn != nil {
+		lastErr = turn.Close()
+	}
 	n.connections.Range(func(key, value interface{}) bool {
 		conn := value.(*Connection)
 		if err := conn.conn.Close(); err != nil {
@@ -139,9 +310,8 @@ func (n *NATTraversal) cleanConnections() {
 		now := time.Now()
 		n.connections.Range(func(key, value interface{}) bool {
 			conn := value.(*Connection)
-			if now.Sub(conn.lastSeen) > 10*time.Minute {
-				conn.conn.Close()
-				n.connections.Delete(key)
+			if now.Sub(time.Unix(0, conn.lastSeen.Load())) > 10*time.Minute {
+				conn.Close()
 			}
 			return true
 		})
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/relay"
+)
+
+var testRelaySecret = []byte("relay-secret-for-tests")
+
+// startRelay 在回环地址上运行中继服务
+func startRelay(t *testing.T, addr *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go relay.NewServer(conn, testRelaySecret, relay.Limits{}).Serve()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func relayTicket(nodeID, peerID string) (ticket, key []byte) {
+	return relay.IssueTicket(testRelaySecret, relay.Ticket{NodeID: nodeID, PeerID: peerID, Expires: time.Now().Add(time.Minute)})
+}
+
+// readRelay 在超时前读取连接上的下一个报文
+func readRelay(conn *Connection, timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func TestRelayConnection(t *testing.T) {
+	server := startRelay(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	addr := server.LocalAddr().(*net.UDPAddr)
+	a := NewNATTraversal(addr.IP, uint16(addr.Port))
+	b := NewNATTraversal(addr.IP, uint16(addr.Port))
+	defer a.Close()
+	defer b.Close()
+
+	// 双方都绑定后 CreateRelayConnection 才返回
+	type result struct {
+		conn *Connection
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		ticket, key := relayTicket("node-b", "node-a")
+		conn, err := b.CreateRelayConnection("node-a", ticket, key)
+		done <- result{conn, err}
+	}()
+	ticket, key := relayTicket("node-a", "node-b")
+	ca, err := a.CreateRelayConnection("node-b", ticket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	cb := r.conn
+
+	if err := a.SendData("node-b", []byte("a to b")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readRelay(cb, time.Second); err != nil || string(data) != "a to b" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if _, err := cb.WriteTo([]byte("b to a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := a.ReceiveData("node-b"); err != nil || string(data) != "b to a" {
+		t.Fatalf("received %q, %v", data, err)
+	}
+
+	// 中继服务重启后丢失会话，双方收到错误帧后重新绑定，通信自动恢复
+	server.Close()
+	startRelay(t, addr)
+	go readRelay(ca, 5*time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ca.WriteTo([]byte("again"), nil)
+		cb.WriteTo([]byte("again"), nil)
+		if data, err := readRelay(cb, 100*time.Millisecond); err == nil && string(data) == "again" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay session not restored after the relay restarted")
+		}
+	}
+
+	// 关闭的连接从穿透管理器中移除
+	ca.Close()
+	if a.SendData("node-b", nil) == nil {
+		t.Fatal("closed relay connection still registered")
+	}
+}
+
+func TestRelayConnectionRejected(t *testing.T) {
+	addr := startRelay(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}).LocalAddr().(*net.UDPAddr)
+	nat := NewNATTraversal(addr.IP, uint16(addr.Port))
+	defer nat.Close()
+
+	ticket, _ := relayTicket("node-a", "node-b")
+	if _, err := nat.CreateRelayConnection("node-b", ticket, []byte("wrong key")); err == nil {
+		t.Fatal("bind with a wrong ticket key accepted")
+	}
+	if _, err := NewNATTraversal(nil, 0).CreateRelayConnection("node-b", ticket, nil); err != ErrNoRelay {
+		t.Fatalf("without a relay: %v", err)
+	}
+}
@@ -0,0 +1,377 @@
+// Package nattest 提供进程内的 NAT 模拟器，用于测试打洞和中继回退。
+//
+// 每个 NAT 为内部主机的外部映射分配回环地址上真实的 UDP 套接字，内部主机通过 Listen 返回的
+// net.PacketConn 收发数据，外部节点看到的是映射的地址。映射和入站过滤规则由 NAT 类型决定。
+// 同一 NAT 之后的主机可以通过内网地址直接通信；不支持发夹（hairpin）转发，
+// 发往本 NAT 外部映射的报文会被丢弃。外部映射默认使用系统分配的随机端口，
+// 也可以通过 AllocatePorts 按固定步长依次分配，模拟可预测端口的对称 NAT，
+// 或通过 RandomPorts 限定在指定范围内随机分配。
+package nattest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Behavior NAT 类型，按 RFC 4787 的映射和过滤行为划分
+type Behavior int
+
+const (
+	// FullCone 映射与目的地址无关，接受任何外部地址发往映射的报文
+	FullCone Behavior = iota
+	// RestrictedCone 映射与目的地址无关，只接受内部主机发送过的外部 IP
+	RestrictedCone
+	// PortRestrictedCone 映射与目的地址无关，只接受内部主机发送过的外部 IP 和端口
+	PortRestrictedCone
+	// Symmetric 每个目的地址使用不同的映射，只接受该目的地址发回的报文
+	Symmetric
+)
+
+// String 返回 NAT 类型的名称
+func (b Behavior) String() string {
+	switch b {
+	case FullCone:
+		return "full-cone"
+	case RestrictedCone:
+		return "restricted-cone"
+	case PortRestrictedCone:
+		return "port-restricted-cone"
+	case Symmetric:
+		return "symmetric"
+	default:
+		return fmt.Sprintf("behavior(%d)", int(b))
+	}
+}
+
+// queueSize 每个内部主机的接收队列长度，队列满时丢弃报文
+const queueSize = 256
+
+// natCount 已创建的 NAT 数，用于为每个 NAT 分配不同的内网网段
+var natCount atomic.Int32
+
+// NAT 一个模拟的 NAT 设备
+type NAT struct {
+	behavior Behavior
+	subnet   net.IP // 内网网段 192.168.x.0/24
+
+	mutex    sync.Mutex
+	hosts    map[string]*Conn // 按内网地址索引的内部主机
+	next     int
+	nextPort int // 按步长分配时下一个映射的端口
+	portStep int // 为 0 时随机分配端口
+	minPort  int // 随机分配的端口范围，为 0 时由系统分配
+	maxPort  int
+}
+
+// New 创建指定类型的 NAT
+func New(behavior Behavior) *NAT {
+	n := natCount.Add(1)
+	return &NAT{
+		behavior: behavior,
+		subnet:   net.IPv4(192, 168, byte(n), 0).To4(),
+		hosts:    make(map[string]*Conn),
+	}
+}
+
+// Behavior 返回 NAT 类型
+func (n *NAT) Behavior() Behavior {
+	return n.behavior
+}
+
+// Listen 在 NAT 之后创建一个内部主机，返回其套接字
+func (n *NAT) Listen() (*Conn, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.next >= 253 {
+		return nil, errors.New("nattest: too many hosts")
+	}
+	n.next++
+
+	addr := &net.UDPAddr{IP: net.IPv4(n.subnet[0], n.subnet[1], n.subnet[2], byte(n.next)), Port: 51820}
+	return n.newConn(addr), nil
+}
+
+// ListenSibling 在 c 所在的内部主机上打开另一个端口的套接字
+func (c *Conn) ListenSibling() (*Conn, error) {
+	n := c.nat
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for port := c.addr.Port + 1; port <= 65535; port++ {
+		addr := &net.UDPAddr{IP: c.addr.IP, Port: port}
+		if _, used := n.hosts[addr.String()]; !used {
+			return n.newConn(addr), nil
+		}
+	}
+	return nil, errors.New("nattest: no free port")
+}
+
+// newConn 创建内网地址为 addr 的套接字，调用方须持有 n.mutex
+func (n *NAT) newConn(addr *net.UDPAddr) *Conn {
+	c := &Conn{
+		nat:      n,
+		addr:     addr,
+		inbound:  make(chan packet, queueSize),
+		closed:   make(chan struct{}),
+		mappings: make(map[string]*mapping),
+	}
+	n.hosts[addr.String()] = c
+	return c
+}
+
+// AllocatePorts 使此后创建的外部映射依次使用端口 next、next+step……，被占用的端口跳过
+func (n *NAT) AllocatePorts(next, step int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.nextPort, n.portStep = next, step
+}
+
+// RandomPorts 使此后创建的外部映射在 [min, max] 中随机选取端口
+func (n *NAT) RandomPorts(min, max int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.minPort, n.maxPort, n.portStep = min, max, 0
+}
+
+// listenMapping 为新的外部映射监听回环地址上的端口，指定的端口都被占用时由系统分配
+func (n *NAT) listenMapping() (*net.UDPConn, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	listen := func(port int) (*net.UDPConn, error) {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	}
+	for n.portStep != 0 && n.nextPort > 0 && n.nextPort <= 65535 {
+		port := n.nextPort
+		n.nextPort += n.portStep
+		if conn, err := listen(port); err == nil {
+			return conn, nil
+		}
+	}
+	for i := 0; n.portStep == 0 && n.maxPort >= n.minPort && n.minPort > 0 && i < 100; i++ {
+		if conn, err := listen(n.minPort + rand.Intn(n.maxPort-n.minPort+1)); err == nil {
+			return conn, nil
+		}
+	}
+	return listen(0)
+}
+
+// inside 判断地址是否位于 NAT 的内网网段
+func (n *NAT) inside(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == n.subnet[0] && ip4[1] == n.subnet[1] && ip4[2] == n.subnet[2]
+}
+
+func (n *NAT) host(addr *net.UDPAddr) *Conn {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.hosts[addr.String()]
+}
+
+// packet 一个待内部主机读取的报文
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// mapping 内部主机的一个外部映射
+type mapping struct {
+	conn *net.UDPConn
+
+	mutex   sync.Mutex
+	allowed map[string]bool // 允许发入的外部 IP 或 IP 和端口
+}
+
+// Conn NAT 之后的内部主机套接字，实现 net.PacketConn
+type Conn struct {
+	nat     *NAT
+	addr    *net.UDPAddr
+	inbound chan packet
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mutex    sync.Mutex
+	mappings map[string]*mapping // 锥形 NAT 只有一个映射，对称 NAT 按目的地址索引
+	deadline time.Time
+}
+
+// mapping 返回发往 dst 使用的外部映射，不存在时创建
+func (c *Conn) mapping(dst *net.UDPAddr) (*mapping, error) {
+	key := ""
+	if c.nat.behavior == Symmetric {
+		key = dst.String()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	if m, ok := c.mappings[key]; ok {
+		return m, nil
+	}
+
+	conn, err := c.nat.listenMapping()
+	if err != nil {
+		return nil, err
+	}
+	m := &mapping{conn: conn, allowed: make(map[string]bool)}
+	c.mappings[key] = m
+	go c.receive(m)
+	return m, nil
+}
+
+// filterKey 返回按 NAT 过滤规则比较外部地址时使用的键，完全锥形 NAT 不过滤
+func (c *Conn) filterKey(addr *net.UDPAddr) string {
+	switch c.nat.behavior {
+	case FullCone:
+		return ""
+	case RestrictedCone:
+		return addr.IP.String()
+	default:
+		return addr.String()
+	}
+}
+
+// receive 读取映射收到的报文，按过滤规则转交内部主机
+func (c *Conn) receive(m *mapping) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if key := c.filterKey(from); key != "" {
+			m.mutex.Lock()
+			allowed := m.allowed[key]
+			m.mutex.Unlock()
+			if !allowed {
+				continue
+			}
+		}
+		c.deliver(append([]byte{}, buf[:n]...), from)
+	}
+}
+
+func (c *Conn) deliver(data []byte, from *net.UDPAddr) {
+	select {
+	case c.inbound <- packet{data: data, from: from}:
+	case <-c.closed:
+	default:
+	}
+}
+
+// ReadFrom 读取一个报文，返回外部发送方的地址或同一 NAT 之后主机的内网地址
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.inbound:
+		return copy(b, p.data), p.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo 发送一个报文：发往同一 NAT 之后的主机时直接投递，否则经外部映射发出
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("nattest: unsupported address %v", addr)
+	}
+
+	if c.nat.inside(dst.IP) {
+		if host := c.nat.host(dst); host != nil {
+			host.deliver(append([]byte{}, b...), c.addr)
+		}
+		return len(b), nil
+	}
+
+	m, err := c.mapping(dst)
+	if err != nil {
+		return 0, err
+	}
+	if key := c.filterKey(dst); key != "" {
+		m.mutex.Lock()
+		m.allowed[key] = true
+		m.mutex.Unlock()
+	}
+	return m.conn.WriteToUDP(b, dst)
+}
+
+// Close 关闭套接字及其全部外部映射
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		close(c.closed)
+		for _, m := range c.mappings {
+			m.conn.Close()
+		}
+		c.mutex.Unlock()
+
+		c.nat.mutex.Lock()
+		delete(c.nat.hosts, c.addr.String())
+		c.nat.mutex.Unlock()
+	})
+	return nil
+}
+
+// LocalAddr 返回内部主机的内网地址
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// PublicAddr 返回发往 dst 使用的外部映射地址，尚未向 dst 发送过报文时返回 nil
+func (c *Conn) PublicAddr(dst *net.UDPAddr) *net.UDPAddr {
+	key := ""
+	if c.nat.behavior == Symmetric {
+		key = dst.String()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	m, ok := c.mappings[key]
+	if !ok {
+		return nil
+	}
+	return m.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// SetDeadline 设置读截止时间，写操作不会阻塞
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline 设置此后读操作的截止时间，不影响正在阻塞的读操作
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+// SetWriteDeadline 写操作不会阻塞，忽略截止时间
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
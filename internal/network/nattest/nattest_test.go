@@ -0,0 +1,157 @@
+package nattest
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, n *NAT) *Conn {
+	t.Helper()
+	c, err := n.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func listenPublic(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readFrom 在 wait 内读取一个报文，超时返回 nil
+func readFrom(t *testing.T, c *Conn, wait time.Duration) net.Addr {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(wait))
+	_, from, err := c.ReadFrom(make([]byte, 1500))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return from
+}
+
+func TestFiltering(t *testing.T) {
+	tests := []struct {
+		behavior  Behavior
+		otherPort bool // 发送过报文的 IP 的其他端口能否发入
+	}{
+		{FullCone, true},
+		{RestrictedCone, true},
+		{PortRestrictedCone, false},
+		{Symmetric, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.behavior.String(), func(t *testing.T) {
+			c := listen(t, New(tt.behavior))
+			server, other := listenPublic(t), listenPublic(t)
+			serverAddr := server.LocalAddr().(*net.UDPAddr)
+
+			// 外部映射建立前不可达
+			if c.PublicAddr(serverAddr) != nil {
+				t.Fatal("mapping exists before sending")
+			}
+			if _, err := c.WriteTo([]byte("hello"), serverAddr); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1500)
+			server.SetReadDeadline(time.Now().Add(time.Second))
+			_, public, err := server.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.PublicAddr(serverAddr); got == nil || got.String() != public.String() {
+				t.Fatalf("PublicAddr = %v, observed %v", got, public)
+			}
+
+			if _, err := server.WriteToUDP([]byte("reply"), public); err != nil {
+				t.Fatal(err)
+			}
+			if from := readFrom(t, c, time.Second); from == nil || from.String() != serverAddr.String() {
+				t.Fatalf("reply from contacted address: got %v", from)
+			}
+
+			// 回环地址上所有外部节点的 IP 相同，other 只能模拟同一 IP 的其他端口
+			if _, err := other.WriteToUDP([]byte("unsolicited"), public); err != nil {
+				t.Fatal(err)
+			}
+			got := readFrom(t, c, 100*time.Millisecond) != nil
+			if got != tt.otherPort {
+				t.Fatalf("packet from another port delivered = %v, want %v", got, tt.otherPort)
+			}
+		})
+	}
+}
+
+func TestSymmetricMapping(t *testing.T) {
+	for _, behavior := range []Behavior{PortRestrictedCone, Symmetric} {
+		c := listen(t, New(behavior))
+		a, b := listenPublic(t), listenPublic(t)
+		for _, dst := range []*net.UDPConn{a, b} {
+			if _, err := c.WriteTo([]byte("x"), dst.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		same := c.PublicAddr(a.LocalAddr().(*net.UDPAddr)).String() == c.PublicAddr(b.LocalAddr().(*net.UDPAddr)).String()
+		if same != (behavior != Symmetric) {
+			t.Errorf("%v: same mapping for different destinations = %v", behavior, same)
+		}
+	}
+}
+
+func TestSameNAT(t *testing.T) {
+	n := New(Symmetric)
+	a, b := listen(t, n), listen(t, n)
+	if _, err := a.WriteTo([]byte("lan"), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if from := readFrom(t, b, time.Second); from == nil || from.String() != a.LocalAddr().String() {
+		t.Fatalf("LAN packet from %v, want %v", from, a.LocalAddr())
+	}
+
+	b.Close()
+	if _, _, err := b.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read after close: %v", err)
+	}
+}
+
+func TestAllocatePorts(t *testing.T) {
+	n := New(Symmetric)
+	base := listenPublic(t).LocalAddr().(*net.UDPAddr).Port
+	n.AllocatePorts(base+100, 3)
+	c := listen(t, n)
+	sibling, err := c.ListenSibling()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sibling.Close()
+	if sibling.LocalAddr().(*net.UDPAddr).Port == c.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal("sibling uses the same port")
+	}
+
+	var ports []int
+	for _, conn := range []*Conn{c, c, sibling} {
+		dst := listenPublic(t).LocalAddr().(*net.UDPAddr)
+		if _, err := conn.WriteTo([]byte("x"), dst); err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, conn.PublicAddr(dst).Port)
+	}
+	// 端口被占用时跳过，只要求按步长递增
+	for i := 1; i < len(ports); i++ {
+		if d := ports[i] - ports[i-1]; d <= 0 || d%3 != 0 {
+			t.Fatalf("mapping ports %v not allocated with step 3", ports)
+		}
+	}
+}
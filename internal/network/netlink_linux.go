@@ -0,0 +1,214 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 以 rtnetlink 配置 TUN 接口的地址、MTU、状态和路由，不依赖 ip 命令
+
+const (
+	nlmsgHeaderSize = unix.SizeofNlMsghdr
+	rtattrSize      = unix.SizeofRtAttr
+)
+
+// netlinkSeq 请求的序号
+var netlinkSeq atomic.Uint32
+
+// netlinkMessage 一条 rtnetlink 请求，由固定头部和属性组成
+type netlinkMessage struct {
+	msgType uint16
+	flags   uint16
+	data    []byte
+}
+
+// addAttr 追加一个属性，按 4 字节对齐
+func (m *netlinkMessage) addAttr(attrType uint16, value []byte) {
+	header := make([]byte, rtattrSize)
+	binary.NativeEndian.PutUint16(header[0:2], uint16(rtattrSize+len(value)))
+	binary.NativeEndian.PutUint16(header[2:4], attrType)
+	m.data = append(m.data, header...)
+	m.data = append(m.data, value...)
+	for len(m.data)%unix.NLMSG_ALIGNTO != 0 {
+		m.data = append(m.data, 0)
+	}
+}
+
+func (m *netlinkMessage) addUint32(attrType uint16, value uint32) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, value)
+	m.addAttr(attrType, b)
+}
+
+// encode 编码为带消息头的请求，要求内核回复确认
+func (m *netlinkMessage) encode(seq uint32) []byte {
+	buf := make([]byte, nlmsgHeaderSize, nlmsgHeaderSize+len(m.data))
+	binary.NativeEndian.PutUint32(buf[0:4], uint32(nlmsgHeaderSize+len(m.data)))
+	binary.NativeEndian.PutUint16(buf[4:6], m.msgType)
+	binary.NativeEndian.PutUint16(buf[6:8], m.flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(buf[8:12], seq)
+	return append(buf, m.data...)
+}
+
+// newAddrMessage 构建为接口 index 添加或删除地址 addr 的请求
+func newAddrMessage(msgType uint16, index int, addr *net.IPNet) *netlinkMessage {
+	family, ip := addressFamily(addr.IP)
+	ones, _ := addr.Mask.Size()
+	m := &netlinkMessage{msgType: msgType}
+	if msgType == unix.RTM_NEWADDR {
+		m.flags = unix.NLM_F_CREATE | unix.NLM_F_REPLACE
+	}
+	// struct ifaddrmsg
+	m.data = make([]byte, unix.SizeofIfAddrmsg)
+	m.data[0] = family
+	m.data[1] = byte(ones)
+	m.data[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(m.data[4:8], uint32(index))
+	// IPv4 的 IFA_LOCAL 为本端地址，IFA_ADDRESS 与之相同时内核按前缀添加直连路由
+	if family == unix.AF_INET {
+		m.addAttr(unix.IFA_LOCAL, ip)
+	}
+	m.addAttr(unix.IFA_ADDRESS, ip)
+	return m
+}
+
+// newLinkMessage 构建设置接口 index 的 MTU 并启动接口的请求，mtu 为 0 时不修改 MTU
+func newLinkMessage(index, mtu int) *netlinkMessage {
+	m := &netlinkMessage{msgType: unix.RTM_NEWLINK}
+	// struct ifinfomsg
+	m.data = make([]byte, unix.SizeofIfInfomsg)
+	m.data[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(m.data[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(m.data[8:12], unix.IFF_UP)
+	binary.NativeEndian.PutUint32(m.data[12:16], unix.IFF_UP)
+	if mtu > 0 {
+		m.addUint32(unix.IFLA_MTU, uint32(mtu))
+	}
+	return m
+}
+
+// newRouteMessage 构建经接口 index 添加或删除到 dst 的路由的请求
+func newRouteMessage(msgType uint16, index int, dst *net.IPNet) *netlinkMessage {
+	family, ip := addressFamily(dst.IP.Mask(dst.Mask))
+	ones, _ := dst.Mask.Size()
+	m := &netlinkMessage{msgType: msgType}
+	if msgType == unix.RTM_NEWROUTE {
+		m.flags = unix.NLM_F_CREATE | unix.NLM_F_REPLACE
+	}
+	// struct rtmsg
+	m.data = make([]byte, unix.SizeofRtMsg)
+	m.data[0] = family
+	m.data[1] = byte(ones)
+	m.data[4] = unix.RT_TABLE_MAIN
+	m.data[5] = unix.RTPROT_STATIC
+	m.data[6] = unix.RT_SCOPE_LINK
+	m.data[7] = unix.RTN_UNICAST
+	m.addAttr(unix.RTA_DST, ip)
+	m.addUint32(unix.RTA_OIF, uint32(index))
+	return m
+}
+
+// addressFamily 返回地址的协议族及其按协议族长度的字节
+func addressFamily(ip net.IP) (byte, []byte) {
+	if v4 := ip.To4(); v4 != nil {
+		return unix.AF_INET, v4
+	}
+	return unix.AF_INET6, ip.To16()
+}
+
+// netlinkRequest 发送请求并等待内核的确认，内核拒绝时返回对应的错误码
+func netlinkRequest(m *netlinkMessage) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("打开 netlink 套接字失败: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("绑定 netlink 套接字失败: %w", err)
+	}
+
+	seq := netlinkSeq.Add(1)
+	if err := unix.Sendto(fd, m.encode(seq), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != seq || msg.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(msg.Data) < 4 {
+				return fmt.Errorf("netlink 确认消息过短")
+			}
+			// struct nlmsgerr 以负的错误码开头，0 表示成功
+			if code := int32(binary.NativeEndian.Uint32(msg.Data[0:4])); code != 0 {
+				return unix.Errno(-code)
+			}
+			return nil
+		}
+	}
+}
+
+// linkIndex 返回接口的索引
+func linkIndex(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return iface.Index, nil
+}
+
+func addAddress(name string, addr *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(newAddrMessage(unix.RTM_NEWADDR, index, addr))
+}
+
+func deleteAddress(name string, addr *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(newAddrMessage(unix.RTM_DELADDR, index, addr))
+}
+
+func setLinkUp(name string, mtu int) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(newLinkMessage(index, mtu))
+}
+
+func addRoute(name string, dst *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(newRouteMessage(unix.RTM_NEWROUTE, index, dst))
+}
+
+func deleteRoute(name string, dst *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(newRouteMessage(unix.RTM_DELROUTE, index, dst))
+}
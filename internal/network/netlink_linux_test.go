@@ -0,0 +1,245 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipNet.IP = ip
+	return ipNet
+}
+
+func TestNetlinkMessages(t *testing.T) {
+	// 请求以 nlmsghdr 开头，属性按 4 字节对齐
+	data := newRouteMessage(unix.RTM_NEWROUTE, 7, mustCIDR(t, "192.168.5.9/24")).encode(42)
+	if size := binary.NativeEndian.Uint32(data[0:4]); int(size) != len(data) || size%4 != 0 {
+		t.Fatalf("length = %d, encoded %d bytes", size, len(data))
+	}
+	flags := binary.NativeEndian.Uint16(data[6:8])
+	if flags&unix.NLM_F_ACK == 0 || flags&unix.NLM_F_CREATE == 0 || binary.NativeEndian.Uint32(data[8:12]) != 42 {
+		t.Fatalf("header = %x", data[:nlmsgHeaderSize])
+	}
+	rtmsg := data[nlmsgHeaderSize:]
+	if rtmsg[0] != unix.AF_INET || rtmsg[1] != 24 || rtmsg[6] != unix.RT_SCOPE_LINK {
+		t.Fatalf("rtmsg = %x", rtmsg[:unix.SizeofRtMsg])
+	}
+	attrs := parseAttrs(t, rtmsg[unix.SizeofRtMsg:])
+	// 路由的目的地址取网段地址
+	if !bytes.Equal(attrs[unix.RTA_DST], []byte{192, 168, 5, 0}) || binary.NativeEndian.Uint32(attrs[unix.RTA_OIF]) != 7 {
+		t.Fatalf("attributes = %v", attrs)
+	}
+
+	data = newAddrMessage(unix.RTM_NEWADDR, 3, mustCIDR(t, "fd00::2/64")).encode(1)
+	ifaddr := data[nlmsgHeaderSize:]
+	if ifaddr[0] != unix.AF_INET6 || ifaddr[1] != 64 || binary.NativeEndian.Uint32(ifaddr[4:8]) != 3 {
+		t.Fatalf("ifaddrmsg = %x", ifaddr[:unix.SizeofIfAddrmsg])
+	}
+	attrs = parseAttrs(t, ifaddr[unix.SizeofIfAddrmsg:])
+	if !net.IP(attrs[unix.IFA_ADDRESS]).Equal(net.ParseIP("fd00::2")) || attrs[unix.IFA_LOCAL] != nil {
+		t.Fatalf("attributes = %v", attrs)
+	}
+}
+
+func parseAttrs(t *testing.T, data []byte) map[uint16][]byte {
+	t.Helper()
+	attrs := make(map[uint16][]byte)
+	for len(data) >= rtattrSize {
+		size := int(binary.NativeEndian.Uint16(data[0:2]))
+		if size < rtattrSize || size > len(data) {
+			t.Fatalf("malformed attribute %x", data)
+		}
+		attrs[binary.NativeEndian.Uint16(data[2:4])] = data[rtattrSize:size]
+		data = data[min((size+3)&^3, len(data)):]
+	}
+	return attrs
+}
+
+// hasRoute 判断主路由表中是否有经接口 index 到 dst 的路由
+func hasRoute(t *testing.T, family int, index int, dst *net.IPNet) bool {
+	t.Helper()
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ones, _ := dst.Mask.Size()
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWROUTE || len(msg.Data) < unix.SizeofRtMsg || int(msg.Data[1]) != ones {
+			continue
+		}
+		attrs := parseAttrs(t, msg.Data[unix.SizeofRtMsg:])
+		if net.IP(attrs[unix.RTA_DST]).Equal(dst.IP) && len(attrs[unix.RTA_OIF]) == 4 &&
+			int(binary.NativeEndian.Uint32(attrs[unix.RTA_OIF])) == index {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTUNConfiguration(t *testing.T) {
+	tun, err := NewTUN("", 1380, 1)
+	if err != nil {
+		t.Skipf("cannot create a TUN device: %v", err)
+	}
+	defer tun.Close()
+
+	v4, v6 := mustCIDR(t, "10.213.0.2/24"), mustCIDR(t, "fd00:213::2/64")
+	if err := tun.AddAddress(v4); err != nil {
+		t.Fatal(err)
+	}
+	ipv6 := tun.AddAddress(v6) == nil
+	if err := tun.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// 重复添加同一地址不报错
+	if err := tun.AddAddress(v4); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := tun.GetIP(); !ip.Equal(v4.IP) {
+		t.Fatalf("ip = %v", ip)
+	}
+
+	iface, err := net.InterfaceByName(tun.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.MTU != 1380 || iface.Flags&net.FlagUp == 0 {
+		t.Fatalf("mtu = %d, flags = %v", iface.MTU, iface.Flags)
+	}
+	if size := tun.PacketSize(); size != 1380 {
+		t.Fatalf("packet size = %d", size)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, addr := range addrs {
+		found[addr.String()] = true
+	}
+	if !found[v4.String()] || (ipv6 && !found[v6.String()]) {
+		t.Fatalf("addresses = %v", addrs)
+	}
+
+	routes := []*net.IPNet{mustCIDR(t, "192.168.213.0/24")}
+	if ipv6 {
+		routes = append(routes, mustCIDR(t, "fd00:214::/64"))
+	}
+	for _, route := range routes {
+		family := unix.AF_INET
+		if route.IP.To4() == nil {
+			family = unix.AF_INET6
+		}
+		if err := tun.AddRoute(route); err != nil {
+			t.Fatal(err)
+		}
+		if !hasRoute(t, family, iface.Index, route) {
+			t.Fatalf("route to %s not installed", route)
+		}
+		if err := tun.DeleteRoute(route); err != nil {
+			t.Fatal(err)
+		}
+		if hasRoute(t, family, iface.Index, route) {
+			t.Fatalf("route to %s not removed", route)
+		}
+	}
+	if len(tun.Routes()) != 0 {
+		t.Fatalf("routes = %v", tun.Routes())
+	}
+
+	if err := tun.RemoveAddress(v4); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := iface.Addrs(); len(addrs) > 0 && addrs[0].String() == v4.String() {
+		t.Fatalf("address %s not removed", v4)
+	}
+}
+
+func TestMultiQueueTUN(t *testing.T) {
+	tun, err := NewTUN("", 1380, 4)
+	if err != nil {
+		t.Skipf("cannot create a multi-queue TUN device: %v", err)
+	}
+	defer tun.Close()
+	if tun.Queues() != 4 {
+		t.Fatalf("%d queues", tun.Queues())
+	}
+	if err := tun.AddAddress(mustCIDR(t, "10.215.0.2/24")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个队列由一个协程读取，记录各流的数据包从哪个队列读出
+	type read struct {
+		queue int
+		port  uint16
+		seq   byte
+	}
+	reads := make(chan read, 64)
+	for i := 0; i < tun.Queues(); i++ {
+		go func(i int) {
+			buf := make([]byte, 1500)
+			for {
+				n, err := tun.Queue(i).Read(buf)
+				if err != nil {
+					return
+				}
+				// 只关心发往测试端口的 IPv4 UDP 包，忽略内核发出的其他报文
+				if n >= 29 && buf[0] == 0x45 && buf[9] == protocolUDP && binary.BigEndian.Uint16(buf[22:24]) == 9999 {
+					reads <- read{queue: i, port: binary.BigEndian.Uint16(buf[20:22]), seq: buf[28]}
+				}
+			}
+		}(i)
+	}
+
+	const flows, packets = 8, 5
+	for f := 0; f < flows; f++ {
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(10, 215, 0, 9), Port: 9999})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for seq := 0; seq < packets; seq++ {
+			if _, err := conn.Write([]byte{byte(seq)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 同一流的数据包从同一队列按发送顺序读出
+	queues := make(map[uint16]int)
+	next := make(map[uint16]byte)
+	for i := 0; i < flows*packets; i++ {
+		select {
+		case r := <-reads:
+			if queue, ok := queues[r.port]; ok && queue != r.queue {
+				t.Fatalf("flow %d read from queues %d and %d", r.port, queue, r.queue)
+			}
+			if r.seq != next[r.port] {
+				t.Fatalf("flow %d: packet %d read before %d", r.port, r.seq, next[r.port])
+			}
+			queues[r.port], next[r.port] = r.queue, r.seq+1
+		case <-time.After(2 * time.Second):
+			t.Fatalf("read %d of %d packets", i, flows*packets)
+		}
+	}
+}
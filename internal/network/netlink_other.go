@@ -0,0 +1,19 @@
+//go:build !linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// errNetlinkUnsupported 当前平台没有实现 TUN 接口的地址和路由配置，须手动配置
+var errNetlinkUnsupported = fmt.Errorf("%s 平台不支持自动配置 TUN 接口: %w", runtime.GOOS, errors.ErrUnsupported)
+
+func addAddress(name string, addr *net.IPNet) error    { return errNetlinkUnsupported }
+func deleteAddress(name string, addr *net.IPNet) error { return errNetlinkUnsupported }
+func setLinkUp(name string, mtu int) error             { return errNetlinkUnsupported }
+func addRoute(name string, dst *net.IPNet) error       { return errNetlinkUnsupported }
+func deleteRoute(name string, dst *net.IPNet) error    { return errNetlinkUnsupported }
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+
+	protocolTCP = 6
+	protocolUDP = 17
+
+	// FNV-1a 哈希的初始值和乘数
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+var (
+	// ErrPacketTooShort 数据包短于 IP 头部
+	ErrPacketTooShort = errors.New("packet too short")
+	// ErrNotIPPacket 数据包不是 IPv4 或 IPv6 包
+	ErrNotIPPacket = errors.New("not an IP packet")
+)
+
+// Packet 从 TUN 接口读取或写入的 IP 数据包的地址信息
+type Packet struct {
+	Version     int
+	Source      net.IP
+	Destination net.IP
+}
+
+// ParsePacket 解析 IPv4 或 IPv6 数据包头部，头部声明的长度超出数据包时返回错误。
+// 返回的地址引用 data 的内容，data 被复用前需要复制。
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) == 0 {
+		return nil, ErrPacketTooShort
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < ipv4HeaderSize {
+			return nil, ErrPacketTooShort
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if headerLen < ipv4HeaderSize || totalLen < headerLen || totalLen > len(data) {
+			return nil, fmt.Errorf("%w: IPv4 header length %d, total length %d, packet %d bytes",
+				ErrPacketTooShort, headerLen, totalLen, len(data))
+		}
+		return &Packet{
+			Version:     4,
+			Source:      net.IP(data[12:16]),
+			Destination: net.IP(data[16:20]),
+		}, nil
+	case 6:
+		if len(data) < ipv6HeaderSize {
+			return nil, ErrPacketTooShort
+		}
+		payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+		if ipv6HeaderSize+payloadLen > len(data) {
+			return nil, fmt.Errorf("%w: IPv6 payload length %d, packet %d bytes",
+				ErrPacketTooShort, payloadLen, len(data))
+		}
+		return &Packet{
+			Version:     6,
+			Source:      net.IP(data[8:24]),
+			Destination: net.IP(data[24:40]),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: version %d", ErrNotIPPacket, data[0]>>4)
+	}
+}
+
+// FlowHash 返回 IP 数据包所属流的哈希值，按两端的地址、协议和 TCP/UDP 端口计算，同一流两个方向的数据包哈希值相同。
+// IPv4 分片只按地址和协议计算，与同一数据报的其他分片哈希值相同；不是 IP 包时返回 0
+func FlowHash(packet []byte) uint32 {
+	var src, dst, transport []byte
+	var proto byte
+	switch {
+	case len(packet) >= ipv4HeaderSize && packet[0]>>4 == 4:
+		src, dst, proto = packet[12:16], packet[16:20], packet[9]
+		headerLen := int(packet[0]&0x0f) * 4
+		// 只有未分片的数据报可取端口，MF 标志和片偏移均为 0
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff == 0 && headerLen <= len(packet) {
+			transport = packet[headerLen:]
+		}
+	case len(packet) >= ipv6HeaderSize && packet[0]>>4 == 6:
+		src, dst, proto, transport = packet[8:24], packet[24:40], packet[6], packet[ipv6HeaderSize:]
+	default:
+		return 0
+	}
+
+	var srcPort, dstPort []byte
+	if (proto == protocolTCP || proto == protocolUDP) && len(transport) >= 4 {
+		srcPort, dstPort = transport[0:2], transport[2:4]
+	}
+	// 两端按字节序排列，使两个方向的哈希值相同
+	if c := bytes.Compare(src, dst); c > 0 || c == 0 && bytes.Compare(srcPort, dstPort) > 0 {
+		src, dst, srcPort, dstPort = dst, src, dstPort, srcPort
+	}
+	hash := fnv32a(fnvOffset, src)
+	hash = fnv32a(hash, srcPort)
+	hash = fnv32a(hash, dst)
+	hash = fnv32a(hash, dstPort)
+	return fnv32a(hash, []byte{proto})
+}
+
+// fnv32a 以 FNV-1a 算法将 data 累加到哈希值 hash
+func fnv32a(hash uint32, data []byte) uint32 {
+	for _, b := range data {
+		hash ^= uint32(b)
+		hash *= fnvPrime
+	}
+	return hash
+}
@@ -0,0 +1,63 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// udpPacket 构造 IPv4 UDP 数据包，fragment 为 IP 头部的标志和片偏移字段
+func udpPacket(src, dst net.IP, srcPort, dstPort, fragment uint16) []byte {
+	packet := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, protocolUDP, 0, 0}
+	binary.BigEndian.PutUint16(packet[6:8], fragment)
+	packet = append(packet, src.To4()...)
+	packet = append(packet, dst.To4()...)
+	packet = binary.BigEndian.AppendUint16(packet, srcPort)
+	packet = binary.BigEndian.AppendUint16(packet, dstPort)
+	return append(packet, 0, 8, 0, 0)
+}
+
+func TestFlowHash(t *testing.T) {
+	a, b := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	flow := FlowHash(udpPacket(a, b, 1000, 53, 0))
+	if flow == 0 || FlowHash(udpPacket(b, a, 53, 1000, 0)) != flow {
+		t.Fatal("directions of a flow hashed differently")
+	}
+	if FlowHash(udpPacket(a, b, 1001, 53, 0)) == flow {
+		t.Fatal("ports not hashed")
+	}
+	// 同一地址之间的流按端口排列两端
+	if FlowHash(udpPacket(a, a, 1000, 53, 0)) != FlowHash(udpPacket(a, a, 53, 1000, 0)) {
+		t.Fatal("directions of a loopback flow hashed differently")
+	}
+	// 各分片不论是否带有端口都按地址计算
+	first, later := udpPacket(a, b, 1000, 53, 0x2000), udpPacket(a, b, 7, 7, 0x0010)
+	if FlowHash(first) != FlowHash(later) {
+		t.Fatal("fragments of a datagram hashed differently")
+	}
+
+	v6 := make([]byte, ipv6HeaderSize+8)
+	v6[0], v6[6] = 0x60, protocolTCP
+	copy(v6[8:24], net.ParseIP("fd00::1"))
+	copy(v6[24:40], net.ParseIP("fd00::2"))
+	binary.BigEndian.PutUint16(v6[40:42], 443)
+	reply := append([]byte{}, v6...)
+	copy(reply[8:24], v6[24:40])
+	copy(reply[24:40], v6[8:24])
+	reply[40], reply[41], reply[42], reply[43] = v6[42], v6[43], v6[40], v6[41]
+	if FlowHash(v6) != FlowHash(reply) {
+		t.Fatal("directions of an IPv6 flow hashed differently")
+	}
+	if FlowHash([]byte("not a packet")) != 0 {
+		t.Fatal("invalid packet hashed")
+	}
+
+	// 承载 IP 包的帧按 IP 流计算，其他帧按 MAC 地址计算
+	macA, macB := net.HardwareAddr{2, 0, 0, 0, 0, 0xa}, net.HardwareAddr{2, 0, 0, 0, 0, 0xb}
+	if FrameFlowHash(append(frameHeader(macB, macA, 0, EtherTypeIPv4), udpPacket(a, b, 1000, 53, 0)...)) != flow {
+		t.Fatal("IP frame not hashed by its flow")
+	}
+	if FrameFlowHash(frameHeader(macB, macA, 0, 0x88b5)) != FrameFlowHash(frameHeader(macA, macB, 0, 0x88b5)) {
+		t.Fatal("directions of a frame flow hashed differently")
+	}
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenUDPReusePort 以 SO_REUSEPORT 监听 UDP 地址 laddr，laddr 为 nil 时监听任意地址的随机端口。
+// 以同一地址再次调用可创建共享该端口的多个套接字：从任一套接字发出的报文源地址相同，
+// 内核按来源将收到的报文分配到其中一个套接字，同一来源的报文总是到达同一个套接字
+func ListenUDPReusePort(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if controlErr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	var address string
+	if laddr != nil {
+		address = laddr.String()
+	}
+	conn, err := config.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
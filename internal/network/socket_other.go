@@ -0,0 +1,15 @@
+//go:build !linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// ListenUDPReusePort 以 SO_REUSEPORT 监听 UDP 地址 laddr，当前平台不支持，返回 errors.ErrUnsupported
+func ListenUDPReusePort(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("%s 平台不支持多个套接字共享端口: %w", runtime.GOOS, errors.ErrUnsupported)
+}
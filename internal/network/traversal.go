@@ -0,0 +1,225 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+
+	"github.com/fenghuilee/sd-wan/internal/stun"
+)
+
+// TraversalMethod 节点之间的 NAT 穿透方式
+type TraversalMethod int
+
+const (
+	// TraversalPunch 双方同时向对方的端点打洞
+	TraversalPunch TraversalMethod = iota
+	// TraversalPredict 对称 NAT 按固定步长分配端口，另一方探测预测的端口
+	TraversalPredict
+	// TraversalBirthday 对称 NAT 随机分配端口，对称一方打开多个套接字，另一方探测随机端口
+	TraversalBirthday
+	// TraversalRelay 双方均为对称 NAT，无法穿透，经中继服务或服务器中继
+	TraversalRelay
+
+	traversalMethods
+)
+
+// String 返回穿透方式的名称
+func (m TraversalMethod) String() string {
+	switch m {
+	case TraversalPunch:
+		return "punch"
+	case TraversalPredict:
+		return "predict"
+	case TraversalBirthday:
+		return "birthday"
+	case TraversalRelay:
+		return "relay"
+	default:
+		return fmt.Sprintf("method(%d)", int(m))
+	}
+}
+
+// maxPortStep 对称 NAT 连续两个映射的端口差不超过该值时视为按固定步长分配
+const maxPortStep = 16
+
+// ChooseTraversal 按双方的 NAT 类型和对称 NAT 观察到的端口步长选择穿透方式。
+// 只有对称 NAT 与端口受限锥形 NAT 之间需要端口预测或生日攻击，
+// 双方均为对称 NAT 时每个探测都会消耗新的映射，无法预测
+func ChooseTraversal(local, remote stun.NATType, localStep, remoteStep int) TraversalMethod {
+	if stun.CanPunch(local, remote) {
+		return TraversalPunch
+	}
+	if local == stun.NATSymmetric && remote == stun.NATSymmetric {
+		return TraversalRelay
+	}
+	step := remoteStep
+	if local == stun.NATSymmetric {
+		step = localStep
+	}
+	if step != 0 && step >= -maxPortStep && step <= maxPortStep {
+		return TraversalPredict
+	}
+	return TraversalBirthday
+}
+
+// TraversalLimits 端口预测和生日攻击的尝试上限
+type TraversalLimits struct {
+	PredictPorts   int    // 端口预测时探测的端口数
+	Sockets        int    // 生日攻击时对称 NAT 一侧额外打开的套接字数
+	ProbesPerRound int    // 生日攻击时另一侧每轮探测的随机端口数
+	MaxProbes      int    // 生日攻击时另一侧最多探测的端口数
+	MinPort        uint16 // 随机探测的端口范围
+	MaxPort        uint16
+}
+
+// DefaultTraversalLimits 返回默认的尝试上限：对称一侧 64 个映射、另一侧 2048 个探测，
+// 在整个端口范围内命中的概率约为 87%
+func DefaultTraversalLimits() TraversalLimits {
+	return TraversalLimits{
+		PredictPorts:   32,
+		Sockets:        64,
+		ProbesPerRound: 64,
+		MaxProbes:      2048,
+		MinPort:        1024,
+		MaxPort:        65535,
+	}
+}
+
+// PredictPorts 按对称 NAT 已观察到的映射端口 base 和步长 step 预测其后续分配的 count 个端口，
+// 超出端口范围的预测被丢弃
+func PredictPorts(base uint16, step, count int) []uint16 {
+	ports := make([]uint16, 0, count)
+	for i := 1; i <= count; i++ {
+		port := int(base) + step*i
+		if port <= 0 || port > 65535 {
+			break
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports
+}
+
+// RandomPorts 在 [MinPort, MaxPort] 中随机选取至多 count 个不在 tried 中的端口，并将其记入 tried
+func (l TraversalLimits) RandomPorts(count int, tried map[uint16]bool) []uint16 {
+	size := int(l.MaxPort) - int(l.MinPort) + 1
+	if size <= 0 {
+		return nil
+	}
+	ports := make([]uint16, 0, count)
+	for len(ports) < count && len(tried) < size {
+		port := l.MinPort + uint16(rand.Intn(size))
+		if tried[port] {
+			continue
+		}
+		tried[port] = true
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// TraversalStats 一种穿透方式的累计统计
+type TraversalStats struct {
+	Method    TraversalMethod
+	Attempts  uint64
+	Successes uint64
+	Probes    uint64 // 发送的端口探测数
+	Sockets   uint64 // 额外打开的套接字数
+}
+
+// String 返回统计摘要
+func (s TraversalStats) String() string {
+	return fmt.Sprintf("%s %d/%d (probes %d, sockets %d)", s.Method, s.Successes, s.Attempts, s.Probes, s.Sockets)
+}
+
+// SetLocalNAT 设置本端经 STUN 探测出的 NAT 类型和对称 NAT 的端口步长
+func (n *NATTraversal) SetLocalNAT(natType stun.NATType, step int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.localNAT, n.localStep = natType, step
+}
+
+// LocalNAT 返回本端的 NAT 类型和端口步长
+func (n *NATTraversal) LocalNAT() (stun.NATType, int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.localNAT, n.localStep
+}
+
+// Choose 为与 NAT 类型为 remote、端口步长为 remoteStep 的对端之间选择穿透方式
+func (n *NATTraversal) Choose(remote stun.NATType, remoteStep int) TraversalMethod {
+	local, localStep := n.LocalNAT()
+	return ChooseTraversal(local, remote, localStep, remoteStep)
+}
+
+// SetLimits 设置端口预测和生日攻击的尝试上限
+func (n *NATTraversal) SetLimits(limits TraversalLimits) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.limits = limits
+}
+
+// Limits 返回端口预测和生日攻击的尝试上限
+func (n *NATTraversal) Limits() TraversalLimits {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.limits
+}
+
+// SetListener 设置生日攻击、中继连接和 TURN 分配打开套接字的方式，默认在任意本地端口上监听 UDP
+func (n *NATTraversal) SetListener(listen func() (net.PacketConn, error)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.listen = listen
+}
+
+// OpenSockets 为生日攻击打开 count 个套接字，任何一个失败时关闭已打开的套接字
+func (n *NATTraversal) OpenSockets(count int) ([]net.PacketConn, error) {
+	n.mutex.Lock()
+	listen := n.listen
+	n.mutex.Unlock()
+
+	conns := make([]net.PacketConn, 0, count)
+	for i := 0; i < count; i++ {
+		conn, err := listen()
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("打开穿透套接字失败: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// RecordTraversal 记录一次穿透的结果，返回该方式更新后的统计
+func (n *NATTraversal) RecordTraversal(method TraversalMethod, success bool, probes, sockets int) TraversalStats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if method < 0 || method >= traversalMethods {
+		return TraversalStats{Method: method}
+	}
+	stats := &n.stats[method]
+	stats.Method = method
+	stats.Attempts++
+	if success {
+		stats.Successes++
+	}
+	stats.Probes += uint64(probes)
+	stats.Sockets += uint64(sockets)
+	return *stats
+}
+
+// Stats 返回尝试过的穿透方式的累计统计
+func (n *NATTraversal) Stats() []TraversalStats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var stats []TraversalStats
+	for _, s := range n.stats {
+		if s.Attempts > 0 {
+			stats = append(stats, s)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fenghuilee/sd-wan/internal/stun"
+)
+
+func TestChooseTraversal(t *testing.T) {
+	tests := []struct {
+		local, remote         stun.NATType
+		localStep, remoteStep int
+		want                  TraversalMethod
+	}{
+		{stun.NATFullCone, stun.NATSymmetric, 0, 0, TraversalPunch},
+		{stun.NATRestrictedCone, stun.NATSymmetric, 0, 7, TraversalPunch},
+		{stun.NATUnknown, stun.NATSymmetric, 0, 0, TraversalPunch},
+		{stun.NATSymmetric, stun.NATSymmetric, 1, 1, TraversalRelay},
+		{stun.NATSymmetric, stun.NATPortRestrictedCone, 1, 0, TraversalPredict},
+		{stun.NATSymmetric, stun.NATPortRestrictedCone, -16, 0, TraversalPredict},
+		{stun.NATSymmetric, stun.NATPortRestrictedCone, 0, 0, TraversalBirthday},
+		{stun.NATSymmetric, stun.NATPortRestrictedCone, 4000, 0, TraversalBirthday},
+		// 只看对称一方的步长
+		{stun.NATPortRestrictedCone, stun.NATSymmetric, 3, 2, TraversalPredict},
+		{stun.NATPortRestrictedCone, stun.NATSymmetric, 3, 17, TraversalBirthday},
+	}
+	for _, tt := range tests {
+		if got := ChooseTraversal(tt.local, tt.remote, tt.localStep, tt.remoteStep); got != tt.want {
+			t.Errorf("ChooseTraversal(%v, %v, %d, %d) = %v, want %v", tt.local, tt.remote, tt.localStep, tt.remoteStep, got, tt.want)
+		}
+	}
+}
+
+func TestPredictPorts(t *testing.T) {
+	ports := PredictPorts(40000, 3, 4)
+	want := []uint16{40003, 40006, 40009, 40012}
+	if len(ports) != len(want) {
+		t.Fatalf("ports = %v", ports)
+	}
+	for i := range want {
+		if ports[i] != want[i] {
+			t.Fatalf("ports = %v, want %v", ports, want)
+		}
+	}
+	// 超出端口范围的预测被丢弃
+	if ports := PredictPorts(65530, 4, 4); len(ports) != 1 || ports[0] != 65534 {
+		t.Fatalf("ports near the top = %v", ports)
+	}
+	if ports := PredictPorts(3, -2, 4); len(ports) != 1 || ports[0] != 1 {
+		t.Fatalf("ports near the bottom = %v", ports)
+	}
+}
+
+func TestRandomPorts(t *testing.T) {
+	limits := TraversalLimits{MinPort: 30000, MaxPort: 30099}
+	tried := make(map[uint16]bool)
+	for round := 0; round < 3; round++ {
+		for _, port := range limits.RandomPorts(40, tried) {
+			if port < limits.MinPort || port > limits.MaxPort {
+				t.Fatalf("port %d out of range", port)
+			}
+		}
+	}
+	// 整个范围探测完后不再返回端口
+	if len(tried) != 100 {
+		t.Fatalf("tried %d ports", len(tried))
+	}
+	if ports := limits.RandomPorts(10, tried); len(ports) != 0 {
+		t.Fatalf("ports after exhausting the range = %v", ports)
+	}
+}
+
+func TestTraversalStats(t *testing.T) {
+	n := NewNATTraversal(nil, 0)
+	defer n.Close()
+	n.SetLocalNAT(stun.NATSymmetric, 0)
+	if got := n.Choose(stun.NATPortRestrictedCone, 0); got != TraversalBirthday {
+		t.Fatalf("method = %v", got)
+	}
+
+	opened := 0
+	n.SetListener(func() (net.PacketConn, error) {
+		opened++
+		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	})
+	sockets, err := n.OpenSockets(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range sockets {
+		conn.Close()
+	}
+	if len(sockets) != 3 || opened != 3 {
+		t.Fatalf("opened %d sockets", opened)
+	}
+
+	n.RecordTraversal(TraversalBirthday, false, 100, 3)
+	stats := n.RecordTraversal(TraversalBirthday, true, 50, 3)
+	if stats.Attempts != 2 || stats.Successes != 1 || stats.Probes != 150 || stats.Sockets != 6 {
+		t.Fatalf("stats = %v", stats)
+	}
+	n.RecordTraversal(TraversalPunch, true, 0, 0)
+	if all := n.Stats(); len(all) != 2 || all[0].Method != TraversalPunch || all[1].String() != "birthday 1/2 (probes 150, sockets 6)" {
+		t.Fatalf("all stats = %v", all)
+	}
+}
@@ -1,67 +1,226 @@
 package network
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/songgao/water"
 )
 
-// TUN 表示一个 TUN 接口
+// TUN 表示一个 TUN 接口或 TAP 接口。Linux 上经 rtnetlink 配置接口的地址、MTU 和路由，
+// 其他平台须手动配置，相应方法返回 errors.ErrUnsupported
 type TUN struct {
-	iface *water.Interface
-	mtu   int
+	queues []*water.Interface // 接口的队列，第一个队列即创建接口时打开的队列
+	mtu    int
+	tap    bool
+	// mtuSet 接口的 MTU 已经由 Up 经 rtnetlink 设置为 mtu
+	mtuSet atomic.Bool
+
+	mutex  sync.Mutex
+	addrs  []*net.IPNet
+	routes map[string]*net.IPNet // 本接口安装的路由，按网段索引
+}
+
+// NewTUN 创建新的 TUN 接口，读写的数据为 IP 包。queues 大于 1 时在 Linux 上以多队列方式（IFF_MULTI_QUEUE）创建接口，
+// 各队列可由不同的协程并行读写；其他平台只打开一个队列
+func NewTUN(name string, mtu, queues int) (*TUN, error) {
+	return newInterface(name, mtu, queues, water.TUN)
 }
 
-// NewTUN 创建新的 TUN 接口
-func NewTUN(name string, mtu int) (*TUN, error) {
+// NewTAP 创建新的 TAP 接口，读写的数据为以太网帧，可与局域网接口桥接。queues 的含义与 NewTUN 相同
+func NewTAP(name string, mtu, queues int) (*TUN, error) {
+	return newInterface(name, mtu, queues, water.TAP)
+}
+
+func newInterface(name string, mtu, queues int, deviceType water.DeviceType) (*TUN, error) {
 	config := water.Config{
-		DeviceType: water.TUN,
+		DeviceType: deviceType,
 	}
 	if name != "" {
 		config.Name = name
 	}
+	if queues > 1 && !setMultiQueue(&config) {
+		queues = 1
+	}
 
-	iface, err := water.New(config)
-	if err != nil {
-		return nil, err
+	t := &TUN{
+		mtu:    mtu,
+		tap:    deviceType == water.TAP,
+		routes: make(map[string]*net.IPNet),
 	}
+	for len(t.queues) < max(queues, 1) {
+		iface, err := water.New(config)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		// 其余队列按名称挂接到第一个队列创建的接口
+		config.Name = iface.Name()
+		t.queues = append(t.queues, iface)
+	}
+	return t, nil
+}
 
-	return &TUN{
-		iface: iface,
-		mtu:   mtu,
-	}, nil
+// Name 返回接口名
+func (t *TUN) Name() string {
+	return t.queues[0].Name()
 }
 
-// Close 关闭 TUN 接口
+// Close 关闭 TUN 接口的全部队列，接口上的地址和路由随之被内核删除
 func (t *TUN) Close() error {
-	return t.iface.Close()
+	var errs []error
+	for _, queue := range t.queues {
+		errs = append(errs, queue.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Queues 返回接口的队列数
+func (t *TUN) Queues() int {
+	return len(t.queues)
 }
 
-// SetIP 设置 TUN 接口的 IP 地址
-func (t *TUN) SetIP(ip net.IP) error {
-	// 这里需要根据不同的操作系统实现具体的 IP 设置逻辑
-	// 暂时返回 nil，表示成功
+// Queue 返回接口的第 i 个队列。内核按流将发出的数据包分配到各队列，同一流的数据包从同一队列依次读出
+func (t *TUN) Queue(i int) io.ReadWriter {
+	return t.queues[i]
+}
+
+// Up 设置接口的 MTU 并启动接口，MTU 为 0 时保持系统默认值
+func (t *TUN) Up() error {
+	if err := setLinkUp(t.Name(), t.mtu); err != nil {
+		return fmt.Errorf("启动接口 %s 失败: %w", t.Name(), err)
+	}
+	t.mtuSet.Store(t.mtu > 0)
 	return nil
 }
 
-// GetIP 获取 TUN 接口的 IP 地址
+// AddAddress 为接口添加地址 addr（如 10.0.0.2/24），前缀内的其他地址经本接口直达。
+// 已添加的地址重复添加时不报错。平台不支持时仍记录该地址，由用户手动配置
+func (t *TUN) AddAddress(addr *net.IPNet) error {
+	err := addAddress(t.Name(), addr)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("为接口 %s 添加地址 %s 失败: %w", t.Name(), addr, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, existing := range t.addrs {
+		if existing.String() == addr.String() {
+			return err
+		}
+	}
+	t.addrs = append(t.addrs, addr)
+	return err
+}
+
+// RemoveAddress 删除接口上的地址 addr，平台不支持时仍删除记录的地址
+func (t *TUN) RemoveAddress(addr *net.IPNet) error {
+	err := deleteAddress(t.Name(), addr)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("删除接口 %s 的地址 %s 失败: %w", t.Name(), addr, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, existing := range t.addrs {
+		if existing.String() == addr.String() {
+			t.addrs = append(t.addrs[:i], t.addrs[i+1:]...)
+			break
+		}
+	}
+	return err
+}
+
+// Addresses 返回已添加的地址
+func (t *TUN) Addresses() []*net.IPNet {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*net.IPNet{}, t.addrs...)
+}
+
+// GetIP 返回接口的第一个地址，未设置时返回 nil
 func (t *TUN) GetIP() (net.IP, error) {
-	// 这里需要根据不同的操作系统实现具体的 IP 获取逻辑
-	// 暂时返回一个示例 IP
-	return net.ParseIP("10.0.0.1"), nil
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.addrs) == 0 {
+		return nil, nil
+	}
+	return t.addrs[0].IP, nil
+}
+
+// AddRoute 安装经本接口到网段 dst 的路由，已存在的同一路由被替换
+func (t *TUN) AddRoute(dst *net.IPNet) error {
+	if err := addRoute(t.Name(), dst); err != nil {
+		return fmt.Errorf("安装经 %s 到 %s 的路由失败: %w", t.Name(), dst, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.routes[dst.String()] = dst
+	return nil
+}
+
+// DeleteRoute 删除经本接口到网段 dst 的路由
+func (t *TUN) DeleteRoute(dst *net.IPNet) error {
+	if err := deleteRoute(t.Name(), dst); err != nil {
+		return fmt.Errorf("删除经 %s 到 %s 的路由失败: %w", t.Name(), dst, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.routes, dst.String())
+	return nil
 }
 
-// Read 从 TUN 接口读取数据
+// Routes 返回本接口安装的路由
+func (t *TUN) Routes() []*net.IPNet {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	routes := make([]*net.IPNet, 0, len(t.routes))
+	for _, route := range t.routes {
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// IsTAP 判断接口是否为 TAP 接口
+func (t *TUN) IsTAP() bool {
+	return t.tap
+}
+
+// Read 从 TUN 接口的第一个队列读取数据
 func (t *TUN) Read(buf []byte) (int, error) {
-	return t.iface.Read(buf)
+	return t.queues[0].Read(buf)
 }
 
-// Write 向 TUN 接口写入数据
+// Write 向 TUN 接口写入数据。多队列时按数据所属的流选择队列，内核记录流所在的队列，
+// 此后该流反方向的数据包从同一队列读出
 func (t *TUN) Write(buf []byte) (int, error) {
-	return t.iface.Write(buf)
+	if len(t.queues) == 1 {
+		return t.queues[0].Write(buf)
+	}
+	var hash uint32
+	if t.IsTAP() {
+		hash = FrameFlowHash(buf)
+	} else {
+		hash = FlowHash(buf)
+	}
+	return t.queues[hash%uint32(len(t.queues))].Write(buf)
 }
 
 // GetMTU 获取 MTU 值
 func (t *TUN) GetMTU() int {
 	return t.mtu
 }
+
+// PacketSize 返回从接口读取一个数据包所需的缓冲区大小：TUN 接口为 MTU，TAP 接口另加以太网帧头和 VLAN 标签。
+// 只有 Up 经 rtnetlink 设置了 MTU 时才能确定，否则（MTU 为 0 或平台不支持、由用户手动配置）返回 0
+func (t *TUN) PacketSize() int {
+	if !t.mtuSet.Load() {
+		return 0
+	}
+	if !t.tap {
+		return t.mtu
+	}
+	return t.mtu + ethernetHeaderSize + vlanTagSize
+}
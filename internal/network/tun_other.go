@@ -0,0 +1,10 @@
+//go:build !linux
+
+package network
+
+import "github.com/songgao/water"
+
+// setMultiQueue 设置以多队列方式创建接口，返回当前平台是否支持
+func setMultiQueue(config *water.Config) bool {
+	return false
+}
@@ -0,0 +1,28 @@
+package network
+
+import "testing"
+
+func TestPacketSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		mtu    int
+		tap    bool
+		mtuSet bool
+		want   int
+	}{
+		{"tun", 1400, false, true, 1400},
+		{"tap", 1400, true, true, 1400 + ethernetHeaderSize + vlanTagSize},
+		{"mtu 0", 0, false, false, 0},
+		{"tap mtu 0", 0, true, false, 0},
+		// MTU 未经 rtnetlink 设置（平台不支持或 Up 失败）时，接口的实际 MTU 未知
+		{"tun not set", 1400, false, false, 0},
+		{"tap not set", 1400, true, false, 0},
+	}
+	for _, test := range tests {
+		tun := &TUN{mtu: test.mtu, tap: test.tap}
+		tun.mtuSet.Store(test.mtuSet)
+		if size := tun.PacketSize(); size != test.want {
+			t.Errorf("%s: PacketSize() = %d, want %d", test.name, size, test.want)
+		}
+	}
+}
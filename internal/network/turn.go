@@ -0,0 +1,569 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/stun"
+)
+
+const (
+	// turnTransactionTimeout 一次 TURN 请求（含重传）的最长时间
+	turnTransactionTimeout = 5 * time.Second
+	// turnInitialRTO 首次重传前等待的时间，此后每次加倍
+	turnInitialRTO = 250 * time.Millisecond
+	// turnPermissionRefresh 权限的刷新间隔，权限在 TURN 服务器上的有效期为 5 分钟
+	turnPermissionRefresh = 4 * time.Minute
+	// turnChannelRefresh 通道的刷新间隔，通道在 TURN 服务器上的有效期为 10 分钟
+	turnChannelRefresh = 8 * time.Minute
+	// turnRefreshCheck 检查分配、权限和通道是否需要刷新的最长间隔
+	turnRefreshCheck = 5 * time.Second
+	// turnQueueSize 已收到但尚未读取的对端报文数，队列满时丢弃报文
+	turnQueueSize = 256
+)
+
+// 通道号范围（RFC 8656 第 12 节）
+const (
+	turnMinChannel uint16 = 0x4000
+	turnMaxChannel uint16 = 0x4FFF
+)
+
+// turnTransportUDP REQUESTED-TRANSPORT 中 UDP 的协议号
+const turnTransportUDP = 17
+
+// ErrTURNClosed TURN 客户端已关闭或分配已失效
+var ErrTURNClosed = errors.New("TURN 分配已关闭")
+
+// TURNClient TURN（RFC 8656）客户端，在 TURN 服务器上分配中继地址并维护权限和通道，实现 net.PacketConn：
+// 写入的报文经 TURN 服务器从中继地址发往对端，读取时返回对端发往中继地址的报文及对端地址。
+// 对端须先以 Permit 授权，分配、权限和通道在后台按时刷新
+type TURNClient struct {
+	conn     net.PacketConn
+	server   *net.UDPAddr
+	username string
+	password string
+
+	mutex       sync.Mutex
+	realm       string
+	nonce       string
+	key         []byte // 长期凭据密钥，收到服务器的 REALM 之前为 nil
+	relayed     *net.UDPAddr
+	mapped      *net.UDPAddr
+	lifetime    time.Duration
+	refreshed   time.Time            // 分配最近一次刷新的时间
+	permissions map[string]time.Time // 按对端 IP 索引的权限及其最近一次刷新的时间
+	channels    map[string]*turnChannel
+	numbers     map[uint16]*turnChannel
+	nextChannel uint16
+	pending     map[[12]byte]chan *stun.Message
+	deadline    time.Time
+
+	packets chan turnPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// turnChannel 绑定到一个对端地址的通道
+type turnChannel struct {
+	number    uint16
+	peer      *net.UDPAddr
+	refreshed time.Time
+}
+
+type turnPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// NewTURNClient 经 conn 以长期凭据在 TURN 服务器 server 上分配中继地址，成功后 conn 归客户端所有，
+// 失败时调用方负责关闭 conn
+func NewTURNClient(conn net.PacketConn, server *net.UDPAddr, username, password string) (*TURNClient, error) {
+	c := &TURNClient{
+		conn:        conn,
+		server:      server,
+		username:    username,
+		password:    password,
+		permissions: make(map[string]time.Time),
+		channels:    make(map[string]*turnChannel),
+		numbers:     make(map[uint16]*turnChannel),
+		nextChannel: turnMinChannel,
+		pending:     make(map[[12]byte]chan *stun.Message),
+		packets:     make(chan turnPacket, turnQueueSize),
+		closed:      make(chan struct{}),
+	}
+	go c.receive()
+
+	response, err := c.request(stun.MethodAllocate, turnTransactionTimeout, func(m *stun.Message) {
+		m.Add(stun.AttrRequestedTransport, []byte{turnTransportUDP, 0, 0, 0})
+	})
+	if err == nil {
+		err = c.allocated(response)
+	}
+	if err != nil {
+		// 调用方关闭 conn 后接收协程退出
+		c.once.Do(func() { close(c.closed) })
+		return nil, fmt.Errorf("TURN 分配失败: %w", err)
+	}
+
+	go c.refresh()
+	return c, nil
+}
+
+// allocated 记录分配成功响应中的中继地址、公网映射和有效期
+func (c *TURNClient) allocated(response *stun.Message) error {
+	relayed, err := response.Address(stun.AttrXORRelayedAddress)
+	if err != nil {
+		return err
+	}
+	if relayed == nil {
+		return fmt.Errorf("%w: 缺少 XOR-RELAYED-ADDRESS", stun.ErrMalformed)
+	}
+	mapped, _ := response.MappedAddress()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.relayed, c.mapped = relayed, mapped
+	c.lifetime = responseLifetime(response)
+	c.refreshed = time.Now()
+	return nil
+}
+
+// responseLifetime 返回响应中的 LIFETIME，缺失时按默认的 10 分钟
+func responseLifetime(response *stun.Message) time.Duration {
+	value := response.Get(stun.AttrLifetime)
+	if len(value) != 4 {
+		return 10 * time.Minute
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+}
+
+// RelayedAddr 返回 TURN 服务器分配的中继地址，对端向该地址发送报文
+func (c *TURNClient) RelayedAddr() *net.UDPAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.relayed
+}
+
+// MappedAddr 返回 TURN 服务器观察到的本端公网映射，服务器未提供时返回 nil
+func (c *TURNClient) MappedAddr() *net.UDPAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.mapped
+}
+
+// Permit 为对端 peer 创建权限并绑定通道，此后双方可经中继地址通信。
+// 通道绑定失败（如服务器通道已满）时仍可经 Send 指示发送，不返回错误
+func (c *TURNClient) Permit(peer *net.UDPAddr) error {
+	if err := c.createPermission(peer); err != nil {
+		return err
+	}
+	c.bindChannel(peer)
+	return nil
+}
+
+// createPermission 创建或刷新对端 IP 的权限
+func (c *TURNClient) createPermission(peer *net.UDPAddr) error {
+	_, err := c.request(stun.MethodCreatePermission, turnTransactionTimeout, func(m *stun.Message) {
+		m.AddAddress(stun.AttrXORPeerAddress, peer)
+	})
+	if err != nil {
+		return fmt.Errorf("创建到 %s 的 TURN 权限失败: %w", peer.IP, err)
+	}
+	c.mutex.Lock()
+	c.permissions[peer.IP.String()] = time.Now()
+	c.mutex.Unlock()
+	return nil
+}
+
+// bindChannel 为对端地址绑定或刷新通道，已绑定的对端沿用原通道号
+func (c *TURNClient) bindChannel(peer *net.UDPAddr) error {
+	c.mutex.Lock()
+	channel := c.channels[peer.String()]
+	number := uint16(0)
+	if channel != nil {
+		number = channel.number
+	} else if c.nextChannel <= turnMaxChannel {
+		number = c.nextChannel
+		c.nextChannel++
+	}
+	c.mutex.Unlock()
+	if number == 0 {
+		return errors.New("TURN 通道号已用尽")
+	}
+
+	_, err := c.request(stun.MethodChannelBind, turnTransactionTimeout, func(m *stun.Message) {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint16(value, number)
+		m.Add(stun.AttrChannelNumber, value)
+		m.AddAddress(stun.AttrXORPeerAddress, peer)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if channel == nil {
+		channel = &turnChannel{number: number, peer: peer}
+		c.channels[peer.String()] = channel
+		c.numbers[number] = channel
+	}
+	now := time.Now()
+	channel.refreshed = now
+	// 通道绑定同时刷新对端 IP 的权限
+	c.permissions[peer.IP.String()] = now
+	return nil
+}
+
+// refresh 按时刷新分配、权限和通道，分配失效后关闭客户端
+func (c *TURNClient) refresh() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return
+		}
+
+		now := time.Now()
+		c.mutex.Lock()
+		refreshAllocation := now.Sub(c.refreshed) >= c.lifetime/2
+		var permissions []net.IP
+		for ip, refreshed := range c.permissions {
+			if now.Sub(refreshed) >= turnPermissionRefresh {
+				permissions = append(permissions, net.ParseIP(ip))
+			}
+		}
+		var channels []*net.UDPAddr
+		for _, channel := range c.channels {
+			if now.Sub(channel.refreshed) >= turnChannelRefresh {
+				channels = append(channels, channel.peer)
+			}
+		}
+		c.mutex.Unlock()
+
+		if refreshAllocation {
+			if err := c.refreshAllocation(); err != nil {
+				var response *stun.ResponseError
+				if errors.As(err, &response) {
+					// 分配已不存在（如服务器重启），无法恢复
+					c.shutdown(false)
+					return
+				}
+			}
+		}
+		// 刷新失败的权限和通道在下次检查时重试
+		for _, channel := range channels {
+			c.bindChannel(channel)
+		}
+		for _, ip := range permissions {
+			c.createPermission(&net.UDPAddr{IP: ip})
+		}
+
+		c.mutex.Lock()
+		wait := min(c.lifetime/2-time.Since(c.refreshed), turnRefreshCheck)
+		c.mutex.Unlock()
+		timer.Reset(max(wait, 0))
+	}
+}
+
+// refreshAllocation 刷新分配的有效期
+func (c *TURNClient) refreshAllocation() error {
+	response, err := c.request(stun.MethodRefresh, turnTransactionTimeout, nil)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lifetime = responseLifetime(response)
+	c.refreshed = time.Now()
+	return nil
+}
+
+// request 发送一个请求并返回成功响应，build 添加方法特有的属性。
+// 服务器要求认证或告知 nonce 过期时以新的 REALM 和 NONCE 重试
+func (c *TURNClient) request(method uint16, timeout time.Duration, build func(*stun.Message)) (*stun.Message, error) {
+	for attempt := 0; ; attempt++ {
+		request, key, err := c.newRequest(method, build)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := c.roundTrip(request, key, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if stun.Class(response.Type) == stun.ClassSuccess {
+			// 认证后的成功响应须携带正确的 MESSAGE-INTEGRITY
+			if key != nil {
+				if err := response.CheckIntegrity(key); err != nil {
+					return nil, err
+				}
+			}
+			return response, nil
+		}
+
+		code, reason := response.Error()
+		realm, nonce := response.Get(stun.AttrRealm), response.Get(stun.AttrNonce)
+		retry := attempt < 2 && nonce != nil &&
+			(code == stun.CodeStaleNonce || (code == stun.CodeUnauthorized && (key == nil || realm != nil)))
+		if !retry {
+			return nil, &stun.ResponseError{Code: code, Reason: reason}
+		}
+		c.mutex.Lock()
+		if realm != nil {
+			c.realm = string(realm)
+		}
+		c.nonce = string(nonce)
+		c.key = stun.LongTermKey(c.username, c.realm, c.password)
+		c.mutex.Unlock()
+	}
+}
+
+// newRequest 构建一个请求，已取得 nonce 时附加长期凭据，返回请求和计算 MESSAGE-INTEGRITY 的密钥
+func (c *TURNClient) newRequest(method uint16, build func(*stun.Message)) (*stun.Message, []byte, error) {
+	request, err := stun.NewMessage(method | stun.ClassRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if build != nil {
+		build(request)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.key != nil {
+		request.Add(stun.AttrUsername, []byte(c.username))
+		request.Add(stun.AttrRealm, []byte(c.realm))
+		request.Add(stun.AttrNonce, []byte(c.nonce))
+	}
+	return request, c.key, nil
+}
+
+// roundTrip 按 RFC 8489 重传请求直到收到同一事务的响应或超时
+func (c *TURNClient) roundTrip(request *stun.Message, key []byte, timeout time.Duration) (*stun.Message, error) {
+	responses := make(chan *stun.Message, 1)
+	c.mutex.Lock()
+	c.pending[request.TransactionID] = responses
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, request.TransactionID)
+		c.mutex.Unlock()
+	}()
+
+	data := request.EncodeWithIntegrity(key)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for rto := turnInitialRTO; ; rto *= 2 {
+		if _, err := c.conn.WriteTo(data, c.server); err != nil {
+			return nil, err
+		}
+		retransmit := time.NewTimer(rto)
+		select {
+		case response := <-responses:
+			retransmit.Stop()
+			return response, nil
+		case <-retransmit.C:
+		case <-deadline.C:
+			retransmit.Stop()
+			return nil, stun.ErrTimeout
+		case <-c.closed:
+			retransmit.Stop()
+			return nil, ErrTURNClosed
+		}
+	}
+}
+
+// receive 读取 TURN 服务器发来的报文：响应交给等待的请求，
+// Data 指示和 ChannelData 中对端的报文放入接收队列，conn 关闭后退出
+func (c *TURNClient) receive() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			// 释放分配的响应只能由本协程接收，不等待确认
+			c.shutdown(false)
+			return
+		}
+		if addr, ok := from.(*net.UDPAddr); !ok || !addr.IP.Equal(c.server.IP) || addr.Port != c.server.Port {
+			continue
+		}
+		data := buf[:n]
+
+		if number, payload, ok := parseChannelData(data); ok {
+			c.mutex.Lock()
+			channel := c.numbers[number]
+			c.mutex.Unlock()
+			if channel != nil {
+				c.deliver(payload, channel.peer)
+			}
+			continue
+		}
+		m, err := stun.Parse(data)
+		if err != nil {
+			continue
+		}
+		switch stun.Class(m.Type) {
+		case stun.ClassIndication:
+			if stun.Method(m.Type) != stun.MethodData {
+				continue
+			}
+			peer, err := m.Address(stun.AttrXORPeerAddress)
+			if err != nil || peer == nil {
+				continue
+			}
+			c.deliver(m.Get(stun.AttrData), peer)
+		case stun.ClassSuccess, stun.ClassError:
+			c.mutex.Lock()
+			responses := c.pending[m.TransactionID]
+			c.mutex.Unlock()
+			if responses != nil {
+				select {
+				case responses <- m:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (c *TURNClient) deliver(data []byte, from *net.UDPAddr) {
+	select {
+	case c.packets <- turnPacket{data: append([]byte{}, data...), from: from}:
+	default:
+	}
+}
+
+// parseChannelData 解析 ChannelData 报文，返回通道号和数据
+func parseChannelData(data []byte) (uint16, []byte, bool) {
+	if len(data) < 4 {
+		return 0, nil, false
+	}
+	number := binary.BigEndian.Uint16(data[0:2])
+	size := int(binary.BigEndian.Uint16(data[2:4]))
+	if number < turnMinChannel || number > turnMaxChannel || 4+size > len(data) {
+		return 0, nil, false
+	}
+	return number, data[4 : 4+size], true
+}
+
+// ReadFrom 读取对端经中继地址发来的下一个报文，返回对端地址
+func (c *TURNClient) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.packets:
+		return copy(b, p.data), p.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo 经中继地址向对端 addr 发送报文，已绑定通道时使用 ChannelData，否则使用 Send 指示
+func (c *TURNClient) WriteTo(b []byte, addr net.Addr) (int, error) {
+	peer, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("不支持的地址类型 %T", addr)
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mutex.Lock()
+	channel := c.channels[peer.String()]
+	_, permitted := c.permissions[peer.IP.String()]
+	c.mutex.Unlock()
+
+	var data []byte
+	switch {
+	case channel != nil:
+		data = make([]byte, 4+len(b))
+		binary.BigEndian.PutUint16(data[0:2], channel.number)
+		binary.BigEndian.PutUint16(data[2:4], uint16(len(b)))
+		copy(data[4:], b)
+	case permitted:
+		indication, err := stun.NewMessage(stun.MethodSend | stun.ClassIndication)
+		if err != nil {
+			return 0, err
+		}
+		indication.AddAddress(stun.AttrXORPeerAddress, peer)
+		indication.Add(stun.AttrData, b)
+		data = indication.Encode()
+	default:
+		return 0, fmt.Errorf("没有到 %s 的 TURN 权限", peer.IP)
+	}
+	if _, err := c.conn.WriteTo(data, c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close 释放 TURN 服务器上的分配并关闭套接字
+func (c *TURNClient) Close() error {
+	return c.shutdown(true)
+}
+
+// shutdown 释放分配并关闭客户端，wait 为假时只发出释放请求而不等待服务器确认。
+// 接收协程和刷新协程关闭客户端时不等待，前者是唯一能收到确认的协程
+func (c *TURNClient) shutdown(wait bool) error {
+	closing := false
+	c.once.Do(func() { closing = true })
+	if !closing {
+		return nil
+	}
+	// 以有效期 0 刷新即释放分配，释放失败时服务器在有效期后自行回收
+	deallocate := func(m *stun.Message) {
+		m.Add(stun.AttrLifetime, []byte{0, 0, 0, 0})
+	}
+	if wait {
+		c.request(stun.MethodRefresh, time.Second, deallocate)
+	} else if request, key, err := c.newRequest(stun.MethodRefresh, deallocate); err == nil {
+		c.conn.WriteTo(request.EncodeWithIntegrity(key), c.server)
+	}
+	close(c.closed)
+	return c.conn.Close()
+}
+
+// LocalAddr 返回本地套接字的地址
+func (c *TURNClient) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// SetDeadline 设置读写截止时间
+func (c *TURNClient) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 设置读截止时间
+func (c *TURNClient) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+// SetWriteDeadline 设置写截止时间
+func (c *TURNClient) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
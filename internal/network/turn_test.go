@@ -0,0 +1,164 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network/turntest"
+	"github.com/fenghuilee/sd-wan/internal/stun"
+)
+
+func newTURNClient(t *testing.T, server *turntest.Server, password string) (*TURNClient, error) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewTURNClient(conn, server.Addr(), "user", password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, nil
+}
+
+// readPeer 在超时前读取连接上的下一个报文
+func readPeer(conn net.PacketConn, timeout time.Duration) (string, net.Addr, error) {
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(buf[:n]), from, nil
+}
+
+func TestTURNClient(t *testing.T) {
+	server, err := turntest.New("user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 先于服务器关闭客户端，避免释放分配的请求等待超时
+	t.Cleanup(func() { server.Close() })
+	// 有效期 1 秒，客户端每半秒刷新一次
+	server.SetLifetime(time.Second)
+
+	a, err := newTURNClient(t, server, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newTURNClient(t, server, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.MappedAddr().String() != a.LocalAddr().String() {
+		t.Fatalf("mapped = %v, local = %v", a.MappedAddr(), a.LocalAddr())
+	}
+	if _, err := a.WriteTo([]byte("early"), b.RelayedAddr()); err == nil {
+		t.Fatal("sent without a permission")
+	}
+
+	// nonce 过期后客户端以新的 nonce 重试
+	server.ExpireNonce()
+	if err := a.Permit(b.RelayedAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Permit(a.RelayedAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 双方绑定了通道，经 ChannelData 通信
+	if _, err := a.WriteTo([]byte("a to b"), b.RelayedAddr()); err != nil {
+		t.Fatal(err)
+	}
+	data, from, err := readPeer(b, time.Second)
+	if err != nil || data != "a to b" || from.String() != a.RelayedAddr().String() {
+		t.Fatalf("read %q from %v, %v", data, from, err)
+	}
+
+	// 同一 IP 上没有通道的对端经 Send 和 Data 指示通信
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := a.WriteTo([]byte("indication"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	data, from, err = readPeer(peer, time.Second)
+	if err != nil || data != "indication" || from.String() != a.RelayedAddr().String() {
+		t.Fatalf("peer read %q from %v, %v", data, from, err)
+	}
+	peer.WriteTo([]byte("reply"), a.RelayedAddr())
+	data, from, err = readPeer(a, time.Second)
+	if err != nil || data != "reply" || from.String() != peer.LocalAddr().String() {
+		t.Fatalf("read %q from %v, %v", data, from, err)
+	}
+
+	// 分配在有效期之后仍然可用
+	time.Sleep(1500 * time.Millisecond)
+	if server.Requests(stun.MethodRefresh) < 2 || server.Allocations() != 2 {
+		t.Fatalf("refreshes = %d, allocations = %d", server.Requests(stun.MethodRefresh), server.Allocations())
+	}
+	if _, err := b.WriteTo([]byte("b to a"), a.RelayedAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := readPeer(a, time.Second); err != nil || data != "b to a" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	// 关闭客户端时释放分配
+	a.Close()
+	if server.Allocations() != 1 {
+		t.Fatalf("allocations after close = %d", server.Allocations())
+	}
+	if _, _, err := readPeer(a, time.Second); err != net.ErrClosed {
+		t.Fatalf("read after close: %v", err)
+	}
+	b.Close()
+}
+
+func TestTURNClientReceiveFailure(t *testing.T) {
+	server, err := turntest.New("user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	c, err := newTURNClient(t, server, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 接收协程读取失败后关闭客户端，不等待只有它自己能收到的释放确认
+	start := time.Now()
+	c.conn.SetReadDeadline(start)
+	if _, _, err := readPeer(c, time.Second); err != net.ErrClosed {
+		t.Fatalf("read after receive failure: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= turnInitialRTO {
+		t.Fatalf("close from the receive goroutine took %v", elapsed)
+	}
+	for deadline := time.Now().Add(time.Second); server.Allocations() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Allocations() != 0 {
+		t.Fatalf("allocations after close = %d", server.Allocations())
+	}
+}
+
+func TestTURNClientUnauthorized(t *testing.T) {
+	server, err := turntest.New("user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	if _, err := newTURNClient(t, server, "wrong"); err == nil {
+		t.Fatal("allocation with a wrong password succeeded")
+	}
+	if server.Allocations() != 0 {
+		t.Fatalf("allocations = %d", server.Allocations())
+	}
+}
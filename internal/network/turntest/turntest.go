@@ -0,0 +1,357 @@
+// Package turntest 提供进程内的最小 TURN（RFC 8656）服务器，用于测试 TURN 客户端和经 TURN 服务器的中继回退。
+//
+// 服务器监听在回环地址上，只支持 UDP 传输和长期凭据认证，实现分配、刷新、权限、通道绑定、
+// Send/Data 指示和 ChannelData。每个分配的中继地址是回环地址上真实的 UDP 套接字，
+// 可与 nattest 的 NAT 组合使用。nonce 不会自行过期，可通过 ExpireNonce 模拟。
+package turntest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/stun"
+)
+
+// Realm 服务器使用的认证域
+const Realm = "turntest"
+
+const (
+	// permissionLifetime 权限的有效期
+	permissionLifetime = 5 * time.Minute
+	// channelLifetime 通道的有效期
+	channelLifetime = 10 * time.Minute
+	// defaultLifetime 未设置时分配的有效期
+	defaultLifetime = 10 * time.Minute
+)
+
+// Server 一个 TURN 服务器
+type Server struct {
+	conn     *net.UDPConn
+	username string
+	key      []byte
+
+	mutex       sync.Mutex
+	nonce       int
+	lifetime    time.Duration
+	allocations map[string]*allocation // 按客户端地址索引
+	requests    map[uint16]int         // 按方法统计通过认证的请求数
+}
+
+// allocation 一个客户端的分配
+type allocation struct {
+	client      *net.UDPAddr
+	relay       *net.UDPConn
+	expires     time.Time
+	permissions map[string]time.Time // 按对端 IP 索引的权限过期时间
+	channels    map[uint16]*channel
+	peers       map[string]uint16 // 按对端地址索引的通道号
+}
+
+type channel struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+// New 在回环地址上启动只接受用户 username 的 TURN 服务器
+func New(username, password string) (*Server, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		conn:        conn,
+		username:    username,
+		key:         stun.LongTermKey(username, Realm, password),
+		nonce:       1,
+		lifetime:    defaultLifetime,
+		allocations: make(map[string]*allocation),
+		requests:    make(map[uint16]int),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr 返回服务器的地址
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// SetLifetime 设置此后分配和刷新授予的有效期
+func (s *Server) SetLifetime(lifetime time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lifetime = lifetime
+}
+
+// ExpireNonce 使当前的 nonce 过期，此后使用旧 nonce 的请求收到 438 响应
+func (s *Server) ExpireNonce() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nonce++
+}
+
+// Allocations 返回未过期的分配数
+func (s *Server) Allocations() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, a := range s.allocations {
+		if time.Now().Before(a.expires) {
+			count++
+		}
+	}
+	return count
+}
+
+// Requests 返回通过认证的 method 请求数
+func (s *Server) Requests(method uint16) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[method]
+}
+
+// Close 关闭服务器和全部分配
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	for key, a := range s.allocations {
+		a.relay.Close()
+		delete(s.allocations, key)
+	}
+	s.mutex.Unlock()
+	return s.conn.Close()
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := buf[:n]
+		if len(data) >= 4 && data[0]&0xC0 == 0x40 {
+			s.handleChannelData(from, data)
+			continue
+		}
+		m, err := stun.Parse(data)
+		if err != nil {
+			continue
+		}
+		switch stun.Class(m.Type) {
+		case stun.ClassRequest:
+			if response := s.handleRequest(from, m); response != nil {
+				s.conn.WriteToUDP(response, from)
+			}
+		case stun.ClassIndication:
+			if stun.Method(m.Type) == stun.MethodSend {
+				peer, err := m.Address(stun.AttrXORPeerAddress)
+				if err == nil && peer != nil {
+					s.forward(from, peer, m.Get(stun.AttrData))
+				}
+			}
+		}
+	}
+}
+
+// handleChannelData 将客户端经通道发送的数据转发给对端
+func (s *Server) handleChannelData(from *net.UDPAddr, data []byte) {
+	number := binary.BigEndian.Uint16(data[0:2])
+	size := int(binary.BigEndian.Uint16(data[2:4]))
+	if 4+size > len(data) {
+		return
+	}
+	s.mutex.Lock()
+	a := s.allocation(from)
+	var peer *net.UDPAddr
+	if a != nil {
+		if c := a.channels[number]; c != nil && time.Now().Before(c.expires) {
+			peer = c.peer
+		}
+	}
+	s.mutex.Unlock()
+	if peer != nil {
+		s.forward(from, peer, data[4:4+size])
+	}
+}
+
+// forward 从客户端的中继地址向对端发送数据，没有权限时丢弃
+func (s *Server) forward(from, peer *net.UDPAddr, data []byte) {
+	s.mutex.Lock()
+	a := s.allocation(from)
+	permitted := a != nil && time.Now().Before(a.permissions[peer.IP.String()])
+	s.mutex.Unlock()
+	if permitted {
+		a.relay.WriteToUDP(data, peer)
+	}
+}
+
+// allocation 返回客户端未过期的分配，调用方须持有 s.mutex
+func (s *Server) allocation(client *net.UDPAddr) *allocation {
+	a := s.allocations[client.String()]
+	if a == nil {
+		return nil
+	}
+	if time.Now().After(a.expires) {
+		a.relay.Close()
+		delete(s.allocations, client.String())
+		return nil
+	}
+	return a
+}
+
+// handleRequest 认证并处理一个请求，返回编码后的响应
+func (s *Server) handleRequest(from *net.UDPAddr, m *stun.Message) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	method := stun.Method(m.Type)
+	response := &stun.Message{Type: method | stun.ClassError, TransactionID: m.TransactionID}
+	nonce := fmt.Sprintf("nonce-%d", s.nonce)
+	challenge := func(code int, reason string) []byte {
+		response.AddError(code, reason)
+		response.Add(stun.AttrRealm, []byte(Realm))
+		response.Add(stun.AttrNonce, []byte(nonce))
+		return response.Encode()
+	}
+	if m.Get(stun.AttrUsername) == nil || m.CheckIntegrity(s.key) != nil {
+		return challenge(stun.CodeUnauthorized, "Unauthorized")
+	}
+	if string(m.Get(stun.AttrUsername)) != s.username || string(m.Get(stun.AttrRealm)) != Realm {
+		return challenge(stun.CodeUnauthorized, "Unauthorized")
+	}
+	if string(m.Get(stun.AttrNonce)) != nonce {
+		return challenge(stun.CodeStaleNonce, "Stale Nonce")
+	}
+	s.requests[method]++
+
+	code, reason := s.apply(from, method, m, response)
+	if code != 0 {
+		response.Type = method | stun.ClassError
+		response.Attributes = nil
+		response.AddError(code, reason)
+	} else {
+		response.Type = method | stun.ClassSuccess
+	}
+	return response.EncodeWithIntegrity(s.key)
+}
+
+// apply 执行已认证的请求，成功时向 response 添加属性，失败时返回错误码
+func (s *Server) apply(from *net.UDPAddr, method uint16, m *stun.Message, response *stun.Message) (int, string) {
+	now := time.Now()
+	a := s.allocation(from)
+	if method == stun.MethodAllocate {
+		if a != nil {
+			return stun.CodeAllocationMismatch, "Allocation Mismatch"
+		}
+		if transport := m.Get(stun.AttrRequestedTransport); len(transport) != 4 || transport[0] != 17 {
+			return stun.CodeUnsupportedTransportProtocol, "Unsupported Transport Protocol"
+		}
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return stun.CodeInsufficientCapacity, "Insufficient Capacity"
+		}
+		a = &allocation{
+			client:      from,
+			relay:       relay,
+			expires:     now.Add(s.lifetime),
+			permissions: make(map[string]time.Time),
+			channels:    make(map[uint16]*channel),
+			peers:       make(map[string]uint16),
+		}
+		s.allocations[from.String()] = a
+		go s.relay(a)
+		response.AddAddress(stun.AttrXORRelayedAddress, relay.LocalAddr().(*net.UDPAddr))
+		response.AddAddress(stun.AttrXORMappedAddress, from)
+		response.Add(stun.AttrLifetime, lifetime(s.lifetime))
+		return 0, ""
+	}
+	if a == nil {
+		return stun.CodeAllocationMismatch, "Allocation Mismatch"
+	}
+
+	switch method {
+	case stun.MethodRefresh:
+		granted := s.lifetime
+		if value := m.Get(stun.AttrLifetime); len(value) == 4 && binary.BigEndian.Uint32(value) == 0 {
+			granted = 0
+		}
+		a.expires = now.Add(granted)
+		if granted == 0 {
+			a.relay.Close()
+			delete(s.allocations, from.String())
+		}
+		response.Add(stun.AttrLifetime, lifetime(granted))
+	case stun.MethodCreatePermission:
+		peer, err := m.Address(stun.AttrXORPeerAddress)
+		if err != nil || peer == nil {
+			return stun.CodeBadRequest, "Bad Request"
+		}
+		a.permissions[peer.IP.String()] = now.Add(permissionLifetime)
+	case stun.MethodChannelBind:
+		peer, err := m.Address(stun.AttrXORPeerAddress)
+		value := m.Get(stun.AttrChannelNumber)
+		if err != nil || peer == nil || len(value) != 4 {
+			return stun.CodeBadRequest, "Bad Request"
+		}
+		number := binary.BigEndian.Uint16(value)
+		bound, ok := a.peers[peer.String()]
+		if number < 0x4000 || number > 0x4FFF || (ok && bound != number) ||
+			(a.channels[number] != nil && a.channels[number].peer.String() != peer.String()) {
+			return stun.CodeBadRequest, "Bad Request"
+		}
+		a.channels[number] = &channel{peer: peer, expires: now.Add(channelLifetime)}
+		a.peers[peer.String()] = number
+		a.permissions[peer.IP.String()] = now.Add(permissionLifetime)
+	default:
+		return stun.CodeBadRequest, "Bad Request"
+	}
+	return 0, ""
+}
+
+func lifetime(d time.Duration) []byte {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(d/time.Second))
+	return value
+}
+
+// relay 将对端发往中继地址的报文转发给客户端，有通道时使用 ChannelData，否则使用 Data 指示
+func (s *Server) relay(a *allocation) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		s.mutex.Lock()
+		permitted := now.Before(a.permissions[from.IP.String()])
+		number, bound := a.peers[from.String()]
+		if bound && now.After(a.channels[number].expires) {
+			bound = false
+		}
+		s.mutex.Unlock()
+		if !permitted {
+			continue
+		}
+
+		var data []byte
+		if bound {
+			data = make([]byte, 4+n)
+			binary.BigEndian.PutUint16(data[0:2], number)
+			binary.BigEndian.PutUint16(data[2:4], uint16(n))
+			copy(data[4:], buf[:n])
+		} else {
+			indication, err := stun.NewMessage(stun.MethodData | stun.ClassIndication)
+			if err != nil {
+				continue
+			}
+			indication.AddAddress(stun.AttrXORPeerAddress, from)
+			indication.Add(stun.AttrData, buf[:n])
+			data = indication.Encode()
+		}
+		s.conn.WriteToUDP(data, a.client)
+	}
+}
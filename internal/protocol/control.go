@@ -0,0 +1,503 @@
+package protocol
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// TLVProtocolVersion 控制消息改用 TLV 编码的协议版本，更低的版本使用 JSON
+const TLVProtocolVersion = 3
+
+// ControlMessage 控制消息，握手、路由、NAT、吊销、节点介绍和打洞消息的负载
+type ControlMessage interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// MarshalControl 按消息头中的协议版本编码控制消息
+func MarshalControl(version uint8, msg ControlMessage) ([]byte, error) {
+	switch {
+	case !IsSupportedVersion(version):
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	case version < TLVProtocolVersion:
+		return json.Marshal(msg)
+	default:
+		return msg.MarshalBinary()
+	}
+}
+
+// UnmarshalControl 按消息头中的协议版本解码控制消息，未知字段被忽略
+func UnmarshalControl(version uint8, data []byte, msg ControlMessage) error {
+	switch {
+	case !IsSupportedVersion(version):
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	case version < TLVProtocolVersion:
+		return json.Unmarshal(data, msg)
+	default:
+		return msg.UnmarshalBinary(data)
+	}
+}
+
+// MarshalHandshake 编码握手消息或握手响应。握手的 TLV 格式与协议版本无关，版本范围位于固定标签，
+// 消息头为版本 3 及以上（包括更新的版本）时一律使用 TLV；只有明确以版本 2 通信的旧节点使用 JSON
+func MarshalHandshake(header uint8, msg ControlMessage) ([]byte, error) {
+	switch {
+	case header < MinProtocolVersion:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header)
+	case header < TLVProtocolVersion:
+		return json.Marshal(msg)
+	default:
+		return msg.MarshalBinary()
+	}
+}
+
+// UnmarshalHandshake 按与 MarshalHandshake 相同的规则解码握手消息或握手响应，
+// 使更新版本的对端也能读出其中的版本范围
+func UnmarshalHandshake(header uint8, data []byte, msg ControlMessage) error {
+	switch {
+	case header < MinProtocolVersion:
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, header)
+	case header < TLVProtocolVersion:
+		return json.Unmarshal(data, msg)
+	default:
+		return msg.UnmarshalBinary(data)
+	}
+}
+
+// HandshakeReplyVersion 返回协商出版本之前应答握手使用的消息头版本：
+// 以版本 2 发起握手的旧节点仍按版本 2 应答，其余对端使用本端版本
+func HandshakeReplyVersion(header uint8) uint8 {
+	if header < TLVProtocolVersion {
+		return MinProtocolVersion
+	}
+	return ProtocolVersion
+}
+
+// HandshakeMessage 字段标签
+const (
+	tagHandshakeNodeID       = 1
+	tagHandshakeTimestamp    = 2
+	tagHandshakePublicIP     = 3
+	tagHandshakePublicPort   = 4
+	tagHandshakePrivateIP    = 5
+	tagHandshakePrivatePort  = 6
+	tagHandshakeAlgorithm    = 7 // 重复字段，按优先级排列
+	tagHandshakeEpoch        = 8
+	tagHandshakeSenderIndex  = 9
+	tagHandshakeMinVersion   = 10
+	tagHandshakeMaxVersion   = 11
+	tagHandshakeCapabilities = 12
+	tagHandshakePreAuthKey   = 13
+	tagHandshakeCertificate  = 14
+	tagHandshakeLocalIP      = 15
+	tagHandshakeNATType      = 16
+	tagHandshakePortStep     = 17 // int16 按 uint16 编码
+	tagHandshakeRelayedIP    = 18
+	tagHandshakeRelayedPort  = 19
+	tagHandshakePrivateIP6   = 20
+	tagHandshakeGlobalIP6    = 21
+	tagHandshakeMode         = 22
+)
+
+// MarshalBinary 将握手消息编码为 TLV
+func (m *HandshakeMessage) MarshalBinary() ([]byte, error) {
+	var w tlvWriter
+	w.string(tagHandshakeNodeID, m.NodeID)
+	w.uint64(tagHandshakeTimestamp, uint64(m.Timestamp))
+	w.ip(tagHandshakePublicIP, m.PublicIP)
+	w.uint16(tagHandshakePublicPort, m.PublicPort)
+	w.ip(tagHandshakePrivateIP, m.PrivateIP)
+	w.uint16(tagHandshakePrivatePort, m.PrivatePort)
+	w.strings(tagHandshakeAlgorithm, m.Algorithms)
+	w.uint8(tagHandshakeEpoch, m.Epoch)
+	w.uint32(tagHandshakeSenderIndex, m.SenderIndex)
+	w.uint8(tagHandshakeMinVersion, m.MinVersion)
+	w.uint8(tagHandshakeMaxVersion, m.MaxVersion)
+	w.uint32(tagHandshakeCapabilities, m.Capabilities)
+	w.string(tagHandshakePreAuthKey, m.PreAuthKey)
+	w.bytes(tagHandshakeCertificate, m.Certificate)
+	w.ip(tagHandshakeLocalIP, m.LocalIP)
+	w.uint8(tagHandshakeNATType, m.NATType)
+	w.uint16(tagHandshakePortStep, uint16(m.PortStep))
+	w.ip(tagHandshakeRelayedIP, m.RelayedIP)
+	w.uint16(tagHandshakeRelayedPort, m.RelayedPort)
+	w.ip(tagHandshakePrivateIP6, m.PrivateIP6)
+	w.ip(tagHandshakeGlobalIP6, m.GlobalIP6)
+	w.uint8(tagHandshakeMode, m.Mode)
+	return w.finish()
+}
+
+// UnmarshalBinary 从 TLV 解码握手消息
+func (m *HandshakeMessage) UnmarshalBinary(data []byte) error {
+	*m = HandshakeMessage{}
+	return readTLV(data, func(tag uint8, value []byte) error {
+		var err error
+		switch tag {
+		case tagHandshakeNodeID:
+			m.NodeID = string(value)
+		case tagHandshakeTimestamp:
+			var timestamp uint64
+			timestamp, err = tlvUint64(tag, value)
+			m.Timestamp = int64(timestamp)
+		case tagHandshakePublicIP:
+			m.PublicIP, err = tlvIP(tag, value)
+		case tagHandshakePublicPort:
+			m.PublicPort, err = tlvUint16(tag, value)
+		case tagHandshakePrivateIP:
+			m.PrivateIP, err = tlvIP(tag, value)
+		case tagHandshakePrivatePort:
+			m.PrivatePort, err = tlvUint16(tag, value)
+		case tagHandshakeAlgorithm:
+			m.Algorithms = append(m.Algorithms, string(value))
+		case tagHandshakeEpoch:
+			m.Epoch, err = tlvUint8(tag, value)
+		case tagHandshakeSenderIndex:
+			m.SenderIndex, err = tlvUint32(tag, value)
+		case tagHandshakeMinVersion:
+			m.MinVersion, err = tlvUint8(tag, value)
+		case tagHandshakeMaxVersion:
+			m.MaxVersion, err = tlvUint8(tag, value)
+		case tagHandshakeCapabilities:
+			m.Capabilities, err = tlvUint32(tag, value)
+		case tagHandshakePreAuthKey:
+			m.PreAuthKey = string(value)
+		case tagHandshakeCertificate:
+			m.Certificate = append([]byte{}, value...)
+		case tagHandshakeLocalIP:
+			m.LocalIP, err = tlvIP(tag, value)
+		case tagHandshakeNATType:
+			m.NATType, err = tlvUint8(tag, value)
+		case tagHandshakePortStep:
+			var step uint16
+			step, err = tlvUint16(tag, value)
+			m.PortStep = int16(step)
+		case tagHandshakeRelayedIP:
+			m.RelayedIP, err = tlvIP(tag, value)
+		case tagHandshakeRelayedPort:
+			m.RelayedPort, err = tlvUint16(tag, value)
+		case tagHandshakePrivateIP6:
+			m.PrivateIP6, err = tlvIP(tag, value)
+		case tagHandshakeGlobalIP6:
+			m.GlobalIP6, err = tlvIP(tag, value)
+		case tagHandshakeMode:
+			m.Mode, err = tlvUint8(tag, value)
+		}
+		return err
+	})
+}
+
+// HandshakeResponse 字段标签
+const (
+	tagResponseStatus        = 1
+	tagResponseAlgorithm     = 2
+	tagResponseSenderIndex   = 3
+	tagResponseVersion       = 4
+	tagResponseCapabilities  = 5
+	tagResponseMinVersion    = 6
+	tagResponseMaxVersion    = 7
+	tagResponseError         = 8
+	tagResponseAddress       = 9
+	tagResponsePrefixLength  = 10
+	tagResponseAddress6      = 11
+	tagResponsePrefixLength6 = 12
+)
+
+// MarshalBinary 将握手响应编码为 TLV
+func (r *HandshakeResponse) MarshalBinary() ([]byte, error) {
+	var w tlvWriter
+	w.string(tagResponseStatus, r.Status)
+	w.string(tagResponseAlgorithm, r.Algorithm)
+	w.uint32(tagResponseSenderIndex, r.SenderIndex)
+	w.uint8(tagResponseVersion, r.Version)
+	w.uint32(tagResponseCapabilities, r.Capabilities)
+	w.uint8(tagResponseMinVersion, r.MinVersion)
+	w.uint8(tagResponseMaxVersion, r.MaxVersion)
+	w.string(tagResponseError, r.Error)
+	w.ip(tagResponseAddress, r.Address)
+	w.uint8(tagResponsePrefixLength, r.PrefixLength)
+	w.ip(tagResponseAddress6, r.Address6)
+	w.uint8(tagResponsePrefixLength6, r.PrefixLength6)
+	return w.finish()
+}
+
+// UnmarshalBinary 从 TLV 解码握手响应
+func (r *HandshakeResponse) UnmarshalBinary(data []byte) error {
+	*r = HandshakeResponse{}
+	return readTLV(data, func(tag uint8, value []byte) error {
+		var err error
+		switch tag {
+		case tagResponseStatus:
+			r.Status = string(value)
+		case tagResponseAlgorithm:
+			r.Algorithm = string(value)
+		case tagResponseSenderIndex:
+			r.SenderIndex, err = tlvUint32(tag, value)
+		case tagResponseVersion:
+			r.Version, err = tlvUint8(tag, value)
+		case tagResponseCapabilities:
+			r.Capabilities, err = tlvUint32(tag, value)
+		case tagResponseMinVersion:
+			r.MinVersion, err = tlvUint8(tag, value)
+		case tagResponseMaxVersion:
+			r.MaxVersion, err = tlvUint8(tag, value)
+		case tagResponseError:
+			r.Error = string(value)
+		case tagResponseAddress:
+			r.Address, err = tlvIP(tag, value)
+		case tagResponsePrefixLength:
+			r.PrefixLength, err = tlvUint8(tag, value)
+		case tagResponseAddress6:
+			r.Address6, err = tlvIP(tag, value)
+		case tagResponsePrefixLength6:
+			r.PrefixLength6, err = tlvUint8(tag, value)
+		}
+		return err
+	})
+}
+
+// RouteMessage 字段标签
+const (
+	tagRouteDestination = 1
+	tagRouteNextHop     = 2
+	tagRouteMetric      = 3
+	tagRouteWithdraw    = 4
+)
+
+// MarshalBinary 将路由消息编码为 TLV
+func (m *RouteMessage) MarshalBinary() ([]byte, error) {
+	var w tlvWriter
+	w.string(tagRouteDestination, m.Destination)
+	w.string(tagRouteNextHop, m.NextHop)
+	w.uint8(tagRouteMetric, m.Metric)
+	if m.Withdraw {
+		w.uint8(tagRouteWithdraw, 1)
+	}
+	return w.finish()
+}
+
+// UnmarshalBinary 从 TLV 解码路由消息
+func (m *RouteMessage) UnmarshalBinary(data []byte) error {
+	*m = RouteMessage{}
+	return readTLV(data, func(tag uint8, value []byte) error {
+		var err error
+		switch tag {
+		case tagRouteDestination:
+			m.Destination = string(value)
+		case tagRouteNextHop:
+			m.NextHop = string(value)
+		case tagRouteMetric:
+			m.Metric, err = tlvUint8(tag, value)
+		case tagRouteWithdraw:
+			var withdraw uint8
+			withdraw, err = tlvUint8(tag, value)
+			m.Withdraw = withdraw != 0
+		}
+		return err
+	})
+}
+
+// NATMessage 字段标签
+const (
+	tagNATTargetID    = 1
+	tagNATTargetIP    = 2
+	tagNATTargetPort  = 3
+	tagNATRelayServer = 4
+	tagNATRelayPort   = 5
+	tagNATRelayTicket = 6
+	tagNATRelayKey    = 7
+)
+
+// MarshalBinary 将 NAT 穿透消息编码为 TLV
+func (m *NATMessage) MarshalBinary() ([]byte, error) {
+	var w tlvWriter
+	w.string(tagNATTargetID, m.TargetID)
+	w.ip(tagNATTargetIP, m.TargetIP)
+	w.uint16(tagNATTargetPort, m.TargetPort)
+	w.ip(tagNATRelayServer, m.RelayServer)
+	w.uint16(tagNATRelayPort, m.RelayPort)
+	w.bytes(tagNATRelayTicket, m.RelayTicket)
+	w.bytes(tagNATRelayKey, m.RelayKey)
+	return w.finish()
+}
+
+// UnmarshalBinary 从 TLV 解码 NAT 穿透消息
+func (m *NATMessage) UnmarshalBinary(data []byte) error {
+	*m = NATMessage{}
+	return readTLV(data, func(tag uint8, value []byte) error {
+		var err error
+		switch tag {
+		case tagNATTargetID:
+			m.TargetID = string(value)
+		case tagNATTargetIP:
+			m.TargetIP, err = tlvIP(tag, value)
+		case tagNATTargetPort:
+			m.TargetPort, err = tlvUint16(tag, value)
+		case tagNATRelayServer:
+			m.RelayServer, err = tlvIP(tag, value)
+		case tagNATRelayPort:
+			m.RelayPort, err = tlvUint16(tag, value)
+		case tagNATRelayTicket:
+			m.RelayTicket = append([]byte{}, value...)
+		case tagNATRelayKey:
+			m.RelayKey = append([]byte{}, value...)
+		}
+		return err
+	})
+}
+
+// RevocationMessage 字段标签
+const (
+	tagRevocationNodeID = 1 // 重复字段
+)
+
+// MarshalBinary 将节点吊销通知编码为 TLV
+func (m *RevocationMessage) MarshalBinary() ([]byte, error) {
+	var w tlvWriter
+	w.strings(tagRevocationNodeID, m.NodeIDs)
+	return w.finish()
+}
+
+// UnmarshalBinary 从 TLV 解码节点吊销通知
+func (m *RevocationMessage) UnmarshalBinary(data []byte) error {
+	*m = RevocationMessage{}
+	return readTLV(data, func(tag uint8, value []byte) error {
+		if tag == tagRevocationNodeID {
+			m.NodeIDs = append(m.NodeIDs, string(value))
+		}
+		return nil
+	})
+}
+
+// PeerMessage 字段标签
+const (
+	tagPeerNodeID      = 1
+	tagPeerPublicKey   = 2
+	tagPeerPublicIP    = 3
+	tagPeerPublicPort  = 4
+	tagPeerLocalIP     = 5
+	tagPeerLocalPort   = 6
+	tagPeerAddress     = 7 // 重复字段
+	tagPeerRoute       = 8 // 重复字段
+	tagPeerVersion     = 9
+	tagPeerToken       = 10
+	tagPeerNATType     = 11
+	tagPeerPortStep    = 12 // int16 按 uint16 编码
+	tagPeerRelayTicket = 13
+	tagPeerRelayKey    = 14
+	tagPeerRelayedIP   = 15
+	tagPeerRelayedPort = 16
+	tagPeerGlobalIP6   = 17
+)
+
+// MarshalBinary 将节点介绍编码为 TLV
+func (m *PeerMessage) MarshalBinary() ([]byte, error) {
+	var w tlvWriter
+	w.string(tagPeerNodeID, m.NodeID)
+	w.bytes(tagPeerPublicKey, m.PublicKey)
+	w.ip(tagPeerPublicIP, m.PublicIP)
+	w.uint16(tagPeerPublicPort, m.PublicPort)
+	w.ip(tagPeerLocalIP, m.LocalIP)
+	w.uint16(tagPeerLocalPort, m.LocalPort)
+	for _, address := range m.Addresses {
+		w.ip(tagPeerAddress, address)
+	}
+	w.strings(tagPeerRoute, m.Routes)
+	w.uint8(tagPeerVersion, m.Version)
+	w.bytes(tagPeerToken, m.Token)
+	w.uint8(tagPeerNATType, m.NATType)
+	w.uint16(tagPeerPortStep, uint16(m.PortStep))
+	w.bytes(tagPeerRelayTicket, m.RelayTicket)
+	w.bytes(tagPeerRelayKey, m.RelayKey)
+	w.ip(tagPeerRelayedIP, m.RelayedIP)
+	w.uint16(tagPeerRelayedPort, m.RelayedPort)
+	w.ip(tagPeerGlobalIP6, m.GlobalIP6)
+	return w.finish()
+}
+
+// UnmarshalBinary 从 TLV 解码节点介绍
+func (m *PeerMessage) UnmarshalBinary(data []byte) error {
+	*m = PeerMessage{}
+	return readTLV(data, func(tag uint8, value []byte) error {
+		var err error
+		switch tag {
+		case tagPeerNodeID:
+			m.NodeID = string(value)
+		case tagPeerPublicKey:
+			m.PublicKey = append([]byte{}, value...)
+		case tagPeerPublicIP:
+			m.PublicIP, err = tlvIP(tag, value)
+		case tagPeerPublicPort:
+			m.PublicPort, err = tlvUint16(tag, value)
+		case tagPeerLocalIP:
+			m.LocalIP, err = tlvIP(tag, value)
+		case tagPeerLocalPort:
+			m.LocalPort, err = tlvUint16(tag, value)
+		case tagPeerAddress:
+			var address net.IP
+			address, err = tlvIP(tag, value)
+			m.Addresses = append(m.Addresses, address)
+		case tagPeerRoute:
+			m.Routes = append(m.Routes, string(value))
+		case tagPeerVersion:
+			m.Version, err = tlvUint8(tag, value)
+		case tagPeerToken:
+			m.Token = append([]byte{}, value...)
+		case tagPeerNATType:
+			m.NATType, err = tlvUint8(tag, value)
+		case tagPeerPortStep:
+			var step uint16
+			step, err = tlvUint16(tag, value)
+			m.PortStep = int16(step)
+		case tagPeerRelayTicket:
+			m.RelayTicket = append([]byte{}, value...)
+		case tagPeerRelayKey:
+			m.RelayKey = append([]byte{}, value...)
+		case tagPeerRelayedIP:
+			m.RelayedIP, err = tlvIP(tag, value)
+		case tagPeerRelayedPort:
+			m.RelayedPort, err = tlvUint16(tag, value)
+		case tagPeerGlobalIP6:
+			m.GlobalIP6, err = tlvIP(tag, value)
+		}
+		return err
+	})
+}
+
+// PunchMessage 字段标签
+const (
+	tagPunchNodeID = 1
+	tagPunchToken  = 2
+	tagPunchAck    = 3
+)
+
+// MarshalBinary 将打洞探测编码为 TLV
+func (m *PunchMessage) MarshalBinary() ([]byte, error) {
+	var w tlvWriter
+	w.string(tagPunchNodeID, m.NodeID)
+	w.bytes(tagPunchToken, m.Token)
+	if m.Ack {
+		w.uint8(tagPunchAck, 1)
+	}
+	return w.finish()
+}
+
+// UnmarshalBinary 从 TLV 解码打洞探测
+func (m *PunchMessage) UnmarshalBinary(data []byte) error {
+	*m = PunchMessage{}
+	return readTLV(data, func(tag uint8, value []byte) error {
+		var err error
+		switch tag {
+		case tagPunchNodeID:
+			m.NodeID = string(value)
+		case tagPunchToken:
+			m.Token = append([]byte{}, value...)
+		case tagPunchAck:
+			var ack uint8
+			ack, err = tlvUint8(tag, value)
+			m.Ack = ack != 0
+		}
+		return err
+	})
+}
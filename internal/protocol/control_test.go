@@ -0,0 +1,296 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func controlMessages() []ControlMessage {
+	return []ControlMessage{
+		&HandshakeMessage{
+			NodeID:       "node-1",
+			Timestamp:    1700000000123456789,
+			PublicIP:     net.IPv4(203, 0, 113, 7).To4(),
+			PublicPort:   51820,
+			PrivateIP:    net.ParseIP("fd00::1"),
+			PrivatePort:  51821,
+			Algorithms:   []string{"chacha20-poly1305", "", "aes-256-gcm"},
+			Epoch:        7,
+			SenderIndex:  0xdeadbeef,
+			MinVersion:   MinProtocolVersion,
+			MaxVersion:   MaxProtocolVersion,
+			Capabilities: LocalCapabilities,
+			PreAuthKey:   "preauth-0123456789",
+			Certificate:  []byte{0x30, 0x82, 0x01, 0x0a},
+			LocalIP:      net.IPv4(192, 168, 1, 20).To4(),
+			NATType:      5,
+			PortStep:     -2,
+			RelayedIP:    net.IPv4(198, 51, 100, 20).To4(),
+			RelayedPort:  49160,
+			PrivateIP6:   net.ParseIP("fd00::2"),
+			GlobalIP6:    net.ParseIP("2001:db8::7"),
+			Mode:         ModeTAP,
+		},
+		&HandshakeMessage{},
+		&HandshakeResponse{
+			Status:       HandshakeStatusOK,
+			Algorithm:    "aes-256-gcm",
+			SenderIndex:  42,
+			Version:      ProtocolVersion,
+			Capabilities: CapRekey,
+			MinVersion:   MinProtocolVersion,
+			MaxVersion:   MaxProtocolVersion,
+			Error:        "none",
+			Address:      net.IPv4(10, 0, 0, 7).To4(),
+			PrefixLength: 24,
+
+			Address6:      net.ParseIP("fd00::7"),
+			PrefixLength6: 64,
+		},
+		&HandshakeResponse{},
+		&RouteMessage{Destination: "10.0.0.0/24", NextHop: "node-2", Metric: 3},
+		&RouteMessage{Destination: "10.0.0.0/24", NextHop: "node-2", Withdraw: true},
+		&RouteMessage{},
+		&NATMessage{
+			TargetID:    "node-3",
+			TargetIP:    net.IPv4(198, 51, 100, 1).To4(),
+			TargetPort:  4500,
+			RelayServer: net.ParseIP("2001:db8::2"),
+			RelayPort:   3478,
+			RelayTicket: bytes.Repeat([]byte{3}, 48),
+			RelayKey:    bytes.Repeat([]byte{4}, 16),
+		},
+		&NATMessage{},
+		&RevocationMessage{NodeIDs: []string{"node-0123456789abcdef", "node-fedcba9876543210"}},
+		&RevocationMessage{},
+		&PeerMessage{
+			NodeID:     "node-0123456789abcdef",
+			PublicKey:  bytes.Repeat([]byte{7}, 32),
+			PublicIP:   net.IPv4(203, 0, 113, 9).To4(),
+			PublicPort: 40001,
+			LocalIP:    net.IPv4(192, 168, 1, 21).To4(),
+			LocalPort:  51820,
+			Addresses:  []net.IP{net.IPv4(10, 0, 0, 3).To4(), net.ParseIP("fd00::3")},
+			Routes:     []string{"192.168.5.0/24", ""},
+			Version:    ProtocolVersion,
+			Token:      []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			NATType:    5,
+			PortStep:   4,
+
+			RelayTicket: bytes.Repeat([]byte{5}, 48),
+			RelayKey:    bytes.Repeat([]byte{6}, 16),
+			RelayedIP:   net.ParseIP("2001:db8::20"),
+			RelayedPort: 49161,
+			GlobalIP6:   net.ParseIP("2001:db8::9"),
+		},
+		&PeerMessage{},
+		&PunchMessage{NodeID: "node-0123456789abcdef", Token: []byte{1, 2, 3, 4}, Ack: true},
+		&PunchMessage{},
+	}
+}
+
+// newControl 返回与 msg 同类型的零值消息
+func newControl(msg ControlMessage) ControlMessage {
+	return reflect.New(reflect.TypeOf(msg).Elem()).Interface().(ControlMessage)
+}
+
+// sameControl 比较两条消息的规范 TLV 编码，JSON 解码的 IPv4 地址为 16 字节形式，不能直接比较
+func sameControl(t *testing.T, a, b ControlMessage) bool {
+	t.Helper()
+	x, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Equal(x, y)
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	for version := uint8(MinProtocolVersion); version <= MaxProtocolVersion; version++ {
+		for _, msg := range controlMessages() {
+			data, err := MarshalControl(version, msg)
+			if err != nil {
+				t.Fatalf("v%d %T: marshal: %v", version, msg, err)
+			}
+			got := newControl(msg)
+			if err := UnmarshalControl(version, data, got); err != nil {
+				t.Fatalf("v%d %T: unmarshal: %v", version, msg, err)
+			}
+			if !sameControl(t, got, msg) {
+				t.Errorf("v%d %T: round trip mismatch\n got  %+v\n want %+v", version, msg, got, msg)
+			}
+		}
+	}
+}
+
+func TestControlUnsupportedVersion(t *testing.T) {
+	msg := &RouteMessage{Destination: "10.0.0.0/24"}
+	for _, version := range []uint8{0, MinProtocolVersion - 1, MaxProtocolVersion + 1} {
+		if _, err := MarshalControl(version, msg); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("marshal v%d: got %v, want ErrUnsupportedVersion", version, err)
+		}
+		if err := UnmarshalControl(version, nil, msg); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("unmarshal v%d: got %v, want ErrUnsupportedVersion", version, err)
+		}
+	}
+}
+
+func TestHandshakeEncoding(t *testing.T) {
+	msg := &HandshakeMessage{NodeID: "node-1", MinVersion: MinProtocolVersion, MaxVersion: MaxProtocolVersion}
+	tlv, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 版本 3 及更新版本的消息头都使用固定的 TLV 格式，只有版本 2 使用 JSON
+	for _, header := range []uint8{TLVProtocolVersion, MaxProtocolVersion, MaxProtocolVersion + 1, 255} {
+		data, err := MarshalHandshake(header, msg)
+		if err != nil {
+			t.Fatalf("marshal v%d: %v", header, err)
+		}
+		if !bytes.Equal(data, tlv) {
+			t.Errorf("v%d: handshake not TLV encoded", header)
+		}
+		var got HandshakeMessage
+		if err := UnmarshalHandshake(header, data, &got); err != nil {
+			t.Fatalf("unmarshal v%d: %v", header, err)
+		}
+		if got.MinVersion != msg.MinVersion || got.MaxVersion != msg.MaxVersion {
+			t.Errorf("v%d: got versions %d-%d", header, got.MinVersion, got.MaxVersion)
+		}
+		if HandshakeReplyVersion(header) != ProtocolVersion {
+			t.Errorf("v%d: reply version %d", header, HandshakeReplyVersion(header))
+		}
+	}
+
+	legacy, err := MarshalHandshake(MinProtocolVersion, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy[0] != '{' {
+		t.Errorf("v%d: handshake not JSON encoded", MinProtocolVersion)
+	}
+	if HandshakeReplyVersion(MinProtocolVersion) != MinProtocolVersion {
+		t.Errorf("v%d: reply version %d", MinProtocolVersion, HandshakeReplyVersion(MinProtocolVersion))
+	}
+	// 版本 3 的对端不接受 JSON
+	if err := UnmarshalHandshake(TLVProtocolVersion, legacy, &HandshakeMessage{}); err == nil {
+		t.Error("JSON handshake accepted with TLV header")
+	}
+	if _, err := MarshalHandshake(MinProtocolVersion-1, msg); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("marshal v%d: got %v, want ErrUnsupportedVersion", MinProtocolVersion-1, err)
+	}
+}
+
+func TestTLVIgnoresUnknownFields(t *testing.T) {
+	want := &RouteMessage{Destination: "10.1.0.0/16", NextHop: "node-9", Metric: 1}
+	data, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 在已知字段前后插入新版本可能增加的字段
+	unknown := []byte{200, 0, 3, 'n', 'e', 'w'}
+	empty := []byte{201, 0, 0}
+	data = append(append(append([]byte{}, unknown...), data...), empty...)
+
+	var got RouteMessage
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestJSONIgnoresUnknownFields(t *testing.T) {
+	data := []byte(`{"Destination":"10.1.0.0/16","Metric":2,"Future":{"a":1}}`)
+	var got RouteMessage
+	if err := UnmarshalControl(MinProtocolVersion, data, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got.Destination != "10.1.0.0/16" || got.Metric != 2 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestTLVMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"short header", []byte{tagRouteMetric, 0}, ErrTruncatedField},
+		{"short value", []byte{tagRouteDestination, 0, 5, 'a'}, ErrTruncatedField},
+		{"wrong integer width", []byte{tagRouteMetric, 0, 2, 0, 1}, ErrInvalidField},
+	}
+	for _, tt := range tests {
+		var msg RouteMessage
+		if err := msg.UnmarshalBinary(tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	var nat NATMessage
+	if err := nat.UnmarshalBinary([]byte{tagNATTargetIP, 0, 3, 1, 2, 3}); !errors.Is(err, ErrInvalidField) {
+		t.Errorf("bad IP length: got %v, want ErrInvalidField", err)
+	}
+}
+
+func TestTLVFieldTooLarge(t *testing.T) {
+	msg := &RouteMessage{Destination: string(make([]byte, 0x10000))}
+	if _, err := msg.MarshalBinary(); !errors.Is(err, ErrFieldTooLarge) {
+		t.Errorf("got %v, want ErrFieldTooLarge", err)
+	}
+}
+
+// fuzzControl 解码任意输入不得 panic；解码成功的消息重新编码后必须稳定
+func fuzzControl(f *testing.F, msg ControlMessage) {
+	for _, seed := range controlMessages() {
+		if reflect.TypeOf(seed) != reflect.TypeOf(msg) {
+			continue
+		}
+		data, err := seed.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{0xff, 0x00, 0x01, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := newControl(msg)
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			return
+		}
+		first, err := decoded.MarshalBinary()
+		if err != nil {
+			t.Fatalf("re-marshal: %v", err)
+		}
+		again := newControl(msg)
+		if err := again.UnmarshalBinary(first); err != nil {
+			t.Fatalf("unmarshal re-encoded message: %v", err)
+		}
+		second, err := again.MarshalBinary()
+		if err != nil {
+			t.Fatalf("re-marshal: %v", err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("encoding not stable:\n %x\n %x", first, second)
+		}
+	})
+}
+
+func FuzzHandshakeMessage(f *testing.F)  { fuzzControl(f, &HandshakeMessage{}) }
+func FuzzHandshakeResponse(f *testing.F) { fuzzControl(f, &HandshakeResponse{}) }
+func FuzzRouteMessage(f *testing.F)      { fuzzControl(f, &RouteMessage{}) }
+func FuzzNATMessage(f *testing.F)        { fuzzControl(f, &NATMessage{}) }
+func FuzzRevocationMessage(f *testing.F) { fuzzControl(f, &RevocationMessage{}) }
+func FuzzPeerMessage(f *testing.F)       { fuzzControl(f, &PeerMessage{}) }
+func FuzzPunchMessage(f *testing.F)      { fuzzControl(f, &PunchMessage{}) }
@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxFrameSourceSize 以太网帧消息中来源节点 ID 的最大长度
+const maxFrameSourceSize = 0xFF
+
+// ErrMalformedFrame 以太网帧消息的负载格式错误
+var ErrMalformedFrame = errors.New("malformed frame message")
+
+// EncodeFrame 编码以太网帧消息的负载：1 字节的来源节点 ID 长度、来源节点 ID 和以太网帧。
+// 接收方据来源学习帧的源 MAC 地址所在的节点；服务器以通过认证的发送节点替换节点自报的来源，
+// 服务器代答的帧来源为空
+func EncodeFrame(source string, frame []byte) ([]byte, error) {
+	if len(source) > maxFrameSourceSize {
+		return nil, fmt.Errorf("%w: source %d bytes", ErrMalformedFrame, len(source))
+	}
+	data := make([]byte, 0, 1+len(source)+len(frame))
+	data = append(data, byte(len(source)))
+	data = append(data, source...)
+	return append(data, frame...), nil
+}
+
+// DecodeFrame 解码以太网帧消息的负载，返回的帧引用 data 的内容
+func DecodeFrame(data []byte) (source string, frame []byte, err error) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "", nil, ErrMalformedFrame
+	}
+	size := int(data[0])
+	return string(data[1 : 1+size]), data[1+size:], nil
+}
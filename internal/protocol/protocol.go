@@ -1,16 +1,50 @@
+// Package protocol 定义 SD-WAN 节点之间的报文格式。
+//
+// 所有报文使用同一种定长消息头，多字节字段均为大端序：
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|    Version    |     Type      |            Length             |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|     Flags     |   Key Epoch   |           Reserved            |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                        Receiver Index                         |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                                                               |
+//	+                            Counter                            +
+//	|                                                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                       Payload (Length) ...                    |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// 字段说明：
+//
+//   - Version：协议版本，握手时协商，会话消息必须使用协商出的版本；
+//     低于 MinProtocolVersion 的报文无法解析
+//   - Type：消息类型，见 MsgType* 常量
+//   - Length：负载长度（加密消息为密文长度，含认证标签），必须与实际长度一致
+//   - Flags：消息标志，见 Flag* 常量，未知标志位被忽略
+//   - Key Epoch：加密消息使用的密钥代数，密钥轮换期间用于选择解密密钥
+//   - Reserved：保留，发送方置零，接收方忽略
+//   - Receiver Index：接收方在握手时分配的会话索引，明文消息为 0
+//   - Counter：加密消息的发送计数器，同时作为 AEAD 随机数，用于防重放
+//
+// 加密消息以整个消息头作为 AEAD 附加数据，任何头部字段被篡改都会导致认证失败。
 package protocol
 
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 
 	"github.com/fenghuilee/sd-wan/pkg/crypto"
 )
 
 const (
-	// 协议版本
-	ProtocolVersion = 1
+	// 协议版本，即本端支持的最高版本
+	ProtocolVersion = 3
 
 	// 消息类型
 	MsgTypeHandshake = 1
@@ -18,33 +52,142 @@ const (
 	MsgTypeKeepAlive = 3
 	MsgTypeRoute     = 4
 	MsgTypeNAT       = 5
+	// 证书请求与响应：客户端以明文请求服务器证书，服务器返回 DER 编码的证书。
+	// 请求负载不得短于响应，避免服务器被用于反射放大攻击
+	MsgTypeCertificate = 6
+	// 节点吊销通知：服务器向在线节点通告已吊销的节点，节点应断开与其的连接
+	MsgTypeRevocation = 7
+	// 节点介绍：服务器向两个节点互相通告对方的端点，双方随即同时向对方打洞
+	MsgTypePeer = 8
+	// 打洞探测：节点之间直接发送的明文探测及其确认，只用于确认路径可达
+	MsgTypePunch = 9
+	// 以太网帧：TAP 模式下节点之间经服务器或直连转发的二层帧，负载格式见 EncodeFrame
+	MsgTypeFrame = 10
 
 	// 头部长度
-	HeaderSize = 12
+	HeaderSize = 20
+
+	// 负载最大长度
+	MaxPayloadSize = 0xFFFF
+
+	// 消息最大长度，接收缓冲区应不小于该长度，避免较大的数据消息被截断
+	MaxMessageSize = HeaderSize + MaxPayloadSize
+
+	// 客户端发送证书请求时填充的负载长度
+	CertificateRequestSize = 1200
+
+	// 消息标志
+	FlagEncrypted = 0x01 // 负载已加密；握手消息中表示使用 Noise 握手
+)
+
+// 虚拟网络模式，服务器只接受与自身模式相同的节点
+const (
+	ModeTUN uint8 = iota // 三层模式，节点之间转发 IP 包
+	ModeTAP              // 二层模式，节点之间转发以太网帧，各节点的局域网桥接为同一个广播域
+)
+
+// ModeName 返回虚拟网络模式的名称
+func ModeName(mode uint8) string {
+	switch mode {
+	case ModeTUN:
+		return "tun"
+	case ModeTAP:
+		return "tap"
+	default:
+		return fmt.Sprintf("mode(%d)", mode)
+	}
+}
+
+var (
+	// ErrTruncated 报文短于消息头
+	ErrTruncated = errors.New("truncated message")
+	// ErrLengthMismatch 消息头中的长度与实际负载长度不一致
+	ErrLengthMismatch = errors.New("message length mismatch")
+	// ErrUnsupportedVersion 不支持的协议版本
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	// ErrPayloadTooLarge 负载超过长度字段的表示范围
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrUnencryptedMessage 本端要求加密但收到明文消息
+	ErrUnencryptedMessage = errors.New("unencrypted message rejected: encryption is required")
+	// ErrUnexpectedEncryption 本端未启用加密但收到加密消息
+	ErrUnexpectedEncryption = errors.New("encrypted message rejected: encryption is disabled")
+	// ErrNoSession 没有可用于解密该消息的会话密钥
+	ErrNoSession = errors.New("no session keys for message epoch")
+	// ErrWrongReceiver 接收索引与本端会话不符
+	ErrWrongReceiver = errors.New("message receiver index mismatch")
+	// ErrVersionMismatch 消息版本与握手协商的版本不一致
+	ErrVersionMismatch = errors.New("message version differs from negotiated version")
 )
 
 // Message 表示一个网络消息
 type Message struct {
 	Version uint8
 	Type    uint8
-	Length  uint16
+	Length  uint16 // 解码时为负载长度，编码时根据 Data 自动计算
+	Flags   uint8
+	Epoch   uint8  // 加密消息使用的密钥代数
+	Index   uint32 // 接收方会话索引
+	Counter uint64 // 加密消息的发送计数器，同时作为 AEAD 随机数
 	Data    []byte
 }
 
-// HandshakeMessage 握手消息
+// HandshakeMessage 握手消息，作为 Noise 握手第一条消息的加密负载传输
 type HandshakeMessage struct {
-	NodeID      string
-	PublicIP    net.IP
-	PublicPort  uint16
-	PrivateIP   net.IP
-	PrivatePort uint16
+	NodeID       string
+	Timestamp    int64 // 发起时间（纳秒），用于拒绝重放的握手消息
+	PublicIP     net.IP
+	PublicPort   uint16
+	PrivateIP    net.IP
+	PrivatePort  uint16
+	Algorithms   []string // 发起方支持的加密算法，按优先级排序
+	Epoch        uint8    // 本次握手派生密钥的代数，重新握手时递增
+	SenderIndex  uint32   // 发起方分配的会话索引
+	MinVersion   uint8    // 发起方支持的最低协议版本，旧节点不携带
+	MaxVersion   uint8    // 发起方支持的最高协议版本，旧节点不携带
+	Capabilities uint32   // 发起方支持的能力位，见 Cap* 常量
+	PreAuthKey   string   // 入网预授权密钥，仅未授权的节点首次握手时需要
+	Certificate  []byte   // 发起方的 DER 编码证书，由内部 CA 签发，公钥即静态公钥
+	LocalIP      net.IP   // 发起方套接字所在的局域网地址，与 PrivatePort 组成内网端点
+	NATType      uint8    // 发起方经 STUN 探测出的 NAT 类型，见 stun.NATType，0 表示未知
+	PortStep     int16    // 发起方对称 NAT 先后两个映射的端口差，非对称 NAT 或未知时为 0
+	RelayedIP    net.IP   // 发起方在 TURN 服务器上分配的中继地址，未使用 TURN 时为空
+	RelayedPort  uint16   // 发起方 TURN 中继地址的端口
+	PrivateIP6   net.IP   // 发起方在双栈虚拟网络中的 IPv6 虚拟地址，PrivateIP 为 IPv4 地址时携带
+	GlobalIP6    net.IP   // 发起方的全局 IPv6 地址，与 PrivatePort 组成 IPv6 端点，没有时为空
+	Mode         uint8    // 发起方的虚拟网络模式，见 Mode* 常量，旧节点不携带，视为 ModeTUN
 }
 
-// RouteMessage 路由消息
+// 握手响应状态
+const (
+	HandshakeStatusOK    = "OK"
+	HandshakeStatusError = "ERROR"
+	HandshakeStatusRetry = "RETRY" // 服务器暂时无法完成握手（如正在查询证书状态），客户端稍后重新握手
+)
+
+// HandshakeResponse 握手响应，作为 Noise 握手第二条消息的加密负载传输
+type HandshakeResponse struct {
+	Status       string
+	Algorithm    string // 服务器选定的加密算法
+	SenderIndex  uint32 // 服务器分配的会话索引
+	Version      uint8  // 协商出的协议版本
+	Capabilities uint32 // 双方共同支持的能力位
+	MinVersion   uint8  // 服务器支持的最低协议版本，便于对端在版本不兼容时定位问题
+	MaxVersion   uint8  // 服务器支持的最高协议版本
+	Error        string
+	Address      net.IP // 服务器为发起方分配的虚拟地址，服务器未分配地址时为空
+	PrefixLength uint8  // 分配地址所在虚拟网段的前缀长度
+	// 服务器同时配置了 IPv6 前缀时为发起方分配的第二个地址，与 Address 组成双栈虚拟地址
+	Address6      net.IP
+	PrefixLength6 uint8
+}
+
+// RouteMessage 路由消息。节点向服务器通告自身后方的网段；服务器向各节点推送其他节点通告的网段，
+// 此时 NextHop 为通告该网段的节点，Withdraw 为 true 表示该路由已撤销
 type RouteMessage struct {
 	Destination string
 	NextHop     string
 	Metric      uint8
+	Withdraw    bool
 }
 
 // NATMessage NAT穿透消息
@@ -54,103 +197,243 @@ type NATMessage struct {
 	TargetPort  uint16
 	RelayServer net.IP
 	RelayPort   uint16
+	RelayTicket []byte // 服务器签发的中继票据，见 relay 包
+	RelayKey    []byte // 中继票据的票据密钥
+}
+
+// RevocationMessage 节点吊销通知，列表较长时分多条消息发送，接收方累积处理
+type RevocationMessage struct {
+	NodeIDs []string
+}
+
+// PeerMessage 节点介绍，描述另一个节点的身份和可尝试打洞的端点
+type PeerMessage struct {
+	NodeID     string
+	PublicKey  []byte   // 对端的静态公钥，节点之间的 Noise 握手以此认证对端，明文模式为空
+	PublicIP   net.IP   // 服务器观察到的对端地址
+	PublicPort uint16   // 服务器观察到的对端端口
+	LocalIP    net.IP   // 对端自报的局域网地址，双方位于同一 NAT 之后时可直达
+	LocalPort  uint16   // 对端自报的本地端口
+	Addresses  []net.IP // 对端的虚拟地址
+	Routes     []string // 对端通告的网段
+	Version    uint8    // 双方都支持的协议版本，直连会话使用该版本
+	Token      []byte   // 本次介绍的随机令牌，打洞探测携带该令牌
+	NATType    uint8    // 对端自报的 NAT 类型
+	PortStep   int16    // 对端对称 NAT 的端口步长，用于端口预测
+
+	RelayTicket []byte // 打洞失败时经中继服务与对端通信的票据，服务器未配置中继时为空
+	RelayKey    []byte // 中继票据的票据密钥
+	RelayedIP   net.IP // 对端在 TURN 服务器上分配的中继地址，双方都有中继地址时打洞失败后经 TURN 服务器通信
+	RelayedPort uint16 // 对端 TURN 中继地址的端口
+	GlobalIP6   net.IP // 对端自报的全局 IPv6 地址，与 LocalPort 组成 IPv6 端点，双方都有 IPv6 时可不经 NAT 直达
+}
+
+// PunchMessage 打洞探测，Ack 为 true 时表示对收到的探测的确认
+type PunchMessage struct {
+	NodeID string
+	Token  []byte
+	Ack    bool
 }
 
-// Protocol 协议处理器
+// Protocol 协议处理器，绑定一个对端的会话密钥环、协商出的协议版本和双方的会话索引
 type Protocol struct {
-	crypto *crypto.Crypto
+	keys        *crypto.KeyRing
+	version     uint8
+	localIndex  uint32
+	remoteIndex uint32
 }
 
-// NewProtocol 创建新的协议处理器
-func NewProtocol(crypto *crypto.Crypto) *Protocol {
+// NewProtocol 创建新的协议处理器，keys 为 nil 时以明文收发。
+// version 是握手协商出的协议版本；localIndex 是本端分配、对端发来的消息中携带的索引；
+// remoteIndex 是对端分配、本端发送时携带的索引。
+func NewProtocol(keys *crypto.KeyRing, version uint8, localIndex, remoteIndex uint32) *Protocol {
 	return &Protocol{
-		crypto: crypto,
+		keys:        keys,
+		version:     version,
+		localIndex:  localIndex,
+		remoteIndex: remoteIndex,
 	}
 }
 
-// Encode 将消息编码为字节流
-func (m *Message) Encode() ([]byte, error) {
-	buf := make([]byte, HeaderSize+len(m.Data))
+// putHeader 将消息头写入 buf，length 为负载长度
+func (m *Message) putHeader(buf []byte, length int) {
 	buf[0] = m.Version
 	buf[1] = m.Type
-	binary.BigEndian.PutUint16(buf[2:4], m.Length)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(length))
+	buf[4] = m.Flags
+	buf[5] = m.Epoch
+	buf[6] = 0
+	buf[7] = 0
+	binary.BigEndian.PutUint32(buf[8:12], m.Index)
+	binary.BigEndian.PutUint64(buf[12:20], m.Counter)
+}
+
+// Encode 将消息编码为字节流，长度字段根据 Data 计算
+func (m *Message) Encode() ([]byte, error) {
+	if len(m.Data) > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	buf := make([]byte, HeaderSize+len(m.Data))
+	m.putHeader(buf, len(m.Data))
 	copy(buf[HeaderSize:], m.Data)
 	return buf, nil
 }
 
-// Decode 从字节流解码消息
+// DecodeMessage 从字节流解码消息，报文截断、长度不符或版本过旧时返回错误。
+// 更高版本的报文头格式不变，可以解码，是否接受由握手协商结果决定。
 func DecodeMessage(data []byte) (*Message, error) {
+	// 旧版本的消息头更短，先检查版本以返回明确的错误
+	if len(data) >= 2 && data[0] < MinProtocolVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[0])
+	}
 	if len(data) < HeaderSize {
-		return nil, nil
+		return nil, ErrTruncated
 	}
 
 	msg := &Message{
 		Version: data[0],
 		Type:    data[1],
 		Length:  binary.BigEndian.Uint16(data[2:4]),
+		Flags:   data[4],
+		Epoch:   data[5],
+		Index:   binary.BigEndian.Uint32(data[8:12]),
+		Counter: binary.BigEndian.Uint64(data[12:20]),
+	}
+
+	if int(msg.Length) != len(data)-HeaderSize {
+		return nil, fmt.Errorf("%w: header %d, actual %d", ErrLengthMismatch, msg.Length, len(data)-HeaderSize)
 	}
 
-	if len(data) > HeaderSize {
-		msg.Data = make([]byte, len(data)-HeaderSize)
+	if msg.Length > 0 {
+		msg.Data = make([]byte, msg.Length)
 		copy(msg.Data, data[HeaderSize:])
 	}
 
 	return msg, nil
 }
 
-// Encode 编码消息
+// Encode 以协商出的协议版本编码消息，启用加密时使用会话发送密钥和单调递增的计数器加密负载，
+// 消息头作为附加数据一并认证
 func (p *Protocol) Encode(msg *Message) ([]byte, error) {
-	// 加密负载
-	var encryptedPayload []byte
-	var err error
-	if p.crypto.IsEnabled() {
-		encryptedPayload, err = p.crypto.Encrypt(msg.Data)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		encryptedPayload = msg.Data
+	out := &Message{
+		Version: p.version,
+		Type:    msg.Type,
+		Flags:   msg.Flags &^ FlagEncrypted,
+		Data:    msg.Data,
+	}
+	if !p.IsEncrypted() {
+		return out.Encode()
 	}
 
-	// 构建消息头
-	header := make([]byte, 5)
-	header[0] = byte(msg.Type)
-	binary.BigEndian.PutUint32(header[1:], uint32(len(encryptedPayload)))
+	session, err := p.keys.SendSession()
+	if err != nil {
+		return nil, err
+	}
+	length := len(msg.Data) + session.Send.Overhead()
+	if length > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+	counter, err := session.NextCounter()
+	if err != nil {
+		return nil, err
+	}
+	out.Flags |= FlagEncrypted
+	out.Epoch = session.Epoch
+	out.Index = p.remoteIndex
+	out.Counter = counter
 
-	// 组合消息
-	return append(header, encryptedPayload...), nil
+	// 先写入消息头，再把密文追加到头部之后
+	buf := make([]byte, HeaderSize, HeaderSize+length)
+	out.putHeader(buf, length)
+	return session.Send.SealTo(buf, counter, msg.Data, buf[:HeaderSize]), nil
 }
 
-// Decode 解码消息
+// Decode 解码消息，版本或加密设置与协商结果不一致、认证失败或检测到重放时返回错误
 func (p *Protocol) Decode(data []byte) (*Message, error) {
-	if len(data) < 5 {
-		return nil, errors.New("message too short")
+	msg, err := DecodeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Version != p.version {
+		return nil, fmt.Errorf("%w: got %d, negotiated %d", ErrVersionMismatch, msg.Version, p.version)
 	}
 
-	msgType := data[0]
-	payloadLen := binary.BigEndian.Uint32(data[1:5])
-	payload := data[5:]
+	encrypted := msg.Flags&FlagEncrypted != 0
+	switch {
+	case p.IsEncrypted() && !encrypted:
+		return nil, ErrUnencryptedMessage
+	case !p.IsEncrypted() && encrypted:
+		return nil, ErrUnexpectedEncryption
+	case !encrypted:
+		return msg, nil
+	}
 
-	if uint32(len(payload)) != payloadLen {
-		return nil, errors.New("invalid payload length")
+	if msg.Index != p.localIndex {
+		return nil, ErrWrongReceiver
 	}
 
-	// 解密负载
+	// 密钥轮换期间可能有多代密钥的代数相同，依次尝试
 	var decryptedPayload []byte
-	var err error
-	if p.crypto.IsEnabled() {
-		decryptedPayload, err = p.crypto.Decrypt(payload)
-		if err != nil {
-			return nil, err
+	err = ErrNoSession
+	for _, session := range p.keys.Candidates(msg.Epoch) {
+		decryptedPayload, err = openMessage(session, msg, data[:HeaderSize])
+		if err == nil {
+			p.keys.Confirm(session)
+			break
 		}
-	} else {
-		decryptedPayload = payload
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Flags &^= FlagEncrypted
+	msg.Length = uint16(len(decryptedPayload))
+	msg.Data = decryptedPayload
+	return msg, nil
+}
+
+// openMessage 使用一代会话密钥解密消息并更新防重放窗口
+func openMessage(session *crypto.Session, msg *Message, header []byte) ([]byte, error) {
+	// 解密前先过滤明显的重放，避免无谓的解密开销
+	replay := session.Replay()
+	if err := replay.Check(msg.Counter); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := session.Recv.Open(msg.Counter, msg.Data, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// 只有通过认证的消息才能推进窗口
+	if err := replay.Update(msg.Counter); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// IsEncrypted 判断协议处理器是否加密消息
+func (p *Protocol) IsEncrypted() bool {
+	return p.keys != nil
+}
+
+// NeedsRekey 判断是否需要重新握手轮换密钥
+func (p *Protocol) NeedsRekey() bool {
+	return p.IsEncrypted() && p.keys.NeedsRekey()
+}
+
+// Version 返回协商出的协议版本
+func (p *Protocol) Version() uint8 {
+	return p.version
+}
+
+// RemoteIndex 返回对端分配的会话索引
+func (p *Protocol) RemoteIndex() uint32 {
+	return p.remoteIndex
+}
 
-	return &Message{
-		Version: ProtocolVersion,
-		Type:    msgType,
-		Length:  uint16(len(decryptedPayload)),
-		Data:    decryptedPayload,
-	}, nil
+// Keys 返回协议处理器使用的会话密钥环
+func (p *Protocol) Keys() *crypto.KeyRing {
+	return p.keys
 }
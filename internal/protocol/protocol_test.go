@@ -0,0 +1,266 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+// loadCaptures 读取 testdata/captures 中真实运行时抓取的报文，
+// 包括明文与 Noise 握手、密钥轮换、数据和保活消息
+func loadCaptures(tb testing.TB) [][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "captures", "*.bin"))
+	if err != nil || len(files) == 0 {
+		tb.Fatalf("no captures found: %v", err)
+	}
+	captures := make([][]byte, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		captures = append(captures, data)
+	}
+	return captures
+}
+
+// newSessionPair 完成一次 Noise 握手，返回客户端与服务器两端的协议处理器
+func newSessionPair(tb testing.TB) (client, server *Protocol) {
+	tb.Helper()
+	clientStatic, err := crypto.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverStatic, err := crypto.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	initiator := crypto.NewInitiatorHandshake(clientStatic, serverStatic.Public)
+	responder := crypto.NewResponderHandshake(serverStatic)
+	initiation, err := initiator.WriteMessage(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := responder.ReadMessage(initiation); err != nil {
+		tb.Fatal(err)
+	}
+	response, err := responder.WriteMessage(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := initiator.ReadMessage(response); err != nil {
+		tb.Fatal(err)
+	}
+
+	clientSession, err := initiator.Split(crypto.AlgorithmChaCha20Poly1305)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverSession, err := responder.Split(crypto.AlgorithmChaCha20Poly1305)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	clientKeys := crypto.NewKeyRing(crypto.DefaultRekeyPolicy())
+	clientKeys.Install(clientSession)
+	serverKeys := crypto.NewKeyRing(crypto.DefaultRekeyPolicy())
+	serverKeys.Install(serverSession)
+	return NewProtocol(clientKeys, ProtocolVersion, 1, 2), NewProtocol(serverKeys, ProtocolVersion, 2, 1)
+}
+
+func TestDecodeCaptures(t *testing.T) {
+	for _, data := range loadCaptures(t) {
+		msg, err := DecodeMessage(data)
+		if err != nil {
+			t.Errorf("decode capture %x: %v", data[:HeaderSize], err)
+			continue
+		}
+		if !IsSupportedVersion(msg.Version) {
+			t.Errorf("capture has unsupported version %d", msg.Version)
+		}
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	valid, err := (&Message{Version: ProtocolVersion, Type: MsgTypeData, Data: []byte("abc")}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"one byte", []byte{ProtocolVersion}, ErrTruncated},
+		{"short header", valid[:HeaderSize-1], ErrTruncated},
+		{"legacy version", []byte{1, MsgTypeHandshake}, ErrUnsupportedVersion},
+		{"missing payload", valid[:len(valid)-1], ErrLengthMismatch},
+		{"trailing bytes", append(append([]byte{}, valid...), 0), ErrLengthMismatch},
+	}
+	for _, tt := range tests {
+		if _, err := DecodeMessage(tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFrameMessage(t *testing.T) {
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 0x0a, 0x08, 0x06}
+	for _, source := range []string{"node-0123456789abcdef", ""} {
+		data, err := EncodeFrame(source, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotSource, gotFrame, err := DecodeFrame(data)
+		if err != nil || gotSource != source || !bytes.Equal(gotFrame, frame) {
+			t.Fatalf("DecodeFrame = %q, %x, %v", gotSource, gotFrame, err)
+		}
+	}
+	for _, data := range [][]byte{nil, {5, 'n', 'o', 'd'}} {
+		if _, _, err := DecodeFrame(data); !errors.Is(err, ErrMalformedFrame) {
+			t.Errorf("DecodeFrame(%x) = %v", data, err)
+		}
+	}
+	if _, err := EncodeFrame(string(make([]byte, 256)), frame); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("oversized source: %v", err)
+	}
+}
+
+func TestProtocolRejectsTampering(t *testing.T) {
+	client, server := newSessionPair(t)
+	frame, err := client.Encode(&Message{Type: MsgTypeData, Data: []byte("payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 修改任何一个字节（包括保留字段）都必须导致认证失败
+	for i := range frame {
+		tampered := append([]byte{}, frame...)
+		tampered[i] ^= 0x80
+		if _, err := server.Decode(tampered); err == nil {
+			t.Fatalf("tampered byte %d accepted", i)
+		}
+	}
+
+	msg, err := server.Decode(frame)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if string(msg.Data) != "payload" {
+		t.Fatalf("payload %q", msg.Data)
+	}
+	if _, err := server.Decode(frame); !errors.Is(err, crypto.ErrReplay) {
+		t.Fatalf("replay: got %v, want ErrReplay", err)
+	}
+}
+
+func TestProtocolRejectsVersionMismatch(t *testing.T) {
+	plain := NewProtocol(nil, ProtocolVersion, 0, 0)
+	frame, err := (&Message{Version: MinProtocolVersion, Type: MsgTypeKeepAlive}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Decode(frame); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("got %v, want ErrVersionMismatch", err)
+	}
+}
+
+// FuzzDecodeMessage 解码任意报文不得 panic；解码成功的报文重新编码后与原报文一致（保留字段除外）
+func FuzzDecodeMessage(f *testing.F) {
+	for _, data := range loadCaptures(f) {
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{1, MsgTypeHandshake})
+	f.Add(make([]byte, HeaderSize))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DecodeMessage(data)
+		if err != nil {
+			return
+		}
+		if int(msg.Length) != len(msg.Data) {
+			t.Fatalf("length %d, data %d", msg.Length, len(msg.Data))
+		}
+		encoded, err := msg.Encode()
+		if err != nil {
+			t.Fatalf("re-encode: %v", err)
+		}
+		want := append([]byte{}, data...)
+		want[6], want[7] = 0, 0
+		if !bytes.Equal(encoded, want) {
+			t.Fatalf("round trip mismatch:\n got  %x\n want %x", encoded, want)
+		}
+	})
+}
+
+// FuzzProtocolDecode 任意报文都不能通过会话认证，明文模式下只接受协商版本的报文
+func FuzzProtocolDecode(f *testing.F) {
+	_, server := newSessionPair(f)
+	plain := NewProtocol(nil, ProtocolVersion, 0, 0)
+	for _, data := range loadCaptures(f) {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if msg, err := server.Decode(data); err == nil {
+			t.Fatalf("forged frame accepted: %+v", msg)
+		}
+
+		msg, err := plain.Decode(data)
+		if err != nil {
+			return
+		}
+		if msg.Version != ProtocolVersion || msg.Flags&FlagEncrypted != 0 {
+			t.Fatalf("plaintext protocol accepted %+v", msg)
+		}
+		if !bytes.Equal(msg.Data, data[HeaderSize:]) {
+			t.Fatalf("payload mismatch")
+		}
+	})
+}
+
+// FuzzProtocolTamper 加密报文原样到达时解密出原负载且只能接收一次，任何字节被修改都会被拒绝
+func FuzzProtocolTamper(f *testing.F) {
+	f.Add(uint8(MsgTypeData), []byte("hello"), uint16(0), uint8(0))
+	f.Add(uint8(MsgTypeKeepAlive), []byte{}, uint16(6), uint8(1))
+	f.Add(uint8(MsgTypeRoute), []byte{1, 0, 1, 'x'}, uint16(30), uint8(0xff))
+
+	f.Fuzz(func(t *testing.T, msgType uint8, payload []byte, pos uint16, mask uint8) {
+		client, server := newSessionPair(t)
+		frame, err := client.Encode(&Message{Type: msgType, Data: payload})
+		if err != nil {
+			if errors.Is(err, ErrPayloadTooLarge) {
+				return
+			}
+			t.Fatalf("encode: %v", err)
+		}
+
+		if mask != 0 {
+			frame[int(pos)%len(frame)] ^= mask
+			if msg, err := server.Decode(frame); err == nil {
+				t.Fatalf("tampered frame accepted: %+v", msg)
+			}
+			return
+		}
+
+		msg, err := server.Decode(frame)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Type != msgType || !bytes.Equal(msg.Data, payload) {
+			t.Fatalf("got type %d payload %x", msg.Type, msg.Data)
+		}
+		if _, err := server.Decode(frame); !errors.Is(err, crypto.ErrReplay) {
+			t.Fatalf("replay: got %v, want ErrReplay", err)
+		}
+	})
+}
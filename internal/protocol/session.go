@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+// ErrReplayedHandshake 握手时间戳不比上一次新，可能是重放攻击
+var ErrReplayedHandshake = errors.New("replayed handshake")
+
+// Peer 已完成握手的对端
+type Peer struct {
+	Index        uint32 // 本端分配的会话索引，对端发来的消息携带该索引
+	RemoteIndex  uint32 // 对端分配的会话索引，本端发送的消息携带该索引
+	NodeID       string
+	Static       [crypto.KeySize]byte
+	Keys         *crypto.KeyRing
+	Version      uint8  // 握手协商出的协议版本
+	Capabilities uint32 // 双方共同支持的能力位
+
+	mutex    sync.RWMutex
+	endpoint *net.UDPAddr
+}
+
+// Protocol 返回与该对端通信使用的协议处理器
+func (p *Peer) Protocol() *Protocol {
+	return NewProtocol(p.Keys, p.Version, p.Index, p.RemoteIndex)
+}
+
+// Endpoint 返回对端最近一次通过认证的消息来源地址
+func (p *Peer) Endpoint() *net.UDPAddr {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.endpoint
+}
+
+// SetEndpoint 更新对端地址，只应在消息通过认证后调用，以支持对端漫游
+func (p *Peer) SetEndpoint(addr *net.UDPAddr) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.endpoint = addr
+}
+
+// SessionTable 会话表，按会话索引、静态公钥和节点 ID 索引已完成握手的对端
+type SessionTable struct {
+	byIndex    map[uint32]*Peer
+	byStatic   map[[crypto.KeySize]byte]*Peer
+	byNode     map[string]*Peer
+	timestamps map[[crypto.KeySize]byte]int64 // 已建立会话的静态公钥最近一次被接受的握手时间戳
+	mutex      sync.RWMutex
+}
+
+// NewSessionTable 创建新的会话表
+func NewSessionTable() *SessionTable {
+	return &SessionTable{
+		byIndex:    make(map[uint32]*Peer),
+		byStatic:   make(map[[crypto.KeySize]byte]*Peer),
+		byNode:     make(map[string]*Peer),
+		timestamps: make(map[[crypto.KeySize]byte]int64),
+	}
+}
+
+// CheckTimestamp 检查对端握手时间戳，每个静态公钥的时间戳必须单调递增。
+// 只检查不记录，握手被接受后由 RecordTimestamp 记录，被拒绝的握手不占用内存
+func (t *SessionTable) CheckTimestamp(remoteStatic [crypto.KeySize]byte, timestamp int64) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if last, ok := t.timestamps[remoteStatic]; ok && timestamp <= last {
+		return ErrReplayedHandshake
+	}
+	return nil
+}
+
+// RecordTimestamp 记录已接受的握手时间戳，须在对端的会话加入会话表后调用，会话被移除时一并删除
+func (t *SessionTable) RecordTimestamp(remoteStatic [crypto.KeySize]byte, timestamp int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.byStatic[remoteStatic]; ok && timestamp > t.timestamps[remoteStatic] {
+		t.timestamps[remoteStatic] = timestamp
+	}
+}
+
+// Add 为对端分配唯一的会话索引并加入会话表，替换同一静态公钥的旧会话
+func (t *SessionTable) Add(peer *Peer) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	index, err := t.newIndex()
+	if err != nil {
+		return err
+	}
+	peer.Index = index
+
+	if old, ok := t.byStatic[peer.Static]; ok {
+		t.remove(old)
+	}
+	t.byIndex[peer.Index] = peer
+	t.byStatic[peer.Static] = peer
+	t.byNode[peer.NodeID] = peer
+	return nil
+}
+
+// newIndex 生成未被占用的随机索引
+func (t *SessionTable) newIndex() (uint32, error) {
+	for {
+		index, err := NewIndex()
+		if err != nil {
+			return 0, err
+		}
+		if _, used := t.byIndex[index]; !used {
+			return index, nil
+		}
+	}
+}
+
+// remove 在持有锁的情况下移除对端
+func (t *SessionTable) remove(peer *Peer) {
+	delete(t.byIndex, peer.Index)
+	if t.byStatic[peer.Static] == peer {
+		delete(t.byStatic, peer.Static)
+	}
+	if t.byNode[peer.NodeID] == peer {
+		delete(t.byNode, peer.NodeID)
+	}
+}
+
+// Remove 移除对端，同一静态公钥没有其他会话时删除其握手时间戳
+func (t *SessionTable) Remove(peer *Peer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.remove(peer)
+	if _, ok := t.byStatic[peer.Static]; !ok {
+		delete(t.timestamps, peer.Static)
+	}
+}
+
+// ByIndex 按会话索引查找对端
+func (t *SessionTable) ByIndex(index uint32) *Peer {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.byIndex[index]
+}
+
+// ByStatic 按静态公钥查找对端
+func (t *SessionTable) ByStatic(static [crypto.KeySize]byte) *Peer {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.byStatic[static]
+}
+
+// ByNode 按节点 ID 查找对端
+func (t *SessionTable) ByNode(nodeID string) *Peer {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.byNode[nodeID]
+}
+
+// Peers 返回所有对端
+func (t *SessionTable) Peers() []*Peer {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	peers := make([]*Peer, 0, len(t.byIndex))
+	for _, peer := range t.byIndex {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// NewIndex 生成一个非零随机会话索引
+func NewIndex() (uint32, error) {
+	var buf [4]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		if index := binary.BigEndian.Uint32(buf[:]); index != 0 {
+			return index, nil
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fenghuilee/sd-wan/pkg/crypto"
+)
+
+func TestSessionTimestamps(t *testing.T) {
+	sessions := NewSessionTable()
+	static := [crypto.KeySize]byte{1}
+
+	// 没有会话的公钥不记录时间戳，被拒绝的握手不占用内存
+	if err := sessions.CheckTimestamp(static, 100); err != nil {
+		t.Fatal(err)
+	}
+	sessions.RecordTimestamp(static, 100)
+	if len(sessions.timestamps) != 0 {
+		t.Fatalf("timestamp recorded without a session: %v", sessions.timestamps)
+	}
+
+	peer := &Peer{NodeID: crypto.NodeID(static), Static: static}
+	if err := sessions.Add(peer); err != nil {
+		t.Fatal(err)
+	}
+	sessions.RecordTimestamp(static, 100)
+	for _, timestamp := range []int64{99, 100} {
+		if err := sessions.CheckTimestamp(static, timestamp); !errors.Is(err, ErrReplayedHandshake) {
+			t.Errorf("timestamp %d: got %v, want ErrReplayedHandshake", timestamp, err)
+		}
+	}
+	if err := sessions.CheckTimestamp(static, 101); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Remove(peer)
+	if len(sessions.timestamps) != 0 {
+		t.Fatalf("timestamp kept after the session was removed: %v", sessions.timestamps)
+	}
+}
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// 控制消息的 TLV 编码，每个字段依次为：
+//
+//	标签（1 字节） | 长度（2 字节，大端序） | 值（长度字节）
+//
+// 整数按类型宽度以大端序定长编码，字符串和 IP 地址直接存放原始字节，
+// 重复字段多次出现同一标签，零值字段不编码。解码时跳过未知标签，
+// 因此新增字段只需分配新标签；已分配标签的含义和类型不得更改。
+const tlvHeaderSize = 3
+
+var (
+	// ErrTruncatedField TLV 字段不完整
+	ErrTruncatedField = errors.New("truncated TLV field")
+	// ErrFieldTooLarge 字段值超过长度字段的表示范围
+	ErrFieldTooLarge = errors.New("TLV field too large")
+	// ErrInvalidField 字段值长度与类型不符
+	ErrInvalidField = errors.New("invalid TLV field")
+)
+
+// tlvWriter TLV 编码器，出错后忽略后续写入，由 finish 统一返回错误
+type tlvWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *tlvWriter) bytes(tag uint8, value []byte) {
+	if w.err != nil || len(value) == 0 {
+		return
+	}
+	if len(value) > 0xFFFF {
+		w.err = fmt.Errorf("%w: tag %d", ErrFieldTooLarge, tag)
+		return
+	}
+	w.buf = append(w.buf, tag, 0, 0)
+	binary.BigEndian.PutUint16(w.buf[len(w.buf)-2:], uint16(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *tlvWriter) string(tag uint8, value string) {
+	w.bytes(tag, []byte(value))
+}
+
+func (w *tlvWriter) strings(tag uint8, values []string) {
+	for _, value := range values {
+		// 空字符串也需要占位，否则重复字段的个数会改变
+		if w.err == nil && value == "" {
+			w.buf = append(w.buf, tag, 0, 0)
+			continue
+		}
+		w.string(tag, value)
+	}
+}
+
+func (w *tlvWriter) uint8(tag uint8, value uint8) {
+	if value != 0 {
+		w.bytes(tag, []byte{value})
+	}
+}
+
+func (w *tlvWriter) uint16(tag uint8, value uint16) {
+	if value != 0 {
+		w.bytes(tag, binary.BigEndian.AppendUint16(nil, value))
+	}
+}
+
+func (w *tlvWriter) uint32(tag uint8, value uint32) {
+	if value != 0 {
+		w.bytes(tag, binary.BigEndian.AppendUint32(nil, value))
+	}
+}
+
+func (w *tlvWriter) uint64(tag uint8, value uint64) {
+	if value != 0 {
+		w.bytes(tag, binary.BigEndian.AppendUint64(nil, value))
+	}
+}
+
+// ip 编码 IP 地址，IPv4 地址使用 4 字节形式
+func (w *tlvWriter) ip(tag uint8, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	w.bytes(tag, ip)
+}
+
+func (w *tlvWriter) finish() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if w.buf == nil {
+		return []byte{}, nil
+	}
+	return w.buf, nil
+}
+
+// readTLV 依次解析 TLV 字段并交给 field 处理，field 应忽略未知标签
+func readTLV(data []byte, field func(tag uint8, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < tlvHeaderSize {
+			return ErrTruncatedField
+		}
+		tag := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:tlvHeaderSize]))
+		if len(data)-tlvHeaderSize < length {
+			return fmt.Errorf("%w: tag %d", ErrTruncatedField, tag)
+		}
+		if err := field(tag, data[tlvHeaderSize:tlvHeaderSize+length]); err != nil {
+			return err
+		}
+		data = data[tlvHeaderSize+length:]
+	}
+	return nil
+}
+
+func invalidField(tag uint8, value []byte) error {
+	return fmt.Errorf("%w: tag %d, length %d", ErrInvalidField, tag, len(value))
+}
+
+func tlvUint8(tag uint8, value []byte) (uint8, error) {
+	if len(value) != 1 {
+		return 0, invalidField(tag, value)
+	}
+	return value[0], nil
+}
+
+func tlvUint16(tag uint8, value []byte) (uint16, error) {
+	if len(value) != 2 {
+		return 0, invalidField(tag, value)
+	}
+	return binary.BigEndian.Uint16(value), nil
+}
+
+func tlvUint32(tag uint8, value []byte) (uint32, error) {
+	if len(value) != 4 {
+		return 0, invalidField(tag, value)
+	}
+	return binary.BigEndian.Uint32(value), nil
+}
+
+func tlvUint64(tag uint8, value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, invalidField(tag, value)
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func tlvIP(tag uint8, value []byte) (net.IP, error) {
+	if len(value) != net.IPv4len && len(value) != net.IPv6len {
+		return nil, invalidField(tag, value)
+	}
+	return append(net.IP{}, value...), nil
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 协议版本范围。
+// 从版本 2 起消息头格式和 Noise 握手格式固定不变，版本号只决定负载语义
+// （如版本 2 的控制消息使用 JSON，版本 3 起使用 TLV）。
+// 握手消息以与版本无关的 TLV 格式编码，只有明确只支持版本 2 的旧节点才回退到 JSON；
+// 服务器选择双方共同支持的最高版本，并以该版本作为握手响应和此后会话消息的消息头版本。
+const (
+	MinProtocolVersion = 2
+	MaxProtocolVersion = ProtocolVersion
+)
+
+// 能力位，在握手中与版本一同交换，会话使用双方能力的交集
+const (
+	CapRekey     uint32 = 1 << iota // 支持会话密钥轮换
+	CapDirect                       // 支持经服务器介绍后与其他节点打洞直连
+	CapTraversal                    // 支持对称 NAT 的端口预测和生日攻击穿透
+	CapRelay                        // 支持打洞失败后经独立的中继服务通信
+)
+
+// LocalCapabilities 本实现支持的全部能力
+const LocalCapabilities = CapRekey | CapDirect | CapTraversal | CapRelay
+
+// ErrNoCommonVersion 双方没有共同支持的协议版本
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// IsSupportedVersion 判断协议版本是否受支持
+func IsSupportedVersion(version uint8) bool {
+	return version >= MinProtocolVersion && version <= MaxProtocolVersion
+}
+
+// NegotiateVersion 在对端声明的版本范围中选出双方都支持的最高版本。
+// 未声明版本范围的旧节点（min、max 均为 0）视为只支持其消息头中的版本。
+func NegotiateVersion(min, max, header uint8) (uint8, error) {
+	if min == 0 && max == 0 {
+		min, max = header, header
+	}
+	if max > MaxProtocolVersion {
+		max = MaxProtocolVersion
+	}
+	if min < MinProtocolVersion {
+		min = MinProtocolVersion
+	}
+	if min > max {
+		return 0, ErrNoCommonVersion
+	}
+	return max, nil
+}
+
+// VersionErrorText 生成版本不兼容时返回给对端的错误信息
+func VersionErrorText(min, max uint8) string {
+	return fmt.Sprintf("%v: peer supports %d-%d, server supports %d-%d",
+		ErrNoCommonVersion, min, max, MinProtocolVersion, MaxProtocolVersion)
+}
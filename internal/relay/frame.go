@@ -0,0 +1,136 @@
+// Package relay 实现独立的中继服务，为无法打洞直连的两个节点转发报文。
+//
+// 中继服务与协调服务器共享一个密钥。协调服务器介绍两个节点时为双方各签发一张票据，
+// 票据绑定持有者和对端的节点 ID，并附带只有持有者知道的票据密钥。节点以票据和
+// 票据密钥计算的认证码向中继服务绑定会话，中继服务把节点 A 到 B 的会话与 B 到 A
+// 的会话配对后在二者之间转发数据帧。数据帧的负载是节点之间端到端加密的消息，
+// 中继服务无法解密，每个会话的转发带宽受配额限制。
+//
+// 中继帧使用定长的帧头，多字节字段均为大端序：
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|    Version    |     Type      |           Reserved            |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                         Payload ...                           |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// 各类帧的负载：
+//
+//   - Bind：票据长度（2 字节）、票据、时间戳（8 字节，纳秒）和认证码，
+//     时间戳须大于同一会话此前的绑定，防止重放的绑定劫持会话
+//   - Bound：1 字节，对端已绑定时为 1
+//   - Data：不透明的数据，原样转发给对端
+//   - Error：1 字节错误码和错误原因
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Version 中继帧的版本
+	Version = 1
+
+	// 帧类型
+	FrameBind  = 1 // 节点绑定会话
+	FrameBound = 2 // 中继服务确认绑定
+	FrameData  = 3 // 转发的数据
+	FrameError = 4 // 中继服务拒绝请求
+
+	// HeaderSize 帧头长度
+	HeaderSize = 4
+	// MaxFrameSize 中继帧的最大长度
+	MaxFrameSize = 65535
+
+	// 错误码
+	ErrorUnauthorized = 1 // 票据或认证码无效，或节点已被吊销
+	ErrorNotBound     = 2 // 发送方没有绑定会话，须重新绑定
+	ErrorPeerAbsent   = 3 // 对端尚未绑定
+)
+
+// ErrMalformed 帧格式错误
+var ErrMalformed = errors.New("malformed relay frame")
+
+// Frame 一个中继帧
+type Frame struct {
+	Type    uint8
+	Payload []byte
+}
+
+// Encode 编码中继帧
+func (f *Frame) Encode() []byte {
+	data := make([]byte, HeaderSize, HeaderSize+len(f.Payload))
+	data[0] = Version
+	data[1] = f.Type
+	return append(data, f.Payload...)
+}
+
+// ParseFrame 解析中继帧，负载引用 data 的内存
+func ParseFrame(data []byte) (*Frame, error) {
+	if len(data) < HeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformed, len(data))
+	}
+	if data[0] != Version {
+		return nil, fmt.Errorf("%w: version %d", ErrMalformed, data[0])
+	}
+	return &Frame{Type: data[1], Payload: data[HeaderSize:]}, nil
+}
+
+// bindRequest Bind 帧的负载
+type bindRequest struct {
+	ticket    []byte
+	timestamp uint64
+	mac       []byte
+}
+
+func (b *bindRequest) marshal() []byte {
+	data := binary.BigEndian.AppendUint16(nil, uint16(len(b.ticket)))
+	data = append(data, b.ticket...)
+	data = binary.BigEndian.AppendUint64(data, b.timestamp)
+	return append(data, b.mac...)
+}
+
+func parseBindRequest(data []byte) (*bindRequest, error) {
+	if len(data) < 2 {
+		return nil, ErrMalformed
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) != n+8+macSize {
+		return nil, ErrMalformed
+	}
+	return &bindRequest{
+		ticket:    data[:n],
+		timestamp: binary.BigEndian.Uint64(data[n:]),
+		mac:       data[n+8:],
+	}, nil
+}
+
+// NewBindFrame 构造以票据 ticket 和票据密钥 key 绑定会话的帧，timestamp 须单调递增
+func NewBindFrame(ticket, key []byte, timestamp uint64) *Frame {
+	request := &bindRequest{ticket: ticket, timestamp: timestamp}
+	request.mac = bindMAC(key, ticket, timestamp)
+	return &Frame{Type: FrameBind, Payload: request.marshal()}
+}
+
+// NewErrorFrame 构造错误帧
+func NewErrorFrame(code uint8, reason string) *Frame {
+	return &Frame{Type: FrameError, Payload: append([]byte{code}, reason...)}
+}
+
+// Error 返回错误帧的错误码和原因
+func (f *Frame) Error() (uint8, string) {
+	if f.Type != FrameError || len(f.Payload) == 0 {
+		return 0, ""
+	}
+	return f.Payload[0], string(f.Payload[1:])
+}
+
+// Paired 返回 Bound 帧是否表示对端已绑定
+func (f *Frame) Paired() bool {
+	return f.Type == FrameBound && len(f.Payload) > 0 && f.Payload[0] == 1
+}
@@ -0,0 +1,31 @@
+package relay
+
+import "time"
+
+// quota 令牌桶，限制会话每秒转发的字节数
+type quota struct {
+	rate   float64 // 每秒补充的字节数，为 0 时不限制
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newQuota(rate, burst int, now time.Time) *quota {
+	// 突发量至少容纳一个最大的帧，否则大帧永远无法通过
+	b := float64(max(burst, MaxFrameSize))
+	return &quota{rate: float64(rate), burst: b, tokens: b, last: now}
+}
+
+// allow 判断 n 字节能否在 now 时刻转发，能则扣除相应的令牌
+func (q *quota) allow(n int, now time.Time) bool {
+	if q.rate == 0 {
+		return true
+	}
+	q.tokens = min(q.burst, q.tokens+now.Sub(q.last).Seconds()*q.rate)
+	q.last = now
+	if q.tokens < float64(n) {
+		return false
+	}
+	q.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+var testSecret = []byte("relay-secret-for-tests")
+
+func TestTicket(t *testing.T) {
+	expires := time.Now().Add(time.Minute).Truncate(time.Second)
+	data, key := IssueTicket(testSecret, Ticket{NodeID: "node-a", PeerID: "node-b", Expires: expires})
+
+	ticket, verified, err := VerifyTicket(testSecret, data, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.NodeID != "node-a" || ticket.PeerID != "node-b" || !ticket.Expires.Equal(expires) {
+		t.Fatalf("ticket = %+v", ticket)
+	}
+	if !bytes.Equal(verified, key) {
+		t.Fatal("ticket key mismatch")
+	}
+
+	if _, _, err := VerifyTicket([]byte("other secret"), data, time.Now()); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("wrong secret: %v", err)
+	}
+	if _, _, err := VerifyTicket(testSecret, data, expires.Add(time.Second)); !errors.Is(err, ErrTicketExpired) {
+		t.Fatalf("expired: %v", err)
+	}
+	for i := range data {
+		tampered := append([]byte{}, data...)
+		tampered[i] ^= 1
+		if _, _, err := VerifyTicket(testSecret, tampered, time.Now()); err == nil {
+			t.Fatalf("tampered byte %d accepted", i)
+		}
+	}
+	for n := 0; n < len(data); n++ {
+		if _, _, err := VerifyTicket(testSecret, data[:n], time.Now()); err == nil {
+			t.Fatalf("truncated ticket of %d bytes accepted", n)
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	frame, err := ParseFrame((&Frame{Type: FrameData, Payload: []byte("opaque")}).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != FrameData || string(frame.Payload) != "opaque" {
+		t.Fatalf("frame = %+v", frame)
+	}
+	if code, reason := NewErrorFrame(ErrorNotBound, "not bound").Error(); code != ErrorNotBound || reason != "not bound" {
+		t.Fatalf("error = %d %q", code, reason)
+	}
+	for _, data := range [][]byte{nil, {Version, FrameData, 0}, {2, FrameData, 0, 0}} {
+		if _, err := ParseFrame(data); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("ParseFrame(%x) = %v", data, err)
+		}
+	}
+	if _, err := parseBindRequest([]byte{0, 10, 1}); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("short bind request: %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Now()
+	q := newQuota(1000, 0, now)
+	sent := 0
+	for q.allow(1000, now) {
+		sent += 1000
+	}
+	if sent != MaxFrameSize/1000*1000 {
+		t.Fatalf("burst of %d bytes", sent)
+	}
+	if q.allow(1000, now.Add(400*time.Millisecond)) {
+		t.Fatal("quota refilled too fast")
+	}
+	if !q.allow(1000, now.Add(time.Second)) {
+		t.Fatal("quota not refilled")
+	}
+	if !newQuota(0, 0, now).allow(1<<30, now) {
+		t.Fatal("unlimited quota rejected a frame")
+	}
+}
+
+// testPeer 模拟经中继服务通信的节点
+type testPeer struct {
+	conn   *net.UDPConn
+	ticket []byte
+	key    []byte
+}
+
+func newTestRelay(t *testing.T, limits Limits) (*Server, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conn, testSecret, limits)
+	go s.Serve()
+	t.Cleanup(func() { conn.Close() })
+	return s, conn.LocalAddr().(*net.UDPAddr)
+}
+
+func newTestPeer(t *testing.T, node, peer string) *testPeer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ticket, key := IssueTicket(testSecret, Ticket{NodeID: node, PeerID: peer, Expires: time.Now().Add(time.Minute)})
+	return &testPeer{conn: conn, ticket: ticket, key: key}
+}
+
+func (p *testPeer) send(t *testing.T, frame *Frame, relay *net.UDPAddr) {
+	t.Helper()
+	if _, err := p.conn.WriteTo(frame.Encode(), relay); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive 读取下一个中继帧，超时返回 nil
+func (p *testPeer) receive(t *testing.T, timeout time.Duration) *Frame {
+	t.Helper()
+	buf := make([]byte, MaxFrameSize)
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := p.conn.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	frame, err := ParseFrame(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func (p *testPeer) bind(t *testing.T, relay *net.UDPAddr) *Frame {
+	t.Helper()
+	p.send(t, NewBindFrame(p.ticket, p.key, uint64(time.Now().UnixNano())), relay)
+	return p.receive(t, time.Second)
+}
+
+func TestServerForwards(t *testing.T) {
+	s, addr := newTestRelay(t, Limits{})
+	a := newTestPeer(t, "node-a", "node-b")
+	b := newTestPeer(t, "node-b", "node-a")
+
+	if frame := a.bind(t, addr); frame == nil || frame.Type != FrameBound || frame.Paired() {
+		t.Fatalf("first bind: %+v", frame)
+	}
+	a.send(t, &Frame{Type: FrameData, Payload: []byte("early")}, addr)
+	if frame := a.receive(t, time.Second); frame == nil || frame.Type != FrameError || frame.Payload[0] != ErrorPeerAbsent {
+		t.Fatalf("data before the peer bound: %+v", frame)
+	}
+	if frame := b.bind(t, addr); frame == nil || !frame.Paired() {
+		t.Fatalf("second bind: %+v", frame)
+	}
+
+	for _, dir := range []struct {
+		from, to *testPeer
+		payload  string
+	}{{a, b, "a to b"}, {b, a, "b to a"}} {
+		dir.from.send(t, &Frame{Type: FrameData, Payload: []byte(dir.payload)}, addr)
+		frame := dir.to.receive(t, time.Second)
+		if frame == nil || frame.Type != FrameData || string(frame.Payload) != dir.payload {
+			t.Fatalf("forwarded %+v, want %q", frame, dir.payload)
+		}
+	}
+	if stats := s.Stats(); stats.Sessions != 2 || stats.Pairs != 1 || stats.Forwarded != 12 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestServerAuthentication(t *testing.T) {
+	s, addr := newTestRelay(t, Limits{})
+	a := newTestPeer(t, "node-a", "node-b")
+
+	// 未绑定的地址不能发送数据
+	a.send(t, &Frame{Type: FrameData, Payload: []byte("x")}, addr)
+	if frame := a.receive(t, time.Second); frame == nil || frame.Payload[0] != ErrorNotBound {
+		t.Fatalf("unbound data: %+v", frame)
+	}
+
+	// 没有票据密钥无法绑定
+	a.send(t, NewBindFrame(a.ticket, []byte("guessed key"), 1), addr)
+	if frame := a.receive(t, time.Second); frame == nil || frame.Payload[0] != ErrorUnauthorized {
+		t.Fatalf("bind with a wrong key: %+v", frame)
+	}
+	forged, key := IssueTicket([]byte("not the secret"), Ticket{NodeID: "node-a", PeerID: "node-b", Expires: time.Now().Add(time.Minute)})
+	a.send(t, NewBindFrame(forged, key, 1), addr)
+	if frame := a.receive(t, time.Second); frame == nil || frame.Payload[0] != ErrorUnauthorized {
+		t.Fatalf("bind with a forged ticket: %+v", frame)
+	}
+
+	// 截获的绑定请求从其他地址重放时被忽略，会话不会被劫持
+	bind := NewBindFrame(a.ticket, a.key, uint64(time.Now().UnixNano()))
+	a.send(t, bind, addr)
+	if frame := a.receive(t, time.Second); frame == nil || frame.Type != FrameBound {
+		t.Fatalf("bind: %+v", frame)
+	}
+	attacker := newTestPeer(t, "node-x", "node-y")
+	attacker.send(t, bind, addr)
+	if frame := attacker.receive(t, 200*time.Millisecond); frame != nil {
+		t.Fatalf("replayed bind answered: %+v", frame)
+	}
+	s.mutex.Lock()
+	bound := s.sessions[pairKey{"node-a", "node-b"}].addr.String()
+	s.mutex.Unlock()
+	if bound != a.conn.LocalAddr().String() {
+		t.Fatalf("session moved to %s", bound)
+	}
+
+	// 被吊销的节点不能绑定
+	s.SetRevoked(func(nodeID string) bool { return nodeID == "node-a" })
+	if frame := a.bind(t, addr); frame == nil || frame.Payload[0] != ErrorUnauthorized {
+		t.Fatalf("revoked bind: %+v", frame)
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	s, addr := newTestRelay(t, Limits{Rate: 1000})
+	a := newTestPeer(t, "node-a", "node-b")
+	b := newTestPeer(t, "node-b", "node-a")
+	a.bind(t, addr)
+	b.bind(t, addr)
+
+	payload := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		a.send(t, &Frame{Type: FrameData, Payload: payload}, addr)
+	}
+	received := 0
+	for b.receive(t, 200*time.Millisecond) != nil {
+		received++
+	}
+	// 突发量之外只有发送期间补充的少量令牌
+	if received < MaxFrameSize/1000-5 || received > MaxFrameSize/1000+5 {
+		t.Fatalf("received %d frames", received)
+	}
+	if stats := s.Stats(); stats.Forwarded != uint64(received)*1000 || stats.Dropped == 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func FuzzServerHandle(f *testing.F) {
+	ticket, key := IssueTicket(testSecret, Ticket{NodeID: "node-a", PeerID: "node-b", Expires: time.Now().Add(time.Hour)})
+	f.Add(NewBindFrame(ticket, key, 1).Encode())
+	f.Add((&Frame{Type: FrameData, Payload: []byte("data")}).Encode())
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer conn.Close()
+	s := NewServer(conn, testSecret, Limits{})
+	from := conn.LocalAddr()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s.handle(data, from)
+	})
+}
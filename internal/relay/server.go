@@ -0,0 +1,236 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout 会话默认的空闲超时时间，节点的直连保活间隔须小于该值
+const DefaultIdleTimeout = time.Minute
+
+// Limits 中继服务对每个会话的限制
+type Limits struct {
+	Rate        int           // 每个会话每秒最多转发的字节数，0 表示不限制
+	Burst       int           // 每个会话可突发转发的字节数
+	IdleTimeout time.Duration // 会话超过该时间没有收到帧则删除
+}
+
+// Stats 中继服务的累计统计
+type Stats struct {
+	Sessions  int    // 当前绑定的会话数
+	Pairs     int    // 当前双方都已绑定的会话对数
+	Forwarded uint64 // 转发的字节数
+	Dropped   uint64 // 超出配额被丢弃的字节数
+}
+
+// pairKey 会话的标识：持有者和对端的节点 ID
+type pairKey struct {
+	node, peer string
+}
+
+// session 一个节点到其对端的中继会话
+type session struct {
+	key       pairKey
+	addr      net.Addr
+	timestamp uint64 // 最近一次绑定的时间戳
+	quota     *quota
+	lastSeen  time.Time
+}
+
+// Server 中继服务，只转发已绑定且已配对的会话之间的数据帧
+type Server struct {
+	conn    net.PacketConn
+	secret  []byte
+	limits  Limits
+	revoked func(nodeID string) bool
+
+	mutex     sync.Mutex
+	sessions  map[pairKey]*session
+	byAddr    map[string]*session
+	forwarded uint64
+	dropped   uint64
+}
+
+// NewServer 在 conn 上提供中继服务，secret 为与协调服务器共享的票据密钥
+func NewServer(conn net.PacketConn, secret []byte, limits Limits) *Server {
+	if limits.IdleTimeout <= 0 {
+		limits.IdleTimeout = DefaultIdleTimeout
+	}
+	return &Server{
+		conn:     conn,
+		secret:   secret,
+		limits:   limits,
+		sessions: make(map[pairKey]*session),
+		byAddr:   make(map[string]*session),
+	}
+}
+
+// SetRevoked 设置判断节点是否已被吊销的函数，被吊销的节点不能绑定会话，其会话不再转发
+func (s *Server) SetRevoked(revoked func(nodeID string) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.revoked = revoked
+}
+
+// Serve 读取并处理中继帧，直到 conn 被关闭
+func (s *Server) Serve() error {
+	done := make(chan struct{})
+	defer close(done)
+	go s.expireSessions(done)
+
+	buf := make([]byte, MaxFrameSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("读取中继帧失败: %v", err)
+			continue
+		}
+		s.handle(buf[:n], from)
+	}
+}
+
+// Stats 返回中继服务的统计
+func (s *Server) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := Stats{Sessions: len(s.sessions), Forwarded: s.forwarded, Dropped: s.dropped}
+	for key := range s.sessions {
+		if _, ok := s.sessions[pairKey{key.peer, key.node}]; ok {
+			stats.Pairs++
+		}
+	}
+	stats.Pairs /= 2
+	return stats
+}
+
+// handle 处理一个中继帧。帧来自不可信的网络，格式错误的帧被丢弃
+func (s *Server) handle(data []byte, from net.Addr) {
+	frame, err := ParseFrame(data)
+	if err != nil {
+		return
+	}
+	switch frame.Type {
+	case FrameBind:
+		s.bind(frame, from)
+	case FrameData:
+		s.forward(frame, from)
+	}
+}
+
+// bind 校验票据和认证码后绑定或更新会话，会话已存在时以时间戳更新的绑定为准，支持节点地址变化
+func (s *Server) bind(frame *Frame, from net.Addr) {
+	request, err := parseBindRequest(frame.Payload)
+	if err != nil {
+		return
+	}
+	ticket, ticketKey, err := VerifyTicket(s.secret, request.ticket, time.Now())
+	if err != nil || !hmac.Equal(request.mac, bindMAC(ticketKey, request.ticket, request.timestamp)) {
+		s.send(NewErrorFrame(ErrorUnauthorized, "invalid ticket"), from)
+		return
+	}
+
+	s.mutex.Lock()
+	if s.isRevoked(ticket.NodeID) || s.isRevoked(ticket.PeerID) {
+		s.mutex.Unlock()
+		s.send(NewErrorFrame(ErrorUnauthorized, "node revoked"), from)
+		return
+	}
+	now := time.Now()
+	id := pairKey{ticket.NodeID, ticket.PeerID}
+	sess := s.sessions[id]
+	switch {
+	case sess == nil:
+		sess = &session{key: id, quota: newQuota(s.limits.Rate, s.limits.Burst, now)}
+		s.sessions[id] = sess
+		log.Printf("节点 %s 绑定到节点 %s 的中继会话 (%s)", ticket.NodeID, ticket.PeerID, from)
+	case request.timestamp <= sess.timestamp:
+		// 重放或乱序到达的绑定
+		s.mutex.Unlock()
+		return
+	}
+	if sess.addr != nil && sess.addr.String() != from.String() {
+		delete(s.byAddr, sess.addr.String())
+	}
+	// 同一地址此前绑定的其他会话被取代
+	if previous := s.byAddr[from.String()]; previous != nil && previous != sess {
+		delete(s.sessions, previous.key)
+	}
+	sess.addr, sess.timestamp, sess.lastSeen = from, request.timestamp, now
+	s.byAddr[from.String()] = sess
+	_, paired := s.sessions[pairKey{ticket.PeerID, ticket.NodeID}]
+	s.mutex.Unlock()
+
+	bound := &Frame{Type: FrameBound, Payload: []byte{0}}
+	if paired {
+		bound.Payload[0] = 1
+	}
+	s.send(bound, from)
+}
+
+// forward 将已绑定会话发来的数据帧转发给对端，超出配额的帧被丢弃
+func (s *Server) forward(frame *Frame, from net.Addr) {
+	s.mutex.Lock()
+	sess := s.byAddr[from.String()]
+	if sess == nil {
+		s.mutex.Unlock()
+		s.send(NewErrorFrame(ErrorNotBound, "not bound"), from)
+		return
+	}
+	now := time.Now()
+	sess.lastSeen = now
+	peer := s.sessions[pairKey{sess.key.peer, sess.key.node}]
+	if peer == nil || s.isRevoked(sess.key.node) || s.isRevoked(sess.key.peer) {
+		s.mutex.Unlock()
+		s.send(NewErrorFrame(ErrorPeerAbsent, "peer not bound"), from)
+		return
+	}
+	if !sess.quota.allow(len(frame.Payload), now) {
+		s.dropped += uint64(len(frame.Payload))
+		s.mutex.Unlock()
+		return
+	}
+	s.forwarded += uint64(len(frame.Payload))
+	to := peer.addr
+	s.mutex.Unlock()
+
+	s.send(frame, to)
+}
+
+// isRevoked 判断节点是否已被吊销，调用方须持有 s.mutex
+func (s *Server) isRevoked(nodeID string) bool {
+	return s.revoked != nil && s.revoked(nodeID)
+}
+
+// expireSessions 定期删除空闲的会话
+func (s *Server) expireSessions(done <-chan struct{}) {
+	ticker := time.NewTicker(s.limits.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			for key, sess := range s.sessions {
+				if now.Sub(sess.lastSeen) > s.limits.IdleTimeout {
+					delete(s.sessions, key)
+					delete(s.byAddr, sess.addr.String())
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+func (s *Server) send(frame *Frame, to net.Addr) {
+	if _, err := s.conn.WriteTo(frame.Encode(), to); err != nil {
+		log.Printf("发送中继帧失败: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	// macSize 票据和绑定认证码的长度
+	macSize = 16
+	// MinSecretLength 共享密钥的最短长度
+	MinSecretLength = 16
+)
+
+var (
+	// ErrInvalidTicket 票据格式错误或认证失败
+	ErrInvalidTicket = errors.New("invalid relay ticket")
+	// ErrTicketExpired 票据已过期
+	ErrTicketExpired = errors.New("relay ticket expired")
+)
+
+// Ticket 协调服务器签发的中继票据，授权节点 NodeID 经中继服务与节点 PeerID 通信
+type Ticket struct {
+	NodeID  string
+	PeerID  string
+	Expires time.Time
+}
+
+// IssueTicket 以共享密钥 secret 签发票据，返回编码后的票据和持有者用于认证绑定请求的票据密钥。
+// 票据可以公开传输，票据密钥须经加密的会话交给持有者
+func IssueTicket(secret []byte, ticket Ticket) (data, key []byte) {
+	body := binary.BigEndian.AppendUint64(nil, uint64(ticket.Expires.Unix()))
+	body = append(body, byte(len(ticket.NodeID)))
+	body = append(body, ticket.NodeID...)
+	body = append(body, byte(len(ticket.PeerID)))
+	body = append(body, ticket.PeerID...)
+	data = append(body, ticketMAC(secret, body)...)
+	return data, ticketKey(secret, data)
+}
+
+// VerifyTicket 以共享密钥 secret 校验票据，返回票据内容和票据密钥
+func VerifyTicket(secret, data []byte, now time.Time) (*Ticket, []byte, error) {
+	if len(data) < 8+1+1+macSize {
+		return nil, nil, ErrInvalidTicket
+	}
+	body, mac := data[:len(data)-macSize], data[len(data)-macSize:]
+	if !hmac.Equal(mac, ticketMAC(secret, body)) {
+		return nil, nil, ErrInvalidTicket
+	}
+
+	ticket := &Ticket{Expires: time.Unix(int64(binary.BigEndian.Uint64(body)), 0)}
+	rest := body[8:]
+	for _, field := range []*string{&ticket.NodeID, &ticket.PeerID} {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, nil, ErrInvalidTicket
+		}
+		*field = string(rest[1 : 1+rest[0]])
+		rest = rest[1+rest[0]:]
+	}
+	if len(rest) != 0 || ticket.NodeID == "" || ticket.PeerID == "" {
+		return nil, nil, ErrInvalidTicket
+	}
+	if now.After(ticket.Expires) {
+		return nil, nil, ErrTicketExpired
+	}
+	return ticket, ticketKey(secret, data), nil
+}
+
+func ticketMAC(secret, body []byte) []byte {
+	return sum(secret, "sd-wan relay ticket", body)
+}
+
+func ticketKey(secret, ticket []byte) []byte {
+	return sum(secret, "sd-wan relay key", ticket)
+}
+
+func bindMAC(key, ticket []byte, timestamp uint64) []byte {
+	return sum(key, "sd-wan relay bind", binary.BigEndian.AppendUint64(append([]byte{}, ticket...), timestamp))
+}
+
+// sum 计算带用途标签的 HMAC-SHA256，截断为 macSize 字节
+func sum(key []byte, label string, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	h.Write(data)
+	return h.Sum(nil)[:macSize]
+}
@@ -0,0 +1,191 @@
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// initialRTO 首次重传前等待的时间，此后每次加倍
+const initialRTO = 250 * time.Millisecond
+
+// ErrTimeout 在超时时间内没有收到响应
+var ErrTimeout = errors.New("STUN request timed out")
+
+// ResponseError 服务器返回的错误响应
+type ResponseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("STUN error %d: %s", e.Code, e.Reason)
+}
+
+// Binding 一次 Binding 请求的结果
+type Binding struct {
+	Mapped *net.UDPAddr // 服务器观察到的请求来源地址，即本端的公网映射
+	Origin *net.UDPAddr // 响应的实际来源地址
+	Other  *net.UDPAddr // 服务器的备用地址，不支持 NAT 类型探测的服务器不携带
+}
+
+// Bind 经 conn 向 server 发送 Binding 请求，change 为 CHANGE-REQUEST 标志。
+// 请求按 RFC 8489 重传直到 timeout，其间 conn 上与本次请求无关的报文被丢弃，
+// 调用方须确保没有其他协程同时读取 conn
+func Bind(conn net.PacketConn, server *net.UDPAddr, change uint32, timeout time.Duration) (*Binding, error) {
+	request, err := NewBindingRequest(change)
+	if err != nil {
+		return nil, err
+	}
+	data := request.Encode()
+
+	deadline := time.Now().Add(timeout)
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	for rto := initialRTO; ; rto *= 2 {
+		if _, err := conn.WriteTo(data, server); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(rto)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			response, err := Parse(buf[:n])
+			if err != nil || response.TransactionID != request.TransactionID {
+				continue
+			}
+			return readBinding(response, from)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// readBinding 解析 Binding 响应
+func readBinding(response *Message, from net.Addr) (*Binding, error) {
+	switch response.Type {
+	case TypeBindingSuccess:
+	case TypeBindingError:
+		code, reason := response.Error()
+		return nil, &ResponseError{Code: code, Reason: reason}
+	default:
+		return nil, fmt.Errorf("%w: unexpected type %#04x", ErrMalformed, response.Type)
+	}
+
+	mapped, err := response.MappedAddress()
+	if err != nil {
+		return nil, err
+	}
+	other, err := response.Address(AttrOtherAddress)
+	if err != nil {
+		return nil, err
+	}
+	origin, _ := from.(*net.UDPAddr)
+	return &Binding{Mapped: mapped, Origin: origin, Other: other}, nil
+}
+
+// Result NAT 探测结果
+type Result struct {
+	Mapped   *net.UDPAddr // 本端的公网映射
+	NAT      NATType
+	PortStep int // 对称 NAT 先后两个映射的端口差，可用于预测后续映射的端口
+}
+
+// Classify 经 conn 探测本端的公网映射和 NAT 类型（RFC 3489 第 10.1 节的流程，
+// 使用 RFC 5780 的属性）。timeout 是单个请求的超时时间，
+// 过滤行为的测试以超时作为否定结果，NAT 按端口过滤时整个探测需要约两倍 timeout。
+// 服务器不支持 CHANGE-REQUEST 时只返回公网映射，NAT 类型为 NATUnknown
+func Classify(conn net.PacketConn, server *net.UDPAddr, timeout time.Duration) (*Result, error) {
+	first, err := Bind(conn, server, 0, timeout)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Mapped: first.Mapped}
+	if isLocal(first.Mapped, conn.LocalAddr()) {
+		result.NAT = NATOpen
+		return result, nil
+	}
+	if first.Other == nil {
+		return result, nil
+	}
+	// 响应器监听在通配地址上时无法告知具体的备用地址，以服务器地址代替
+	other := first.Other
+	if other.IP.IsUnspecified() {
+		other = &net.UDPAddr{IP: server.IP, Port: other.Port}
+	}
+
+	// 过滤行为的测试须在向备用地址发送请求之前进行，否则 NAT 会放行备用地址的响应。
+	// 从备用地址和端口收到响应说明 NAT 不过滤来源，是完全锥形 NAT
+	var unsupported *ResponseError
+	_, err = Bind(conn, server, ChangeIP|ChangePort, timeout)
+	switch {
+	case err == nil:
+		result.NAT = NATFullCone
+		return result, nil
+	case errors.Is(err, ErrTimeout), errors.As(err, &unsupported):
+	default:
+		return nil, err
+	}
+
+	// 从同一地址的另一端口收到响应说明 NAT 只按地址过滤
+	restricted := NATPortRestrictedCone
+	_, err = Bind(conn, server, ChangePort, timeout)
+	switch {
+	case err == nil:
+		restricted = NATRestrictedCone
+	case errors.As(err, &unsupported):
+		return result, nil
+	case !errors.Is(err, ErrTimeout):
+		return nil, err
+	}
+
+	// 发往备用地址时公网映射改变说明映射与目的地址有关，是对称 NAT
+	second, err := Bind(conn, other, 0, timeout)
+	if err != nil {
+		return result, nil
+	}
+	if second.Mapped.Port != first.Mapped.Port || !second.Mapped.IP.Equal(first.Mapped.IP) {
+		result.NAT = NATSymmetric
+		result.PortStep = second.Mapped.Port - first.Mapped.Port
+	} else {
+		result.NAT = restricted
+	}
+	return result, nil
+}
+
+// isLocal 判断公网映射是否就是本机套接字的地址，即本端没有经过 NAT
+func isLocal(mapped *net.UDPAddr, local net.Addr) bool {
+	udp, ok := local.(*net.UDPAddr)
+	if !ok || udp.Port != mapped.Port {
+		return false
+	}
+	if udp.IP.Equal(mapped.IP) {
+		return true
+	}
+	if !udp.IP.IsUnspecified() {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,423 @@
+// Package stun 实现 STUN（RFC 8489，兼容 RFC 5389）Binding 请求的客户端和响应器，
+// 以及基于 RFC 5780 CHANGE-REQUEST 的 NAT 类型探测。
+//
+// 消息编解码同时支持 TURN（RFC 8656）的方法和属性，以及长期凭据的 MESSAGE-INTEGRITY，
+// TURN 客户端见 network 包。不支持 TCP 传输。
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+// 消息头和属性的固定长度
+const (
+	headerSize          = 20
+	attributeHeaderSize = 4
+	transactionIDSize   = 12
+)
+
+// magicCookie 固定的魔数，RFC 3489 之前的实现在该位置放置事务 ID 的一部分
+const magicCookie = 0x2112A442
+
+// fingerprintXOR FINGERPRINT 属性的 CRC-32 与之异或的常量
+const fingerprintXOR = 0x5354554e
+
+// 消息类型
+const (
+	TypeBindingRequest uint16 = 0x0001
+	TypeBindingSuccess uint16 = 0x0101
+	TypeBindingError   uint16 = 0x0111
+)
+
+// TURN 方法（RFC 8656），消息类型为方法与类别之和
+const (
+	MethodAllocate         uint16 = 0x0003
+	MethodRefresh          uint16 = 0x0004
+	MethodSend             uint16 = 0x0006
+	MethodData             uint16 = 0x0007
+	MethodCreatePermission uint16 = 0x0008
+	MethodChannelBind      uint16 = 0x0009
+)
+
+// 消息类别
+const (
+	ClassRequest    uint16 = 0x0000
+	ClassIndication uint16 = 0x0010
+	ClassSuccess    uint16 = 0x0100
+	ClassError      uint16 = 0x0110
+
+	classMask uint16 = 0x0110
+)
+
+// Method 返回消息类型中的方法
+func Method(msgType uint16) uint16 {
+	return msgType &^ classMask
+}
+
+// Class 返回消息类型中的类别
+func Class(msgType uint16) uint16 {
+	return msgType & classMask
+}
+
+// 属性类型，不大于 maxRequiredAttribute 的属性接收方必须理解
+const (
+	AttrMappedAddress      uint16 = 0x0001
+	AttrChangeRequest      uint16 = 0x0003 // RFC 5780
+	AttrUsername           uint16 = 0x0006
+	AttrMessageIntegrity   uint16 = 0x0008
+	AttrErrorCode          uint16 = 0x0009
+	AttrUnknownAttributes  uint16 = 0x000A
+	AttrChannelNumber      uint16 = 0x000C // RFC 8656
+	AttrLifetime           uint16 = 0x000D // RFC 8656
+	AttrXORPeerAddress     uint16 = 0x0012 // RFC 8656
+	AttrData               uint16 = 0x0013 // RFC 8656
+	AttrRealm              uint16 = 0x0014
+	AttrNonce              uint16 = 0x0015
+	AttrXORRelayedAddress  uint16 = 0x0016 // RFC 8656
+	AttrRequestedTransport uint16 = 0x0019 // RFC 8656
+	AttrXORMappedAddress   uint16 = 0x0020
+	AttrSoftware           uint16 = 0x8022
+	AttrFingerprint        uint16 = 0x8028
+	AttrResponseOrigin     uint16 = 0x802B // RFC 5780
+	AttrOtherAddress       uint16 = 0x802C // RFC 5780
+
+	maxRequiredAttribute uint16 = 0x7FFF
+)
+
+// CHANGE-REQUEST 标志
+const (
+	ChangePort uint32 = 0x02
+	ChangeIP   uint32 = 0x04
+)
+
+// 错误码
+const (
+	CodeBadRequest                   = 400
+	CodeUnauthorized                 = 401
+	CodeForbidden                    = 403
+	CodeUnknownAttribute             = 420
+	CodeAllocationMismatch           = 437 // RFC 8656
+	CodeStaleNonce                   = 438
+	CodeUnsupportedTransportProtocol = 442 // RFC 8656
+	CodeAllocationQuotaReached       = 486 // RFC 8656
+	CodeInsufficientCapacity         = 508 // RFC 8656
+)
+
+// integritySize MESSAGE-INTEGRITY 属性值（HMAC-SHA1）的长度
+const integritySize = sha1.Size
+
+// 属性值的固定长度
+const (
+	errorCodeHeaderSize    = 4
+	addressHeaderSize      = 4
+	changeRequestValueSize = 4
+	addressFamilyIPv4      = 0x01
+	addressFamilyIPv6      = 0x02
+)
+
+var (
+	// ErrNotSTUN 报文不是 STUN 消息
+	ErrNotSTUN = errors.New("not a STUN message")
+	// ErrMalformed STUN 消息格式错误
+	ErrMalformed = errors.New("malformed STUN message")
+	// ErrFingerprint FINGERPRINT 属性校验失败
+	ErrFingerprint = errors.New("STUN fingerprint mismatch")
+	// ErrIntegrity 缺少 MESSAGE-INTEGRITY 属性或校验失败
+	ErrIntegrity = errors.New("STUN message integrity check failed")
+)
+
+// Attribute 一个 STUN 属性
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message 一个 STUN 消息
+type Message struct {
+	Type          uint16
+	TransactionID [transactionIDSize]byte
+	Attributes    []Attribute
+
+	// 解析出的 MESSAGE-INTEGRITY 及其覆盖的内容，用于 CheckIntegrity
+	integrity []byte
+	covered   []byte
+}
+
+// IsMessage 判断报文是否可能是 STUN 消息：首字节为 0 或 1（方法编号小于 0x80 的消息）且带有魔数。
+// 本项目消息头的首字节是不小于 2 的协议版本号，两种报文可以在同一端口上区分
+func IsMessage(data []byte) bool {
+	return len(data) >= headerSize &&
+		data[0] < 2 &&
+		binary.BigEndian.Uint32(data[4:8]) == magicCookie
+}
+
+// NewMessage 创建带随机事务 ID 的消息
+func NewMessage(msgType uint16) (*Message, error) {
+	m := &Message{Type: msgType}
+	if _, err := rand.Read(m.TransactionID[:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewBindingRequest 创建带随机事务 ID 的 Binding 请求，change 为 CHANGE-REQUEST 标志，0 表示不携带
+func NewBindingRequest(change uint32) (*Message, error) {
+	m, err := NewMessage(TypeBindingRequest)
+	if err != nil {
+		return nil, err
+	}
+	if change != 0 {
+		m.Add(AttrChangeRequest, binary.BigEndian.AppendUint32(nil, change))
+	}
+	return m, nil
+}
+
+// Add 追加一个属性
+func (m *Message) Add(attrType uint16, value []byte) {
+	m.Attributes = append(m.Attributes, Attribute{Type: attrType, Value: value})
+}
+
+// AddAddress 追加一个地址属性，XOR-MAPPED-ADDRESS 等 XOR 地址属性按 RFC 8489 与魔数和事务 ID 异或
+func (m *Message) AddAddress(attrType uint16, addr *net.UDPAddr) {
+	m.Add(attrType, m.encodeAddress(attrType, addr))
+}
+
+// Get 返回第一个指定类型的属性值，不存在时返回 nil
+func (m *Message) Get(attrType uint16) []byte {
+	for _, attr := range m.Attributes {
+		if attr.Type == attrType {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+// Address 解析地址属性，不存在时返回 nil
+func (m *Message) Address(attrType uint16) (*net.UDPAddr, error) {
+	value := m.Get(attrType)
+	if value == nil {
+		return nil, nil
+	}
+	return m.decodeAddress(attrType, value)
+}
+
+// MappedAddress 返回服务器观察到的请求来源地址，优先使用 XOR-MAPPED-ADDRESS
+func (m *Message) MappedAddress() (*net.UDPAddr, error) {
+	addr, err := m.Address(AttrXORMappedAddress)
+	if addr != nil || err != nil {
+		return addr, err
+	}
+	addr, err = m.Address(AttrMappedAddress)
+	if addr == nil && err == nil {
+		return nil, fmt.Errorf("%w: no mapped address", ErrMalformed)
+	}
+	return addr, err
+}
+
+// ChangeRequest 返回 CHANGE-REQUEST 标志，未携带时返回 0
+func (m *Message) ChangeRequest() (uint32, error) {
+	value := m.Get(AttrChangeRequest)
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != changeRequestValueSize {
+		return 0, fmt.Errorf("%w: CHANGE-REQUEST length %d", ErrMalformed, len(value))
+	}
+	return binary.BigEndian.Uint32(value), nil
+}
+
+// AddError 追加 ERROR-CODE 属性
+func (m *Message) AddError(code int, reason string) {
+	value := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	m.Add(AttrErrorCode, append(value, reason...))
+}
+
+// Error 返回错误响应中的错误码和原因，未携带 ERROR-CODE 时返回 0
+func (m *Message) Error() (int, string) {
+	value := m.Get(AttrErrorCode)
+	if len(value) < errorCodeHeaderSize {
+		return 0, ""
+	}
+	return int(value[2]&0x07)*100 + int(value[3]), string(value[errorCodeHeaderSize:])
+}
+
+// Encode 编码消息，并在末尾附加 FINGERPRINT 属性
+func (m *Message) Encode() []byte {
+	return m.EncodeWithIntegrity(nil)
+}
+
+// EncodeWithIntegrity 编码消息，key 不为空时以其附加 MESSAGE-INTEGRITY 属性，最后附加 FINGERPRINT 属性
+func (m *Message) EncodeWithIntegrity(key []byte) []byte {
+	buf := make([]byte, headerSize, headerSize+64)
+	binary.BigEndian.PutUint16(buf[0:2], m.Type)
+	binary.BigEndian.PutUint32(buf[4:8], magicCookie)
+	copy(buf[8:headerSize], m.TransactionID[:])
+	for _, attr := range m.Attributes {
+		buf = appendAttribute(buf, attr.Type, attr.Value)
+	}
+
+	// MESSAGE-INTEGRITY 覆盖此前的全部内容，消息长度需先包含 MESSAGE-INTEGRITY 自身
+	if key != nil {
+		binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-headerSize+attributeHeaderSize+integritySize))
+		buf = appendAttribute(buf, AttrMessageIntegrity, integrity(key, buf))
+	}
+
+	// FINGERPRINT 覆盖此前的全部内容，消息长度需先包含 FINGERPRINT 自身
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-headerSize+attributeHeaderSize+4))
+	fingerprint := crc32.ChecksumIEEE(buf) ^ fingerprintXOR
+	return appendAttribute(buf, AttrFingerprint, binary.BigEndian.AppendUint32(nil, fingerprint))
+}
+
+// CheckIntegrity 以 key 校验解析出的消息的 MESSAGE-INTEGRITY 属性
+func (m *Message) CheckIntegrity(key []byte) error {
+	if m.integrity == nil || !hmac.Equal(m.integrity, integrity(key, m.covered)) {
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// LongTermKey 返回长期凭据的 MESSAGE-INTEGRITY 密钥 MD5(username:realm:password)。
+// 不对用户名和密码做 OpaqueString 处理，只含 ASCII 字符的凭据不受影响
+func LongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+func integrity(key, covered []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(covered)
+	return mac.Sum(nil)
+}
+
+func appendAttribute(buf []byte, attrType uint16, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, attrType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	// 属性值按 4 字节对齐
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// Parse 解析 STUN 消息。报文来自不可信的网络，格式错误时返回错误；
+// 携带 FINGERPRINT 时校验其值，FINGERPRINT 之后的属性被忽略；
+// MESSAGE-INTEGRITY 由调用方以 CheckIntegrity 校验，其后除 FINGERPRINT 外的属性被忽略
+func Parse(data []byte) (*Message, error) {
+	if !IsMessage(data) {
+		return nil, ErrNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || headerSize+length > len(data) {
+		return nil, fmt.Errorf("%w: length %d", ErrMalformed, length)
+	}
+	data = data[:headerSize+length]
+
+	m := &Message{Type: binary.BigEndian.Uint16(data[0:2])}
+	copy(m.TransactionID[:], data[8:headerSize])
+
+	for offset := headerSize; offset < len(data); {
+		if len(data)-offset < attributeHeaderSize {
+			return nil, fmt.Errorf("%w: truncated attribute", ErrMalformed)
+		}
+		attrType := binary.BigEndian.Uint16(data[offset:])
+		size := int(binary.BigEndian.Uint16(data[offset+2:]))
+		start := offset + attributeHeaderSize
+		if size > len(data)-start {
+			return nil, fmt.Errorf("%w: attribute %#04x length %d", ErrMalformed, attrType, size)
+		}
+		value := data[start : start+size]
+
+		if attrType == AttrFingerprint {
+			if size != 4 {
+				return nil, fmt.Errorf("%w: FINGERPRINT length %d", ErrMalformed, size)
+			}
+			// FINGERPRINT 计算时消息长度截止到 FINGERPRINT 属性的末尾
+			covered := append([]byte{}, data[:offset]...)
+			binary.BigEndian.PutUint16(covered[2:4], uint16(start+size-headerSize))
+			if crc32.ChecksumIEEE(covered)^fingerprintXOR != binary.BigEndian.Uint32(value) {
+				return nil, ErrFingerprint
+			}
+			return m, nil
+		}
+		if attrType == AttrMessageIntegrity && m.integrity == nil {
+			if size != integritySize {
+				return nil, fmt.Errorf("%w: MESSAGE-INTEGRITY length %d", ErrMalformed, size)
+			}
+			// MESSAGE-INTEGRITY 计算时消息长度截止到 MESSAGE-INTEGRITY 属性的末尾
+			m.covered = append([]byte{}, data[:offset]...)
+			binary.BigEndian.PutUint16(m.covered[2:4], uint16(start+size-headerSize))
+			m.integrity = append([]byte{}, value...)
+		} else if m.integrity == nil {
+			m.Add(attrType, append([]byte{}, value...))
+		}
+		offset = start + (size+3)&^3
+	}
+	return m, nil
+}
+
+// encodeAddress 编码地址属性的值
+func (m *Message) encodeAddress(attrType uint16, addr *net.UDPAddr) []byte {
+	family, ip := byte(addressFamilyIPv4), addr.IP.To4()
+	if ip == nil {
+		family, ip = addressFamilyIPv6, addr.IP.To16()
+	}
+	value := make([]byte, addressHeaderSize+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	copy(value[addressHeaderSize:], ip)
+	if isXORAddress(attrType) {
+		m.xorAddress(value)
+	}
+	return value
+}
+
+// decodeAddress 解析地址属性的值
+func (m *Message) decodeAddress(attrType uint16, value []byte) (*net.UDPAddr, error) {
+	if len(value) < addressHeaderSize {
+		return nil, fmt.Errorf("%w: address attribute %#04x", ErrMalformed, attrType)
+	}
+	size := net.IPv4len
+	if value[1] == addressFamilyIPv6 {
+		size = net.IPv6len
+	} else if value[1] != addressFamilyIPv4 {
+		return nil, fmt.Errorf("%w: address family %d", ErrMalformed, value[1])
+	}
+	if len(value) != addressHeaderSize+size {
+		return nil, fmt.Errorf("%w: address attribute %#04x length %d", ErrMalformed, attrType, len(value))
+	}
+
+	value = append([]byte{}, value...)
+	if isXORAddress(attrType) {
+		m.xorAddress(value)
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(value[addressHeaderSize:]),
+		Port: int(binary.BigEndian.Uint16(value[2:4])),
+	}, nil
+}
+
+// isXORAddress 判断地址属性是否与魔数和事务 ID 异或编码
+func isXORAddress(attrType uint16) bool {
+	return attrType == AttrXORMappedAddress || attrType == AttrXORPeerAddress || attrType == AttrXORRelayedAddress
+}
+
+// xorAddress 将地址属性的端口与魔数高 16 位异或，地址与魔数和事务 ID 异或
+func (m *Message) xorAddress(value []byte) {
+	var key [4 + transactionIDSize]byte
+	binary.BigEndian.PutUint32(key[:4], magicCookie)
+	copy(key[4:], m.TransactionID[:])
+	value[2] ^= key[0]
+	value[3] ^= key[1]
+	for i := addressHeaderSize; i < len(value); i++ {
+		value[i] ^= key[i-addressHeaderSize]
+	}
+}
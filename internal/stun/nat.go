@@ -0,0 +1,51 @@
+package stun
+
+import "fmt"
+
+// NATType NAT 类型，按 RFC 3489 的分类
+type NATType uint8
+
+const (
+	// NATUnknown 未探测或服务器不支持探测
+	NATUnknown NATType = iota
+	// NATOpen 没有经过 NAT，本机地址即公网地址
+	NATOpen
+	// NATFullCone 映射与目的地址无关，接受任何外部地址的报文
+	NATFullCone
+	// NATRestrictedCone 映射与目的地址无关，只接受本端发送过的外部 IP 的报文
+	NATRestrictedCone
+	// NATPortRestrictedCone 映射与目的地址无关，只接受本端发送过的外部 IP 和端口的报文
+	NATPortRestrictedCone
+	// NATSymmetric 每个目的地址使用不同的映射
+	NATSymmetric
+)
+
+// String 返回 NAT 类型的名称
+func (t NATType) String() string {
+	switch t {
+	case NATUnknown:
+		return "unknown"
+	case NATOpen:
+		return "open"
+	case NATFullCone:
+		return "full-cone"
+	case NATRestrictedCone:
+		return "restricted-cone"
+	case NATPortRestrictedCone:
+		return "port-restricted-cone"
+	case NATSymmetric:
+		return "symmetric"
+	default:
+		return fmt.Sprintf("nat(%d)", uint8(t))
+	}
+}
+
+// CanPunch 判断两个 NAT 类型之后的节点能否打洞直连，未知类型按可以尝试处理。
+// 对称 NAT 向对端发送时使用新的映射，对端只知道其发往服务器的映射：
+// 对端按端口过滤或同为对称 NAT 时，双方的探测都会被对方的 NAT 丢弃
+func CanPunch(a, b NATType) bool {
+	strict := func(t NATType) bool {
+		return t == NATPortRestrictedCone || t == NATSymmetric
+	}
+	return !(a == NATSymmetric && strict(b) || b == NATSymmetric && strict(a))
+}
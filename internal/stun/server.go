@@ -0,0 +1,192 @@
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// software 响应中 SOFTWARE 属性的值
+const software = "sd-wan"
+
+// Responder STUN 响应器，应答 Binding 请求并按 CHANGE-REQUEST 从备用地址或端口回复。
+//
+// 主套接字通常与服务器的其他协议共用，由调用方读取后交给 Handle；
+// 备用地址和备用端口上的套接字由响应器创建并自行读取。
+// 只配置了备用端口时客户端无法区分完全锥形和受限锥形 NAT，
+// 只配置了备用地址时无法区分受限锥形和端口受限锥形 NAT。
+type Responder struct {
+	conns [2][2]net.PacketConn // 按 [是否为备用地址][是否为备用端口] 索引，[0][0] 为主套接字
+	wg    sync.WaitGroup
+}
+
+// NewResponder 在主套接字之外监听备用地址 alternateIP 和备用端口 alternatePort，
+// 二者均可为空，此时响应器只能告知客户端其公网地址
+func NewResponder(primary net.PacketConn, alternateIP net.IP, alternatePort int) (*Responder, error) {
+	r := &Responder{}
+	r.conns[0][0] = primary
+	local := primary.LocalAddr().(*net.UDPAddr)
+
+	listen := func(ip net.IP, port int) (net.PacketConn, error) {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	}
+	var err error
+	if alternatePort != 0 {
+		if r.conns[0][1], err = listen(local.IP, alternatePort); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if alternateIP != nil {
+		if r.conns[1][0], err = listen(alternateIP, local.Port); err != nil {
+			r.Close()
+			return nil, err
+		}
+		if alternatePort != 0 {
+			if r.conns[1][1], err = listen(alternateIP, alternatePort); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+	}
+
+	for i := range r.conns {
+		for j, conn := range r.conns[i] {
+			if conn != nil && (i != 0 || j != 0) {
+				r.wg.Add(1)
+				go r.serve(i, j)
+			}
+		}
+	}
+	return r, nil
+}
+
+// OtherAddress 返回响应中告知客户端的备用地址，没有备用套接字时返回 nil
+func (r *Responder) OtherAddress() *net.UDPAddr {
+	if other := r.other(0, 0); other != nil {
+		return other.LocalAddr().(*net.UDPAddr)
+	}
+	return nil
+}
+
+// Handle 处理主套接字收到的报文，报文不是 STUN 消息时返回 false
+func (r *Responder) Handle(data []byte, from net.Addr) bool {
+	if !IsMessage(data) {
+		return false
+	}
+	r.handle(0, 0, data, from)
+	return true
+}
+
+// Close 关闭响应器创建的套接字，主套接字由调用方关闭
+func (r *Responder) Close() error {
+	for i := range r.conns {
+		for j, conn := range r.conns[i] {
+			if conn != nil && (i != 0 || j != 0) {
+				conn.Close()
+			}
+		}
+	}
+	r.wg.Wait()
+	return nil
+}
+
+// serve 读取备用套接字收到的请求
+func (r *Responder) serve(i, j int) {
+	defer r.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := r.conns[i][j].ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if IsMessage(buf[:n]) {
+			r.handle(i, j, buf[:n], from)
+		}
+	}
+}
+
+// other 返回与套接字 [i][j] 相对的备用套接字：优先选择地址和端口都不同的，
+// 其次是端口不同的，最后是地址不同的
+func (r *Responder) other(i, j int) net.PacketConn {
+	for _, c := range [][2]int{{1 - i, 1 - j}, {i, 1 - j}, {1 - i, j}} {
+		if conn := r.conns[c[0]][c[1]]; conn != nil {
+			return conn
+		}
+	}
+	return nil
+}
+
+// handle 应答套接字 [i][j] 收到的请求。报文来自不可信的网络，格式错误的请求被丢弃
+func (r *Responder) handle(i, j int, data []byte, from net.Addr) {
+	request, err := Parse(data)
+	if err != nil || request.Type != TypeBindingRequest {
+		return
+	}
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	conn := r.conns[i][j]
+
+	// 不理解的必选属性按 RFC 8489 以 420 拒绝
+	var unknown []byte
+	for _, attr := range request.Attributes {
+		if attr.Type <= maxRequiredAttribute && attr.Type != AttrChangeRequest {
+			unknown = binary.BigEndian.AppendUint16(unknown, attr.Type)
+		}
+	}
+	if unknown != nil {
+		response := r.errorResponse(request, CodeUnknownAttribute, "Unknown Attribute")
+		response.Add(AttrUnknownAttributes, unknown)
+		r.send(conn, response, addr)
+		return
+	}
+
+	change, err := request.ChangeRequest()
+	if err != nil {
+		r.send(conn, r.errorResponse(request, CodeBadRequest, "Bad Request"), addr)
+		return
+	}
+	if change&ChangeIP != 0 {
+		i = 1 - i
+	}
+	if change&ChangePort != 0 {
+		j = 1 - j
+	}
+	// 无法从请求的地址回复时与不支持 CHANGE-REQUEST 的服务器一样以 420 拒绝
+	origin := r.conns[i][j]
+	if origin == nil {
+		response := r.errorResponse(request, CodeUnknownAttribute, "Cannot Change Address")
+		response.Add(AttrUnknownAttributes, binary.BigEndian.AppendUint16(nil, AttrChangeRequest))
+		r.send(conn, response, addr)
+		return
+	}
+
+	response := &Message{Type: TypeBindingSuccess, TransactionID: request.TransactionID}
+	response.AddAddress(AttrXORMappedAddress, addr)
+	response.AddAddress(AttrResponseOrigin, origin.LocalAddr().(*net.UDPAddr))
+	if other := r.other(i, j); other != nil {
+		response.AddAddress(AttrOtherAddress, other.LocalAddr().(*net.UDPAddr))
+	}
+	response.Add(AttrSoftware, []byte(software))
+	r.send(origin, response, addr)
+}
+
+func (r *Responder) errorResponse(request *Message, code int, reason string) *Message {
+	response := &Message{Type: TypeBindingError, TransactionID: request.TransactionID}
+	response.AddError(code, reason)
+	response.Add(AttrSoftware, []byte(software))
+	return response
+}
+
+func (r *Responder) send(conn net.PacketConn, response *Message, addr *net.UDPAddr) {
+	if _, err := conn.WriteTo(response.Encode(), addr); err != nil {
+		log.Printf("发送 STUN 响应失败: %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package stun
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fenghuilee/sd-wan/internal/network/nattest"
+)
+
+// RFC 5769 第 2.2 节的 IPv4 响应示例，去掉了 MESSAGE-INTEGRITY 和 FINGERPRINT
+const sampleResponse = "0101001c2112a442b7e7a701bc34d686fa87dfae" +
+	"8022000b7465737420766563746f7220" +
+	"002000080001a147e112a643"
+
+func TestParseSample(t *testing.T) {
+	data, _ := hex.DecodeString(sampleResponse)
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != TypeBindingSuccess {
+		t.Fatalf("type = %#04x", m.Type)
+	}
+	mapped, err := m.MappedAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped.String() != "192.0.2.1:32853" {
+		t.Fatalf("mapped = %v", mapped)
+	}
+	if got := string(m.Get(AttrSoftware)); got != "test vector" {
+		t.Fatalf("software = %q", got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	m, err := NewBindingRequest(ChangeIP | ChangePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820}
+	m.AddAddress(AttrXORMappedAddress, v6)
+	m.AddAddress(AttrOtherAddress, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 3479})
+	m.AddError(CodeUnknownAttribute, "odd")
+
+	data := m.Encode()
+	if !IsMessage(data) {
+		t.Fatal("encoded message not recognised")
+	}
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.TransactionID != m.TransactionID {
+		t.Fatal("transaction ID changed")
+	}
+	if change, _ := parsed.ChangeRequest(); change != ChangeIP|ChangePort {
+		t.Fatalf("change = %#x", change)
+	}
+	if mapped, _ := parsed.MappedAddress(); mapped.String() != v6.String() {
+		t.Fatalf("mapped = %v", mapped)
+	}
+	if other, _ := parsed.Address(AttrOtherAddress); other.String() != "198.51.100.7:3479" {
+		t.Fatalf("other = %v", other)
+	}
+	if code, reason := parsed.Error(); code != CodeUnknownAttribute || reason != "odd" {
+		t.Fatalf("error = %d %q", code, reason)
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err := Parse(data); !errors.Is(err, ErrFingerprint) {
+		t.Fatalf("corrupted fingerprint: %v", err)
+	}
+
+	// 本项目消息头以协议版本开头，不会被误认为 STUN 消息
+	header := make([]byte, headerSize)
+	header[0] = 3
+	copy(header[4:], data[4:8])
+	if IsMessage(header) {
+		t.Fatal("protocol header recognised as STUN")
+	}
+}
+
+// RFC 5769 第 2.2 节完整的 IPv4 响应示例，以短期凭据密码计算 MESSAGE-INTEGRITY
+const sampleIntegrityResponse = "0101003c2112a442b7e7a701bc34d686fa87dfae" +
+	"8022000b7465737420766563746f7220" +
+	"002000080001a147e112a643" +
+	"000800142b91f599fd9e90c38c7489f92af9ba53f06be7d7" +
+	"80280004c07d4c96"
+
+func TestIntegrity(t *testing.T) {
+	data, _ := hex.DecodeString(sampleIntegrityResponse)
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckIntegrity([]byte("VOkJxbRl1RmTxUk/WvJxBt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckIntegrity([]byte("wrong password")); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("wrong key: %v", err)
+	}
+
+	// 长期凭据密钥，MESSAGE-INTEGRITY 之后追加的属性不被接受
+	key := LongTermKey("user", "example.org", "pass")
+	request, err := NewMessage(MethodAllocate | ClassRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Add(AttrUsername, []byte("user"))
+	request.AddAddress(AttrXORPeerAddress, &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 4000})
+	parsed, err := Parse(request.EncodeWithIntegrity(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.CheckIntegrity(key); err != nil {
+		t.Fatal(err)
+	}
+	if Method(parsed.Type) != MethodAllocate || Class(parsed.Type) != ClassRequest {
+		t.Fatalf("type = %#04x", parsed.Type)
+	}
+	if peer, _ := parsed.Address(AttrXORPeerAddress); peer.String() != "203.0.113.9:4000" {
+		t.Fatalf("peer = %v", peer)
+	}
+	if plain, _ := Parse(request.Encode()); plain.CheckIntegrity(key) == nil {
+		t.Fatal("message without MESSAGE-INTEGRITY accepted")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	sample, _ := hex.DecodeString(sampleResponse)
+	f.Add(sample)
+	request, _ := NewBindingRequest(ChangePort)
+	f.Add(request.Encode())
+	f.Add(request.EncodeWithIntegrity(LongTermKey("user", "realm", "pass")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Parse(data)
+		if err != nil {
+			return
+		}
+		m.MappedAddress()
+		m.Address(AttrOtherAddress)
+		m.ChangeRequest()
+		m.Error()
+		m.CheckIntegrity([]byte("key"))
+		if _, err := Parse(m.Encode()); err != nil {
+			t.Fatalf("re-encoded message rejected: %v", err)
+		}
+	})
+}
+
+// freePort 返回回环地址上一个空闲的 UDP 端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// newTestResponder 在回环地址上启动响应器，full 为 true 时同时监听备用地址 127.0.0.2 和备用端口
+func newTestResponder(t *testing.T, full bool) *net.UDPAddr {
+	t.Helper()
+	primary, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alternateIP net.IP
+	alternatePort := 0
+	if full {
+		alternateIP, alternatePort = net.IPv4(127, 0, 0, 2), freePort(t)
+	}
+	r, err := NewResponder(primary, alternateIP, alternatePort)
+	if err != nil {
+		primary.Close()
+		t.Skipf("alternate loopback address unavailable: %v", err)
+	}
+	t.Cleanup(func() {
+		primary.Close()
+		r.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := primary.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			r.Handle(buf[:n], from)
+		}
+	}()
+	return primary.LocalAddr().(*net.UDPAddr)
+}
+
+func TestClassify(t *testing.T) {
+	server := newTestResponder(t, true)
+	tests := []struct {
+		behavior nattest.Behavior
+		want     NATType
+	}{
+		{nattest.FullCone, NATFullCone},
+		{nattest.RestrictedCone, NATRestrictedCone},
+		{nattest.PortRestrictedCone, NATPortRestrictedCone},
+		{nattest.Symmetric, NATSymmetric},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.behavior.String(), func(t *testing.T) {
+			t.Parallel()
+			conn, err := nattest.New(tt.behavior).Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			result, err := Classify(conn, server, 300*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.NAT != tt.want {
+				t.Fatalf("NAT = %v, want %v", result.NAT, tt.want)
+			}
+			if public := conn.PublicAddr(server); result.Mapped.String() != public.String() {
+				t.Fatalf("mapped = %v, want %v", result.Mapped, public)
+			}
+		})
+	}
+
+	t.Run("open", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		result, err := Classify(conn, server, 300*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.NAT != NATOpen || result.Mapped.String() != conn.LocalAddr().String() {
+			t.Fatalf("result = %v %v", result.NAT, result.Mapped)
+		}
+	})
+}
+
+func TestClassifyWithoutAlternate(t *testing.T) {
+	server := newTestResponder(t, false)
+	conn, err := nattest.New(nattest.Symmetric).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	result, err := Classify(conn, server, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NAT != NATUnknown || result.Mapped == nil {
+		t.Fatalf("result = %v %v", result.NAT, result.Mapped)
+	}
+
+	var respErr *ResponseError
+	if _, err := Bind(conn, server, ChangePort, 300*time.Millisecond); !errors.As(err, &respErr) || respErr.Code != CodeUnknownAttribute {
+		t.Fatalf("change request without alternate: %v", err)
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 无关的报文被丢弃
+	silent.WriteTo([]byte("noise"), conn.LocalAddr())
+	if _, err := Bind(conn, silent.LocalAddr().(*net.UDPAddr), 0, 100*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCanPunch(t *testing.T) {
+	types := []NATType{NATUnknown, NATOpen, NATFullCone, NATRestrictedCone, NATPortRestrictedCone, NATSymmetric}
+	for _, a := range types {
+		for _, b := range types {
+			hard := a == NATSymmetric && (b == NATSymmetric || b == NATPortRestrictedCone) ||
+				b == NATSymmetric && (a == NATSymmetric || a == NATPortRestrictedCone)
+			if CanPunch(a, b) == hard {
+				t.Errorf("CanPunch(%v, %v) = %v", a, b, !hard)
+			}
+		}
+	}
+	if got := NATSymmetric.String(); got != "symmetric" {
+		t.Errorf("name = %q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// 支持的加密算法
+const (
+	AlgorithmAES256GCM         = "aes-256-gcm"
+	AlgorithmChaCha20Poly1305  = "chacha20-poly1305"
+	AlgorithmXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// ErrNoCommonAlgorithm 双方没有共同支持的加密算法
+var ErrNoCommonAlgorithm = errors.New("no common encryption algorithm")
+
+// supportedAlgorithms 本实现支持的全部算法
+var supportedAlgorithms = []string{
+	AlgorithmAES256GCM,
+	AlgorithmChaCha20Poly1305,
+	AlgorithmXChaCha20Poly1305,
+}
+
+// newAEAD 根据算法名称创建 AEAD
+func newAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case AlgorithmAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AlgorithmChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case AlgorithmXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, errors.New("unsupported encryption algorithm")
+	}
+}
+
+// IsSupportedAlgorithm 判断算法是否受支持
+func IsSupportedAlgorithm(algorithm string) bool {
+	for _, a := range supportedAlgorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportedAlgorithms 返回本实现支持的全部算法
+func SupportedAlgorithms() []string {
+	return append([]string(nil), supportedAlgorithms...)
+}
+
+// HasAESHardware 判断当前 CPU 是否支持 AES 硬件指令
+func HasAESHardware() bool {
+	return cpu.X86.HasAES || cpu.ARM64.HasAES || cpu.S390X.HasAES
+}
+
+// PreferredAlgorithms 生成握手时提供给对端的算法列表，按优先级排序。
+// 配置的算法排在首位；启用硬件加速且 CPU 支持 AES 指令时优先 AES-GCM，
+// 否则优先 ChaCha20 系列，适合 OpenWrt 等没有 AES-NI 的设备。
+func PreferredAlgorithms(configured string, hardwareAcceleration bool) []string {
+	order := []string{AlgorithmChaCha20Poly1305, AlgorithmXChaCha20Poly1305, AlgorithmAES256GCM}
+	if hardwareAcceleration && HasAESHardware() {
+		order = []string{AlgorithmAES256GCM, AlgorithmChaCha20Poly1305, AlgorithmXChaCha20Poly1305}
+	}
+
+	algorithms := make([]string, 0, len(order)+1)
+	if IsSupportedAlgorithm(configured) {
+		algorithms = append(algorithms, configured)
+	}
+	for _, a := range order {
+		if a != configured {
+			algorithms = append(algorithms, a)
+		}
+	}
+	return algorithms
+}
+
+// NegotiateAlgorithm 从对端提供的算法列表中选出双方都允许的算法。
+// 按对端给出的优先级选择第一个同时出现在 allowed 中的算法。
+func NegotiateAlgorithm(offered, allowed []string) (string, error) {
+	for _, o := range offered {
+		if !IsSupportedAlgorithm(o) {
+			continue
+		}
+		for _, a := range allowed {
+			if o == a {
+				return o, nil
+			}
+		}
+	}
+	return "", ErrNoCommonAlgorithm
+}
@@ -1,97 +1,83 @@
 package crypto
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"io"
 )
 
 // Crypto 加密管理器
 type Crypto struct {
-	enabled bool
-	key     []byte
-	aead    cipher.AEAD
+	enabled   bool
+	key       []byte
+	algorithm string
+	aead      cipher.AEAD
 }
 
-// NewCrypto 创建新的加密管理器
+// NewCrypto 创建新的加密管理器，key 必须是握手派生出的 32 字节会话密钥
 func NewCrypto(enabled bool, key []byte, algorithm string) (*Crypto, error) {
 	if !enabled {
 		return &Crypto{enabled: false}, nil
 	}
 
-	// 使用 SHA-256 生成固定长度的密钥
-	hash := sha256.Sum256(key)
-	key = hash[:]
-
-	var block cipher.Block
-	var err error
-
-	switch algorithm {
-	case "aes-256-gcm":
-		block, err = aes.NewCipher(key)
-		if err != nil {
-			return nil, err
-		}
-	case "chacha20-poly1305":
-		// 使用 ChaCha20-Poly1305
-		block, err = aes.NewCipher(key)
-		if err != nil {
-			return nil, err
-		}
-	default:
-		return nil, errors.New("unsupported encryption algorithm")
+	if len(key) != 32 {
+		return nil, errors.New("invalid session key size")
 	}
 
-	aead, err := cipher.NewGCM(block)
+	aead, err := newAEAD(algorithm, key)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Crypto{
-		enabled: true,
-		key:     key,
-		aead:    aead,
+		enabled:   true,
+		key:       key,
+		algorithm: algorithm,
+		aead:      aead,
 	}, nil
 }
 
-// Encrypt 加密数据
-func (c *Crypto) Encrypt(plaintext []byte) ([]byte, error) {
+// nonce 由 64 位计数器构造随机数，高位补零。
+// 每个方向的会话密钥独立，计数器单调递增即可保证随机数不重复。
+func (c *Crypto) nonce(counter uint64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// Seal 使用计数器随机数加密数据，additionalData 一并认证但不加密
+func (c *Crypto) Seal(counter uint64, plaintext, additionalData []byte) []byte {
 	if !c.enabled {
-		return plaintext, nil
+		return plaintext
 	}
+	return c.aead.Seal(nil, c.nonce(counter), plaintext, additionalData)
+}
 
-	nonce := make([]byte, c.aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+// SealTo 与 Seal 相同，但把密文追加到 dst 之后，避免额外拷贝
+func (c *Crypto) SealTo(dst []byte, counter uint64, plaintext, additionalData []byte) []byte {
+	if !c.enabled {
+		return append(dst, plaintext...)
 	}
-
-	ciphertext := c.aead.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return c.aead.Seal(dst, c.nonce(counter), plaintext, additionalData)
 }
 
-// Decrypt 解密数据
-func (c *Crypto) Decrypt(ciphertext []byte) ([]byte, error) {
+// Open 使用计数器随机数解密并认证数据
+func (c *Crypto) Open(counter uint64, ciphertext, additionalData []byte) ([]byte, error) {
 	if !c.enabled {
 		return ciphertext, nil
 	}
+	return c.aead.Open(nil, c.nonce(counter), ciphertext, additionalData)
+}
 
-	if len(ciphertext) < c.aead.NonceSize() {
-		return nil, errors.New("ciphertext too short")
-	}
-
-	nonce := ciphertext[:c.aead.NonceSize()]
-	ciphertext = ciphertext[c.aead.NonceSize():]
-
-	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, err
+// Overhead 返回加密后增加的认证标签长度
+func (c *Crypto) Overhead() int {
+	if !c.enabled {
+		return 0
 	}
-
-	return plaintext, nil
+	return c.aead.Overhead()
 }
 
 // GenerateKey 生成随机密钥
@@ -107,3 +93,8 @@ func GenerateKey(size int) (string, error) {
 func (c *Crypto) IsEnabled() bool {
 	return c.enabled
 }
+
+// Algorithm 返回当前使用的加密算法
+func (c *Crypto) Algorithm() string {
+	return c.algorithm
+}
@@ -0,0 +1,154 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeySize Curve25519 密钥长度
+const KeySize = curve25519.ScalarSize
+
+// KeyPair Curve25519 静态或临时密钥对
+type KeyPair struct {
+	Private [KeySize]byte
+	Public  [KeySize]byte
+}
+
+// GenerateKeyPair 生成新的 Curve25519 密钥对
+func GenerateKeyPair() (*KeyPair, error) {
+	var private [KeySize]byte
+	if _, err := io.ReadFull(rand.Reader, private[:]); err != nil {
+		return nil, err
+	}
+	return NewKeyPair(private[:])
+}
+
+// NewKeyPair 根据私钥构建密钥对
+func NewKeyPair(private []byte) (*KeyPair, error) {
+	if len(private) != KeySize {
+		return nil, errors.New("invalid private key size")
+	}
+
+	kp := &KeyPair{}
+	copy(kp.Private[:], private)
+	// 按 RFC 7748 对私钥进行钳位
+	kp.Private[0] &= 248
+	kp.Private[31] &= 127
+	kp.Private[31] |= 64
+
+	public, err := curve25519.X25519(kp.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(kp.Public[:], public)
+	return kp, nil
+}
+
+// ParseKeyPair 从 Base64 编码的私钥解析密钥对
+func ParseKeyPair(encoded string) (*KeyPair, error) {
+	private, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("解析私钥失败: %v", err)
+	}
+	return NewKeyPair(private)
+}
+
+// ParsePublicKey 解析 Base64 编码的公钥
+func ParsePublicKey(encoded string) ([KeySize]byte, error) {
+	var public [KeySize]byte
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return public, fmt.Errorf("解析公钥失败: %v", err)
+	}
+	if len(raw) != KeySize {
+		return public, errors.New("invalid public key size")
+	}
+	copy(public[:], raw)
+	return public, nil
+}
+
+// EncodeKey 将密钥编码为 Base64 字符串
+func EncodeKey(key [KeySize]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// LoadOrCreateKeyPair 从文件加载 Base64 编码的私钥，文件不存在时生成新密钥对并以 0600 权限保存。
+// created 表示本次调用生成了新密钥。
+func LoadOrCreateKeyPair(path string) (kp *KeyPair, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		kp, err = ParseKeyPair(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, false, fmt.Errorf("读取密钥文件 %s 失败: %v", path, err)
+		}
+		return kp, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	kp, err = GenerateKeyPair()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := writeKeyFile(path, EncodeKey(kp.Private)+"\n"); err != nil {
+		return nil, false, fmt.Errorf("保存密钥文件 %s 失败: %v", path, err)
+	}
+	return kp, true, nil
+}
+
+// writeKeyFile 先写入临时文件再重命名，避免中断时留下不完整的密钥文件
+func writeKeyFile(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// NodeID 根据静态公钥派生节点 ID，同一密钥对始终得到相同的 ID
+func NodeID(public [KeySize]byte) string {
+	sum := blake2s.Sum256(public[:])
+	return "node-" + hex.EncodeToString(sum[:8])
+}
+
+// dh 执行 X25519 密钥交换
+func dh(private, public [KeySize]byte) ([KeySize]byte, error) {
+	var shared [KeySize]byte
+	out, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return shared, err
+	}
+	copy(shared[:], out)
+	return shared, nil
+}
@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadOrCreateKeyPair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "identity.key")
+
+	first, created, err := LoadOrCreateKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected a new key to be created")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode %v, want 0600", info.Mode().Perm())
+	}
+
+	second, created, err := LoadOrCreateKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || *second != *first {
+		t.Fatal("reloaded key differs from the stored key")
+	}
+	if NodeID(first.Public) != NodeID(second.Public) {
+		t.Fatal("node ID changed across loads")
+	}
+}
+
+func TestLoadOrCreateKeyPairRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	if err := os.WriteFile(path, []byte("not base64!"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadOrCreateKeyPair(path); err == nil {
+		t.Fatal("corrupt key file accepted")
+	}
+}
+
+func TestNodeID(t *testing.T) {
+	a, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := NodeID(a.Public)
+	if !strings.HasPrefix(id, "node-") || len(id) != len("node-")+16 {
+		t.Fatalf("unexpected node ID format %q", id)
+	}
+	if id == NodeID(b.Public) {
+		t.Fatal("different keys produced the same node ID")
+	}
+}
@@ -0,0 +1,327 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// 握手采用 Noise_IK_25519_ChaChaPoly_BLAKE2s 模式：
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
+//
+// 发起方（客户端）需要预先知道响应方（服务器）的静态公钥，
+// 一个往返即可完成双向认证并派生出独立的收发会话密钥。
+const (
+	noiseProtocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+	noisePrologue     = "sd-wan"
+	noiseTagSize      = chacha20poly1305.Overhead
+)
+
+var (
+	// ErrHandshakeState 握手消息顺序错误
+	ErrHandshakeState = errors.New("handshake message out of order")
+	// ErrHandshakeShort 握手消息长度不足
+	ErrHandshakeShort = errors.New("handshake message too short")
+)
+
+// symmetricState Noise 对称状态
+type symmetricState struct {
+	ck     [blake2s.Size]byte
+	h      [blake2s.Size]byte
+	k      [chacha20poly1305.KeySize]byte
+	hasKey bool
+	n      uint64
+}
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func hmacBlake2s(key []byte, data ...[]byte) [blake2s.Size]byte {
+	var out [blake2s.Size]byte
+	mac := hmac.New(newBlake2s, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// hkdf Noise 规范中的 HKDF，返回两个输出
+func hkdf(ck, ikm []byte) ([blake2s.Size]byte, [blake2s.Size]byte) {
+	temp := hmacBlake2s(ck, ikm)
+	out1 := hmacBlake2s(temp[:], []byte{0x01})
+	out2 := hmacBlake2s(temp[:], out1[:], []byte{0x02})
+	return out1, out2
+}
+
+func (s *symmetricState) init() {
+	// 协议名长度超过哈希长度时取其哈希值
+	s.h = blake2s.Sum256([]byte(noiseProtocolName))
+	s.ck = s.h
+	s.mixHash([]byte(noisePrologue))
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := newBlake2s()
+	h.Write(s.h[:])
+	h.Write(data)
+	copy(s.h[:], h.Sum(nil))
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	ck, k := hkdf(s.ck[:], ikm)
+	s.ck = ck
+	s.k = k
+	s.hasKey = true
+	s.n = 0
+}
+
+func (s *symmetricState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], s.n)
+	return nonce
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	if !s.hasKey {
+		s.mixHash(plaintext)
+		return plaintext, nil
+	}
+
+	aead, err := chacha20poly1305.New(s.k[:])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, s.nonce(), plaintext, s.h[:])
+	s.n++
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if !s.hasKey {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+
+	aead, err := chacha20poly1305.New(s.k[:])
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, s.nonce(), ciphertext, s.h[:])
+	if err != nil {
+		return nil, err
+	}
+	s.n++
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// Handshake Noise IK 握手状态机
+type Handshake struct {
+	ss        symmetricState
+	initiator bool
+	static    *KeyPair
+	ephemeral *KeyPair
+	rs        [KeySize]byte
+	re        [KeySize]byte
+	step      int
+}
+
+// NewInitiatorHandshake 创建握手发起方，remoteStatic 为响应方静态公钥
+func NewInitiatorHandshake(static *KeyPair, remoteStatic [KeySize]byte) *Handshake {
+	h := &Handshake{
+		initiator: true,
+		static:    static,
+		rs:        remoteStatic,
+	}
+	h.ss.init()
+	h.ss.mixHash(remoteStatic[:])
+	return h
+}
+
+// NewResponderHandshake 创建握手响应方
+func NewResponderHandshake(static *KeyPair) *Handshake {
+	h := &Handshake{
+		initiator: false,
+		static:    static,
+	}
+	h.ss.init()
+	h.ss.mixHash(static.Public[:])
+	return h
+}
+
+// WriteMessage 生成下一条握手消息，payload 在握手密钥保护下传输
+func (h *Handshake) WriteMessage(payload []byte) ([]byte, error) {
+	var err error
+	switch {
+	case h.initiator && h.step == 0:
+		// -> e, es, s, ss
+		if h.ephemeral, err = GenerateKeyPair(); err != nil {
+			return nil, err
+		}
+		out := append([]byte{}, h.ephemeral.Public[:]...)
+		h.ss.mixHash(h.ephemeral.Public[:])
+		if err := h.mixDH(h.ephemeral.Private, h.rs); err != nil {
+			return nil, err
+		}
+		encStatic, err := h.ss.encryptAndHash(h.static.Public[:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, encStatic...)
+		if err := h.mixDH(h.static.Private, h.rs); err != nil {
+			return nil, err
+		}
+		encPayload, err := h.ss.encryptAndHash(payload)
+		if err != nil {
+			return nil, err
+		}
+		h.step++
+		return append(out, encPayload...), nil
+
+	case !h.initiator && h.step == 1:
+		// <- e, ee, se
+		if h.ephemeral, err = GenerateKeyPair(); err != nil {
+			return nil, err
+		}
+		out := append([]byte{}, h.ephemeral.Public[:]...)
+		h.ss.mixHash(h.ephemeral.Public[:])
+		if err := h.mixDH(h.ephemeral.Private, h.re); err != nil {
+			return nil, err
+		}
+		if err := h.mixDH(h.ephemeral.Private, h.rs); err != nil {
+			return nil, err
+		}
+		encPayload, err := h.ss.encryptAndHash(payload)
+		if err != nil {
+			return nil, err
+		}
+		h.step++
+		return append(out, encPayload...), nil
+	}
+
+	return nil, ErrHandshakeState
+}
+
+// ReadMessage 处理对端握手消息并返回其中的 payload。
+// 处理失败时握手状态保持不变，伪造的消息不会破坏正在进行的握手。
+func (h *Handshake) ReadMessage(msg []byte) ([]byte, error) {
+	saved := *h
+	payload, err := h.readMessage(msg)
+	if err != nil {
+		*h = saved
+	}
+	return payload, err
+}
+
+func (h *Handshake) readMessage(msg []byte) ([]byte, error) {
+	switch {
+	case !h.initiator && h.step == 0:
+		// -> e, es, s, ss
+		if len(msg) < KeySize+KeySize+noiseTagSize+noiseTagSize {
+			return nil, ErrHandshakeShort
+		}
+		copy(h.re[:], msg[:KeySize])
+		h.ss.mixHash(h.re[:])
+		if err := h.mixDH(h.static.Private, h.re); err != nil {
+			return nil, err
+		}
+		rs, err := h.ss.decryptAndHash(msg[KeySize : KeySize+KeySize+noiseTagSize])
+		if err != nil {
+			return nil, err
+		}
+		copy(h.rs[:], rs)
+		if err := h.mixDH(h.static.Private, h.rs); err != nil {
+			return nil, err
+		}
+		payload, err := h.ss.decryptAndHash(msg[KeySize+KeySize+noiseTagSize:])
+		if err != nil {
+			return nil, err
+		}
+		h.step++
+		return payload, nil
+
+	case h.initiator && h.step == 1:
+		// <- e, ee, se
+		if len(msg) < KeySize+noiseTagSize {
+			return nil, ErrHandshakeShort
+		}
+		copy(h.re[:], msg[:KeySize])
+		h.ss.mixHash(h.re[:])
+		if err := h.mixDH(h.ephemeral.Private, h.re); err != nil {
+			return nil, err
+		}
+		if err := h.mixDH(h.static.Private, h.re); err != nil {
+			return nil, err
+		}
+		payload, err := h.ss.decryptAndHash(msg[KeySize:])
+		if err != nil {
+			return nil, err
+		}
+		h.step++
+		return payload, nil
+	}
+
+	return nil, ErrHandshakeState
+}
+
+// mixDH 执行一次 DH 并混入链密钥
+func (h *Handshake) mixDH(private, public [KeySize]byte) error {
+	shared, err := dh(private, public)
+	if err != nil {
+		return err
+	}
+	h.ss.mixKey(shared[:])
+	return nil
+}
+
+// RemoteStatic 返回对端静态公钥，响应方在读取第一条消息后可用
+func (h *Handshake) RemoteStatic() [KeySize]byte {
+	return h.rs
+}
+
+// Complete 判断握手是否已完成
+func (h *Handshake) Complete() bool {
+	return h.step >= 2
+}
+
+// Split 派生会话密钥，发起方与响应方的收发方向互换
+func (h *Handshake) Split(algorithm string) (*Session, error) {
+	if !h.Complete() {
+		return nil, ErrHandshakeState
+	}
+
+	k1, k2 := hkdf(h.ss.ck[:], nil)
+	sendKey, recvKey := k1, k2
+	if !h.initiator {
+		sendKey, recvKey = k2, k1
+	}
+
+	send, err := NewCrypto(true, sendKey[:], algorithm)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := NewCrypto(true, recvKey[:], algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		Send:         send,
+		Recv:         recv,
+		RemoteStatic: h.rs,
+		created:      time.Now(),
+	}, nil
+}
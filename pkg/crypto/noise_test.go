@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newHandshakePair 创建一对尚未交换消息的发起方与响应方
+func newHandshakePair(tb testing.TB) (initiator, responder *Handshake) {
+	tb.Helper()
+	clientStatic, err := GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serverStatic, err := GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewInitiatorHandshake(clientStatic, serverStatic.Public), NewResponderHandshake(serverStatic)
+}
+
+func TestHandshakeSurvivesForgedMessages(t *testing.T) {
+	initiator, responder := newHandshakePair(t)
+	initiation, err := initiator.WriteMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 伪造的第一条消息不能破坏响应方状态
+	forged := append([]byte{}, initiation...)
+	forged[len(forged)-1] ^= 1
+	if _, err := responder.ReadMessage(forged); err == nil {
+		t.Fatal("forged initiation accepted")
+	}
+	payload, err := responder.ReadMessage(initiation)
+	if err != nil {
+		t.Fatalf("read initiation: %v", err)
+	}
+	if string(payload) != "hello" {
+		t.Fatalf("payload %q", payload)
+	}
+
+	response, err := responder.WriteMessage([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 伪造或截断的响应不能破坏发起方状态
+	for _, bad := range [][]byte{nil, response[:KeySize], append(bytes.Repeat([]byte{9}, KeySize), response[KeySize:]...)} {
+		if _, err := initiator.ReadMessage(bad); err == nil {
+			t.Fatal("forged response accepted")
+		}
+	}
+	payload, err = initiator.ReadMessage(response)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if string(payload) != "world" {
+		t.Fatalf("payload %q", payload)
+	}
+
+	send, err := initiator.Split(AlgorithmAES256GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv, err := responder.Split(AlgorithmAES256GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := send.Send.Seal(0, []byte("data"), nil)
+	if opened, err := recv.Recv.Open(0, sealed, nil); err != nil || string(opened) != "data" {
+		t.Fatalf("session keys mismatch: %v", err)
+	}
+}
+
+// FuzzHandshakeReadMessage 任意握手消息都不能通过认证，且不会破坏进行中的握手
+func FuzzHandshakeReadMessage(f *testing.F) {
+	initiator, _ := newHandshakePair(f)
+	initiation, err := initiator.WriteMessage([]byte("payload"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(initiation)
+	f.Add(initiation[:KeySize])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if bytes.Equal(data, initiation) {
+			return
+		}
+
+		// 响应方读取伪造的第一条消息
+		_, fresh := newHandshakePair(t)
+		if _, err := fresh.ReadMessage(data); err == nil {
+			t.Fatal("forged initiation accepted")
+		}
+
+		// 发起方读取伪造的响应后仍能完成真实握手
+		client, server := newHandshakePair(t)
+		first, err := client.WriteMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.ReadMessage(first); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.ReadMessage(data); err == nil {
+			t.Fatal("forged response accepted")
+		}
+		second, err := server.WriteMessage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.ReadMessage(second); err != nil {
+			t.Fatalf("genuine response rejected after forged one: %v", err)
+		}
+	})
+}
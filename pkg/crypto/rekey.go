@@ -0,0 +1,150 @@
+package crypto
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 默认密钥轮换参数，单个密钥最长使用约 2 分钟或 2^60 条消息
+const (
+	DefaultRekeyAfterTime     = 120 * time.Second
+	DefaultRekeyAfterMessages = uint64(1) << 60
+)
+
+// ErrSessionExpired 当前会话密钥已超过使用期限，必须等待重新握手
+var ErrSessionExpired = errors.New("session keys expired")
+
+// RekeyPolicy 会话密钥轮换策略
+type RekeyPolicy struct {
+	RekeyAfterTime     time.Duration // 超过该时长发起重新握手
+	RekeyAfterMessages uint64        // 发送消息数超过该值发起重新握手
+}
+
+// DefaultRekeyPolicy 返回默认的密钥轮换策略
+func DefaultRekeyPolicy() RekeyPolicy {
+	return RekeyPolicy{
+		RekeyAfterTime:     DefaultRekeyAfterTime,
+		RekeyAfterMessages: DefaultRekeyAfterMessages,
+	}
+}
+
+// RejectAfterTime 密钥的最长使用时间，留出重新握手的宽限期
+func (p RekeyPolicy) RejectAfterTime() time.Duration {
+	return p.RekeyAfterTime * 3 / 2
+}
+
+// expired 判断会话密钥是否已不可用
+func (p RekeyPolicy) expired(s *Session) bool {
+	return s.Age() > p.RejectAfterTime() || s.Sent() >= RejectAfterMessages
+}
+
+// KeyRing 与一个对端之间的会话密钥环。
+// 轮换期间同时保留三代密钥：current 用于发送，previous 用于接收仍在途中的旧报文，
+// next 是响应方新协商、尚未被对端确认的密钥，收到用它加密的第一条消息后才切换发送。
+type KeyRing struct {
+	mutex    sync.RWMutex
+	policy   RekeyPolicy
+	current  *Session
+	previous *Session
+	next     *Session
+}
+
+// NewKeyRing 创建新的会话密钥环
+func NewKeyRing(policy RekeyPolicy) *KeyRing {
+	return &KeyRing{policy: policy}
+}
+
+// Install 立即启用新密钥发送，发起方收到握手响应后调用
+func (r *KeyRing) Install(s *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.current != nil {
+		r.previous = r.current
+	}
+	r.current = s
+	r.next = nil
+}
+
+// Stage 暂存新密钥，响应方完成握手后调用，待对端使用新密钥后再切换
+func (r *KeyRing) Stage(s *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.current == nil {
+		r.current = s
+		return
+	}
+	r.next = s
+}
+
+// Confirm 收到用暂存密钥加密的消息，说明对端已切换，本端随之切换
+func (r *KeyRing) Confirm(s *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.next != s {
+		return
+	}
+	r.previous = r.current
+	r.current = r.next
+	r.next = nil
+}
+
+// Current 返回当前发送使用的密钥
+func (r *KeyRing) Current() *Session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.current
+}
+
+// SendSession 返回可用于发送的密钥，超过使用期限时返回错误
+func (r *KeyRing) SendSession() (*Session, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.current == nil || r.policy.expired(r.current) {
+		return nil, ErrSessionExpired
+	}
+	return r.current, nil
+}
+
+// Candidates 返回代数匹配且仍在有效期内的接收密钥，暂存密钥优先
+func (r *KeyRing) Candidates(epoch uint8) []*Session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	candidates := make([]*Session, 0, 3)
+	for _, s := range []*Session{r.next, r.current, r.previous} {
+		if s != nil && s.Epoch == epoch && !r.policy.expired(s) {
+			candidates = append(candidates, s)
+		}
+	}
+	return candidates
+}
+
+// NeedsRekey 判断当前密钥是否达到轮换条件
+func (r *KeyRing) NeedsRekey() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.current == nil {
+		return true
+	}
+	return r.current.Age() >= r.policy.RekeyAfterTime || r.current.Sent() >= r.policy.RekeyAfterMessages
+}
+
+// NextEpoch 返回下一代密钥的代数
+func (r *KeyRing) NextEpoch() uint8 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.current == nil {
+		return 0
+	}
+	return r.current.Epoch + 1
+}
+
+// RemoteStatic 返回对端静态公钥
+func (r *KeyRing) RemoteStatic() ([KeySize]byte, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.current == nil {
+		return [KeySize]byte{}, false
+	}
+	return r.current.RemoteStatic, true
+}
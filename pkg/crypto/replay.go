@@ -0,0 +1,110 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// 滑动窗口参数，参考 RFC 6479 与 WireGuard 的实现：
+// 位图按 64 位分块组成环形缓冲区，窗口前移时只需清零越过的块。
+const (
+	replayBlockBits  = 64
+	replayRingBlocks = 32
+	// ReplayWindowSize 可接受的乱序范围（计数器个数）
+	ReplayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+)
+
+var (
+	// ErrReplay 重放检测失败
+	ErrReplay = errors.New("replay detected")
+	// ErrReplayDuplicate 计数器已经接收过
+	ErrReplayDuplicate = fmt.Errorf("%w: duplicate counter", ErrReplay)
+	// ErrReplayTooOld 计数器落在窗口之外
+	ErrReplayTooOld = fmt.Errorf("%w: counter too old", ErrReplay)
+)
+
+// ReplayWindow 接收方向的防重放滑动窗口
+type ReplayWindow struct {
+	mutex      sync.Mutex
+	bitmap     [replayRingBlocks]uint64
+	last       uint64
+	started    bool
+	duplicates uint64
+	tooOld     uint64
+}
+
+// check 在持有锁的情况下检查计数器
+func (w *ReplayWindow) check(counter uint64) error {
+	if !w.started || counter > w.last {
+		return nil
+	}
+	if w.last-counter >= ReplayWindowSize {
+		return ErrReplayTooOld
+	}
+	block := (counter / replayBlockBits) % replayRingBlocks
+	if w.bitmap[block]&(1<<(counter%replayBlockBits)) != 0 {
+		return ErrReplayDuplicate
+	}
+	return nil
+}
+
+// count 统计被丢弃的报文
+func (w *ReplayWindow) count(err error) {
+	switch err {
+	case ErrReplayDuplicate:
+		w.duplicates++
+	case ErrReplayTooOld:
+		w.tooOld++
+	}
+}
+
+// Check 在解密前快速判断计数器是否可能被接受，不修改窗口
+func (w *ReplayWindow) Check(counter uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	err := w.check(counter)
+	w.count(err)
+	return err
+}
+
+// Update 在报文通过认证后记录计数器。
+// 并发接收同一计数器时只有第一个调用成功，因此需要再次检查。
+func (w *ReplayWindow) Update(counter uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.check(counter); err != nil {
+		w.count(err)
+		return err
+	}
+
+	if !w.started || counter > w.last {
+		current := w.last / replayBlockBits
+		next := counter / replayBlockBits
+		if !w.started {
+			current = next
+			w.bitmap = [replayRingBlocks]uint64{}
+		}
+
+		// 清零窗口前移时越过的块
+		diff := next - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(current+i)%replayRingBlocks] = 0
+		}
+		w.last = counter
+		w.started = true
+	}
+
+	w.bitmap[(counter/replayBlockBits)%replayRingBlocks] |= 1 << (counter % replayBlockBits)
+	return nil
+}
+
+// Stats 返回因重复和过旧而丢弃的报文数
+func (w *ReplayWindow) Stats() (duplicates, tooOld uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.duplicates, w.tooOld
+}
@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// replayModel 防重放窗口的参考实现：记录全部已接收的计数器
+type replayModel struct {
+	seen    map[uint64]bool
+	last    uint64
+	started bool
+}
+
+func (m *replayModel) update(counter uint64) error {
+	if m.started && counter <= m.last {
+		if m.last-counter >= ReplayWindowSize {
+			return ErrReplayTooOld
+		}
+		if m.seen[counter] {
+			return ErrReplayDuplicate
+		}
+	}
+	m.seen[counter] = true
+	if !m.started || counter > m.last {
+		m.last = counter
+		m.started = true
+	}
+	return nil
+}
+
+// checkAgainstModel 依次接收计数器，窗口的判定必须与参考实现一致
+func checkAgainstModel(t *testing.T, counters []uint64) {
+	t.Helper()
+	var window ReplayWindow
+	model := &replayModel{seen: make(map[uint64]bool)}
+	for i, counter := range counters {
+		checkErr := window.Check(counter)
+		got := window.Update(counter)
+		want := model.update(counter)
+		if !errors.Is(got, want) || (got == nil) != (want == nil) {
+			t.Fatalf("step %d counter %d: got %v, want %v", i, counter, got, want)
+		}
+		if checkErr != nil && got == nil {
+			t.Fatalf("step %d counter %d: Check rejected (%v) but Update accepted", i, counter, checkErr)
+		}
+	}
+}
+
+func TestReplayWindowMatchesModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		var counters []uint64
+		var base uint64
+		for i := 0; i < 2000; i++ {
+			// 重复接收已出现过的计数器
+			if len(counters) > 0 && rng.Intn(20) == 0 {
+				counters = append(counters, counters[rng.Intn(len(counters))])
+				continue
+			}
+			// 大部分计数器在窗口附近乱序到达，偶尔整体跳跃
+			if rng.Intn(50) == 0 {
+				base += uint64(rng.Intn(4 * ReplayWindowSize))
+			}
+			base += uint64(rng.Intn(3))
+			back := uint64(rng.Intn(ReplayWindowSize + 64))
+			if back > base {
+				back = base
+			}
+			counters = append(counters, base-back)
+		}
+		checkAgainstModel(t, counters)
+	}
+}
+
+// FuzzReplayWindow 任意计数器序列下，窗口与参考实现的判定一致
+func FuzzReplayWindow(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add(binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, ReplayWindowSize+5), 5))
+	f.Add(binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, ^uint64(0)), 0))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var counters []uint64
+		for len(data) >= 8 {
+			counters = append(counters, binary.BigEndian.Uint64(data))
+			data = data[8:]
+		}
+		checkAgainstModel(t, counters)
+	})
+}
@@ -0,0 +1,49 @@
+package crypto
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// RejectAfterMessages 单个会话密钥允许发送的最大消息数，预留余量防止计数器回绕
+const RejectAfterMessages = ^uint64(0) - (1 << 13)
+
+// ErrCounterExhausted 发送计数器耗尽，必须重新握手
+var ErrCounterExhausted = errors.New("session counter exhausted")
+
+// Session 一对节点之间一代会话密钥，收发方向使用不同的密钥
+type Session struct {
+	Send         *Crypto
+	Recv         *Crypto
+	RemoteStatic [KeySize]byte
+	Epoch        uint8 // 密钥代数，随消息头发送，用于在轮换期间选择解密密钥
+
+	created     time.Time
+	sendCounter atomic.Uint64
+	replay      ReplayWindow
+}
+
+// NextCounter 分配下一个发送计数器，作为随机数随消息头发送
+func (s *Session) NextCounter() (uint64, error) {
+	counter := s.sendCounter.Add(1) - 1
+	if counter >= RejectAfterMessages {
+		return 0, ErrCounterExhausted
+	}
+	return counter, nil
+}
+
+// Sent 返回已使用该密钥发送的消息数
+func (s *Session) Sent() uint64 {
+	return s.sendCounter.Load()
+}
+
+// Age 返回会话密钥的使用时长
+func (s *Session) Age() time.Duration {
+	return time.Since(s.created)
+}
+
+// Replay 返回接收方向的防重放窗口
+func (s *Session) Replay() *ReplayWindow {
+	return &s.replay
+}